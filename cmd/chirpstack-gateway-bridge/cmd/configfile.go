@@ -67,7 +67,30 @@ join_euis=[{{ range $index, $elm := .Filters.JoinEUIs }}
 # Valid options are:
 #   * semtech_udp
 #   * basic_station
-type="{{ .Backend.Type }}"
+#   * concentratord
+#   * simulator
+#
+# Multiple backends can be run concurrently by configuring a list of types,
+# e.g. type=["semtech_udp", "basic_station"]. Downlinks, gateway configuration
+# and commands are routed to the backend to which the gateway is connected.
+type=[{{ range $index, $elm := .Backend.Type }}{{ if $index }}, {{ end }}"{{ $elm }}"{{ end }}]
+
+
+  # Backend state storage.
+  #
+  # When configured, the Semtech UDP backend persists the gateway registry
+  # (address, protocol version and last-seen timestamp per gateway) and the
+  # in-flight downlinks in an embedded database within this directory. The
+  # state is restored on startup, such that downlinks can be sent to the
+  # gateways without waiting for their next PULL_DATA, and TX_ACKs of
+  # downlinks sent before the restart are handled. When left blank, the
+  # state is not persisted.
+  #
+  # The Basic Station backend does not persist its state, as the stations
+  # must re-connect after a restart and the in-flight downlinks (diid) are
+  # only confirmed over the websocket connection they were sent on.
+  [backend.storage]
+  directory="{{ .Backend.Storage.Directory }}"
 
 
   # Semtech UDP packet-forwarder backend.
@@ -96,16 +119,196 @@ type="{{ .Backend.Type }}"
 
   # Cache expiration
   #
-  # ChirpStack Gateway Bridge temporarily store downlinks. If a gateway does not send any
-  # UDP data within the configured timeout the downlink is discarded.
+  # ChirpStack Gateway Bridge keeps track of the in-flight downlinks, using a token which is
+  # unique per gateway. If a gateway does not send a TX_ACK within the configured timeout,
+  # the downlink is discarded and reported with the INTERNAL_ERROR status.
   cache_default_expiration="{{ .Backend.SemtechUDP.CacheDefaultExpiration }}"
 
   # Cache cleanup interval
   #
-  # ChirpStack Gateway Bridge temporarily store downlinks in a cache. The cache is cleaned in 
-  # the configured interval.
+  # The in-flight downlinks are checked for expiration in the configured interval.
   cache_cleanup_interval="{{ .Backend.SemtechUDP.CacheCleanupInterval }}"
 
+  # PUSH_DATA deduplication window.
+  #
+  # Packet-forwarders might retransmit a PUSH_DATA packet when the PUSH_ACK
+  # was not received (e.g. on a bad backhaul). Retransmitted packets with the
+  # same random token and payload, received within this window, are
+  # acknowledged but not handled again. Set to 0 to disable deduplication.
+  push_data_dedup_window="{{ .Backend.SemtechUDP.PushDataDedupWindow }}"
+
+  # Number of workers.
+  #
+  # The received UDP packets are handled by this number of workers. Packets
+  # of the same gateway are always handled by the same worker, such that
+  # these are handled and the uplinks are published in order. When set to 0,
+  # the number of CPUs is used.
+  workers={{ .Backend.SemtechUDP.Workers }}
+
+  # Queue size.
+  #
+  # The maximum number of received packets queued per worker, the maximum
+  # number of uplinks queued for publishing per worker and the maximum number
+  # of packets queued for sending.
+  queue_size={{ .Backend.SemtechUDP.QueueSize }}
+
+  # Queue overflow policy.
+  #
+  # This defines which packet is dropped when a worker queue is full:
+  #   drop_newest: the received packet is dropped
+  #   drop_oldest: the oldest queued packet is dropped
+  overflow_policy="{{ .Backend.SemtechUDP.OverflowPolicy }}"
+
+  # Batch size.
+  #
+  # The maximum number of UDP packets read or written by a single system call.
+  # Batched reads and writes are only supported on Linux.
+  batch_size={{ .Backend.SemtechUDP.BatchSize }}
+
+  # Gateway IDs allowlist.
+  #
+  # When set, only packets from the configured gateway IDs are accepted.
+  # Packets from other gateways are dropped. When empty, all gateways are
+  # accepted.
+  #
+  # Example:
+  # gateway_ids=[
+  #   "0102030405060708",
+  #   "0807060504030201",
+  # ]
+  gateway_ids=[{{ range $index, $elm := .Backend.SemtechUDP.GatewayIDs }}
+    "{{ $elm }}",{{ end }}
+  ]
+
+  # Gateway address pinning.
+  #
+  # When enabled, a gateway is pinned to the network of the source address of
+  # its first packet. Packets for this gateway received from a different
+  # network are dropped, until the gateway has not been seen for the
+  # connection_timeout_duration.
+  [backend.semtech_udp.address_pinning]
+  # Enable address pinning.
+  enabled={{ .Backend.SemtechUDP.AddressPinning.Enabled }}
+
+  # IPv4 prefix length.
+  #
+  # The prefix-length of the pinned IPv4 network. Use 32 to pin the gateway
+  # to a single IPv4 address.
+  ipv4_prefix_length={{ .Backend.SemtechUDP.AddressPinning.IPv4PrefixLength }}
+
+  # IPv6 prefix length.
+  #
+  # The prefix-length of the pinned IPv6 network. Use 128 to pin the gateway
+  # to a single IPv6 address.
+  ipv6_prefix_length={{ .Backend.SemtechUDP.AddressPinning.IPv6PrefixLength }}
+
+
+  # Traffic capture.
+  #
+  # When a file is configured, all UDP datagrams received from and sent to
+  # the gateways are appended to this file (JSON lines, including the
+  # timestamp and the address of the gateway). A capture can be replayed
+  # using the "replay" sub-command.
+  [backend.semtech_udp.capture]
+  # Capture file.
+  #
+  # When left blank, capturing is disabled.
+  file="{{ .Backend.SemtechUDP.Capture.File }}"
+
+  # Max. file size (bytes).
+  #
+  # When the capture file exceeds this size, it is rotated (the rotated files
+  # get a .1, .2, ... suffix). Set this to 0 to disable rotation.
+  max_size={{ .Backend.SemtechUDP.Capture.MaxSize }}
+
+  # Max. number of rotated files to keep.
+  max_files={{ .Backend.SemtechUDP.Capture.MaxFiles }}
+
+
+  # Fine-timestamp AES keys.
+  #
+  # Geolocation capable gateways (e.g. SX1301 v2) can encrypt the fine-
+  # timestamp, using one of the AES keys of the gateway. The key index is
+  # sent by the gateway (aesk). When a key is configured for the gateway and
+  # key index, the encrypted fine-timestamp is decrypted and exposed as plain
+  # fine-timestamp. Configure one entry per gateway and key index.
+  #
+  # Example:
+  # [[backend.semtech_udp.fine_timestamp_keys]]
+  # gateway_id="0102030405060708"
+  # aesk=0
+  # key="000102030405060708090a0b0c0d0e0f"
+{{ range $i, $key := .Backend.SemtechUDP.FineTimestampKeys }}
+  [[backend.semtech_udp.fine_timestamp_keys]]
+  gateway_id="{{ $key.GatewayID }}"
+  aesk={{ $key.AESK }}
+  key="{{ $key.Key }}"
+{{ end }}
+
+  # Relay servers.
+  #
+  # When configured, the PUSH_DATA and PULL_DATA packets received from the
+  # gateways are forwarded as-is to the configured upstream UDP servers
+  # (e.g. a legacy network server), using a UDP socket per gateway. The
+  # PULL_RESP packets (downlinks) of the upstream for which downlink is
+  # enabled are proxied to the gateway, and the TX_ACK is returned to this
+  # upstream. Downlink can be enabled for at most one upstream.
+  #
+  # Example:
+  # [[backend.semtech_udp.relay]]
+  # server="legacy-ns.example.com:1700"
+  # downlink=true
+{{ range $i, $relay := .Backend.SemtechUDP.Relay }}
+  [[backend.semtech_udp.relay]]
+  server="{{ $relay.Server }}"
+  downlink={{ $relay.Downlink }}
+{{ end }}
+
+  # Packet-forwarder configuration.
+  #
+  # When configured, ChirpStack Gateway Bridge will update the packet-forwarder
+  # configuration file when a gateway configuration is received from the
+  # network server. The SX1301_conf radio and channel settings of the base
+  # file are merged with the received channel-plan and written to the output
+  # file, after which the restart command is executed. The restart command
+  # must refer to one of the commands configured in the [commands] section.
+  # The result is published as exec event.
+  #
+  # Example:
+  # [[backend.semtech_udp.configuration]]
+  # gateway_id="0102030405060708"
+  # base_file="/etc/lora-packet-forwarder/global_conf.json"
+  # output_file="/etc/lora-packet-forwarder/local_conf.json"
+  # restart_command="restart-packet-forwarder"
+{{ range $i, $config := .Backend.SemtechUDP.Configuration }}
+  [[backend.semtech_udp.configuration]]
+  gateway_id="{{ $config.GatewayID }}"
+  base_file="{{ $config.BaseFile }}"
+  output_file="{{ $config.OutputFile }}"
+  restart_command="{{ $config.RestartCommand }}"
+{{ end }}
+
+
+  # ChirpStack Concentratord backend.
+  [backend.concentratord]
+
+  # Check for CRC OK.
+  #
+  # When set to true, uplink frames with an invalid CRC will be dropped.
+  crc_check={{ .Backend.Concentratord.CRCCheck }}
+
+  # Event API URL.
+  #
+  # The ZeroMQ socket on which the Concentratord publishes its events
+  # (uplinks and gateway stats).
+  event_url="{{ .Backend.Concentratord.EventURL }}"
+
+  # Command API URL.
+  #
+  # The ZeroMQ socket on which the Concentratord accepts commands
+  # (downlinks and gateway configuration).
+  command_url="{{ .Backend.Concentratord.CommandURL }}"
+
 
   # Basic Station backend.
   [backend.basic_station]
@@ -123,6 +326,10 @@ type="{{ .Backend.Type }}"
   #
   # When set, the websocket listener will use TLS to secure the connections
   # between the gateways and ChirpStack Gateway Bridge (optional).
+  #
+  # The certificate, key and CA certificate files are reloaded when they are
+  # modified. New connections will use the reloaded files, existing connections
+  # are not affected.
   tls_cert="{{ .Backend.BasicStation.TLSCert }}"
   tls_key="{{ .Backend.BasicStation.TLSKey }}"
 
@@ -132,6 +339,33 @@ type="{{ .Backend.Type }}"
   # certificate of the gateway has been signed by this CA certificate.
   ca_cert="{{ .Backend.BasicStation.CACert }}"
 
+  # CUPS directory.
+  #
+  # When set, the CUPS /update-info endpoint is enabled. This directory must
+  # contain a sub-directory per gateway ID (e.g. 0102030405060708), containing
+  # the following (optional) files:
+  #
+  #   * cups.uri, cups.trust, cups.crt, cups.key: CUPS URI and credentials
+  #   * tc.uri, tc.trust, tc.crt, tc.key: LNS URI and credentials
+  #   * update.bin: station firmware update
+  #   * update.version: package version of the firmware update
+  #   * update.sig-<key crc>: signature of update.bin, for the signing-key
+  #     with the given CRC32
+  #
+  # Credentials are only sent when their CRC differs from the cupsCredCrc /
+  # tcCredCrc reported by the station. When the .crt file is absent, the .key
+  # file may contain an authorization token (the certificate is then sent as
+  # four zero bytes). The firmware update is only sent when the version
+  # differs from the package reported by the station and a signature exists
+  # for one of the station signing-keys.
+  #
+  # As the response contains the credentials of the gateway, the request must
+  # be authenticated using either a client certificate (see ca_cert) of which
+  # the CommonName matches the gateway ID, or the authorization token of the
+  # gateway (see [backend.basic_station.auth]). Requests are rejected when
+  # neither is configured.
+  cups_directory="{{ .Backend.BasicStation.CUPSDirectory }}"
+
   # Stats interval.
   #
   # This defines the interval in which the ChirpStack Gateway Bridge forwards
@@ -156,6 +390,50 @@ type="{{ .Backend.Type }}"
   # Write timeout.
   write_timeout="{{ .Backend.BasicStation.WriteTimeout }}"
 
+  # TX ack timeout.
+  #
+  # When the gateway does not confirm the transmission of a downlink within
+  # this timeout (relative to the scheduled transmission time), the next
+  # downlink item (if any) is sent to the gateway. The same applies when the
+  # gateway disconnects before confirming the transmission, as the Basic
+  # Station protocol does not report failed transmissions. RX1 and RX2 items
+  # of the same downlink are sent to the gateway as a single message.
+  tx_ack_timeout="{{ .Backend.BasicStation.TxAckTimeout }}"
+
+  # Duplicate connection policy.
+  #
+  # This defines what happens when a gateway connects while a connection
+  # with the same gateway ID already exists (e.g. when the old TCP connection
+  # is half-open after a NAT rebind). Valid options are:
+  #   * reject:      reject the new connection
+  #   * replace:     close the existing connection, the stats and timesync
+  #                  state are kept for the new connection
+  #   * keep_newest: close the existing connection, the new connection
+  #                  starts with a clean state
+  duplicate_connection_policy="{{ .Backend.BasicStation.DuplicateConnectionPolicy }}"
+
+  # Enable runcmd.
+  #
+  # When enabled, gateway command exec requests for the "runcmd" command are
+  # executed by the Basic Station. The stdin of the request must contain the
+  # name of one of the commands configured in the [commands] section, of
+  # which the command-line is executed on the gateway. The "getxtime" command
+  # is always executed by the Basic Station.
+  runcmd_enabled={{ .Backend.BasicStation.RunCommandEnabled }}
+
+  # Enable remote shell.
+  #
+  # When enabled, gateway command exec requests for the "rmtsh" command open
+  # a remote shell session on the Basic Station. Note that this gives shell
+  # access to the gateway to anyone who is able to send commands to the
+  # ChirpStack Gateway Bridge.
+  remote_shell_enabled={{ .Backend.BasicStation.RemoteShellEnabled }}
+
+  # Remote shell max. duration.
+  #
+  # The remote shell session is stopped after this duration.
+  remote_shell_max_duration="{{ .Backend.BasicStation.RemoteShellMaxDuration }}"
+
   # Region.
   #
   # Please refer to the LoRaWAN Regional Parameters specification
@@ -168,6 +446,90 @@ type="{{ .Backend.Type }}"
   # Maximum frequency (Hz).
   frequency_max={{ .Backend.BasicStation.FrequencyMax }}
 
+  # Traffic capture.
+  #
+  # When a file is configured, all websocket messages received from and sent
+  # to the gateways are appended to this file (JSON lines, including the
+  # timestamp, gateway ID and message type). A capture can be replayed using
+  # the "replay" sub-command.
+  [backend.basic_station.capture]
+  # Capture file.
+  #
+  # When left blank, capturing is disabled.
+  file="{{ .Backend.BasicStation.Capture.File }}"
+
+  # Max. file size (bytes).
+  #
+  # When the capture file exceeds this size, it is rotated (the rotated files
+  # get a .1, .2, ... suffix). Set this to 0 to disable rotation.
+  max_size={{ .Backend.BasicStation.Capture.MaxSize }}
+
+  # Max. number of rotated files to keep.
+  max_files={{ .Backend.BasicStation.Capture.MaxFiles }}
+
+  # Token authentication.
+  #
+  # When configured, the gateways must provide a token using the
+  # Authorization header (e.g. provisioned using the tc.key file of the
+  # Basic Station). The token may be prefixed by "Bearer ". This can be used
+  # as an alternative to, or in combination with client-certificates.
+  [backend.basic_station.auth]
+  # Authentication type.
+  #
+  # Valid options are:
+  #   * "":         token authentication is disabled
+  #   * token_file: tokens are read from the token_file
+  #   * hmac:       tokens are derived from the hmac_secret
+  type="{{ .Backend.BasicStation.Auth.Type }}"
+
+  # Token file.
+  #
+  # Each line must contain the gateway ID and the token, separated by
+  # a space. Empty lines and lines starting with # are ignored.
+  token_file="{{ .Backend.BasicStation.Auth.TokenFile }}"
+
+  # HMAC secret.
+  #
+  # The token of each gateway is the hex encoded HMAC-SHA256 of the
+  # (lower-case, hex encoded) gateway ID, using this secret as key.
+  hmac_secret="{{ .Backend.BasicStation.Auth.HMACSecret }}"
+
+  # Reload interval.
+  #
+  # The interval in which the token_file is checked for changes. A modified
+  # file is reloaded without restarting ChirpStack Gateway Bridge. Set to 0s
+  # to disable reloading.
+  reload_interval="{{ .Backend.BasicStation.Auth.ReloadInterval }}"
+
+  # Router-info routing.
+  #
+  # By default, the router-info endpoint returns the URI of the instance
+  # that received the request. When running multiple instances, the
+  # router-info endpoint can be used to route each gateway to a specific
+  # instance. The routes are matched first (the first matching route is used),
+  # when none of the routes match, the instance is selected using consistent
+  # hashing of the gateway ID over the instances.
+  [backend.basic_station.router_info]
+  # Instances.
+  #
+  # The LNS URIs of the instances (scheme://host:port), used for consistent
+  # hashing. Example: ["wss://lns-1.example.com:3001", "wss://lns-2.example.com:3001"]
+  instances=[{{ range $index, $elm := .Backend.BasicStation.RouterInfo.Instances }}
+    "{{ $elm }}",{{ end }}
+  ]
+
+  # Routes.
+  #
+  # Example:
+  # [[backend.basic_station.router_info.routes]]
+  # gateway_id_range=["0000000000000000", "00000000ffffffff"]
+  # uri="wss://lns-1.example.com:3001"
+{{ range $i, $route := .Backend.BasicStation.RouterInfo.Routes }}
+  [[backend.basic_station.router_info.routes]]
+  gateway_id_range=["{{ index $route.GatewayIDRange 0 }}", "{{ index $route.GatewayIDRange 1 }}"]
+  uri="{{ $route.URI }}"
+{{ end }}
+
   # Concentrator configuration.
   #
   # This section contains the configuration for the SX1301 concentrator chips.
@@ -222,11 +584,192 @@ type="{{ .Backend.Type }}"
       frequency={{ $concentrator.FSK.Frequency }}
 {{ end }}
 
+  # Router configuration profiles.
+  #
+  # Profiles make it possible to use a different region, frequency range,
+  # concentrator configuration and NetID / JoinEUI filters per gateway.
+  # A gateway is mapped to the first profile matching its gateway ID or one
+  # of its (inclusive) gateway ID ranges. Gateways that do not match any
+  # profile use the region, frequency range and concentrator configuration
+  # above, and the global filters.
+  #
+  # Example:
+  # [[backend.basic_station.profiles]]
+  # name="us915_sb2"
+  # gateway_ids=["0102030405060708"]
+  # gateway_id_ranges=[
+  #   ["0101010100000000", "01010101ffffffff"],
+  # ]
+  # region="US915"
+  # frequency_min=902000000
+  # frequency_max=928000000
+  #
+  #   [backend.basic_station.profiles.filters]
+  #   net_ids=["000000"]
+  #   join_euis=[]
+  #
+  #   [[backend.basic_station.profiles.concentrators]]
+  #     [backend.basic_station.profiles.concentrators.multi_sf]
+  #     frequencies=[
+  #       903900000,
+  #       904100000,
+  #       904300000,
+  #       904500000,
+  #       904700000,
+  #       904900000,
+  #       905100000,
+  #       905300000,
+  #     ]
+  #
+  #     [backend.basic_station.profiles.concentrators.lora_std]
+  #     frequency=904600000
+  #     bandwidth=500000
+  #     spreading_factor=8
+{{ range $i, $profile := .Backend.BasicStation.Profiles }}
+  [[backend.basic_station.profiles]]
+  name="{{ $profile.Name }}"
+  gateway_ids=[{{ range $index, $elm := $profile.GatewayIDs }}
+    "{{ $elm }}",{{ end }}
+  ]
+  gateway_id_ranges=[{{ range $index, $elm := $profile.GatewayIDRanges }}
+    ["{{ index $elm 0 }}", "{{ index $elm 1 }}"],{{ end }}
+  ]
+  region="{{ $profile.Region }}"
+  frequency_min={{ $profile.FrequencyMin }}
+  frequency_max={{ $profile.FrequencyMax }}
+
+    [backend.basic_station.profiles.filters]
+    net_ids=[{{ range $index, $elm := $profile.Filters.NetIDs }}
+      "{{ $elm }}",{{ end }}
+    ]
+    join_euis=[{{ range $index, $elm := $profile.Filters.JoinEUIs }}
+      ["{{ index $elm 0 }}", "{{ index $elm 1 }}"],{{ end }}
+    ]
+{{ range $j, $concentrator := $profile.Concentrators }}
+    [[backend.basic_station.profiles.concentrators]]
+      [backend.basic_station.profiles.concentrators.multi_sf]
+      frequencies=[{{ range $index, $elm := $concentrator.MultiSF.Frequencies }}
+        {{ $elm }},{{ end }}
+      ]
+
+      [backend.basic_station.profiles.concentrators.lora_std]
+      frequency={{ $concentrator.LoRaSTD.Frequency }}
+      bandwidth={{ $concentrator.LoRaSTD.Bandwidth }}
+      spreading_factor={{ $concentrator.LoRaSTD.SpreadingFactor }}
+
+      [backend.basic_station.profiles.concentrators.fsk]
+      frequency={{ $concentrator.FSK.Frequency }}
+{{ end }}{{ end }}
+
+
+  # Simulator backend.
+  #
+  # The simulator backend generates synthetic traffic for a number of virtual
+  # gateways and devices, e.g. for load-testing the MQTT broker and network
+  # server without any radio hardware. Downlinks are acknowledged by the
+  # simulator.
+  [backend.simulator]
+
+  # Number of simulated gateways.
+  gateways={{ .Backend.Simulator.Gateways }}
+
+  # Number of simulated devices per gateway.
+  devices_per_gateway={{ .Backend.Simulator.DevicesPerGateway }}
+
+  # Gateway ID, DevEUI and DevAddr bases.
+  #
+  # The IDs of the gateways and devices are allocated sequentially, starting
+  # at these values.
+  gateway_id_base="{{ .Backend.Simulator.GatewayIDBase }}"
+  dev_eui_base="{{ .Backend.Simulator.DevEUIBase }}"
+  dev_addr_base="{{ .Backend.Simulator.DevAddrBase }}"
+
+  # JoinEUI used for the join-requests.
+  join_eui="{{ .Backend.Simulator.JoinEUI }}"
+
+  # Device key.
+  #
+  # This key is used by all devices for signing the join-requests and as
+  # session keys for the data uplinks (LoRaWAN 1.0). Provision the devices
+  # using this key to make the network server accept the uplinks.
+  device_key="{{ .Backend.Simulator.DeviceKey }}"
+
+  # Uplink interval.
+  #
+  # Each device sends on average one uplink per interval. The uplinks are
+  # generated at random moments (Poisson process).
+  uplink_interval="{{ .Backend.Simulator.UplinkInterval }}"
+
+  # Join-request ratio.
+  #
+  # The ratio (0 - 1) of uplinks that are join-requests, the other uplinks
+  # are unconfirmed data uplinks.
+  join_request_ratio={{ .Backend.Simulator.JoinRequestRatio }}
+
+  # FRMPayload size (bytes) of the data uplinks.
+  payload_size={{ .Backend.Simulator.PayloadSize }}
+
+  # Uplink frequencies (Hz).
+  #
+  # Each uplink uses a random frequency from this list.
+  frequencies=[{{ range $index, $elm := .Backend.Simulator.Frequencies }}
+    {{ $elm }},{{ end }}
+  ]
+
+  # Uplink spreading-factors.
+  #
+  # Each device uses a random spreading-factor from this list.
+  spreading_factors=[{{ range $index, $elm := .Backend.Simulator.SpreadingFactors }}
+    {{ $elm }},{{ end }}
+  ]
+
+  # Uplink bandwidth (Hz).
+  bandwidth={{ .Backend.Simulator.Bandwidth }}
+
+  # RSSI and SNR distribution.
+  #
+  # The mean RSSI (dBm) and SNR (dB) of each device are drawn from a normal
+  # distribution with the given mean and std. deviation. Each uplink adds a
+  # smaller random variation (fading) to the values of the device.
+  rssi_mean={{ .Backend.Simulator.RSSIMean }}
+  rssi_std_dev={{ .Backend.Simulator.RSSIStdDev }}
+  snr_mean={{ .Backend.Simulator.SNRMean }}
+  snr_std_dev={{ .Backend.Simulator.SNRStdDev }}
+
+  # Stats interval.
+  #
+  # This defines the interval in which the gateway stats are emitted.
+  stats_interval="{{ .Backend.Simulator.StatsInterval }}"
+
+  # Downlink tx ack errors.
+  #
+  # By default all downlinks are acknowledged with status OK. Each entry
+  # defines the ratio (0 - 1) of downlinks that is acknowledged with the given
+  # error status (e.g. TOO_LATE, COLLISION_PACKET or TX_FREQ). The sum of the
+  # ratios must not exceed 1. Example:
+  #
+  # [[backend.simulator.tx_ack_errors]]
+  # status="COLLISION_PACKET"
+  # ratio=0.05
+{{ range $i, $e := .Backend.Simulator.TxAckErrors }}
+  [[backend.simulator.tx_ack_errors]]
+  status="{{ $e.Status }}"
+  ratio={{ $e.Ratio }}
+{{ end }}
+
 # Integration configuration.
 [integration]
+# Integration type.
+#
+# This defines the integration to which the gateway events are published and
+# from which the commands are received. Valid options are:
+# * mqtt:  MQTT integration, see the [integration.mqtt] section
+# * http:  HTTP integration, see the [integration.http] section
+type="{{ .Integration.Type }}"
+
 # Payload marshaler.
 #
-# This defines how the MQTT payloads are encoded. Valid options are:
+# This defines how the MQTT and HTTP payloads are encoded. Valid options are:
 # * protobuf:  Protobuf encoding
 # * json:      JSON encoding (for debugging)
 marshaler="{{ .Integration.Marshaler }}"
@@ -270,6 +813,78 @@ marshaler="{{ .Integration.Marshaler }}"
   # process will be terminated on a connection error.
   terminate_on_connect_error={{ .Integration.MQTT.TerminateOnConnectError }}
 
+  # Protocol version.
+  #
+  # The MQTT protocol version to use, this must be 4 (MQTT v3.1.1) or 5
+  # (MQTT v5). When using MQTT v5, the gateway_id, event_type and uplink_id
+  # (uplink events only) are added as user properties to the published events.
+  protocol_version={{ .Integration.MQTT.ProtocolVersion }}
+
+  # Session expiry interval (MQTT v5 only).
+  #
+  # When set, this replaces the clean_session option. The MQTT broker keeps
+  # the session (including the subscriptions and queued commands) for the
+  # given interval after the connection has been lost. Downlink commands
+  # published with a message expiry interval are dropped by the MQTT broker
+  # when they expire before they could be delivered. Commands delivered with
+  # a remaining message expiry interval of 0 are dropped by the ChirpStack
+  # Gateway Bridge. Setting a message expiry interval is up to the publisher
+  # of the commands. When set to 0, the session ends when the connection is
+  # closed.
+  # Valid units are 'ms', 's', 'm', 'h'. Note that these values can be combined, e.g. '24h30m15s'.
+  session_expiry_interval="{{ .Integration.MQTT.SessionExpiryInterval }}"
+
+  # Shared subscription group (MQTT v5 only).
+  #
+  # When set, the command topics are subscribed to as shared subscription
+  # ($share/<group>/<topic>), such that the commands are load-balanced over
+  # all the ChirpStack Gateway Bridge instances using the same group.
+  shared_subscription_group="{{ .Integration.MQTT.SharedSubscriptionGroup }}"
+
+
+  # Event queue.
+  #
+  # When a directory is configured, events that can not be published (e.g.
+  # because the MQTT broker is unreachable) are stored in a persistent queue
+  # within this directory. The queued events are published in order after the
+  # connection has been restored, also after a restart. When left blank, the
+  # queue is disabled.
+  [integration.mqtt.queue]
+  directory="{{ .Integration.MQTT.Queue.Directory }}"
+
+  # Max number of queued events per event type (0 = no limit).
+  max_size={{ .Integration.MQTT.Queue.MaxSize }}
+
+  # Max age of queued events (0 = no limit).
+  #
+  # Queued events older than the given duration are dropped instead of being
+  # published.
+  # Valid units are 'ms', 's', 'm', 'h'. Note that these values can be combined, e.g. '24h30m15s'.
+  max_age="{{ .Integration.MQTT.Queue.MaxAge }}"
+
+  # Drop policy.
+  #
+  # This defines which event is dropped when the max size has been reached:
+  #   * drop_oldest: the oldest queued event is dropped
+  #   * drop_newest: the new event is dropped
+  drop_policy="{{ .Integration.MQTT.Queue.DropPolicy }}"
+
+    # Per event type policies (optional).
+    #
+    # The max_size, max_age and drop_policy can be overridden per event type
+    # (e.g. up, stats, ack). Settings which are not set (or set to 0) are
+    # taken from the global settings above. Example:
+    #
+    # [integration.mqtt.queue.events.stats]
+    # max_size=100
+    # max_age="1h"
+    # drop_policy="drop_oldest"
+{{ range $event, $policy := .Integration.MQTT.Queue.Events }}
+    [integration.mqtt.queue.events.{{ $event }}]
+    max_size={{ $policy.MaxSize }}
+    max_age="{{ $policy.MaxAge }}"
+    drop_policy="{{ $policy.DropPolicy }}"
+{{ end }}
 
   # MQTT authentication.
   [integration.mqtt.auth]
@@ -309,6 +924,7 @@ marshaler="{{ .Integration.Marshaler }}"
     # Set the "clean session" flag in the connect message when this client
     # connects to an MQTT broker. By setting this flag you are indicating
     # that no messages saved by the broker for this client should be delivered.
+    # When using MQTT v5, this is replaced by session_expiry_interval.
     clean_session={{ .Integration.MQTT.Auth.Generic.CleanSession }}
 
     # Client ID
@@ -323,6 +939,9 @@ marshaler="{{ .Integration.Marshaler }}"
     # Use this when setting up a secure connection (when server uses ssl://...)
     # but the certificate used by the server is not trusted by any CA certificate
     # on the server (e.g. when self generated).
+    #
+    # The CA certificate, TLS certificate and TLS key files are reloaded when
+    # they are modified. The reloaded files are used on (re)connect.
     ca_cert="{{ .Integration.MQTT.Auth.Generic.CACert }}"
 
     # mqtt TLS certificate file (optional)
@@ -407,6 +1026,153 @@ marshaler="{{ .Integration.Marshaler }}"
     tls_key="{{ .Integration.MQTT.Auth.AzureIoTHub.TLSKey }}"
 
 
+  # HTTP integration configuration.
+  #
+  # The events and states are posted to the configured URLs, the commands are
+  # received by the command server (when configured).
+  [integration.http]
+  # Event URL template.
+  event_url_template="{{ .Integration.HTTP.EventURLTemplate }}"
+
+  # State URL template.
+  #
+  # When set to a blank string, states will not be posted.
+  state_url_template="{{ .Integration.HTTP.StateURLTemplate }}"
+
+  # Request timeout.
+  timeout="{{ .Integration.HTTP.Timeout }}"
+
+  # Max retries.
+  #
+  # Requests which fail because of a connection error or a 5xx or 429 response
+  # are retried up to the given number of times.
+  max_retries={{ .Integration.HTTP.MaxRetries }}
+
+  # Retry interval.
+  #
+  # The interval before the first retry, which is doubled after each retry.
+  retry_interval="{{ .Integration.HTTP.RetryInterval }}"
+
+  # HMAC secret.
+  #
+  # When set, the requests are signed using the X-Signature-Timestamp header,
+  # containing the unix timestamp, and the X-Signature header, containing
+  # "sha256=" followed by the hex encoded HMAC-SHA256 of "<timestamp>.<body>".
+  # The received commands must be signed the same way, the timestamp may not
+  # deviate more than five minutes.
+  hmac_secret="{{ .Integration.HTTP.HMACSecret }}"
+
+  # Additional request headers.
+  #
+  # Example:
+  # [integration.http.headers]
+  # authorization="Bearer secret"
+  [integration.http.headers]
+{{ range $k, $v := .Integration.HTTP.Headers }}  {{ $k }}="{{ $v }}"
+{{ end }}
+    # Command server.
+    #
+    # When a bind is configured, the commands can be posted to:
+    #   /gateway/<gateway_id>/command/<command>
+    # where command is one of down, config, exec or raw. The commands are only
+    # accepted for the gateways connected to the ChirpStack Gateway Bridge.
+    # The commands must be authenticated, therefore the hmac_secret and / or
+    # the ca_cert (client-certificates) must be set when the bind is set.
+    [integration.http.command]
+    # ip:port to bind the command server to (leave blank to disable).
+    bind="{{ .Integration.HTTP.Command.Bind }}"
+
+    # TLS certificate and key files.
+    #
+    # When set, the command server listens for HTTPS requests.
+    tls_cert="{{ .Integration.HTTP.Command.TLSCert }}"
+    tls_key="{{ .Integration.HTTP.Command.TLSKey }}"
+
+    # TLS CA certificate.
+    #
+    # When configured, the command server requires a client certificate
+    # signed by this CA certificate.
+    ca_cert="{{ .Integration.HTTP.Command.CACert }}"
+
+
+  # Integration instances.
+  #
+  # By default, a single integration is configured using the above
+  # [integration.mqtt] or [integration.http] section. When one or multiple
+  # instances are configured, the events are published to each instance and
+  # the [integration.mqtt] and [integration.http] sections are only used as
+  # base configuration, which is inherited by the instances and which can be
+  # overridden per instance. Note that each instance must use a different
+  # client_id and (HTTP) command bind. When the queue is enabled, the queue of
+  # each instance is stored in a sub-directory of the queue directory, named
+  # after the instance.
+  #
+  # For each instance, the following settings can be configured:
+  #   * name: the name of the instance (must be unique)
+  #   * type: the integration type (defaults to the above type)
+  #   * marshaler: the payload marshaler (defaults to the above marshaler)
+  #   * events: the event types to publish (up, stats, ack, raw, exec), all events
+  #     are published when left blank
+  #   * commands: when set to true, the downlinks, gateway configuration and
+  #     commands received by this instance are handled, else these are ignored
+  #
+  # Example:
+  # [[integration.instances]]
+  # name="chirpstack"
+  # commands=true
+  #
+  # [[integration.instances]]
+  # name="analytics"
+  # marshaler="json"
+  # events=["up"]
+  #
+  #   [integration.instances.mqtt.auth.generic]
+  #   servers=["tcp://analytics:1883"]
+  #   client_id="analytics-bridge"
+  #
+  # [[integration.instances]]
+  # name="webhook"
+  # type="http"
+  # marshaler="json"
+  # events=["up"]
+  #
+  #   [integration.instances.http]
+  #   event_url_template="https://example.com/webhook"
+{{ range $i, $instance := .Integration.Instances }}
+  [[integration.instances]]
+  name="{{ $instance.Name }}"
+  type="{{ $instance.Type }}"
+  marshaler="{{ $instance.Marshaler }}"
+  events=[{{ range $index, $elm := $instance.Events }}{{ if $index }}, {{ end }}"{{ $elm }}"{{ end }}]
+  commands={{ $instance.Commands }}
+
+    [integration.instances.mqtt]
+    event_topic_template="{{ $instance.MQTT.EventTopicTemplate }}"
+    state_topic_template="{{ $instance.MQTT.StateTopicTemplate }}"
+    command_topic_template="{{ $instance.MQTT.CommandTopicTemplate }}"
+    protocol_version={{ $instance.MQTT.ProtocolVersion }}
+
+    [integration.instances.mqtt.queue]
+    directory="{{ $instance.MQTT.Queue.Directory }}"
+
+    [integration.instances.mqtt.auth]
+    type="{{ $instance.MQTT.Auth.Type }}"
+
+    [integration.instances.mqtt.auth.generic]
+    servers=[{{ range $index, $elm := $instance.MQTT.Auth.Generic.Servers }}{{ if $index }}, {{ end }}"{{ $elm }}"{{ end }}]
+    username="{{ $instance.MQTT.Auth.Generic.Username }}"
+    password="{{ $instance.MQTT.Auth.Generic.Password }}"
+    client_id="{{ $instance.MQTT.Auth.Generic.ClientID }}"
+
+    [integration.instances.http]
+    event_url_template="{{ $instance.HTTP.EventURLTemplate }}"
+    state_url_template="{{ $instance.HTTP.StateURLTemplate }}"
+    hmac_secret="{{ $instance.HTTP.HMACSecret }}"
+
+    [integration.instances.http.command]
+    bind="{{ $instance.HTTP.Command.Bind }}"
+{{ end }}
+
 # Metrics configuration.
 [metrics]
 
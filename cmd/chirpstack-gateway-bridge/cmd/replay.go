@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/capture"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration"
+)
+
+var replaySpeed float64
+
+var replayCmd = &cobra.Command{
+	Use:   "replay [capture file]",
+	Short: "Replay a capture of the gateway traffic through the backend",
+	Long: `Replay the messages received from the gateways, as recorded in the given
+capture file, through the backend and the configured integration.
+
+The backend is selected based on the capture. The listener of the backend is
+bound to a random localhost port and the messages sent by the backend are
+discarded. Persistence, capturing and the Semtech UDP relay and
+packet-forwarder configuration are disabled during the replay.`,
+	Args: cobra.ExactArgs(1),
+	RunE: replay,
+}
+
+func init() {
+	replayCmd.Flags().Float64Var(&replaySpeed, "speed", 1, "replay speed relative to the original speed (0 = without delays)")
+}
+
+func replay(cmd *cobra.Command, args []string) error {
+	backendType, err := getCaptureBackendType(args[0])
+	if err != nil {
+		return errors.Wrap(err, "get capture backend type error")
+	}
+
+	setReplayConfig(backendType)
+
+	tasks := []func() error{
+		setLogJSON,
+		setLogLevel,
+		setupFilters,
+		setupBackend,
+		setupIntegration,
+		setupForwarder,
+		startIntegration,
+		startBackend,
+	}
+
+	for _, t := range tasks {
+		if err := t(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	r, ok := backend.GetBackend().(capture.Replayer)
+	if !ok {
+		return fmt.Errorf("backend %s does not support replay", backendType)
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return errors.Wrap(err, "open capture file error")
+	}
+	defer f.Close()
+
+	log.WithFields(log.Fields{
+		"file":    args[0],
+		"backend": backendType,
+		"speed":   replaySpeed,
+	}).Info("replaying capture")
+
+	if err := r.Replay(capture.NewReader(f), replaySpeed); err != nil {
+		return errors.Wrap(err, "replay error")
+	}
+
+	log.Info("replay completed")
+
+	if err := backend.GetBackend().Stop(); err != nil {
+		return errors.Wrap(err, "stop backend error")
+	}
+
+	return integration.GetIntegration().Stop()
+}
+
+// getCaptureBackendType returns the backend of the first record of the
+// given capture file.
+func getCaptureBackendType(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.Wrap(err, "open capture file error")
+	}
+	defer f.Close()
+
+	rec, err := capture.NewReader(f).Next()
+	if err != nil {
+		return "", errors.Wrap(err, "read capture record error")
+	}
+
+	return rec.Backend, nil
+}
+
+// setReplayConfig updates the configuration, such that the replay does not
+// interfere with a running instance nor sends any data to the gateways.
+func setReplayConfig(backendType string) {
+	config.C.Backend.Type = []string{backendType}
+	config.C.Backend.Storage.Directory = ""
+
+	config.C.Backend.SemtechUDP.UDPBind = "127.0.0.1:0"
+	config.C.Backend.SemtechUDP.Relay = nil
+	config.C.Backend.SemtechUDP.Configuration = nil
+	config.C.Backend.SemtechUDP.Capture.File = ""
+
+	config.C.Backend.BasicStation.Bind = "127.0.0.1:0"
+	config.C.Backend.BasicStation.TLSSupportProxy = false
+	config.C.Backend.BasicStation.TLSCert = ""
+	config.C.Backend.BasicStation.TLSKey = ""
+	config.C.Backend.BasicStation.CACert = ""
+	config.C.Backend.BasicStation.Auth.Type = ""
+	config.C.Backend.BasicStation.Capture.File = ""
+}
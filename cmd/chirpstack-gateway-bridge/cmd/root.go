@@ -8,6 +8,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -37,12 +38,20 @@ func init() {
 
 	// default values
 	viper.SetDefault("general.log_level", 4)
-	viper.SetDefault("backend.type", "semtech_udp")
+	viper.SetDefault("backend.type", []string{"semtech_udp"})
 	viper.SetDefault("backend.semtech_udp.udp_bind", "0.0.0.0:1700")
 	viper.SetDefault("backend.semtech_udp.connection_timeout_duration", time.Minute)
 
 	viper.SetDefault("backend.semtech_udp.cache_default_expiration", 15*time.Second)
 	viper.SetDefault("backend.semtech_udp.cache_cleanup_interval", 15*time.Second)
+	viper.SetDefault("backend.semtech_udp.push_data_dedup_window", 10*time.Second)
+	viper.SetDefault("backend.semtech_udp.queue_size", 1024)
+	viper.SetDefault("backend.semtech_udp.overflow_policy", "drop_newest")
+	viper.SetDefault("backend.semtech_udp.batch_size", 32)
+	viper.SetDefault("backend.semtech_udp.address_pinning.ipv4_prefix_length", 32)
+	viper.SetDefault("backend.semtech_udp.address_pinning.ipv6_prefix_length", 128)
+	viper.SetDefault("backend.semtech_udp.capture.max_size", 10485760)
+	viper.SetDefault("backend.semtech_udp.capture.max_files", 5)
 
 	viper.SetDefault("backend.concentratord.crc_check", true)
 	viper.SetDefault("backend.concentratord.event_url", "ipc:///tmp/concentratord_event")
@@ -53,10 +62,36 @@ func init() {
 	viper.SetDefault("backend.basic_station.ping_interval", time.Minute)
 	viper.SetDefault("backend.basic_station.read_timeout", time.Minute+(5*time.Second))
 	viper.SetDefault("backend.basic_station.write_timeout", time.Second)
+	viper.SetDefault("backend.basic_station.tx_ack_timeout", time.Second*5)
+	viper.SetDefault("backend.basic_station.remote_shell_max_duration", time.Minute*5)
+	viper.SetDefault("backend.basic_station.duplicate_connection_policy", "reject")
+	viper.SetDefault("backend.basic_station.auth.reload_interval", time.Second*30)
 	viper.SetDefault("backend.basic_station.region", "EU868")
 	viper.SetDefault("backend.basic_station.frequency_min", 863000000)
 	viper.SetDefault("backend.basic_station.frequency_max", 870000000)
+	viper.SetDefault("backend.basic_station.capture.max_size", 10485760)
+	viper.SetDefault("backend.basic_station.capture.max_files", 5)
 
+	viper.SetDefault("backend.simulator.gateways", 1)
+	viper.SetDefault("backend.simulator.devices_per_gateway", 10)
+	viper.SetDefault("backend.simulator.gateway_id_base", "0000000000000001")
+	viper.SetDefault("backend.simulator.dev_eui_base", "0000000000000001")
+	viper.SetDefault("backend.simulator.dev_addr_base", "00000001")
+	viper.SetDefault("backend.simulator.join_eui", "0000000000000000")
+	viper.SetDefault("backend.simulator.device_key", "00000000000000000000000000000000")
+	viper.SetDefault("backend.simulator.uplink_interval", time.Minute)
+	viper.SetDefault("backend.simulator.join_request_ratio", 0.01)
+	viper.SetDefault("backend.simulator.payload_size", 10)
+	viper.SetDefault("backend.simulator.frequencies", []uint32{868100000, 868300000, 868500000})
+	viper.SetDefault("backend.simulator.spreading_factors", []uint32{7, 8, 9, 10, 11, 12})
+	viper.SetDefault("backend.simulator.bandwidth", 125000)
+	viper.SetDefault("backend.simulator.rssi_mean", -100)
+	viper.SetDefault("backend.simulator.rssi_std_dev", 10)
+	viper.SetDefault("backend.simulator.snr_mean", 5)
+	viper.SetDefault("backend.simulator.snr_std_dev", 4)
+	viper.SetDefault("backend.simulator.stats_interval", time.Second*30)
+
+	viper.SetDefault("integration.type", "mqtt")
 	viper.SetDefault("integration.marshaler", "protobuf")
 	viper.SetDefault("integration.mqtt.auth.type", "generic")
 
@@ -67,6 +102,9 @@ func init() {
 	viper.SetDefault("integration.mqtt.keep_alive", 30*time.Second)
 	viper.SetDefault("integration.mqtt.max_reconnect_interval", time.Minute)
 	viper.SetDefault("integration.mqtt.max_token_wait", time.Minute)
+	viper.SetDefault("integration.mqtt.protocol_version", 4)
+	viper.SetDefault("integration.mqtt.queue.max_size", 10000)
+	viper.SetDefault("integration.mqtt.queue.drop_policy", "drop_oldest")
 
 	viper.SetDefault("integration.mqtt.auth.generic.servers", []string{"tcp://127.0.0.1:1883"})
 	viper.SetDefault("integration.mqtt.auth.generic.clean_session", true)
@@ -76,12 +114,19 @@ func init() {
 
 	viper.SetDefault("integration.mqtt.auth.azure_iot_hub.sas_token_expiration", 24*time.Hour)
 
+	viper.SetDefault("integration.http.event_url_template", "http://127.0.0.1:8090/gateway/{{ .GatewayID }}/event/{{ .EventType }}")
+	viper.SetDefault("integration.http.state_url_template", "http://127.0.0.1:8090/gateway/{{ .GatewayID }}/state/{{ .StateType }}")
+	viper.SetDefault("integration.http.timeout", 10*time.Second)
+	viper.SetDefault("integration.http.max_retries", 3)
+	viper.SetDefault("integration.http.retry_interval", time.Second)
+
 	viper.SetDefault("meta_data.dynamic.split_delimiter", "=")
 	viper.SetDefault("meta_data.dynamic.execution_interval", time.Minute)
 	viper.SetDefault("meta_data.dynamic.max_execution_duration", time.Second)
 
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(configCmd)
+	rootCmd.AddCommand(replayCmd)
 }
 
 // Execute executes the root command.
@@ -146,6 +191,77 @@ func initConfig() {
 	if config.C.Integration.MQTT.Auth.Generic.Server != "" {
 		config.C.Integration.MQTT.Auth.Generic.Servers = []string{config.C.Integration.MQTT.Auth.Generic.Server}
 	}
+
+	if err := setIntegrationInstances(); err != nil {
+		log.WithError(err).Fatal("set integration instances config error")
+	}
+}
+
+// setIntegrationInstances sets the MQTT and HTTP configuration of the
+// integration instances. Each instance inherits the [integration.mqtt] and
+// [integration.http] configuration, which is overridden by the configuration
+// of the instance.
+func setIntegrationInstances() error {
+	for i := range config.C.Integration.Instances {
+		instance := &config.C.Integration.Instances[i]
+
+		instance.MQTT = config.IntegrationMQTT{}
+		if err := mergeIntegrationInstanceConfig(i, "mqtt", &instance.MQTT); err != nil {
+			return errors.Wrapf(err, "mqtt config of instance %s error", instance.Name)
+		}
+
+		instance.HTTP = config.IntegrationHTTP{}
+		if err := mergeIntegrationInstanceConfig(i, "http", &instance.HTTP); err != nil {
+			return errors.Wrapf(err, "http config of instance %s error", instance.Name)
+		}
+
+		if instance.Type == "" {
+			instance.Type = config.C.Integration.Type
+		}
+
+		if instance.Marshaler == "" {
+			instance.Marshaler = config.C.Integration.Marshaler
+		}
+
+		if instance.MQTT.Auth.Generic.Server != "" {
+			instance.MQTT.Auth.Generic.Servers = []string{instance.MQTT.Auth.Generic.Server}
+		}
+	}
+
+	return nil
+}
+
+// mergeIntegrationInstanceConfig merges the [integration.<key>] configuration
+// with the configuration of the given instance and unmarshals the result
+// into out.
+func mergeIntegrationInstanceConfig(i int, key string, out interface{}) error {
+	// Note: the settings are retrieved for each call, as merging modifies the
+	// nested maps.
+	settings := viper.AllSettings()
+	integrationSettings, _ := settings["integration"].(map[string]interface{})
+	baseSettings, _ := integrationSettings[key].(map[string]interface{})
+	instanceSettings, _ := integrationSettings["instances"].([]interface{})
+
+	v := viper.New()
+	if err := v.MergeConfigMap(baseSettings); err != nil {
+		return errors.Wrap(err, "merge config error")
+	}
+
+	if i < len(instanceSettings) {
+		if s, ok := instanceSettings[i].(map[string]interface{}); ok {
+			if m, ok := s[key].(map[string]interface{}); ok {
+				if err := v.MergeConfigMap(m); err != nil {
+					return errors.Wrap(err, "merge instance config error")
+				}
+			}
+		}
+	}
+
+	if err := v.Unmarshal(out); err != nil {
+		return errors.Wrap(err, "unmarshal config error")
+	}
+
+	return nil
 }
 
 func viperBindEnvs(iface interface{}, parts ...string) {
@@ -164,6 +280,11 @@ func viperBindEnvs(iface interface{}, parts ...string) {
 
 		switch v.Kind() {
 		case reflect.Struct:
+			// squashed (embedded) structs share the parent key
+			if tv == ",squash" {
+				viperBindEnvs(v.Interface(), parts...)
+				continue
+			}
 			viperBindEnvs(v.Interface(), append(parts, tv)...)
 		default:
 			// Bash doesn't allow env variable names with a dot so
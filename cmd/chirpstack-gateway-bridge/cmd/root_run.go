@@ -48,7 +48,15 @@ func run(cmd *cobra.Command, args []string) error {
 	log.WithField("signal", <-sigChan).Info("signal received")
 	log.Warning("shutting down server")
 
-	integration.GetIntegration().Stop()
+	// The backend is stopped first, such that the pending state is persisted
+	// and the last events are published before stopping the integration.
+	if err := backend.GetBackend().Stop(); err != nil {
+		log.WithError(err).Error("stop backend error")
+	}
+
+	if err := integration.GetIntegration().Stop(); err != nil {
+		return errors.Wrap(err, "stop integration error")
+	}
 
 	return nil
 }
@@ -119,6 +127,12 @@ func setupCommands() error {
 	if err := commands.Setup(config.C); err != nil {
 		return errors.Wrap(err, "setup commands error")
 	}
+
+	// Some backends are able to execute commands on the gateway.
+	if e, ok := backend.GetBackend().(commands.RemoteExecutor); ok {
+		commands.SetRemoteExecutor(e)
+	}
+
 	return nil
 }
 
@@ -6,29 +6,58 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/basicstation"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/concentratord"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/semtechudp"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/simulator"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
 	"github.com/chirpstack/chirpstack/api/go/v4/gw"
 )
 
 var backend Backend
 
-// Setup configures the backend.
+// Setup configures the backend. When multiple backend types are configured,
+// these are run concurrently.
 func Setup(conf config.Config) error {
-	var err error
-
-	switch conf.Backend.Type {
-	case "semtech_udp":
-		backend, err = semtechudp.NewBackend(conf)
-	case "basic_station":
-		backend, err = basicstation.NewBackend(conf)
-	default:
-		return fmt.Errorf("unknown backend type: %s", conf.Backend.Type)
+	var backends []Backend
+	types := make(map[string]struct{})
+
+	for _, t := range conf.Backend.Type {
+		if _, ok := types[t]; ok {
+			return fmt.Errorf("backend type configured multiple times: %s", t)
+		}
+		types[t] = struct{}{}
+
+		var b Backend
+		var err error
+
+		switch t {
+		case "semtech_udp":
+			b, err = semtechudp.NewBackend(conf)
+		case "basic_station":
+			b, err = basicstation.NewBackend(conf)
+		case "concentratord":
+			b, err = concentratord.NewBackend(conf)
+		case "simulator":
+			b, err = simulator.NewBackend(conf)
+		default:
+			return fmt.Errorf("unknown backend type: %s", t)
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "new backend error")
+		}
+
+		backends = append(backends, b)
 	}
 
-	if err != nil {
-		return errors.Wrap(err, "new backend error")
+	switch len(backends) {
+	case 0:
+		return errors.New("no backend type configured")
+	case 1:
+		backend = backends[0]
+	default:
+		backend = newMultiBackend(backends)
 	}
 
 	return nil
@@ -71,3 +100,13 @@ type Backend interface {
 	// RawPacketForwarderCommand sends the given raw command to the packet-forwarder.
 	RawPacketForwarderCommand(*gw.RawPacketForwarderCommand) error
 }
+
+// OrderedUplinkBackend is implemented by backends which publish the uplinks
+// of a gateway in order, from a bounded number of goroutines. The handler
+// func set by SetOrderedUplinkFrameFunc must therefore handle the uplink
+// before returning, rather than handling it asynchronously.
+type OrderedUplinkBackend interface {
+	// SetOrderedUplinkFrameFunc sets the UplinkFrame handler func which is
+	// called in order for the uplinks of a gateway.
+	SetOrderedUplinkFrameFunc(func(*gw.UplinkFrame))
+}
@@ -0,0 +1,200 @@
+package basicstation
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+)
+
+// Authentication types.
+const (
+	authTypeTokenFile = "token_file"
+	authTypeHMAC      = "hmac"
+)
+
+// tokenStore validates the Authorization token of a gateway.
+type tokenStore interface {
+	// validate returns true when the given token is valid for the gateway.
+	validate(gatewayID lorawan.EUI64, token string) bool
+}
+
+// fileTokenStore reads the per gateway tokens from a file. Each line of the
+// file contains the gateway ID and the token, separated by whitespace. Empty
+// lines and lines starting with # are ignored.
+type fileTokenStore struct {
+	sync.RWMutex
+
+	path    string
+	modTime time.Time
+	tokens  map[lorawan.EUI64]string
+}
+
+func newFileTokenStore(path string) (*fileTokenStore, error) {
+	s := fileTokenStore{
+		path: path,
+	}
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// reload reads the token file in case it has been modified since the last
+// read.
+func (s *fileTokenStore) reload() error {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return errors.Wrap(err, "stat token file error")
+	}
+
+	s.RLock()
+	modTime := s.modTime
+	s.RUnlock()
+
+	if fi.ModTime().Equal(modTime) {
+		return nil
+	}
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return errors.Wrap(err, "open token file error")
+	}
+	defer f.Close()
+
+	tokens := make(map[lorawan.EUI64]string)
+	scanner := bufio.NewScanner(f)
+	var line int
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return fmt.Errorf("expected gateway id and token on line %d", line)
+		}
+
+		var gatewayID lorawan.EUI64
+		if err := gatewayID.UnmarshalText([]byte(fields[0])); err != nil {
+			return errors.Wrapf(err, "decode gateway id error on line %d", line)
+		}
+		tokens[gatewayID] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "read token file error")
+	}
+
+	s.Lock()
+	s.tokens = tokens
+	s.modTime = fi.ModTime()
+	s.Unlock()
+
+	log.WithFields(log.Fields{
+		"file":   s.path,
+		"tokens": len(tokens),
+	}).Info("backend/basicstation: token file loaded")
+
+	return nil
+}
+
+func (s *fileTokenStore) validate(gatewayID lorawan.EUI64, token string) bool {
+	s.RLock()
+	expected, ok := s.tokens[gatewayID]
+	s.RUnlock()
+
+	if !ok {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+// hmacTokenStore derives the token of a gateway from a master secret. The
+// token is the hex encoded HMAC-SHA256 of the (lower-case, hex encoded)
+// gateway ID.
+type hmacTokenStore struct {
+	secret []byte
+}
+
+func (s *hmacTokenStore) validate(gatewayID lorawan.EUI64, token string) bool {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(gatewayID.String()))
+	expected := hex.EncodeToString(mac.Sum(nil))
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(token))) == 1
+}
+
+// getAuthorizationToken returns the token from the Authorization header. The
+// optional Bearer scheme is removed.
+func getAuthorizationToken(r *http.Request) string {
+	token := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+		token = strings.TrimSpace(token[7:])
+	}
+	return token
+}
+
+// authenticate validates the Authorization token of the request for the
+// given gateway ID. It always returns true when token authentication is not
+// configured.
+func (b *Backend) authenticate(gatewayID lorawan.EUI64, r *http.Request) bool {
+	if b.tokenStore == nil {
+		return true
+	}
+
+	token := getAuthorizationToken(r)
+	if token == "" {
+		authFailureCounter("missing_token").Inc()
+		log.WithFields(log.Fields{
+			"gateway_id":  gatewayID,
+			"remote_addr": r.RemoteAddr,
+		}).Warning("backend/basicstation: authorization token missing")
+		return false
+	}
+
+	if !b.tokenStore.validate(gatewayID, token) {
+		authFailureCounter("invalid_token").Inc()
+		log.WithFields(log.Fields{
+			"gateway_id":  gatewayID,
+			"remote_addr": r.RemoteAddr,
+		}).Warning("backend/basicstation: invalid authorization token")
+		return false
+	}
+
+	return true
+}
+
+// reloadTokenStoreLoop periodically reloads the token file (if modified)
+// until the backend is stopped.
+func (b *Backend) reloadTokenStoreLoop(s *fileTokenStore) {
+	ticker := time.NewTicker(b.authReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.reload(); err != nil {
+				log.WithError(err).WithField("file", s.path).Error("backend/basicstation: reload token file error")
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package basicstation
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+)
+
+func TestFileTokenStore(t *testing.T) {
+	assert := require.New(t)
+
+	tempDir, err := ioutil.TempDir("", "test")
+	assert.NoError(err)
+	defer os.RemoveAll(tempDir)
+
+	tokenFile := filepath.Join(tempDir, "tokens")
+	assert.NoError(ioutil.WriteFile(tokenFile, []byte("# comment\n\n0102030405060708 secret1\n"), 0600))
+
+	s, err := newFileTokenStore(tokenFile)
+	assert.NoError(err)
+
+	assert.True(s.validate(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, "secret1"))
+	assert.False(s.validate(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, "secret2"))
+	assert.False(s.validate(lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}, "secret1"))
+
+	t.Run("reload", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(ioutil.WriteFile(tokenFile, []byte("0102030405060708 secret2\n"), 0600))
+		modTime := time.Now().Add(time.Second)
+		assert.NoError(os.Chtimes(tokenFile, modTime, modTime))
+		assert.NoError(s.reload())
+
+		assert.False(s.validate(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, "secret1"))
+		assert.True(s.validate(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, "secret2"))
+	})
+
+	t.Run("invalid file", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(ioutil.WriteFile(tokenFile, []byte("0102030405060708\n"), 0600))
+		modTime := time.Now().Add(2 * time.Second)
+		assert.NoError(os.Chtimes(tokenFile, modTime, modTime))
+		assert.EqualError(s.reload(), "expected gateway id and token on line 1")
+
+		// the previous tokens are kept
+		assert.True(s.validate(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, "secret2"))
+	})
+}
+
+func TestHMACTokenStore(t *testing.T) {
+	assert := require.New(t)
+
+	s := hmacTokenStore{secret: []byte("secret")}
+
+	// echo -n "0102030405060708" | openssl dgst -sha256 -hmac "secret"
+	token := "b33a8c5b62abc2d7b0c977cecbe3b5263ce9c12de695ae2fe491a6811b1b27e8"
+	assert.True(s.validate(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, token))
+	assert.False(s.validate(lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}, token))
+	assert.False(s.validate(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, "invalid"))
+}
+
+func TestGetAuthorizationToken(t *testing.T) {
+	tests := []struct {
+		Header   string
+		Expected string
+	}{
+		{"", ""},
+		{"secret", "secret"},
+		{"Bearer secret", "secret"},
+		{"bearer  secret ", "secret"},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Header, func(t *testing.T) {
+			assert := require.New(t)
+
+			r, err := http.NewRequest("GET", "/", nil)
+			assert.NoError(err)
+			r.Header.Set("Authorization", tst.Header)
+
+			assert.Equal(tst.Expected, getAuthorizationToken(r))
+		})
+	}
+}
@@ -1,12 +1,10 @@
 package basicstation
 
 import (
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
@@ -23,9 +21,10 @@ import (
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/basicstation/structs"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/stats"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/capture"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/certificate"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
 	"github.com/brocaar/lorawan"
-	"github.com/brocaar/lorawan/band"
 	"github.com/brocaar/lorawan/gps"
 	"github.com/chirpstack/chirpstack/api/go/v4/gw"
 )
@@ -37,6 +36,21 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin:     func(*http.Request) bool { return true },
 }
 
+// Policies for handling a new connection for a gateway that is already
+// connected.
+const (
+	// duplicateConnectionReject rejects the new connection.
+	duplicateConnectionReject = "reject"
+
+	// duplicateConnectionReplace closes the existing connection. The stats
+	// and timesync state are kept for the new connection.
+	duplicateConnectionReplace = "replace"
+
+	// duplicateConnectionKeepNewest closes the existing connection. The new
+	// connection starts with a clean state.
+	duplicateConnectionKeepNewest = "keep_newest"
+)
+
 // Backend implements a Basic Station backend.
 type Backend struct {
 	sync.RWMutex
@@ -48,6 +62,7 @@ type Backend struct {
 
 	server   *http.Server
 	ln       net.Listener
+	certs    *certificate.Reloader
 	scheme   string
 	isClosed bool
 
@@ -56,24 +71,63 @@ type Backend struct {
 	timesyncInterval time.Duration
 	readTimeout      time.Duration
 	writeTimeout     time.Duration
+	txAckTimeout     time.Duration
+
+	duplicateConnectionPolicy string
+	runCommandEnabled         bool
+	remoteShellEnabled        bool
+	remoteShellMaxDuration    time.Duration
+	getXTimeTimeout           time.Duration
 
-	gateways gateways
+	// runCommands holds the command-lines of the configured [commands], by
+	// name. Only these can be executed using runcmd.
+	runCommands map[string]string
+
+	gateways       gateways
+	remoteCommands remoteCommands
 
 	downlinkTxAckFunc           func(*gw.DownlinkTxAck)
 	uplinkFrameFunc             func(*gw.UplinkFrame)
 	gatewayStatsFunc            func(*gw.GatewayStats)
 	rawPacketForwarderEventFunc func(*gw.RawPacketForwarderEvent)
 
-	band          band.Band
-	region        band.Name
-	netIDs        []lorawan.NetID
-	joinEUIs      [][2]lorawan.EUI64
-	frequencyMin  uint32
-	frequencyMax  uint32
-	concentrators []config.BasicStationConcentrator
+	// defaultProfile is used for gateways that do not match any of the
+	// configured profiles.
+	defaultProfile profile
+	profiles       []profile
+
+	// Directory containing the per gateway CUPS configuration.
+	cupsDirectory string
+
+	// tokenStore is used to validate the Authorization token of the
+	// gateways. It is nil when token authentication is disabled.
+	tokenStore         tokenStore
+	authReloadInterval time.Duration
+
+	// routerInfo returns the LNS endpoint for router-info requests.
+	routerInfo routerInfoRouter
 
-	// Cache to store diid to UUIDs.
+	// done is closed when the backend is stopped.
+	done chan struct{}
+
+	// Capture of the gateway traffic, nil when disabled.
+	capture *capture.Writer
+
+	// Cache to store the downlink attempts by diid. Each attempt is sent
+	// using its own diid, such that a dntxed can't be attributed to an other
+	// attempt of the same downlink frame.
 	diidCache *cache.Cache
+	diid      uint32
+}
+
+// downlinkAttempt contains a downlink frame of which the item(s) at index
+// have been sent to the gateway, waiting for the dntxed message.
+type downlinkAttempt struct {
+	gatewayID  lorawan.EUI64
+	conn       *connection
+	frame      *gw.DownlinkFrame
+	index      int
+	txAckItems []*gw.DownlinkTxAckItem
 }
 
 // NewBackend creates a new Backend.
@@ -82,7 +136,8 @@ func NewBackend(conf config.Config) (*Backend, error) {
 		scheme: "ws",
 
 		gateways: gateways{
-			gateways: make(map[lorawan.EUI64]*connection),
+			gateways:       make(map[lorawan.EUI64]*connection),
+			configurations: make(map[lorawan.EUI64]gatewayConfiguration),
 		},
 
 		tlsSupportProxy: conf.Backend.BasicStation.TLSSupportProxy,
@@ -95,45 +150,86 @@ func NewBackend(conf config.Config) (*Backend, error) {
 		timesyncInterval: conf.Backend.BasicStation.TimesyncInterval,
 		readTimeout:      conf.Backend.BasicStation.ReadTimeout,
 		writeTimeout:     conf.Backend.BasicStation.WriteTimeout,
+		txAckTimeout:     conf.Backend.BasicStation.TxAckTimeout,
 
-		region:        band.Name(conf.Backend.BasicStation.Region),
-		frequencyMin:  conf.Backend.BasicStation.FrequencyMin,
-		frequencyMax:  conf.Backend.BasicStation.FrequencyMax,
-		concentrators: config.C.Backend.BasicStation.Concentrators,
+		cupsDirectory: conf.Backend.BasicStation.CUPSDirectory,
+
+		duplicateConnectionPolicy: conf.Backend.BasicStation.DuplicateConnectionPolicy,
+
+		remoteCommands: remoteCommands{
+			getXTime: make(map[lorawan.EUI64][]*pendingGetXTime),
+			shells:   make(map[lorawan.EUI64]map[uint8]*remoteShell),
+		},
+		runCommandEnabled:      conf.Backend.BasicStation.RunCommandEnabled,
+		remoteShellEnabled:     conf.Backend.BasicStation.RemoteShellEnabled,
+		remoteShellMaxDuration: conf.Backend.BasicStation.RemoteShellMaxDuration,
+		getXTimeTimeout:        getXTimeTimeout,
+		runCommands:            make(map[string]string),
 
 		diidCache: cache.New(time.Minute, time.Minute),
+		diid:      rand.Uint32(),
+
+		authReloadInterval: conf.Backend.BasicStation.Auth.ReloadInterval,
+		done:               make(chan struct{}),
 	}
 
-	for _, n := range conf.Filters.NetIDs {
-		var netID lorawan.NetID
-		if err := netID.UnmarshalText([]byte(n)); err != nil {
-			return nil, errors.Wrap(err, "unmarshal netid error")
-		}
-		b.netIDs = append(b.netIDs, netID)
+	switch b.duplicateConnectionPolicy {
+	case "":
+		b.duplicateConnectionPolicy = duplicateConnectionReject
+	case duplicateConnectionReject, duplicateConnectionReplace, duplicateConnectionKeepNewest:
+	default:
+		return nil, fmt.Errorf("invalid duplicate_connection_policy: %s", b.duplicateConnectionPolicy)
 	}
 
-	for _, set := range conf.Filters.JoinEUIs {
-		var joinEUIs [2]lorawan.EUI64
-		for i, s := range set {
-			var eui lorawan.EUI64
-			if err := eui.UnmarshalText([]byte(s)); err != nil {
-				return nil, errors.Wrap(err, "unmarshal joineui error")
-			}
-			joinEUIs[i] = eui
-		}
-		b.joinEUIs = append(b.joinEUIs, joinEUIs)
+	for name, cmd := range conf.Commands.Commands {
+		b.runCommands[name] = cmd.Command
 	}
 
 	var err error
-	b.band, err = band.GetConfig(b.region, false, lorawan.DwellTimeNoLimit)
+	b.defaultProfile, err = newProfile("default", conf.Backend.BasicStation.Region, conf.Backend.BasicStation.FrequencyMin, conf.Backend.BasicStation.FrequencyMax, conf.Backend.BasicStation.Concentrators, conf.Filters.NetIDs, conf.Filters.JoinEUIs)
 	if err != nil {
-		return nil, errors.Wrap(err, "get band config error")
+		return nil, errors.Wrap(err, "new default profile error")
+	}
+
+	switch conf.Backend.BasicStation.Auth.Type {
+	case "":
+	case authTypeTokenFile:
+		b.tokenStore, err = newFileTokenStore(conf.Backend.BasicStation.Auth.TokenFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "new token file store error")
+		}
+	case authTypeHMAC:
+		if conf.Backend.BasicStation.Auth.HMACSecret == "" {
+			return nil, errors.New("auth hmac_secret must be set")
+		}
+		b.tokenStore = &hmacTokenStore{secret: []byte(conf.Backend.BasicStation.Auth.HMACSecret)}
+	default:
+		return nil, fmt.Errorf("invalid auth type: %s", conf.Backend.BasicStation.Auth.Type)
+	}
+
+	b.routerInfo, err = newRouterInfoRouter(conf.Backend.BasicStation.RouterInfo)
+	if err != nil {
+		return nil, errors.Wrap(err, "new router-info router error")
+	}
+
+	b.capture, err = capture.NewWriter(conf.Backend.BasicStation.Capture.File, conf.Backend.BasicStation.Capture.MaxSize, conf.Backend.BasicStation.Capture.MaxFiles)
+	if err != nil {
+		return nil, errors.Wrap(err, "new capture writer error")
+	}
+
+	for _, profileConf := range conf.Backend.BasicStation.Profiles {
+		p, err := newProfileFromConfig(profileConf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "new profile error (name: %s)", profileConf.Name)
+		}
+		b.profiles = append(b.profiles, p)
 	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/router-info", func(w http.ResponseWriter, r *http.Request) {
 		b.websocketWrap(b.handleRouterInfo, w, r)
 	})
+	mux.HandleFunc("/update-info", b.handleUpdateInfo)
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		connectCounter().Inc()
 		b.websocketWrap(b.handleGateway, w, r)
@@ -152,20 +248,14 @@ func NewBackend(conf config.Config) (*Backend, error) {
 		Handler: mux,
 	}
 
-	// if the CA cert is configured, setup client certificate verification.
-	if b.caCert != "" {
-		rawCACert, err := ioutil.ReadFile(b.caCert)
+	// if TLS is configured, the certificates are reloaded when modified and
+	// if the CA cert is configured, client certificates are verified.
+	if b.tlsCert != "" || b.tlsKey != "" || b.caCert != "" {
+		b.certs, err = certificate.NewReloader(b.caCert, b.tlsCert, b.tlsKey)
 		if err != nil {
-			return nil, errors.Wrap(err, "read ca cert error")
-		}
-
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(rawCACert)
-
-		b.server.TLSConfig = &tls.Config{
-			ClientCAs:  caCertPool,
-			ClientAuth: tls.RequireAndVerifyClientCert,
+			return nil, errors.Wrap(err, "load tls certificates error")
 		}
+		b.server.TLSConfig = b.certs.ServerTLSConfig()
 	}
 
 	return &b, nil
@@ -193,42 +283,290 @@ func (b *Backend) SetRawPacketForwarderEventFunc(f func(*gw.RawPacketForwarderEv
 
 // SetSubscribeEventFunc sets the Subscribe handler func.
 func (b *Backend) SetSubscribeEventFunc(f func(events.Subscribe)) {
-	b.gateways.subscribeEventFunc = f
+	b.gateways.setSubscribeEventFunc(f)
 }
 
-// SendDownlinkFrame sends the given downlink frame.
+// SendDownlinkFrame sends the given downlink frame. When the frame contains
+// multiple items, the next item is sent when the item can not be sent or when
+// the gateway did not confirm the transmission within the tx ack timeout.
+// RX1 / RX2 items are sent to the gateway as a single message.
 func (b *Backend) SendDownlinkFrame(df *gw.DownlinkFrame) error {
 	b.Lock()
 	defer b.Unlock()
 
-	pl, err := structs.DownlinkFrameFromProto(b.band, df)
-	if err != nil {
-		return errors.Wrap(err, "downlink frame from proto error")
-	}
-
 	var gatewayID lorawan.EUI64
 	if err := gatewayID.UnmarshalText([]byte(df.GetGatewayId())); err != nil {
 		return errors.Wrap(err, "decode gateway id error")
 	}
 
-	// Store downlink under DIID in cache
-	b.diidCache.SetDefault(fmt.Sprintf("%d", df.GetDownlinkId()), df)
+	acks := make([]*gw.DownlinkTxAckItem, len(df.Items))
+	for i := range acks {
+		acks[i] = &gw.DownlinkTxAckItem{
+			Status: gw.TxAckStatus_IGNORED,
+		}
+	}
 
-	websocketSendCounter("dnmsg").Inc()
-	if err := b.sendToGateway(gatewayID, pl); err != nil {
-		return errors.Wrap(err, "send to gateway error")
+	return b.sendDownlinkFrame(gatewayID, df, 0, acks)
+}
+
+// sendDownlinkFrame sends the downlink frame item(s) starting at index i.
+// In case of an error, the next item(s) are tried. When none of the items
+// could be sent, the tx ack is reported. Note that this must be called with
+// the lock of the backend held.
+func (b *Backend) sendDownlinkFrame(gatewayID lorawan.EUI64, df *gw.DownlinkFrame, i int, txAckItems []*gw.DownlinkTxAckItem) error {
+	var err error
+	var diid uint32
+	var timeout time.Duration
+
+	for i < len(df.Items) {
+		count := downlinkItemCount(df, i)
+		timeout = b.getTxAckTimeout(df.Items[i+count-1])
+
+		err = func() error {
+			pl, _, err := structs.DownlinkFrameFromProto(b.getProfile(gatewayID).band, df, i)
+			if err != nil {
+				return errors.Wrap(err, "downlink frame from proto error")
+			}
+
+			conn, err := b.gateways.get(gatewayID)
+			if err != nil {
+				return errors.Wrap(err, "get gateway error")
+			}
+
+			// The attempt must be stored before sending, as the dntxed
+			// could be received before sendToGateway returns.
+			diid = b.addDownlinkAttempt(downlinkAttempt{
+				gatewayID:  gatewayID,
+				conn:       conn,
+				frame:      df,
+				index:      i,
+				txAckItems: txAckItems,
+			}, timeout)
+			pl.DIID = diid
+
+			websocketSendCounter("dnmsg").Inc()
+			if err := b.sendToGateway(gatewayID, pl); err != nil {
+				b.diidCache.Delete(fmt.Sprintf("%d", diid))
+				return errors.Wrap(err, "send to gateway error")
+			}
+
+			return nil
+		}()
+		if err == nil {
+			break
+		}
+
+		log.WithError(err).WithFields(log.Fields{
+			"gateway_id":  gatewayID,
+			"downlink_id": df.GetDownlinkId(),
+			"item_index":  i,
+		}).Error("backend/basicstation: send downlink-frame item error")
+
+		for j := i; j < i+count; j++ {
+			txAckItems[j].Status = gw.TxAckStatus_INTERNAL_ERROR
+		}
+		i += count
+	}
+
+	if err != nil {
+		b.sendDownlinkTxAck(gatewayID, df, txAckItems)
+		return err
 	}
 
+	// Schedule the fallback to the next item(s) in case the gateway does not
+	// confirm the transmission.
+	time.AfterFunc(timeout, func() {
+		b.handleDownlinkTxAckTimeout(diid)
+	})
+
 	log.WithFields(log.Fields{
 		"gateway_id":  gatewayID,
 		"downlink_id": df.GetDownlinkId(),
+		"diid":        diid,
+		"item_index":  i,
 	}).Info("backend/basicstation: downlink-frame message sent to gateway")
 
 	return nil
 }
 
-// ApplyConfiguration is not implemented.
+// addDownlinkAttempt stores the given attempt under a newly allocated diid.
+// The attempt is kept for a minute after the tx ack timeout, as the timeout
+// handler must be able to find it. Note that this must be called with the
+// lock of the backend held.
+func (b *Backend) addDownlinkAttempt(a downlinkAttempt, timeout time.Duration) uint32 {
+	for {
+		b.diid++
+		if err := b.diidCache.Add(fmt.Sprintf("%d", b.diid), a, timeout+time.Minute); err == nil {
+			return b.diid
+		}
+	}
+}
+
+// popDownlinkAttempt returns and removes the attempt with the given diid.
+func (b *Backend) popDownlinkAttempt(diid uint32) (downlinkAttempt, bool) {
+	key := fmt.Sprintf("%d", diid)
+
+	v, ok := b.diidCache.Get(key)
+	if !ok {
+		return downlinkAttempt{}, false
+	}
+	b.diidCache.Delete(key)
+
+	return v.(downlinkAttempt), true
+}
+
+// handleDownlinkTxAckTimeout sends the next downlink frame item(s) in case the
+// transmission of the attempt with the given diid has not been confirmed.
+func (b *Backend) handleDownlinkTxAckTimeout(diid uint32) {
+	b.Lock()
+	defer b.Unlock()
+
+	a, ok := b.popDownlinkAttempt(diid)
+	if !ok {
+		// the transmission has been confirmed
+		return
+	}
+
+	downlinkTxAckTimeoutCounter().Inc()
+	log.WithFields(log.Fields{
+		"gateway_id":  a.gatewayID,
+		"downlink_id": a.frame.GetDownlinkId(),
+		"diid":        diid,
+		"item_index":  a.index,
+	}).Warning("backend/basicstation: downlink transmission not confirmed by gateway")
+
+	b.sendNextDownlinkItem(a)
+}
+
+// handleDownlinkAttemptsFailed sends the next downlink frame item(s) for the
+// attempts that were sent over the given connection, as the gateway can't
+// confirm these once the connection has been closed.
+func (b *Backend) handleDownlinkAttemptsFailed(conn *connection) {
+	b.Lock()
+	defer b.Unlock()
+
+	for key, item := range b.diidCache.Items() {
+		a, ok := item.Object.(downlinkAttempt)
+		if !ok || a.conn != conn {
+			continue
+		}
+		b.diidCache.Delete(key)
+
+		log.WithFields(log.Fields{
+			"gateway_id":  a.gatewayID,
+			"downlink_id": a.frame.GetDownlinkId(),
+			"item_index":  a.index,
+		}).Warning("backend/basicstation: gateway disconnected before confirming downlink transmission")
+
+		b.sendNextDownlinkItem(a)
+	}
+}
+
+// sendNextDownlinkItem marks the item(s) of the given attempt as failed and
+// sends the next item(s). When there are no items left, the tx ack is
+// reported. Note that this must be called with the lock of the backend held.
+func (b *Backend) sendNextDownlinkItem(a downlinkAttempt) {
+	count := downlinkItemCount(a.frame, a.index)
+	for j := a.index; j < a.index+count; j++ {
+		a.txAckItems[j].Status = gw.TxAckStatus_INTERNAL_ERROR
+	}
+
+	if a.index+count < len(a.frame.Items) {
+		if err := b.sendDownlinkFrame(a.gatewayID, a.frame, a.index+count, a.txAckItems); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"gateway_id":  a.gatewayID,
+				"downlink_id": a.frame.GetDownlinkId(),
+			}).Error("backend/basicstation: send downlink-frame error")
+		}
+		return
+	}
+
+	b.sendDownlinkTxAck(a.gatewayID, a.frame, a.txAckItems)
+}
+
+// getTxAckTimeout returns the duration after which the transmission of the
+// given item is expected to be confirmed by the gateway.
+func (b *Backend) getTxAckTimeout(item *gw.DownlinkFrameItem) time.Duration {
+	timeout := b.txAckTimeout
+	timing := item.GetTxInfo().GetTiming()
+
+	if delay := timing.GetDelay(); delay != nil {
+		timeout += delay.GetDelay().AsDuration()
+	}
+
+	if gpsEpoch := timing.GetGpsEpoch(); gpsEpoch != nil {
+		txTime := time.Time(gps.NewTimeFromTimeSinceGPSEpoch(gpsEpoch.GetTimeSinceGpsEpoch().AsDuration()))
+		if d := time.Until(txTime); d > 0 {
+			timeout += d
+		}
+	}
+
+	return timeout
+}
+
+func (b *Backend) sendDownlinkTxAck(gatewayID lorawan.EUI64, df *gw.DownlinkFrame, txAckItems []*gw.DownlinkTxAckItem) {
+	txAck := gw.DownlinkTxAck{
+		GatewayId:  gatewayID.String(),
+		DownlinkId: df.GetDownlinkId(),
+		Items:      txAckItems,
+	}
+
+	if conn, err := b.gateways.get(gatewayID); err == nil {
+		conn.stats.CountDownlink(df, &txAck)
+	}
+
+	if b.downlinkTxAckFunc != nil {
+		b.downlinkTxAckFunc(&txAck)
+	}
+}
+
+// downlinkItemCount returns the number of items that are sent as a single
+// message to the gateway, starting at index i.
+func downlinkItemCount(df *gw.DownlinkFrame, i int) int {
+	if i+1 < len(df.Items) && structs.IsRX2Item(df.Items[i], df.Items[i+1]) {
+		return 2
+	}
+	return 1
+}
+
+// ApplyConfiguration converts the given gateway configuration into a
+// router-config message and sends it to the gateway. The router-config is
+// stored, so that it is sent again when the gateway re-connects.
 func (b *Backend) ApplyConfiguration(gwConfig *gw.GatewayConfiguration) error {
+	var gatewayID lorawan.EUI64
+	if err := gatewayID.UnmarshalText([]byte(gwConfig.GetGatewayId())); err != nil {
+		return errors.Wrap(err, "decode gateway id error")
+	}
+
+	if conf, ok := b.gateways.getConfiguration(gatewayID); ok && conf.version == gwConfig.GetVersion() {
+		return nil
+	}
+
+	routerConfig, err := b.getProfile(gatewayID).getRouterConfigForGatewayConfiguration(gwConfig)
+	if err != nil {
+		return errors.Wrap(err, "get router config error")
+	}
+
+	b.gateways.setConfiguration(gatewayID, gatewayConfiguration{
+		version:      gwConfig.GetVersion(),
+		routerConfig: routerConfig,
+	})
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"version":    gwConfig.GetVersion(),
+	}).Info("backend/basicstation: gateway configuration stored")
+
+	// The router-config will be sent on connect when the gateway is not
+	// connected.
+	if _, err := b.gateways.get(gatewayID); err != nil {
+		return nil
+	}
+
+	if err := b.sendRouterConfig(gatewayID); err != nil {
+		return errors.Wrap(err, "send router config error")
+	}
+
 	return nil
 }
 
@@ -262,6 +600,10 @@ func (b *Backend) RawPacketForwarderCommand(pl *gw.RawPacketForwarderCommand) er
 
 // Start starts the backend.
 func (b *Backend) Start() error {
+	if s, ok := b.tokenStore.(*fileTokenStore); ok && b.authReloadInterval != 0 {
+		go b.reloadTokenStoreLoop(s)
+	}
+
 	go func() {
 		log.WithFields(log.Fields{
 			"bind":              b.ln.Addr(),
@@ -271,7 +613,7 @@ func (b *Backend) Start() error {
 			"tls_key":           b.tlsKey,
 		}).Info("backend/basicstation: starting websocket listener")
 
-		if b.tlsCert == "" && b.tlsKey == "" && b.caCert == "" {
+		if b.certs == nil {
 			// no tls
 			if b.tlsSupportProxy {
 				log.Info("backend/basicstation: TLS support handled by reverse-proxy")
@@ -283,7 +625,8 @@ func (b *Backend) Start() error {
 		} else {
 			// tls
 			b.scheme = "wss"
-			if err := b.server.ServeTLS(b.ln, b.tlsCert, b.tlsKey); err != nil && !b.isClosed {
+			// the certificates are provided by the TLSConfig
+			if err := b.server.ServeTLS(b.ln, "", ""); err != nil && !b.isClosed {
 				log.WithError(err).Fatal("backend/basicstation: server error")
 			}
 		}
@@ -295,11 +638,61 @@ func (b *Backend) Start() error {
 // Stop stops the backend.
 func (b *Backend) Stop() error {
 	b.isClosed = true
+	close(b.done)
+	if b.certs != nil {
+		if err := b.certs.Close(); err != nil {
+			log.WithError(err).Error("backend/basicstation: close certificate reloader error")
+		}
+	}
+	if err := b.capture.Close(); err != nil {
+		log.WithError(err).Error("backend/basicstation: close capture error")
+	}
 	return b.ln.Close()
 }
 
-func (b *Backend) getRouterConfig() (structs.RouterConfig, error) {
-	return structs.GetRouterConfig(b.region, b.netIDs, b.joinEUIs, b.frequencyMin, b.frequencyMax, b.concentrators)
+// getProfile returns the first profile matching the given gateway ID, or the
+// default profile in case none of the profiles match.
+func (b *Backend) getProfile(gatewayID lorawan.EUI64) *profile {
+	for i := range b.profiles {
+		if b.profiles[i].matches(gatewayID) {
+			return &b.profiles[i]
+		}
+	}
+
+	return &b.defaultProfile
+}
+
+// getRouterConfigForGateway returns the router-config for the given gateway.
+// When a configuration has been received through ApplyConfiguration, this
+// configuration is returned, else the router-config is generated from the
+// profile of the gateway.
+func (b *Backend) getRouterConfigForGateway(gatewayID lorawan.EUI64) (structs.RouterConfig, error) {
+	conf, ok := b.gateways.getConfiguration(gatewayID)
+	if !ok {
+		return b.getProfile(gatewayID).getRouterConfig()
+	}
+
+	// The router-config might have been generated some time ago.
+	muxTime := float64(time.Now().UnixMicro()) / 1000000
+	conf.routerConfig.MuxTime = &muxTime
+
+	return conf.routerConfig, nil
+}
+
+func (b *Backend) sendRouterConfig(gatewayID lorawan.EUI64) error {
+	routerConfig, err := b.getRouterConfigForGateway(gatewayID)
+	if err != nil {
+		return errors.Wrap(err, "get router config error")
+	}
+
+	websocketSendCounter("router_config").Inc()
+	if err := b.sendToGateway(gatewayID, routerConfig); err != nil {
+		return errors.Wrap(err, "send to gateway error")
+	}
+
+	log.WithField("gateway_id", gatewayID).Info("backend/basicstation: router-config message sent to gateway")
+
+	return nil
 }
 
 func (b *Backend) handleRouterInfo(r *http.Request, conn *connection) {
@@ -319,6 +712,11 @@ func (b *Backend) handleRouterInfo(r *http.Request, conn *connection) {
 		URI:    fmt.Sprintf("%s://%s/gateway/%s", b.scheme, r.Host, lorawan.EUI64(req.Router)),
 	}
 
+	// route the gateway to a specific instance when configured
+	if uri, ok := b.routerInfo.getURI(lorawan.EUI64(req.Router)); ok {
+		resp.URI = fmt.Sprintf("%s/gateway/%s", uri, lorawan.EUI64(req.Router))
+	}
+
 	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
 		var cn lorawan.EUI64
 
@@ -329,6 +727,13 @@ func (b *Backend) handleRouterInfo(r *http.Request, conn *connection) {
 		}
 	}
 
+	// The router is only known after reading the router-info request, the
+	// Authorization token is therefore validated here instead of on upgrade.
+	if !b.authenticate(lorawan.EUI64(req.Router), r) {
+		resp.URI = ""
+		resp.Error = fmt.Sprintf("authentication failed for router %s", lorawan.EUI64(req.Router))
+	}
+
 	bb, err := json.Marshal(resp)
 	if err != nil {
 		log.WithError(err).Error("backend/basicstation: marshal json error")
@@ -353,15 +758,9 @@ func (b *Backend) handleRouterInfo(r *http.Request, conn *connection) {
 
 func (b *Backend) handleGateway(r *http.Request, conn *connection) {
 	// get the gateway id from the url
-	urlParts := strings.Split(r.URL.Path, "/")
-	if len(urlParts) < 2 {
-		log.WithField("url", r.URL.Path).Error("backend/basicstation: unable to read gateway id from url")
-		return
-	}
-
-	var gatewayID lorawan.EUI64
-	if err := gatewayID.UnmarshalText([]byte(urlParts[len(urlParts)-1])); err != nil {
-		log.WithError(err).Error("backend/basicstation: parse gateway id error")
+	gatewayID, err := getGatewayIDFromPath(r.URL.Path)
+	if err != nil {
+		log.WithError(err).WithField("url", r.URL.Path).Error("backend/basicstation: get gateway id from url error")
 		return
 	}
 
@@ -376,16 +775,34 @@ func (b *Backend) handleGateway(r *http.Request, conn *connection) {
 		}
 	}
 
-	// make sure we're not overwriting an existing connection
-	_, err := b.gateways.get(gatewayID)
-	if err == nil {
-		log.WithField("gateway_id", gatewayID).Error("backend/basicstation: connection with same gateway id already exists")
-		return
-	}
-
 	// set the gateway connection
-	if err := b.gateways.set(gatewayID, conn); err != nil {
-		log.WithError(err).WithField("gateway_id", gatewayID).Error("backend/basicstation: set gateway error")
+	if b.duplicateConnectionPolicy == duplicateConnectionReject {
+		// make sure we're not overwriting an existing connection
+		_, err := b.gateways.get(gatewayID)
+		if err == nil {
+			duplicateConnectionCounter(b.duplicateConnectionPolicy).Inc()
+			log.WithField("gateway_id", gatewayID).Error("backend/basicstation: connection with same gateway id already exists")
+			return
+		}
+
+		if err := b.gateways.set(gatewayID, conn); err != nil {
+			log.WithError(err).WithField("gateway_id", gatewayID).Error("backend/basicstation: set gateway error")
+		}
+	} else {
+		old := b.gateways.replace(gatewayID, conn, b.duplicateConnectionPolicy == duplicateConnectionReplace)
+		if old != nil {
+			duplicateConnectionCounter(b.duplicateConnectionPolicy).Inc()
+			log.WithFields(log.Fields{
+				"gateway_id":  gatewayID,
+				"remote_addr": r.RemoteAddr,
+				"policy":      b.duplicateConnectionPolicy,
+			}).Warning("backend/basicstation: replacing existing connection with same gateway id")
+
+			// Remote shell sessions and pending getxtime requests belong to
+			// the old connection.
+			b.remoteCommands.remove(gatewayID)
+			b.closeConnection(gatewayID, old)
+		}
 	}
 	log.WithFields(log.Fields{
 		"gateway_id":  gatewayID,
@@ -397,7 +814,22 @@ func (b *Backend) handleGateway(r *http.Request, conn *connection) {
 	// remove the gateway on return
 	defer func() {
 		done <- struct{}{}
-		b.gateways.remove(gatewayID)
+
+		// The downlinks sent over this connection can't be confirmed anymore.
+		// This must be handled after removing the connection, such that the
+		// next item is only sent when the gateway has re-connected.
+		err := b.gateways.remove(gatewayID, conn)
+		b.handleDownlinkAttemptsFailed(conn)
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"gateway_id":  gatewayID,
+				"remote_addr": r.RemoteAddr,
+			}).Info("backend/basicstation: replaced gateway connection closed")
+			return
+		}
+
+		b.remoteCommands.remove(gatewayID)
 		log.WithFields(log.Fields{
 			"gateway_id":  gatewayID,
 			"remote_addr": r.RemoteAddr,
@@ -416,6 +848,10 @@ func (b *Backend) handleGateway(r *http.Request, conn *connection) {
 				stats.GatewayId = gatewayID.String()
 				stats.Time = timestamppb.Now()
 
+				if conf, ok := b.gateways.getConfiguration(gatewayID); ok {
+					stats.ConfigVersion = conf.version
+				}
+
 				if b.gatewayStatsFunc != nil {
 					b.gatewayStatsFunc(stats)
 				}
@@ -439,12 +875,18 @@ func (b *Backend) handleGateway(r *http.Request, conn *connection) {
 		// reset the read deadline as the Basic Station doesn't respond to PONG messages (yet)
 		conn.conn.SetReadDeadline(time.Now().Add(b.readTimeout))
 
+		b.captureMessage(capture.DirectionIn, gatewayID, r.RemoteAddr, mt, msg)
+
 		if mt == websocket.BinaryMessage {
 			log.WithFields(log.Fields{
 				"gateway_id":     gatewayID,
 				"message_base64": base64.StdEncoding.EncodeToString(msg),
 			}).Debug("backend/basicstation: binary message received")
 
+			if b.handleRemoteShellData(gatewayID, msg) {
+				continue
+			}
+
 			b.handleRawPacketForwarderEvent(gatewayID, msg)
 			continue
 		}
@@ -530,7 +972,7 @@ func (b *Backend) handleGateway(r *http.Request, conn *connection) {
 				}).Error("backend/basicstation: unmarshal json message error")
 				continue
 			}
-			b.handleDownlinkTransmittedMessage(gatewayID, pl)
+			b.handleDownlinkTransmittedMessage(gatewayID, conn, pl)
 		case structs.TimeSyncMessage:
 			// handle time sync request
 			var pl structs.TimeSyncRequest
@@ -543,6 +985,30 @@ func (b *Backend) handleGateway(r *http.Request, conn *connection) {
 				continue
 			}
 			b.handleTimeSync(gatewayID, pl)
+		case structs.GetXTimeMessage:
+			// handle getxtime response
+			var pl structs.GetXTimeResponse
+			if err := json.Unmarshal(msg, &pl); err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"message_type": msgType,
+					"gateway_id":   gatewayID,
+					"payload":      string(msg),
+				}).Error("backend/basicstation: unmarshal json message error")
+				continue
+			}
+			b.handleGetXTime(gatewayID, pl)
+		case structs.RemoteShellMessage:
+			// handle remote shell response
+			var pl structs.RemoteShellResponse
+			if err := json.Unmarshal(msg, &pl); err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"message_type": msgType,
+					"gateway_id":   gatewayID,
+					"payload":      string(msg),
+				}).Error("backend/basicstation: unmarshal json message error")
+				continue
+			}
+			b.handleRemoteShellResponse(gatewayID, pl)
 		default:
 			b.handleRawPacketForwarderEvent(gatewayID, msg)
 		}
@@ -560,23 +1026,13 @@ func (b *Backend) handleVersion(gatewayID lorawan.EUI64, pl structs.Version) {
 		// "features":   pl.Features,
 	}).Info("backend/basicstation: gateway version received")
 
-	routerConfig, err := b.getRouterConfig()
-	if err != nil {
-		log.WithError(err).Error("backend/basicstation: get router config error")
-		return
+	if err := b.sendRouterConfig(gatewayID); err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Error("backend/basicstation: send router-config error")
 	}
-
-	websocketSendCounter("router_config").Inc()
-	if err := b.sendToGateway(gatewayID, routerConfig); err != nil {
-		log.WithError(err).Error("backend/basicstation: send to gateway error")
-		return
-	}
-
-	log.WithField("gateway_id", gatewayID).Info("backend/basicstation: router-config message sent to gateway")
 }
 
 func (b *Backend) handleJoinRequest(gatewayID lorawan.EUI64, v structs.JoinRequest) {
-	uplinkFrame, err := structs.JoinRequestToProto(b.band, gatewayID, v)
+	uplinkFrame, err := structs.JoinRequestToProto(b.getProfile(gatewayID).band, gatewayID, v)
 	if err != nil {
 		log.WithError(err).WithFields(log.Fields{
 			"gateway_id": gatewayID,
@@ -602,7 +1058,7 @@ func (b *Backend) handleJoinRequest(gatewayID lorawan.EUI64, v structs.JoinReque
 }
 
 func (b *Backend) handleProprietaryDataFrame(gatewayID lorawan.EUI64, v structs.UplinkProprietaryFrame) {
-	uplinkFrame, err := structs.UplinkProprietaryFrameToProto(b.band, gatewayID, v)
+	uplinkFrame, err := structs.UplinkProprietaryFrameToProto(b.getProfile(gatewayID).band, gatewayID, v)
 	if err != nil {
 		log.WithError(err).WithFields(log.Fields{
 			"gateway_id": gatewayID,
@@ -627,39 +1083,65 @@ func (b *Backend) handleProprietaryDataFrame(gatewayID lorawan.EUI64, v structs.
 	}
 }
 
-func (b *Backend) handleDownlinkTransmittedMessage(gatewayID lorawan.EUI64, v structs.DownlinkTransmitted) {
-	b.RLock()
-	defer b.RUnlock()
+// handleDownlinkTransmittedMessage reports the tx ack for the attempt with the
+// diid of the given message. Messages for unknown attempts, e.g. of which the
+// tx ack timeout has already been handled, are ignored, as the tx ack of the
+// downlink has been (or will be) reported by the fallback.
+func (b *Backend) handleDownlinkTransmittedMessage(gatewayID lorawan.EUI64, conn *connection, v structs.DownlinkTransmitted) {
+	b.Lock()
+	defer b.Unlock()
 
-	txack, err := structs.DownlinkTransmittedToProto(gatewayID, v)
-	if err != nil {
-		log.WithError(err).WithFields(log.Fields{
+	key := fmt.Sprintf("%d", v.DIID)
+	item, ok := b.diidCache.Get(key)
+	if !ok || item.(downlinkAttempt).conn != conn {
+		log.WithFields(log.Fields{
 			"gateway_id": gatewayID,
-		}).Error("backend/basicstation: error converting downlink transmitted to protobuf message")
+			"diid":       v.DIID,
+		}).Warning("backend/basicstation: ignoring downlink transmitted message for unknown or expired diid")
 		return
 	}
+	b.diidCache.Delete(key)
 
-	if v, ok := b.diidCache.Get(fmt.Sprintf("%d", v.DIID)); ok {
-		pl := v.(*gw.DownlinkFrame)
-		txack.DownlinkId = pl.DownlinkId
-
-		if conn, err := b.gateways.get(gatewayID); err == nil {
-			conn.stats.CountDownlink(pl, &txack)
-		}
+	a := item.(downlinkAttempt)
+	index := a.index
+	if downlinkItemCount(a.frame, index) == 2 && isRX2Transmission(a.frame.Items[index], v) {
+		index++
 	}
+	a.txAckItems[index].Status = gw.TxAckStatus_OK
 
 	log.WithFields(log.Fields{
 		"gateway_id":  gatewayID,
-		"downlink_id": txack.GetDownlinkId(),
+		"downlink_id": a.frame.GetDownlinkId(),
+		"diid":        v.DIID,
 	}).Info("backend/basicstation: downlink transmitted message received")
 
-	if b.downlinkTxAckFunc != nil {
-		b.downlinkTxAckFunc(&txack)
+	b.sendDownlinkTxAck(gatewayID, a.frame, a.txAckItems)
+}
+
+// isRX2Transmission returns true when the xtime of the downlink transmitted
+// message indicates that the RX1 item was transmitted in the RX2 window.
+func isRX2Transmission(rx1 *gw.DownlinkFrameItem, v structs.DownlinkTransmitted) bool {
+	ctx := rx1.GetTxInfo().GetContext()
+	delay := rx1.GetTxInfo().GetTiming().GetDelay()
+	if v.XTime == 0 || len(ctx) < 16 || delay == nil {
+		return false
+	}
+
+	// xtime is in microseconds, RX2 is one second after RX1
+	rxXTime := binary.BigEndian.Uint64(ctx[8:16])
+	rx2Threshold := uint64((delay.GetDelay().AsDuration() + time.Second/2) / time.Microsecond)
+
+	// the upper 16 bits contain the xtime session, which changes when the
+	// station reconnects, in which case the xtime values can't be compared
+	if v.XTime>>48 != rxXTime>>48 || v.XTime < rxXTime {
+		return false
 	}
+
+	return v.XTime-rxXTime >= rx2Threshold
 }
 
 func (b *Backend) handleUplinkDataFrame(gatewayID lorawan.EUI64, v structs.UplinkDataFrame) {
-	uplinkFrame, err := structs.UplinkDataFrameToProto(b.band, gatewayID, v)
+	uplinkFrame, err := structs.UplinkDataFrameToProto(b.getProfile(gatewayID).band, gatewayID, v)
 	if err != nil {
 		log.WithError(err).WithFields(log.Fields{
 			"gateway_id": gatewayID,
@@ -737,6 +1219,8 @@ func (b *Backend) sendToGateway(gatewayID lorawan.EUI64, v interface{}) error {
 		"message":    string(bb),
 	}).Debug("sending message to gateway")
 
+	b.captureMessage(capture.DirectionOut, gatewayID, "", websocket.TextMessage, bb)
+
 	conn.conn.SetWriteDeadline(time.Now().Add(b.writeTimeout))
 	if err := conn.conn.WriteMessage(websocket.TextMessage, bb); err != nil {
 		return errors.Wrap(err, "send message to gateway error")
@@ -754,6 +1238,8 @@ func (b *Backend) sendRawToGateway(gatewayID lorawan.EUI64, messageType int, dat
 	conn.Lock()
 	defer conn.Unlock()
 
+	b.captureMessage(capture.DirectionOut, gatewayID, "", messageType, data)
+
 	conn.conn.SetWriteDeadline(time.Now().Add(b.writeTimeout))
 	if err := conn.conn.WriteMessage(messageType, data); err != nil {
 		return errors.Wrap(err, "send message to gateway error")
@@ -762,7 +1248,50 @@ func (b *Backend) sendRawToGateway(gatewayID lorawan.EUI64, messageType int, dat
 	return nil
 }
 
+// closeConnection sends a close message to the given connection and closes
+// the underlying network connection. The latter makes sure that the read loop
+// of the connection returns, also when the gateway does not respond to the
+// close message (e.g. in case of a half-open TCP connection).
+func (b *Backend) closeConnection(gatewayID lorawan.EUI64, conn *connection) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "connection replaced")
+	if err := conn.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(b.writeTimeout)); err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Warning("backend/basicstation: send close message error")
+	}
+
+	if err := conn.conn.Close(); err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Error("backend/basicstation: close connection error")
+	}
+}
+
+// getGatewayIDFromPath returns the gateway ID from the last element of the
+// given URL path.
+func getGatewayIDFromPath(path string) (lorawan.EUI64, error) {
+	var gatewayID lorawan.EUI64
+
+	urlParts := strings.Split(path, "/")
+	if len(urlParts) < 2 {
+		return gatewayID, errors.New("unable to read gateway id from url")
+	}
+
+	if err := gatewayID.UnmarshalText([]byte(urlParts[len(urlParts)-1])); err != nil {
+		return gatewayID, errors.Wrap(err, "parse gateway id error")
+	}
+
+	return gatewayID, nil
+}
+
 func (b *Backend) websocketWrap(handler func(*http.Request, *connection), w http.ResponseWriter, r *http.Request) {
+	// Validate the Authorization token before the upgrade when the gateway
+	// ID is part of the URL. For router-info requests, this is done by the
+	// handler.
+	if gatewayID, err := getGatewayIDFromPath(r.URL.Path); err == nil && !b.authenticate(gatewayID, r) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.WithError(err).Error("backend/basicstation: websocket upgrade error")
@@ -1,7 +1,15 @@
 package basicstation
 
 import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -14,6 +22,8 @@ import (
 
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/basicstation/structs"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/capture"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/commands"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
 	"github.com/brocaar/lorawan"
 	"github.com/brocaar/lorawan/gps"
@@ -37,7 +47,7 @@ func (ts *BackendTestSuite) SetupTest() {
 	assert := require.New(ts.T())
 
 	var conf config.Config
-	conf.Backend.Type = "basic_station"
+	conf.Backend.Type = []string{"basic_station"}
 	conf.Backend.BasicStation.Bind = "127.0.0.1:0"
 	conf.Filters.NetIDs = []string{"010203"}
 	conf.Filters.JoinEUIs = [][2]string{{"0000000000000000", "0102030405060708"}}
@@ -48,14 +58,22 @@ func (ts *BackendTestSuite) SetupTest() {
 	conf.Backend.BasicStation.PingInterval = time.Minute
 	conf.Backend.BasicStation.ReadTimeout = 2 * time.Minute
 	conf.Backend.BasicStation.WriteTimeout = time.Second
+	conf.Backend.BasicStation.RunCommandEnabled = true
+	conf.Backend.BasicStation.RemoteShellEnabled = true
+	conf.Commands.Commands = map[string]struct {
+		MaxExecutionDuration time.Duration `mapstructure:"max_execution_duration"`
+		Command              string        `mapstructure:"command"`
+	}{
+		"reboot": {Command: "/sbin/reboot now"},
+	}
 
 	ts.backend, err = NewBackend(conf)
 	assert.NoError(err)
 
 	subscribeChan := make(chan events.Subscribe, 1)
-	ts.backend.gateways.subscribeEventFunc = func(pl events.Subscribe) {
+	ts.backend.SetSubscribeEventFunc(func(pl events.Subscribe) {
 		subscribeChan <- pl
-	}
+	})
 	assert.NoError(ts.backend.Start())
 
 	ts.wsAddr = ts.backend.ln.Addr().String()
@@ -71,9 +89,9 @@ func (ts *BackendTestSuite) SetupTest() {
 
 func (ts *BackendTestSuite) TearDownTest() {
 	subscribeChan := make(chan events.Subscribe, 1)
-	ts.backend.gateways.subscribeEventFunc = func(pl events.Subscribe) {
+	ts.backend.SetSubscribeEventFunc(func(pl events.Subscribe) {
 		subscribeChan <- pl
-	}
+	})
 
 	assert := require.New(ts.T())
 	assert.NoError(ts.wsClient.Close())
@@ -109,6 +127,222 @@ func (ts *BackendTestSuite) TestRouterInfo() {
 	}, resp)
 }
 
+func (ts *BackendTestSuite) TestTokenAuthentication() {
+	ts.backend.tokenStore = &hmacTokenStore{secret: []byte("secret")}
+	defer func() {
+		ts.backend.tokenStore = nil
+	}()
+
+	// HMAC-SHA256 of 0102030405060708
+	token := "b33a8c5b62abc2d7b0c977cecbe3b5263ce9c12de695ae2fe491a6811b1b27e8"
+	d := &websocket.Dialer{}
+
+	ts.T().Run("gateway invalid token", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, resp, err := d.Dial(fmt.Sprintf("ws://%s/gateway/0102030405060708", ts.wsAddr), http.Header{
+			"Authorization": []string{"Bearer invalid"},
+		})
+		assert.Equal(websocket.ErrBadHandshake, err)
+		assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	ts.T().Run("router-info missing token", func(t *testing.T) {
+		assert := require.New(t)
+
+		ws, _, err := d.Dial(fmt.Sprintf("ws://%s/router-info", ts.wsAddr), nil)
+		assert.NoError(err)
+		defer ws.Close()
+
+		assert.NoError(ws.WriteJSON(structs.RouterInfoRequest{
+			Router: structs.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+		}))
+
+		var resp structs.RouterInfoResponse
+		assert.NoError(ws.ReadJSON(&resp))
+		assert.Equal("", resp.URI)
+		assert.Equal("authentication failed for router 0102030405060708", resp.Error)
+	})
+
+	ts.T().Run("router-info valid token", func(t *testing.T) {
+		assert := require.New(t)
+
+		ws, _, err := d.Dial(fmt.Sprintf("ws://%s/router-info", ts.wsAddr), http.Header{
+			"Authorization": []string{"Bearer " + token},
+		})
+		assert.NoError(err)
+		defer ws.Close()
+
+		assert.NoError(ws.WriteJSON(structs.RouterInfoRequest{
+			Router: structs.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+		}))
+
+		var resp structs.RouterInfoResponse
+		assert.NoError(ws.ReadJSON(&resp))
+		assert.Equal(fmt.Sprintf("ws://%s/gateway/0102030405060708", ts.wsAddr), resp.URI)
+		assert.Equal("", resp.Error)
+	})
+}
+
+func (ts *BackendTestSuite) TestUpdateInfo() {
+	assert := require.New(ts.T())
+
+	tempDir, err := ioutil.TempDir("", "test")
+	assert.NoError(err)
+	defer os.RemoveAll(tempDir)
+
+	gwDir := filepath.Join(tempDir, "0102030405060708")
+	assert.NoError(os.Mkdir(gwDir, 0755))
+
+	for name, content := range map[string][]byte{
+		"cups.uri":        []byte("https://cups.example.com:443\n"),
+		"cups.trust":      {0x0a},
+		"cups.key":        []byte("token"),
+		"tc.uri":          []byte("wss://lns.example.com:443\n"),
+		"tc.trust":        {0x01, 0x02, 0x03},
+		"tc.crt":          pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{0x04, 0x05}}),
+		"tc.key":          []byte("key"),
+		"update.version":  []byte("2.0.0"),
+		"update.bin":      {0x09, 0x09},
+		"update.sig-1234": {0x08},
+	} {
+		assert.NoError(ioutil.WriteFile(filepath.Join(gwDir, name), content, 0644))
+	}
+
+	// The update-info request must be authenticated, a separate backend is
+	// therefore used with token authentication enabled.
+	var conf config.Config
+	conf.Backend.BasicStation.Bind = "127.0.0.1:0"
+	conf.Backend.BasicStation.Region = "EU868"
+	conf.Backend.BasicStation.CUPSDirectory = tempDir
+	conf.Backend.BasicStation.Auth.Type = authTypeHMAC
+	conf.Backend.BasicStation.Auth.HMACSecret = "secret"
+
+	backend, err := NewBackend(conf)
+	assert.NoError(err)
+	assert.NoError(backend.Start())
+	defer backend.Stop()
+
+	// echo -n "0102030405060708" | openssl dgst -sha256 -hmac "secret"
+	token := "b33a8c5b62abc2d7b0c977cecbe3b5263ce9c12de695ae2fe491a6811b1b27e8"
+	// echo -n "0807060504030201" | openssl dgst -sha256 -hmac "secret"
+	unknownToken := "aaca77a89c7196c738cf3923888f2ecd77fec48994a10e56be49493d97d89d46"
+
+	// the cups.crt file is absent, which is encoded as four zero bytes
+	cupsCred := []byte{0x0a, 0x00, 0x00, 0x00, 0x00, 't', 'o', 'k', 'e', 'n'}
+	tcCred := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 'k', 'e', 'y'}
+
+	tests := []struct {
+		Name             string
+		Request          structs.UpdateInfoRequest
+		Token            string
+		ExpectedStatus   int
+		ExpectedResponse structs.UpdateInfoResponse
+	}{
+		{
+			Name: "tc uri, credentials and firmware update",
+			Request: structs.UpdateInfoRequest{
+				Router:  structs.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+				CUPSURI: "https://cups.example.com:443",
+				Package: "1.0.0",
+				Keys:    []uint32{1111, 1234},
+			},
+			Token:          token,
+			ExpectedStatus: http.StatusOK,
+			ExpectedResponse: structs.UpdateInfoResponse{
+				TCURI:          "wss://lns.example.com:443",
+				CUPSCredential: cupsCred,
+				TCCredential:   tcCred,
+				KeyCRC:         1234,
+				Signature:      []byte{0x08},
+				UpdateData:     []byte{0x09, 0x09},
+			},
+		},
+		{
+			Name: "up-to-date",
+			Request: structs.UpdateInfoRequest{
+				Router:      structs.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+				CUPSURI:     "https://cups.example.com:443",
+				TCURI:       "wss://lns.example.com:443",
+				CUPSCredCRC: crc32.ChecksumIEEE(cupsCred),
+				TCCredCRC:   crc32.ChecksumIEEE(tcCred),
+				Package:     "2.0.0",
+				Keys:        []uint32{1234},
+			},
+			Token:          token,
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Name: "no signature for station keys",
+			Request: structs.UpdateInfoRequest{
+				Router:      structs.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+				CUPSURI:     "https://cups.example.com:443",
+				TCURI:       "wss://lns.example.com:443",
+				CUPSCredCRC: crc32.ChecksumIEEE(cupsCred),
+				TCCredCRC:   crc32.ChecksumIEEE(tcCred),
+				Package:     "1.0.0",
+				Keys:        []uint32{1111},
+			},
+			Token:          token,
+			ExpectedStatus: http.StatusOK,
+		},
+		{
+			Name: "missing token",
+			Request: structs.UpdateInfoRequest{
+				Router: structs.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+			},
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Name: "token of other gateway",
+			Request: structs.UpdateInfoRequest{
+				Router: structs.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+			},
+			Token:          unknownToken,
+			ExpectedStatus: http.StatusUnauthorized,
+		},
+		{
+			Name: "unknown gateway",
+			Request: structs.UpdateInfoRequest{
+				Router: structs.EUI64{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01},
+			},
+			Token:          unknownToken,
+			ExpectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tst := range tests {
+		ts.T().Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			bb, err := json.Marshal(tst.Request)
+			assert.NoError(err)
+
+			req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s/update-info", backend.ln.Addr()), bytes.NewReader(bb))
+			assert.NoError(err)
+			if tst.Token != "" {
+				req.Header.Set("Authorization", "Bearer "+tst.Token)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			assert.NoError(err)
+			defer resp.Body.Close()
+
+			assert.Equal(tst.ExpectedStatus, resp.StatusCode)
+			if tst.ExpectedStatus != http.StatusOK {
+				return
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.NoError(err)
+
+			expected, err := tst.ExpectedResponse.MarshalBinary()
+			assert.NoError(err)
+			assert.Equal(expected, body)
+		})
+	}
+}
+
 func (ts *BackendTestSuite) TestVersion() {
 	assert := require.New(ts.T())
 
@@ -121,11 +355,148 @@ func (ts *BackendTestSuite) TestVersion() {
 
 	var routerConfig structs.RouterConfig
 	assert.NoError(ts.wsClient.ReadJSON(&routerConfig))
+	routerConfig.MuxTime = nil
 
-	routerConfig, err := ts.backend.getRouterConfig()
+	expected, err := ts.backend.defaultProfile.getRouterConfig()
 	assert.NoError(err)
+	expected.MuxTime = nil
 
-	assert.Equal(routerConfig, routerConfig)
+	assert.Equal(expected, routerConfig)
+}
+
+func (ts *BackendTestSuite) TestApplyConfiguration() {
+	assert := require.New(ts.T())
+
+	gwConf := gw.GatewayConfiguration{
+		GatewayId: "0102030405060708",
+		Version:   "1.2.3",
+		Channels: []*gw.ChannelConfiguration{
+			{
+				Frequency: 868100000,
+				ModulationConfig: &gw.ChannelConfiguration_LoraModulationConfig{
+					LoraModulationConfig: &gw.LoraModulationConfig{
+						Bandwidth:        125000,
+						SpreadingFactors: []uint32{7, 8, 9, 10, 11, 12},
+					},
+				},
+			},
+		},
+	}
+
+	expected, err := ts.backend.defaultProfile.getRouterConfigForGatewayConfiguration(&gwConf)
+	assert.NoError(err)
+	expected.MuxTime = nil
+
+	assert.NoError(ts.backend.ApplyConfiguration(&gwConf))
+
+	ts.T().Run("Router-config sent", func(t *testing.T) {
+		assert := require.New(t)
+
+		var routerConfig structs.RouterConfig
+		assert.NoError(ts.wsClient.ReadJSON(&routerConfig))
+		routerConfig.MuxTime = nil
+		assert.Equal(expected, routerConfig)
+	})
+
+	ts.T().Run("Router-config sent on version", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(ts.wsClient.WriteJSON(structs.Version{
+			MessageType: structs.VersionMessage,
+			Protocol:    2,
+		}))
+
+		var routerConfig structs.RouterConfig
+		assert.NoError(ts.wsClient.ReadJSON(&routerConfig))
+		routerConfig.MuxTime = nil
+		assert.Equal(expected, routerConfig)
+	})
+
+	ts.T().Run("Configuration stored", func(t *testing.T) {
+		assert := require.New(t)
+
+		conf, ok := ts.backend.gateways.getConfiguration(lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08})
+		assert.True(ok)
+		assert.Equal("1.2.3", conf.version)
+	})
+}
+
+func (ts *BackendTestSuite) TestDuplicateConnection() {
+	gatewayID := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	d := &websocket.Dialer{}
+	url := fmt.Sprintf("ws://%s/gateway/0102030405060708", ts.wsAddr)
+
+	ts.T().Run("reject", func(t *testing.T) {
+		assert := require.New(t)
+		ts.backend.duplicateConnectionPolicy = duplicateConnectionReject
+
+		current, err := ts.backend.gateways.get(gatewayID)
+		assert.NoError(err)
+
+		ws, _, err := d.Dial(url, nil)
+		assert.NoError(err)
+		defer ws.Close()
+
+		// the new connection is closed by the backend
+		_, _, err = ws.ReadMessage()
+		assert.Error(err)
+
+		conn, err := ts.backend.gateways.get(gatewayID)
+		assert.NoError(err)
+		assert.True(conn == current)
+	})
+
+	ts.T().Run("replace", func(t *testing.T) {
+		assert := require.New(t)
+		ts.backend.duplicateConnectionPolicy = duplicateConnectionReplace
+
+		current, err := ts.backend.gateways.get(gatewayID)
+		assert.NoError(err)
+		lastTimesync := time.Now().Truncate(time.Second)
+		assert.NoError(ts.backend.gateways.setLastTimesync(gatewayID, lastTimesync))
+
+		ws, _, err := d.Dial(url, nil)
+		assert.NoError(err)
+
+		// the existing connection is closed by the backend
+		_, _, err = ts.wsClient.ReadMessage()
+		assert.True(websocket.IsCloseError(err, websocket.CloseNormalClosure))
+		ts.wsClient = ws
+
+		conn, err := ts.backend.gateways.get(gatewayID)
+		assert.NoError(err)
+		assert.False(conn == current)
+		assert.True(conn.stats == current.stats)
+
+		timesync, err := ts.backend.gateways.getLastTimesync(gatewayID)
+		assert.NoError(err)
+		assert.True(lastTimesync.Equal(timesync))
+	})
+
+	ts.T().Run("keep newest", func(t *testing.T) {
+		assert := require.New(t)
+		ts.backend.duplicateConnectionPolicy = duplicateConnectionKeepNewest
+
+		current, err := ts.backend.gateways.get(gatewayID)
+		assert.NoError(err)
+		assert.NoError(ts.backend.gateways.setLastTimesync(gatewayID, time.Now()))
+
+		ws, _, err := d.Dial(url, nil)
+		assert.NoError(err)
+
+		_, _, err = ts.wsClient.ReadMessage()
+		assert.True(websocket.IsCloseError(err, websocket.CloseNormalClosure))
+		ts.wsClient = ws
+
+		conn, err := ts.backend.gateways.get(gatewayID)
+		assert.NoError(err)
+		assert.False(conn == current)
+		assert.False(conn.stats == current.stats)
+
+		timesync, err := ts.backend.gateways.getLastTimesync(gatewayID)
+		assert.NoError(err)
+		assert.True(timesync.IsZero())
+	})
 }
 
 func (ts *BackendTestSuite) TestUplinkDataFrame() {
@@ -461,7 +832,15 @@ func (ts *BackendTestSuite) TestDownlinkTransmitted() {
 		},
 	}
 
-	ts.backend.diidCache.SetDefault("12345", &df)
+	conn, err := ts.backend.gateways.get(lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08})
+	assert.NoError(err)
+
+	ts.backend.diidCache.SetDefault("12345", downlinkAttempt{
+		gatewayID:  lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+		conn:       conn,
+		frame:      &df,
+		txAckItems: []*gw.DownlinkTxAckItem{{Status: gw.TxAckStatus_IGNORED}},
+	})
 
 	dtx := structs.DownlinkTransmitted{
 		MessageType: structs.DownlinkTransmittedMessage,
@@ -482,9 +861,6 @@ func (ts *BackendTestSuite) TestDownlinkTransmitted() {
 		},
 	}, txAck)
 
-	conn, err := ts.backend.gateways.get(lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08})
-	assert.NoError(err)
-
 	stats := conn.stats.ExportStats()
 	assert.True(proto.Equal(&gw.GatewayStats{
 		TxPacketsReceived: 1,
@@ -551,13 +927,15 @@ func (ts *BackendTestSuite) TestSendDownlinkFrame() {
 	err := ts.backend.SendDownlinkFrame(&pl)
 	assert.NoError(err)
 
-	idResp, ok := ts.backend.diidCache.Get("1234")
-	assert.True(ok)
-	assert.Equal(&pl, idResp)
-
 	var df structs.DownlinkFrame
 	assert.NoError(ts.wsClient.ReadJSON(&df))
 
+	// the downlink is sent using the diid of the attempt
+	a, ok := ts.backend.diidCache.Get(fmt.Sprintf("%d", df.DIID))
+	assert.True(ok)
+	assert.Equal(&pl, a.(downlinkAttempt).frame)
+	assert.Equal(0, a.(downlinkAttempt).index)
+
 	delay1 := 1
 	dr2 := 2
 	freq := uint32(868100000)
@@ -571,7 +949,7 @@ func (ts *BackendTestSuite) TestSendDownlinkFrame() {
 		MessageType: structs.DownlinkMessage,
 		DevEui:      "01-01-01-01-01-01-01-01",
 		DC:          0,
-		DIID:        1234,
+		DIID:        df.DIID,
 		Priority:    1,
 		PDU:         "01020304",
 		RCtx:        &rCtx,
@@ -592,6 +970,427 @@ func (ts *BackendTestSuite) TestSendDownlinkFrame() {
 	*/
 }
 
+func (ts *BackendTestSuite) TestSendDownlinkFrameFallback() {
+	ts.backend.txAckTimeout = 100 * time.Millisecond
+
+	item := func(pl []byte, timing *gw.Timing) *gw.DownlinkFrameItem {
+		return &gw.DownlinkFrameItem{
+			PhyPayload: pl,
+			TxInfo: &gw.DownlinkTxInfo{
+				Frequency: 868100000,
+				Power:     14,
+				Modulation: &gw.Modulation{
+					Parameters: &gw.Modulation_Lora{
+						Lora: &gw.LoraModulationInfo{
+							Bandwidth:             125000,
+							SpreadingFactor:       10,
+							CodeRate:              gw.CodeRate_CR_4_5,
+							PolarizationInversion: true,
+						},
+					},
+				},
+				Timing:  timing,
+				Context: []byte{0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 4},
+			},
+		}
+	}
+	immediately := &gw.Timing{
+		Parameters: &gw.Timing_Immediately{
+			Immediately: &gw.ImmediatelyTimingInfo{},
+		},
+	}
+	delay := func(d time.Duration) *gw.Timing {
+		return &gw.Timing{
+			Parameters: &gw.Timing_Delay{
+				Delay: &gw.DelayTimingInfo{
+					Delay: durationpb.New(d),
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		Name                string
+		Items               []*gw.DownlinkFrameItem
+		ExpectedPDUs        []string
+		DownlinkTransmitted *structs.DownlinkTransmitted
+		LateTransmitted     bool
+		ExpectedTxAckItems  []gw.TxAckStatus
+	}{
+		{
+			Name: "first item not confirmed",
+			Items: []*gw.DownlinkFrameItem{
+				item([]byte{1, 2, 3}, immediately),
+				item([]byte{4, 5, 6}, immediately),
+			},
+			ExpectedPDUs:        []string{"010203", "040506"},
+			DownlinkTransmitted: &structs.DownlinkTransmitted{},
+			ExpectedTxAckItems:  []gw.TxAckStatus{gw.TxAckStatus_INTERNAL_ERROR, gw.TxAckStatus_OK},
+		},
+		{
+			Name: "first item confirmed after timeout",
+			Items: []*gw.DownlinkFrameItem{
+				item([]byte{1, 2, 3}, immediately),
+				item([]byte{4, 5, 6}, immediately),
+			},
+			ExpectedPDUs:        []string{"010203", "040506"},
+			DownlinkTransmitted: &structs.DownlinkTransmitted{},
+			LateTransmitted:     true,
+			ExpectedTxAckItems:  []gw.TxAckStatus{gw.TxAckStatus_INTERNAL_ERROR, gw.TxAckStatus_INTERNAL_ERROR},
+		},
+		{
+			Name: "no item confirmed",
+			Items: []*gw.DownlinkFrameItem{
+				item([]byte{1, 2, 3}, immediately),
+			},
+			ExpectedPDUs:       []string{"010203"},
+			ExpectedTxAckItems: []gw.TxAckStatus{gw.TxAckStatus_INTERNAL_ERROR},
+		},
+		{
+			Name: "rx1 + rx2, transmitted in rx1",
+			Items: []*gw.DownlinkFrameItem{
+				item([]byte{1, 2, 3}, delay(time.Second)),
+				item([]byte{1, 2, 3}, delay(2*time.Second)),
+			},
+			ExpectedPDUs:        []string{"010203"},
+			DownlinkTransmitted: &structs.DownlinkTransmitted{XTime: 4 + 1000000},
+			ExpectedTxAckItems:  []gw.TxAckStatus{gw.TxAckStatus_OK, gw.TxAckStatus_IGNORED},
+		},
+		{
+			Name: "rx1 + rx2, transmitted in rx2",
+			Items: []*gw.DownlinkFrameItem{
+				item([]byte{1, 2, 3}, delay(time.Second)),
+				item([]byte{1, 2, 3}, delay(2*time.Second)),
+			},
+			ExpectedPDUs:        []string{"010203"},
+			DownlinkTransmitted: &structs.DownlinkTransmitted{XTime: 4 + 2000000},
+			ExpectedTxAckItems:  []gw.TxAckStatus{gw.TxAckStatus_IGNORED, gw.TxAckStatus_OK},
+		},
+		{
+			Name: "rx1 + rx2, transmitted after reconnect with new xtime session",
+			Items: []*gw.DownlinkFrameItem{
+				item([]byte{1, 2, 3}, delay(time.Second)),
+				item([]byte{1, 2, 3}, delay(2*time.Second)),
+			},
+			ExpectedPDUs:        []string{"010203"},
+			DownlinkTransmitted: &structs.DownlinkTransmitted{XTime: 1<<48 + 2000000},
+			ExpectedTxAckItems:  []gw.TxAckStatus{gw.TxAckStatus_OK, gw.TxAckStatus_IGNORED},
+		},
+		{
+			Name: "rx1 + rx2, xtime before uplink",
+			Items: []*gw.DownlinkFrameItem{
+				item([]byte{1, 2, 3}, delay(time.Second)),
+				item([]byte{1, 2, 3}, delay(2*time.Second)),
+			},
+			ExpectedPDUs:        []string{"010203"},
+			DownlinkTransmitted: &structs.DownlinkTransmitted{XTime: 2},
+			ExpectedTxAckItems:  []gw.TxAckStatus{gw.TxAckStatus_OK, gw.TxAckStatus_IGNORED},
+		},
+	}
+
+	for i, tst := range tests {
+		ts.T().Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			txAckChan := make(chan *gw.DownlinkTxAck, 1)
+			ts.backend.downlinkTxAckFunc = func(pl *gw.DownlinkTxAck) {
+				txAckChan <- pl
+			}
+
+			downlinkID := uint32(2000 + i)
+			assert.NoError(ts.backend.SendDownlinkFrame(&gw.DownlinkFrame{
+				DownlinkId: downlinkID,
+				GatewayId:  "0102030405060708",
+				Items:      tst.Items,
+			}))
+
+			// each attempt is sent using its own diid
+			var diids []uint32
+			for _, pdu := range tst.ExpectedPDUs {
+				var df structs.DownlinkFrame
+				assert.NoError(ts.wsClient.ReadJSON(&df))
+				assert.Equal(pdu, df.PDU)
+				assert.NotContains(diids, df.DIID)
+				diids = append(diids, df.DIID)
+			}
+
+			if dtx := tst.DownlinkTransmitted; dtx != nil {
+				dtx.MessageType = structs.DownlinkTransmittedMessage
+				dtx.DIID = diids[len(diids)-1]
+				if tst.LateTransmitted {
+					dtx.DIID = diids[0]
+				}
+				assert.NoError(ts.wsClient.WriteJSON(dtx))
+			}
+
+			txAck := <-txAckChan
+			assert.Equal(downlinkID, txAck.DownlinkId)
+
+			var statuses []gw.TxAckStatus
+			for _, item := range txAck.Items {
+				statuses = append(statuses, item.Status)
+			}
+			assert.Equal(tst.ExpectedTxAckItems, statuses)
+
+			// the tx ack is reported once
+			select {
+			case <-txAckChan:
+				assert.FailNow("unexpected tx ack")
+			case <-time.After(150 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func (ts *BackendTestSuite) TestSendDownlinkFrameDisconnect() {
+	assert := require.New(ts.T())
+
+	gatewayID := lorawan.EUI64{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01}
+	ts.backend.txAckTimeout = time.Minute
+	ts.backend.SetSubscribeEventFunc(func(events.Subscribe) {})
+
+	txAckChan := make(chan *gw.DownlinkTxAck, 1)
+	ts.backend.downlinkTxAckFunc = func(pl *gw.DownlinkTxAck) {
+		txAckChan <- pl
+	}
+
+	ws, _, err := (&websocket.Dialer{}).Dial(fmt.Sprintf("ws://%s/gateway/%s", ts.wsAddr, gatewayID), nil)
+	assert.NoError(err)
+	assert.Eventually(func() bool {
+		_, err := ts.backend.gateways.get(gatewayID)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	item := &gw.DownlinkFrameItem{
+		PhyPayload: []byte{1, 2, 3},
+		TxInfo: &gw.DownlinkTxInfo{
+			Frequency: 868100000,
+			Power:     14,
+			Modulation: &gw.Modulation{
+				Parameters: &gw.Modulation_Lora{
+					Lora: &gw.LoraModulationInfo{
+						Bandwidth:       125000,
+						SpreadingFactor: 10,
+						CodeRate:        gw.CodeRate_CR_4_5,
+					},
+				},
+			},
+			Timing: &gw.Timing{
+				Parameters: &gw.Timing_Immediately{
+					Immediately: &gw.ImmediatelyTimingInfo{},
+				},
+			},
+		},
+	}
+
+	assert.NoError(ts.backend.SendDownlinkFrame(&gw.DownlinkFrame{
+		DownlinkId: 3000,
+		GatewayId:  gatewayID.String(),
+		Items:      []*gw.DownlinkFrameItem{item, item},
+	}))
+
+	var df structs.DownlinkFrame
+	assert.NoError(ws.ReadJSON(&df))
+
+	// the attempt fails when the connection is closed, the next item can't
+	// be sent as the gateway is no longer connected
+	assert.NoError(ws.Close())
+
+	select {
+	case txAck := <-txAckChan:
+		assert.Equal(uint32(3000), txAck.DownlinkId)
+		assert.Equal(gw.TxAckStatus_INTERNAL_ERROR, txAck.Items[0].Status)
+		assert.Equal(gw.TxAckStatus_INTERNAL_ERROR, txAck.Items[1].Status)
+	case <-time.After(time.Second):
+		assert.FailNow("tx ack not received")
+	}
+}
+
+func (ts *BackendTestSuite) TestExecuteRemoteCommand() {
+	ts.T().Run("Not supported", func(t *testing.T) {
+		assert := require.New(t)
+
+		err := ts.backend.ExecuteRemoteCommand(&gw.GatewayCommandExecRequest{
+			GatewayId: "0102030405060708",
+			Command:   "reboot",
+		})
+		assert.Equal(commands.ErrRemoteExecNotSupported, err)
+
+		err = ts.backend.ExecuteRemoteCommand(&gw.GatewayCommandExecRequest{
+			GatewayId: "0807060504030201",
+			Command:   "runcmd",
+		})
+		assert.Equal(commands.ErrRemoteExecNotSupported, err)
+	})
+
+	ts.T().Run("runcmd", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(ts.backend.ExecuteRemoteCommand(&gw.GatewayCommandExecRequest{
+			GatewayId: "0102030405060708",
+			Command:   "runcmd",
+			ExecId:    1,
+			Stdin:     []byte("reboot"),
+		}))
+
+		var pl structs.RunCommand
+		assert.NoError(ts.wsClient.ReadJSON(&pl))
+		assert.Equal(structs.RunCommand{
+			MessageType: structs.RunCommandMessage,
+			Command:     "/sbin/reboot",
+			Arguments:   []string{"now"},
+		}, pl)
+	})
+
+	ts.T().Run("runcmd command not configured", func(t *testing.T) {
+		assert := require.New(t)
+
+		err := ts.backend.ExecuteRemoteCommand(&gw.GatewayCommandExecRequest{
+			GatewayId: "0102030405060708",
+			Command:   "runcmd",
+			ExecId:    1,
+			Stdin:     []byte("/bin/sh -c id"),
+		})
+		assert.EqualError(err, "command does not exist")
+	})
+
+	ts.T().Run("Disabled", func(t *testing.T) {
+		assert := require.New(t)
+
+		var conf config.Config
+		conf.Backend.BasicStation.Bind = "127.0.0.1:0"
+		conf.Backend.BasicStation.Region = "EU868"
+		backend, err := NewBackend(conf)
+		assert.NoError(err)
+
+		// the gateway must be connected to the backend
+		backend.gateways.gateways[lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}] = &connection{}
+
+		for _, cmd := range []string{"runcmd", "rmtsh"} {
+			err := backend.ExecuteRemoteCommand(&gw.GatewayCommandExecRequest{
+				GatewayId: "0102030405060708",
+				Command:   cmd,
+				Stdin:     []byte("reboot"),
+			})
+			assert.EqualError(err, cmd+" is disabled")
+		}
+	})
+
+	ts.T().Run("getxtime", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(ts.backend.ExecuteRemoteCommand(&gw.GatewayCommandExecRequest{
+			GatewayId: "0102030405060708",
+			Command:   "getxtime",
+			ExecId:    2,
+		}))
+
+		var pl structs.GetXTimeRequest
+		assert.NoError(ts.wsClient.ReadJSON(&pl))
+		assert.Equal(structs.GetXTimeMessage, pl.MessageType)
+
+		ts.backend.remoteCommands.Lock()
+		pending := ts.backend.remoteCommands.getXTime[lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}]
+		assert.Len(pending, 1)
+		assert.Equal(uint32(2), pending[0].execID)
+		ts.backend.remoteCommands.Unlock()
+
+		assert.NoError(ts.wsClient.WriteJSON(structs.GetXTimeResponse{
+			MessageType: structs.GetXTimeMessage,
+			XTime:       12345,
+		}))
+
+		assert.Eventually(func() bool {
+			ts.backend.remoteCommands.Lock()
+			defer ts.backend.remoteCommands.Unlock()
+			return len(ts.backend.remoteCommands.getXTime[lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}]) == 0
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	ts.T().Run("getxtime timeout", func(t *testing.T) {
+		assert := require.New(t)
+		ts.backend.getXTimeTimeout = 100 * time.Millisecond
+		defer func() { ts.backend.getXTimeTimeout = getXTimeTimeout }()
+
+		assert.NoError(ts.backend.ExecuteRemoteCommand(&gw.GatewayCommandExecRequest{
+			GatewayId: "0102030405060708",
+			Command:   "getxtime",
+			ExecId:    3,
+		}))
+
+		var pl structs.GetXTimeRequest
+		assert.NoError(ts.wsClient.ReadJSON(&pl))
+
+		// the pending request expires when the gateway does not respond
+		assert.Eventually(func() bool {
+			ts.backend.remoteCommands.Lock()
+			defer ts.backend.remoteCommands.Unlock()
+			return len(ts.backend.remoteCommands.getXTime[lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}]) == 0
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	ts.T().Run("rmtsh", func(t *testing.T) {
+		assert := require.New(t)
+		ts.backend.remoteShellMaxDuration = 200 * time.Millisecond
+
+		rawChan := make(chan *gw.RawPacketForwarderEvent, 1)
+		ts.backend.rawPacketForwarderEventFunc = func(pl *gw.RawPacketForwarderEvent) {
+			rawChan <- pl
+		}
+
+		assert.NoError(ts.backend.ExecuteRemoteCommand(&gw.GatewayCommandExecRequest{
+			GatewayId:   "0102030405060708",
+			Command:     "rmtsh",
+			ExecId:      3,
+			Stdin:       []byte("uptime\n"),
+			Environment: map[string]string{"TERM": "xterm"},
+		}))
+
+		start := 0
+		var pl structs.RemoteShellRequest
+		assert.NoError(ts.wsClient.ReadJSON(&pl))
+		assert.Equal(structs.RemoteShellRequest{
+			MessageType: structs.RemoteShellMessage,
+			User:        "chirpstack",
+			Term:        "xterm",
+			Start:       &start,
+		}, pl)
+
+		mt, msg, err := ts.wsClient.ReadMessage()
+		assert.NoError(err)
+		assert.Equal(websocket.BinaryMessage, mt)
+		assert.Equal(append([]byte{0}, []byte("uptime\n")...), msg)
+
+		// stdin for the same exec id is written to the existing session
+		assert.NoError(ts.backend.ExecuteRemoteCommand(&gw.GatewayCommandExecRequest{
+			GatewayId: "0102030405060708",
+			Command:   "rmtsh",
+			ExecId:    3,
+			Stdin:     []byte("exit\n"),
+		}))
+		mt, msg, err = ts.wsClient.ReadMessage()
+		assert.NoError(err)
+		assert.Equal(websocket.BinaryMessage, mt)
+		assert.Equal(append([]byte{0}, []byte("exit\n")...), msg)
+
+		// session output is not forwarded as raw packet-forwarder event
+		assert.NoError(ts.wsClient.WriteMessage(websocket.BinaryMessage, append([]byte{0}, []byte("up 1 day")...)))
+		select {
+		case <-rawChan:
+			assert.Fail("unexpected raw packet-forwarder event")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		// the session is stopped after the max duration
+		var stop structs.RemoteShellRequest
+		assert.NoError(ts.wsClient.ReadJSON(&stop))
+		assert.Equal(structs.RemoteShellRequest{
+			MessageType: structs.RemoteShellMessage,
+			Stop:        &start,
+		}, stop)
+	})
+}
+
 func (ts *BackendTestSuite) TestRawPacketForwarderCommand() {
 	ts.T().Run("JSON", func(t *testing.T) {
 		assert := require.New(t)
@@ -638,17 +1437,15 @@ func (ts *BackendTestSuite) TestRawPacketForwarderEvent() {
 		assert.Equal([]byte{0x01, 0x02, 0x03, 0x04}, pl.Payload)
 	})
 
-	ts.T().Run("JSON rmtsh", func(t *testing.T) {
+	ts.T().Run("JSON unknown msgtype", func(t *testing.T) {
 		assert := require.New(t)
 
 		jsonMsg := `{
-		  "msgtype"  : "rmtsh",
-		  "rmtsh"    : [
+		  "msgtype"  : "foo",
+		  "bar"      : [
 			{
 			  "user"     : "foo",
-			  "started"  : true,
-			  "age"      : 1,
-			  "pid"      : 2
+			  "started"  : true
 			}
 		  ]
 		}`
@@ -682,6 +1479,85 @@ func (ts *BackendTestSuite) TestTimeSync() {
 	assert.True(tsresp.GPSTime >= startGPS && tsresp.GPSTime <= endGPS)
 }
 
+func (ts *BackendTestSuite) TestCapture() {
+	assert := require.New(ts.T())
+
+	tempDir, err := ioutil.TempDir("", "test")
+	assert.NoError(err)
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "capture.jsonl")
+	w, err := capture.NewWriter(path, 0, 0)
+	assert.NoError(err)
+	ts.backend.capture = w
+
+	tsync := structs.TimeSyncRequest{
+		MessageType: structs.TimeSyncMessage,
+		TxTime:      112233445566,
+	}
+	assert.NoError(ts.wsClient.WriteJSON(&tsync))
+
+	var tsresp structs.TimeSyncResponse
+	assert.NoError(ts.wsClient.ReadJSON(&tsresp))
+
+	f, err := os.Open(path)
+	assert.NoError(err)
+	defer f.Close()
+	r := capture.NewReader(f)
+
+	rec, err := r.Next()
+	assert.NoError(err)
+	assert.Equal("basic_station", rec.Backend)
+	assert.Equal(capture.DirectionIn, rec.Direction)
+	assert.Equal("0102030405060708", rec.GatewayID)
+	assert.Equal(capture.MessageTypeText, rec.MessageType)
+	assert.Equal(ts.wsClient.LocalAddr().String(), rec.Addr)
+
+	msgType, err := structs.GetMessageType(rec.Data)
+	assert.NoError(err)
+	assert.Equal(structs.TimeSyncMessage, msgType)
+
+	rec, err = r.Next()
+	assert.NoError(err)
+	assert.Equal(capture.DirectionOut, rec.Direction)
+	assert.Equal("0102030405060708", rec.GatewayID)
+	assert.Equal(capture.MessageTypeText, rec.MessageType)
+
+	msgType, err = structs.GetMessageType(rec.Data)
+	assert.NoError(err)
+	assert.Equal(structs.TimeSyncMessage, msgType)
+}
+
+func (ts *BackendTestSuite) TestReplay() {
+	assert := require.New(ts.T())
+
+	ts.backend.SetSubscribeEventFunc(func(pl events.Subscribe) {})
+
+	rawPacketForwarderEventChan := make(chan *gw.RawPacketForwarderEvent, 2)
+	ts.backend.rawPacketForwarderEventFunc = func(pl *gw.RawPacketForwarderEvent) {
+		rawPacketForwarderEventChan <- pl
+	}
+
+	var buf bytes.Buffer
+	for _, rec := range []capture.Record{
+		{Time: time.Now(), Backend: "basic_station", Direction: capture.DirectionIn, GatewayID: "0807060504030201", MessageType: capture.MessageTypeBinary, Data: []byte{0x01, 0x02}},
+		{Time: time.Now(), Backend: "basic_station", Direction: capture.DirectionOut, GatewayID: "0807060504030201", MessageType: capture.MessageTypeBinary, Data: []byte{0x03, 0x04}},
+		{Time: time.Now(), Backend: "basic_station", Direction: capture.DirectionIn, GatewayID: "0807060504030201", MessageType: capture.MessageTypeBinary, Data: []byte{0x05, 0x06}},
+	} {
+		assert.NoError(json.NewEncoder(&buf).Encode(rec))
+	}
+
+	assert.NoError(ts.backend.Replay(capture.NewReader(&buf), 0))
+
+	// all messages have been handled when the replay returns
+	assert.Len(rawPacketForwarderEventChan, 2)
+	pl := <-rawPacketForwarderEventChan
+	assert.Equal("0807060504030201", pl.GatewayId)
+	assert.Equal([]byte{0x01, 0x02}, pl.Payload)
+	pl = <-rawPacketForwarderEventChan
+	assert.Equal([]byte{0x05, 0x06}, pl.Payload)
+}
+
 func TestBackend(t *testing.T) {
 	suite.Run(t, new(BackendTestSuite))
 }
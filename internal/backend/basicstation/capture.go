@@ -0,0 +1,141 @@
+package basicstation
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/capture"
+	"github.com/brocaar/lorawan"
+)
+
+// captureBackend is the backend name used in the capture records.
+const captureBackend = "basic_station"
+
+// replayCloseTimeout defines the max. duration to wait for the backend to
+// close a replayed connection.
+const replayCloseTimeout = 5 * time.Second
+
+// captureMessage writes the given websocket message to the capture (when
+// enabled).
+func (b *Backend) captureMessage(direction string, gatewayID lorawan.EUI64, addr string, messageType int, data []byte) {
+	if b.capture == nil {
+		return
+	}
+
+	mt := capture.MessageTypeText
+	if messageType == websocket.BinaryMessage {
+		mt = capture.MessageTypeBinary
+	}
+
+	if err := b.capture.Write(capture.Record{
+		Backend:     captureBackend,
+		Direction:   direction,
+		Addr:        addr,
+		GatewayID:   gatewayID.String(),
+		MessageType: mt,
+		Data:        data,
+	}); err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Error("backend/basicstation: capture message error")
+	}
+}
+
+// replayConnection is a websocket connection, opened to the backend for
+// replaying the messages of a gateway.
+type replayConnection struct {
+	conn *websocket.Conn
+	done chan struct{}
+}
+
+// Replay sends the captured messages received from the gateways to the
+// websocket listener of the backend, such that these are handled by the
+// same code-path as the messages of a connected gateway. For each gateway a
+// websocket connection is opened on its first message. The messages sent by
+// the backend are discarded.
+func (b *Backend) Replay(r *capture.Reader, speed float64) error {
+	if b.certs != nil {
+		return errors.New("replay is not supported when tls is configured")
+	}
+
+	conns := make(map[string]*replayConnection)
+	defer func() {
+		for gatewayID, c := range conns {
+			b.closeReplayConnection(gatewayID, c)
+		}
+	}()
+
+	return capture.Replay(r, speed, func(rec capture.Record) error {
+		if rec.Backend != captureBackend || rec.Direction != capture.DirectionIn {
+			return nil
+		}
+
+		c, ok := conns[rec.GatewayID]
+		if !ok {
+			var err error
+			c, err = b.dialReplayConnection(rec.GatewayID)
+			if err != nil {
+				return errors.Wrap(err, "dial replay connection error")
+			}
+			conns[rec.GatewayID] = c
+		}
+
+		mt := websocket.TextMessage
+		if rec.MessageType == capture.MessageTypeBinary {
+			mt = websocket.BinaryMessage
+		}
+
+		if err := c.conn.WriteMessage(mt, rec.Data); err != nil {
+			// The backend might have closed the connection, a new connection
+			// is opened on the next message of the gateway.
+			log.WithError(err).WithField("gateway_id", rec.GatewayID).Warning("backend/basicstation: replay message error")
+			c.conn.Close()
+			delete(conns, rec.GatewayID)
+		}
+
+		return nil
+	})
+}
+
+func (b *Backend) dialReplayConnection(gatewayID string) (*replayConnection, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/gateway/%s", b.ln.Addr(), gatewayID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c := replayConnection{
+		conn: conn,
+		done: make(chan struct{}),
+	}
+
+	// Discard the messages sent by the backend, until the connection closes.
+	go func() {
+		defer close(c.done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	return &c, nil
+}
+
+// closeReplayConnection closes the given connection. As the close message is
+// handled after the replayed messages, waiting for the backend to close the
+// connection ensures that all messages have been handled.
+func (b *Backend) closeReplayConnection(gatewayID string, c *replayConnection) {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "replay completed")
+	if err := c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(b.writeTimeout)); err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Warning("backend/basicstation: send close message error")
+	}
+
+	select {
+	case <-c.done:
+	case <-time.After(replayCloseTimeout):
+	}
+
+	c.conn.Close()
+}
@@ -0,0 +1,242 @@
+package basicstation
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/basicstation/structs"
+	"github.com/brocaar/lorawan"
+)
+
+// handleUpdateInfo handles the CUPS update-info requests. The CUPS URI, LNS
+// URI, credentials and firmware updates are read from the CUPS directory,
+// which contains a sub-directory per gateway ID:
+//
+//	cups.uri, cups.trust, cups.crt, cups.key: CUPS URI and credentials
+//	tc.uri, tc.trust, tc.crt, tc.key: LNS URI and credentials
+//	update.bin, update.version: firmware update and its package version
+//	update.sig-<key crc>: signature of update.bin for the given signing-key
+//
+// All files are optional. Items are only returned in case they differ from
+// what is reported by the station.
+func (b *Backend) handleUpdateInfo(w http.ResponseWriter, r *http.Request) {
+	if b.cupsDirectory == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cupsRequestCounter().Inc()
+
+	var req structs.UpdateInfoRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.WithError(err).Error("backend/basicstation: decode update-info request error")
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	gatewayID := lorawan.EUI64(req.Router)
+
+	// The update-info response contains the credentials of the gateway, the
+	// request must therefore be authenticated by either the client
+	// certificate or the Authorization token.
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		var cn lorawan.EUI64
+		if err := cn.UnmarshalText([]byte(r.TLS.PeerCertificates[0].Subject.CommonName)); err != nil || cn != gatewayID {
+			log.WithFields(log.Fields{
+				"gateway_id":  gatewayID,
+				"common_name": r.TLS.PeerCertificates[0].Subject.CommonName,
+			}).Error("backend/basicstation: CommonName verification failed")
+			http.Error(w, "certificate CommonName does not match router", http.StatusForbidden)
+			return
+		}
+	} else if b.tokenStore == nil || !b.authenticate(gatewayID, r) {
+		log.WithFields(log.Fields{
+			"gateway_id":  gatewayID,
+			"remote_addr": r.RemoteAddr,
+		}).Warning("backend/basicstation: update-info request is not authenticated")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	resp, err := b.getUpdateInfo(req)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			log.WithField("gateway_id", gatewayID).Warning("backend/basicstation: no CUPS configuration for gateway")
+			http.NotFound(w, r)
+			return
+		}
+
+		log.WithError(err).WithField("gateway_id", gatewayID).Error("backend/basicstation: get update-info error")
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	bb, err := resp.MarshalBinary()
+	if err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Error("backend/basicstation: marshal update-info response error")
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := w.Write(bb); err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Error("backend/basicstation: write update-info response error")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id":       gatewayID,
+		"remote_addr":      r.RemoteAddr,
+		"station":          req.Station,
+		"package":          req.Package,
+		"cups_uri_update":  resp.CUPSURI != "",
+		"tc_uri_update":    resp.TCURI != "",
+		"cups_cred_update": len(resp.CUPSCredential) != 0,
+		"tc_cred_update":   len(resp.TCCredential) != 0,
+		"firmware_update":  len(resp.UpdateData) != 0,
+	}).Info("backend/basicstation: update-info request received")
+}
+
+func (b *Backend) getUpdateInfo(req structs.UpdateInfoRequest) (structs.UpdateInfoResponse, error) {
+	var resp structs.UpdateInfoResponse
+	dir := filepath.Join(b.cupsDirectory, lorawan.EUI64(req.Router).String())
+
+	if _, err := os.Stat(dir); err != nil {
+		return resp, errors.Wrap(err, "stat gateway directory error")
+	}
+
+	// URIs
+	cupsURI, err := readOptionalFile(filepath.Join(dir, "cups.uri"))
+	if err != nil {
+		return resp, err
+	}
+	if uri := strings.TrimSpace(string(cupsURI)); uri != "" && uri != req.CUPSURI {
+		resp.CUPSURI = uri
+		cupsUpdateCounter("cups_uri").Inc()
+	}
+
+	tcURI, err := readOptionalFile(filepath.Join(dir, "tc.uri"))
+	if err != nil {
+		return resp, err
+	}
+	if uri := strings.TrimSpace(string(tcURI)); uri != "" && uri != req.TCURI {
+		resp.TCURI = uri
+		cupsUpdateCounter("tc_uri").Inc()
+	}
+
+	// Credentials
+	cupsCred, err := readCredential(dir, "cups")
+	if err != nil {
+		return resp, errors.Wrap(err, "read cups credential error")
+	}
+	if len(cupsCred) != 0 && crc32.ChecksumIEEE(cupsCred) != req.CUPSCredCRC {
+		resp.CUPSCredential = cupsCred
+		cupsUpdateCounter("cups_cred").Inc()
+	}
+
+	tcCred, err := readCredential(dir, "tc")
+	if err != nil {
+		return resp, errors.Wrap(err, "read tc credential error")
+	}
+	if len(tcCred) != 0 && crc32.ChecksumIEEE(tcCred) != req.TCCredCRC {
+		resp.TCCredential = tcCred
+		cupsUpdateCounter("tc_cred").Inc()
+	}
+
+	// Firmware update
+	version, err := readOptionalFile(filepath.Join(dir, "update.version"))
+	if err != nil {
+		return resp, err
+	}
+	if v := strings.TrimSpace(string(version)); v == "" || v == req.Package {
+		return resp, nil
+	}
+
+	for _, keyCRC := range req.Keys {
+		sig, err := readOptionalFile(filepath.Join(dir, fmt.Sprintf("update.sig-%d", keyCRC)))
+		if err != nil {
+			return resp, err
+		}
+		if len(sig) == 0 {
+			continue
+		}
+
+		resp.UpdateData, err = ioutil.ReadFile(filepath.Join(dir, "update.bin"))
+		if err != nil {
+			return resp, errors.Wrap(err, "read update file error")
+		}
+		resp.KeyCRC = keyCRC
+		resp.Signature = sig
+		cupsUpdateCounter("firmware").Inc()
+
+		return resp, nil
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": lorawan.EUI64(req.Router),
+		"keys":       req.Keys,
+	}).Warning("backend/basicstation: no firmware update signature found for station signing-keys")
+
+	return resp, nil
+}
+
+// readCredential returns the credential blob, which is the concatenation of
+// the trust, certificate and key. When the certificate is absent, it is
+// replaced by four zero bytes and the key may contain the authorization
+// token. PEM encoded files are converted to DER. It returns nil when no trust
+// file exists.
+func readCredential(dir, prefix string) ([]byte, error) {
+	var out []byte
+
+	for _, ext := range []string{"trust", "crt", "key"} {
+		b, err := readOptionalFile(filepath.Join(dir, prefix+"."+ext))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(b) == 0 {
+			switch ext {
+			case "trust":
+				return nil, nil
+			case "crt":
+				out = append(out, 0x00, 0x00, 0x00, 0x00)
+			}
+			continue
+		}
+
+		if block, _ := pem.Decode(b); block != nil {
+			b = block.Bytes
+		}
+
+		out = append(out, b...)
+	}
+
+	return out, nil
+}
+
+// readOptionalFile returns the content of the given file, or nil when the
+// file does not exist.
+func readOptionalFile(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "read file error")
+	}
+	return b, nil
+}
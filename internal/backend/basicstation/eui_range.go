@@ -0,0 +1,34 @@
+package basicstation
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/lorawan"
+)
+
+// euiRange holds an inclusive range of EUIs.
+type euiRange [2]lorawan.EUI64
+
+// parse decodes the given start and end EUI. An error is returned when the
+// start EUI is greater than the end EUI, as the range would match nothing.
+func (r *euiRange) parse(s [2]string) error {
+	for i := range s {
+		if err := r[i].UnmarshalText([]byte(s[i])); err != nil {
+			return errors.Wrap(err, "decode eui error")
+		}
+	}
+
+	if bytes.Compare(r[0][:], r[1][:]) > 0 {
+		return fmt.Errorf("range start %s is greater than range end %s", r[0], r[1])
+	}
+
+	return nil
+}
+
+// contains returns true when the given EUI is within the range.
+func (r euiRange) contains(eui lorawan.EUI64) bool {
+	return bytes.Compare(eui[:], r[0][:]) >= 0 && bytes.Compare(eui[:], r[1][:]) <= 0
+}
@@ -0,0 +1,38 @@
+package basicstation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+)
+
+func TestEUIRange(t *testing.T) {
+	t.Run("Contains", func(t *testing.T) {
+		assert := require.New(t)
+
+		var r euiRange
+		assert.NoError(r.parse([2]string{"0100000000000000", "01000000000000ff"}))
+
+		assert.True(r.contains(lorawan.EUI64{0x01}))
+		assert.True(r.contains(lorawan.EUI64{0x01, 0, 0, 0, 0, 0, 0, 0x80}))
+		assert.True(r.contains(lorawan.EUI64{0x01, 0, 0, 0, 0, 0, 0, 0xff}))
+		assert.False(r.contains(lorawan.EUI64{0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}))
+		assert.False(r.contains(lorawan.EUI64{0x01, 0, 0, 0, 0, 0, 0x01, 0}))
+	})
+
+	t.Run("Invalid EUI", func(t *testing.T) {
+		assert := require.New(t)
+
+		var r euiRange
+		assert.Error(r.parse([2]string{"foo", "01000000000000ff"}))
+	})
+
+	t.Run("Start greater than end", func(t *testing.T) {
+		assert := require.New(t)
+
+		var r euiRange
+		assert.EqualError(r.parse([2]string{"01000000000000ff", "0100000000000000"}), "range start 01000000000000ff is greater than range end 0100000000000000")
+	})
+}
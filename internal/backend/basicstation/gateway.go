@@ -7,6 +7,7 @@ import (
 
 	"github.com/gorilla/websocket"
 
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/basicstation/structs"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/stats"
 	"github.com/brocaar/lorawan"
@@ -14,6 +15,7 @@ import (
 
 var (
 	errGatewayDoesNotExist = errors.New("gateway does not exist")
+	errConnectionReplaced  = errors.New("connection has been replaced")
 )
 
 type connection struct {
@@ -23,10 +25,21 @@ type connection struct {
 	lastTimesync time.Time
 }
 
+// gatewayConfiguration holds the router-config for a gateway, as received
+// through ApplyConfiguration.
+type gatewayConfiguration struct {
+	version      string
+	routerConfig structs.RouterConfig
+}
+
 type gateways struct {
 	sync.RWMutex
 	gateways map[lorawan.EUI64]*connection
 
+	// configurations are not removed when the gateway disconnects, so that
+	// they can be sent again on re-connect.
+	configurations map[lorawan.EUI64]gatewayConfiguration
+
 	subscribeEventFunc func(events.Subscribe)
 }
 
@@ -41,6 +54,13 @@ func (g *gateways) get(id lorawan.EUI64) (*connection, error) {
 	return gw, nil
 }
 
+func (g *gateways) setSubscribeEventFunc(f func(events.Subscribe)) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.subscribeEventFunc = f
+}
+
 func (g *gateways) set(id lorawan.EUI64, c *connection) error {
 	g.Lock()
 	defer g.Unlock()
@@ -54,6 +74,37 @@ func (g *gateways) set(id lorawan.EUI64, c *connection) error {
 	return nil
 }
 
+// replace sets the gateway connection, replacing the existing connection (if
+// any). When keepState is set, the stats collector and timesync state of the
+// existing connection are transferred to the new connection. It returns the
+// replaced connection or nil.
+func (g *gateways) replace(id lorawan.EUI64, c *connection, keepState bool) *connection {
+	g.Lock()
+	defer g.Unlock()
+
+	old, ok := g.gateways[id]
+	if !ok {
+		g.gateways[id] = c
+
+		if g.subscribeEventFunc != nil {
+			g.subscribeEventFunc(events.Subscribe{Subscribe: true, GatewayID: id})
+		}
+
+		return nil
+	}
+
+	if keepState {
+		c.stats = old.stats
+		c.lastTimesync = old.lastTimesync
+	}
+
+	// The gateway is still subscribed, there is no need to emit a new
+	// subscribe event.
+	g.gateways[id] = c
+
+	return old
+}
+
 func (g *gateways) getLastTimesync(id lorawan.EUI64) (time.Time, error) {
 	g.RLock()
 	defer g.RUnlock()
@@ -81,10 +132,32 @@ func (g *gateways) setLastTimesync(id lorawan.EUI64, ts time.Time) error {
 	return nil
 }
 
-func (g *gateways) remove(id lorawan.EUI64) error {
+func (g *gateways) getConfiguration(id lorawan.EUI64) (gatewayConfiguration, bool) {
+	g.RLock()
+	defer g.RUnlock()
+
+	conf, ok := g.configurations[id]
+	return conf, ok
+}
+
+func (g *gateways) setConfiguration(id lorawan.EUI64, conf gatewayConfiguration) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.configurations[id] = conf
+}
+
+// remove removes the given gateway connection. In case the connection has
+// been replaced by a new connection, errConnectionReplaced is returned and
+// the gateway is not removed.
+func (g *gateways) remove(id lorawan.EUI64, c *connection) error {
 	g.Lock()
 	defer g.Unlock()
 
+	if current, ok := g.gateways[id]; ok && current != c {
+		return errConnectionReplaced
+	}
+
 	if g.subscribeEventFunc != nil {
 		g.subscribeEventFunc(events.Subscribe{Subscribe: false, GatewayID: id})
 	}
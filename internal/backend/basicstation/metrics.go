@@ -30,6 +30,31 @@ var (
 		Name: "backend_basicstation_gateway_disconnect_count",
 		Help: "The number of gateways that disconnected from the backend.",
 	})
+
+	gdc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_basicstation_gateway_duplicate_connection_count",
+		Help: "The number of connections received for an already connected gateway (per duplicate connection policy).",
+	}, []string{"policy"})
+
+	auf = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_basicstation_auth_failure_count",
+		Help: "The number of failed gateway authentications (per reason).",
+	}, []string{"reason"})
+
+	dtt = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backend_basicstation_downlink_tx_ack_timeout_count",
+		Help: "The number of downlink transmissions that were not confirmed by the gateway within the tx ack timeout.",
+	})
+
+	cur = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backend_basicstation_cups_update_info_count",
+		Help: "The number of CUPS update-info requests received by the backend.",
+	})
+
+	cuu = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_basicstation_cups_update_count",
+		Help: "The number of CUPS updates sent by the backend (per update type).",
+	}, []string{"type"})
 )
 
 func websocketPingPongCounter(typ string) prometheus.Counter {
@@ -51,3 +76,23 @@ func connectCounter() prometheus.Counter {
 func disconnectCounter() prometheus.Counter {
 	return gwd
 }
+
+func duplicateConnectionCounter(policy string) prometheus.Counter {
+	return gdc.With(prometheus.Labels{"policy": policy})
+}
+
+func authFailureCounter(reason string) prometheus.Counter {
+	return auf.With(prometheus.Labels{"reason": reason})
+}
+
+func downlinkTxAckTimeoutCounter() prometheus.Counter {
+	return dtt
+}
+
+func cupsRequestCounter() prometheus.Counter {
+	return cur
+}
+
+func cupsUpdateCounter(typ string) prometheus.Counter {
+	return cuu.With(prometheus.Labels{"type": typ})
+}
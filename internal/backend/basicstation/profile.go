@@ -0,0 +1,118 @@
+package basicstation
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/basicstation/structs"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/band"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+// profile holds the router configuration for a set of gateways.
+type profile struct {
+	name            string
+	gatewayIDs      map[lorawan.EUI64]struct{}
+	gatewayIDRanges []euiRange
+
+	band          band.Band
+	region        band.Name
+	netIDs        []lorawan.NetID
+	joinEUIs      [][2]lorawan.EUI64
+	frequencyMin  uint32
+	frequencyMax  uint32
+	concentrators []config.BasicStationConcentrator
+}
+
+func newProfile(name, region string, frequencyMin, frequencyMax uint32, concentrators []config.BasicStationConcentrator, netIDs []string, joinEUIs [][2]string) (profile, error) {
+	p := profile{
+		name:          name,
+		gatewayIDs:    make(map[lorawan.EUI64]struct{}),
+		region:        band.Name(region),
+		frequencyMin:  frequencyMin,
+		frequencyMax:  frequencyMax,
+		concentrators: concentrators,
+	}
+
+	for _, n := range netIDs {
+		var netID lorawan.NetID
+		if err := netID.UnmarshalText([]byte(n)); err != nil {
+			return p, errors.Wrap(err, "unmarshal netid error")
+		}
+		p.netIDs = append(p.netIDs, netID)
+	}
+
+	for _, set := range joinEUIs {
+		var euis [2]lorawan.EUI64
+		for i, s := range set {
+			var eui lorawan.EUI64
+			if err := eui.UnmarshalText([]byte(s)); err != nil {
+				return p, errors.Wrap(err, "unmarshal joineui error")
+			}
+			euis[i] = eui
+		}
+		p.joinEUIs = append(p.joinEUIs, euis)
+	}
+
+	var err error
+	p.band, err = band.GetConfig(p.region, false, lorawan.DwellTimeNoLimit)
+	if err != nil {
+		return p, errors.Wrap(err, "get band config error")
+	}
+
+	return p, nil
+}
+
+func newProfileFromConfig(conf config.BasicStationProfile) (profile, error) {
+	if conf.Name == "" {
+		return profile{}, errors.New("profile name must be set")
+	}
+
+	p, err := newProfile(conf.Name, conf.Region, conf.FrequencyMin, conf.FrequencyMax, conf.Concentrators, conf.Filters.NetIDs, conf.Filters.JoinEUIs)
+	if err != nil {
+		return p, err
+	}
+
+	for _, s := range conf.GatewayIDs {
+		var gatewayID lorawan.EUI64
+		if err := gatewayID.UnmarshalText([]byte(s)); err != nil {
+			return p, errors.Wrap(err, "unmarshal gateway id error")
+		}
+		p.gatewayIDs[gatewayID] = struct{}{}
+	}
+
+	for _, set := range conf.GatewayIDRanges {
+		var r euiRange
+		if err := r.parse(set); err != nil {
+			return p, errors.Wrap(err, "parse gateway id range error")
+		}
+		p.gatewayIDRanges = append(p.gatewayIDRanges, r)
+	}
+
+	return p, nil
+}
+
+// matches returns true when the given gateway ID is mapped to the profile,
+// either by its gateway ID or by one of its (inclusive) gateway ID ranges.
+func (p *profile) matches(gatewayID lorawan.EUI64) bool {
+	if _, ok := p.gatewayIDs[gatewayID]; ok {
+		return true
+	}
+
+	for _, r := range p.gatewayIDRanges {
+		if r.contains(gatewayID) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *profile) getRouterConfig() (structs.RouterConfig, error) {
+	return structs.GetRouterConfig(p.region, p.netIDs, p.joinEUIs, p.frequencyMin, p.frequencyMax, p.concentrators)
+}
+
+func (p *profile) getRouterConfigForGatewayConfiguration(gwConf *gw.GatewayConfiguration) (structs.RouterConfig, error) {
+	return structs.GetRouterConfigForGatewayConfiguration(p.region, p.netIDs, p.joinEUIs, p.frequencyMin, p.frequencyMax, gwConf)
+}
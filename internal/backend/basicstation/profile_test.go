@@ -0,0 +1,141 @@
+package basicstation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/band"
+)
+
+func TestGetProfile(t *testing.T) {
+	assert := require.New(t)
+
+	var err error
+	b := Backend{}
+	b.defaultProfile, err = newProfile("default", "EU868", 863000000, 870000000, nil, nil, nil)
+	assert.NoError(err)
+
+	for _, conf := range []config.BasicStationProfile{
+		{
+			Name:       "us915_sb2",
+			GatewayIDs: []string{"0102030405060708"},
+			GatewayIDRanges: [][2]string{
+				{"0100000000000000", "01000000000000ff"},
+			},
+			Region: "US915",
+		},
+		{
+			Name:       "au915",
+			GatewayIDs: []string{"0807060504030201"},
+			Region:     "AU915",
+		},
+	} {
+		p, err := newProfileFromConfig(conf)
+		assert.NoError(err)
+		b.profiles = append(b.profiles, p)
+	}
+
+	tests := []struct {
+		Name            string
+		GatewayID       lorawan.EUI64
+		ExpectedProfile string
+		ExpectedRegion  band.Name
+	}{
+		{
+			Name:            "gateway id",
+			GatewayID:       lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+			ExpectedProfile: "us915_sb2",
+			ExpectedRegion:  band.US915,
+		},
+		{
+			Name:            "gateway id range, lower bound",
+			GatewayID:       lorawan.EUI64{0x01},
+			ExpectedProfile: "us915_sb2",
+			ExpectedRegion:  band.US915,
+		},
+		{
+			Name:            "gateway id range, upper bound",
+			GatewayID:       lorawan.EUI64{0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff},
+			ExpectedProfile: "us915_sb2",
+			ExpectedRegion:  band.US915,
+		},
+		{
+			Name:            "second profile",
+			GatewayID:       lorawan.EUI64{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01},
+			ExpectedProfile: "au915",
+			ExpectedRegion:  band.AU915,
+		},
+		{
+			Name:            "no match",
+			GatewayID:       lorawan.EUI64{0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00},
+			ExpectedProfile: "default",
+			ExpectedRegion:  band.EU868,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			p := b.getProfile(tst.GatewayID)
+			assert.Equal(tst.ExpectedProfile, p.name)
+			assert.Equal(tst.ExpectedRegion, p.region)
+			assert.NotNil(p.band)
+		})
+	}
+}
+
+func TestDefaultProfile(t *testing.T) {
+	assert := require.New(t)
+
+	concentrators := []config.BasicStationConcentrator{
+		{
+			MultiSF: config.BasicStationConcentratorMultiSF{
+				Frequencies: []uint32{868100000, 868300000, 868500000},
+			},
+		},
+	}
+
+	// the default profile must be taken from the given configuration
+	var conf config.Config
+	conf.Backend.BasicStation.Bind = "127.0.0.1:0"
+	conf.Backend.BasicStation.Region = "EU868"
+	conf.Backend.BasicStation.Concentrators = concentrators
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+	defer b.Stop()
+
+	assert.Equal(concentrators, b.defaultProfile.concentrators)
+}
+
+func TestNewProfileFromConfigErrors(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Config        config.BasicStationProfile
+		ExpectedError string
+	}{
+		{
+			Name:          "no name",
+			Config:        config.BasicStationProfile{Region: "EU868"},
+			ExpectedError: "profile name must be set",
+		},
+		{
+			Name:          "invalid region",
+			Config:        config.BasicStationProfile{Name: "test", Region: "XX123"},
+			ExpectedError: "get band config error: lorawan/band: band XX123 is undefined",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			_, err := newProfileFromConfig(tst.Config)
+			assert.EqualError(err, tst.ExpectedError)
+		})
+	}
+}
@@ -0,0 +1,401 @@
+package basicstation
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/basicstation/structs"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/commands"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+// Commands that are executed by the Basic Station instead of the host.
+const (
+	remoteCommandRunCommand  = "runcmd"
+	remoteCommandGetXTime    = "getxtime"
+	remoteCommandRemoteShell = "rmtsh"
+)
+
+// maxRemoteShells defines the max. number of remote shell sessions per gateway.
+const maxRemoteShells = 8
+
+// getXTimeTimeout defines the time after which a pending getxtime request
+// expires when the gateway does not respond.
+const getXTimeTimeout = 10 * time.Second
+
+type remoteShell struct {
+	execID uint32
+	timer  *time.Timer
+}
+
+type pendingGetXTime struct {
+	execID uint32
+	timer  *time.Timer
+}
+
+// remoteCommands holds the state of the commands executed by the gateways.
+type remoteCommands struct {
+	sync.Mutex
+
+	// getXTime holds the pending getxtime requests, in order. As the response
+	// does not contain a reference to the request, the responses are matched
+	// in the same order.
+	getXTime map[lorawan.EUI64][]*pendingGetXTime
+
+	// shells holds the remote shell sessions by session index.
+	shells map[lorawan.EUI64]map[uint8]*remoteShell
+}
+
+// remove removes the remote shell sessions and pending getxtime requests of
+// the given gateway. An error is published for the pending getxtime requests,
+// as these will not be responded anymore.
+func (r *remoteCommands) remove(id lorawan.EUI64) {
+	r.Lock()
+	for _, s := range r.shells[id] {
+		s.timer.Stop()
+	}
+
+	pending := r.getXTime[id]
+	delete(r.getXTime, id)
+	delete(r.shells, id)
+	r.Unlock()
+
+	for _, p := range pending {
+		p.timer.Stop()
+		commands.PublishExecResponse(&gw.GatewayCommandExecResponse{
+			GatewayId: id.String(),
+			ExecId:    p.execID,
+			Error:     "gateway disconnected",
+		})
+	}
+}
+
+// removeGetXTime removes the given pending getxtime request. It returns false
+// when the request is not pending anymore.
+func (r *remoteCommands) removeGetXTime(id lorawan.EUI64, p *pendingGetXTime) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	pending := r.getXTime[id]
+	for i := range pending {
+		if pending[i] == p {
+			r.getXTime[id] = append(pending[:i:i], pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ExecuteRemoteCommand executes the runcmd, getxtime and rmtsh commands on
+// the Basic Station. For other commands or when the gateway is not connected
+// to this backend, commands.ErrRemoteExecNotSupported is returned. The runcmd
+// and rmtsh commands must be explicitly enabled, as these execute commands on
+// the gateway.
+func (b *Backend) ExecuteRemoteCommand(req *gw.GatewayCommandExecRequest) error {
+	var gatewayID lorawan.EUI64
+	if err := gatewayID.UnmarshalText([]byte(req.GetGatewayId())); err != nil {
+		return errors.Wrap(err, "decode gateway id error")
+	}
+
+	if _, err := b.gateways.get(gatewayID); err != nil {
+		return commands.ErrRemoteExecNotSupported
+	}
+
+	switch req.GetCommand() {
+	case remoteCommandRunCommand:
+		if !b.runCommandEnabled {
+			return errors.New("runcmd is disabled")
+		}
+		return b.runCommand(gatewayID, req)
+	case remoteCommandGetXTime:
+		return b.getXTime(gatewayID, req)
+	case remoteCommandRemoteShell:
+		if !b.remoteShellEnabled {
+			return errors.New("rmtsh is disabled")
+		}
+		return b.remoteShell(gatewayID, req)
+	default:
+		return commands.ErrRemoteExecNotSupported
+	}
+}
+
+// runCommand sends the command-line of the command given as stdin to the
+// gateway. Like the commands executed on the host, the command must be
+// configured in the [commands] section. As the Basic Station does not return
+// the output of the command, the response is published directly.
+func (b *Backend) runCommand(gatewayID lorawan.EUI64, req *gw.GatewayCommandExecRequest) error {
+	name := strings.TrimSpace(string(req.GetStdin()))
+	if name == "" {
+		return errors.New("stdin must contain the command to run")
+	}
+
+	cmd, ok := b.runCommands[name]
+	if !ok {
+		return errors.New("command does not exist")
+	}
+
+	args, err := commands.ParseCommandLine(cmd)
+	if err != nil {
+		return errors.Wrap(err, "parse command error")
+	}
+	if len(args) == 0 {
+		return errors.New("no command is given")
+	}
+
+	websocketSendCounter(string(structs.RunCommandMessage)).Inc()
+	if err := b.sendToGateway(gatewayID, structs.RunCommand{
+		MessageType: structs.RunCommandMessage,
+		Command:     args[0],
+		Arguments:   args[1:],
+	}); err != nil {
+		return errors.Wrap(err, "send to gateway error")
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"exec_id":    req.GetExecId(),
+		"command":    name,
+		"exec":       args[0],
+	}).Info("backend/basicstation: runcmd message sent to gateway")
+
+	commands.PublishExecResponse(&gw.GatewayCommandExecResponse{
+		GatewayId: req.GetGatewayId(),
+		ExecId:    req.GetExecId(),
+	})
+
+	return nil
+}
+
+// getXTime requests the xtime of the gateway. The xtime is published as
+// stdout once the gateway responds. An error is published when the gateway
+// does not respond within the getxtime timeout.
+func (b *Backend) getXTime(gatewayID lorawan.EUI64, req *gw.GatewayCommandExecRequest) error {
+	p := pendingGetXTime{
+		execID: req.GetExecId(),
+	}
+
+	b.remoteCommands.Lock()
+	p.timer = time.AfterFunc(b.getXTimeTimeout, func() {
+		b.expireGetXTime(gatewayID, &p)
+	})
+	b.remoteCommands.getXTime[gatewayID] = append(b.remoteCommands.getXTime[gatewayID], &p)
+	b.remoteCommands.Unlock()
+
+	websocketSendCounter(string(structs.GetXTimeMessage)).Inc()
+	if err := b.sendToGateway(gatewayID, structs.GetXTimeRequest{
+		MessageType: structs.GetXTimeMessage,
+	}); err != nil {
+		if b.remoteCommands.removeGetXTime(gatewayID, &p) {
+			p.timer.Stop()
+		}
+
+		return errors.Wrap(err, "send to gateway error")
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"exec_id":    req.GetExecId(),
+	}).Info("backend/basicstation: getxtime message sent to gateway")
+
+	return nil
+}
+
+func (b *Backend) handleGetXTime(gatewayID lorawan.EUI64, pl structs.GetXTimeResponse) {
+	b.remoteCommands.Lock()
+	pending := b.remoteCommands.getXTime[gatewayID]
+	if len(pending) == 0 {
+		b.remoteCommands.Unlock()
+		log.WithField("gateway_id", gatewayID).Warning("backend/basicstation: unexpected getxtime message received")
+		return
+	}
+	execID := pending[0].execID
+	pending[0].timer.Stop()
+	b.remoteCommands.getXTime[gatewayID] = pending[1:]
+	b.remoteCommands.Unlock()
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"exec_id":    execID,
+		"xtime":      pl.XTime,
+	}).Info("backend/basicstation: getxtime message received")
+
+	commands.PublishExecResponse(&gw.GatewayCommandExecResponse{
+		GatewayId: gatewayID.String(),
+		ExecId:    execID,
+		Stdout:    []byte(strconv.FormatInt(pl.XTime, 10)),
+	})
+}
+
+// expireGetXTime publishes an error for the given getxtime request, in case
+// it is still pending.
+func (b *Backend) expireGetXTime(gatewayID lorawan.EUI64, p *pendingGetXTime) {
+	if !b.remoteCommands.removeGetXTime(gatewayID, p) {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"exec_id":    p.execID,
+	}).Warning("backend/basicstation: getxtime request timed out")
+
+	commands.PublishExecResponse(&gw.GatewayCommandExecResponse{
+		GatewayId: gatewayID.String(),
+		ExecId:    p.execID,
+		Error:     "getxtime timeout",
+	})
+}
+
+// remoteShell starts a remote shell session on the gateway and writes the
+// stdin to the session. When a session already exists for the exec ID, the
+// stdin is written to the existing session. The output of the session is
+// published as exec events. The session is stopped after the configured
+// max. duration.
+func (b *Backend) remoteShell(gatewayID lorawan.EUI64, req *gw.GatewayCommandExecRequest) error {
+	b.remoteCommands.Lock()
+	shells, ok := b.remoteCommands.shells[gatewayID]
+	if !ok {
+		shells = make(map[uint8]*remoteShell)
+		b.remoteCommands.shells[gatewayID] = shells
+	}
+
+	for i, s := range shells {
+		if s.execID == req.GetExecId() {
+			b.remoteCommands.Unlock()
+			return b.sendRemoteShellData(gatewayID, i, req.GetStdin())
+		}
+	}
+
+	index := -1
+	for i := 0; i < maxRemoteShells; i++ {
+		if _, ok := shells[uint8(i)]; !ok {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		b.remoteCommands.Unlock()
+		return errors.New("max number of remote shell sessions reached")
+	}
+
+	execID := req.GetExecId()
+	shells[uint8(index)] = &remoteShell{
+		execID: execID,
+		timer: time.AfterFunc(b.remoteShellMaxDuration, func() {
+			b.stopRemoteShell(gatewayID, uint8(index), execID)
+		}),
+	}
+	b.remoteCommands.Unlock()
+
+	user := req.GetEnvironment()["USER"]
+	if user == "" {
+		user = "chirpstack"
+	}
+
+	websocketSendCounter(string(structs.RemoteShellMessage)).Inc()
+	if err := b.sendToGateway(gatewayID, structs.RemoteShellRequest{
+		MessageType: structs.RemoteShellMessage,
+		User:        user,
+		Term:        req.GetEnvironment()["TERM"],
+		Start:       &index,
+	}); err != nil {
+		b.remoteCommands.Lock()
+		shells[uint8(index)].timer.Stop()
+		delete(shells, uint8(index))
+		b.remoteCommands.Unlock()
+
+		return errors.Wrap(err, "send to gateway error")
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"exec_id":    execID,
+		"session":    index,
+	}).Info("backend/basicstation: remote shell session started")
+
+	return b.sendRemoteShellData(gatewayID, uint8(index), req.GetStdin())
+}
+
+func (b *Backend) sendRemoteShellData(gatewayID lorawan.EUI64, index uint8, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	if err := b.sendRawToGateway(gatewayID, websocket.BinaryMessage, append([]byte{index}, data...)); err != nil {
+		return errors.Wrap(err, "send remote shell data error")
+	}
+
+	return nil
+}
+
+func (b *Backend) stopRemoteShell(gatewayID lorawan.EUI64, index uint8, execID uint32) {
+	b.remoteCommands.Lock()
+	s, ok := b.remoteCommands.shells[gatewayID][index]
+	if !ok || s.execID != execID {
+		b.remoteCommands.Unlock()
+		return
+	}
+	delete(b.remoteCommands.shells[gatewayID], index)
+	b.remoteCommands.Unlock()
+
+	stop := int(index)
+
+	websocketSendCounter(string(structs.RemoteShellMessage)).Inc()
+	if err := b.sendToGateway(gatewayID, structs.RemoteShellRequest{
+		MessageType: structs.RemoteShellMessage,
+		Stop:        &stop,
+	}); err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Error("backend/basicstation: stop remote shell session error")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"exec_id":    execID,
+		"session":    index,
+	}).Info("backend/basicstation: remote shell session stopped")
+}
+
+// handleRemoteShellData publishes the given binary message as exec event, in
+// case it belongs to a remote shell session. The first byte of the message
+// contains the session index.
+func (b *Backend) handleRemoteShellData(gatewayID lorawan.EUI64, msg []byte) bool {
+	if len(msg) == 0 {
+		return false
+	}
+
+	b.remoteCommands.Lock()
+	s, ok := b.remoteCommands.shells[gatewayID][msg[0]]
+	b.remoteCommands.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	commands.PublishExecResponse(&gw.GatewayCommandExecResponse{
+		GatewayId: gatewayID.String(),
+		ExecId:    s.execID,
+		Stdout:    msg[1:],
+	})
+
+	return true
+}
+
+func (b *Backend) handleRemoteShellResponse(gatewayID lorawan.EUI64, pl structs.RemoteShellResponse) {
+	for i, s := range pl.RemoteShell {
+		log.WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"session":    i,
+			"user":       s.User,
+			"started":    s.Started,
+			"age":        s.Age,
+			"pid":        s.PID,
+		}).Info("backend/basicstation: remote shell session status received")
+	}
+}
@@ -0,0 +1,105 @@
+package basicstation
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+// routerInfoVirtualNodes defines the number of points on the hash ring per
+// instance. More points result in a more even distribution of the gateways.
+const routerInfoVirtualNodes = 128
+
+// routerInfoRoute routes a range of gateway IDs to an LNS endpoint.
+type routerInfoRoute struct {
+	gatewayIDRange euiRange
+	uri            string
+}
+
+// routerInfoRingNode is a point on the consistent hash ring.
+type routerInfoRingNode struct {
+	hash uint64
+	uri  string
+}
+
+// routerInfoRouter returns the LNS endpoint for a gateway in router-info
+// responses. The routes table has priority over the consistent hashing over
+// the instances.
+type routerInfoRouter struct {
+	routes []routerInfoRoute
+	ring   []routerInfoRingNode
+}
+
+func newRouterInfoRouter(conf config.BasicStationRouterInfo) (routerInfoRouter, error) {
+	var r routerInfoRouter
+
+	for _, route := range conf.Routes {
+		if route.URI == "" {
+			return r, errors.New("route uri must be set")
+		}
+
+		var rr routerInfoRoute
+		rr.uri = strings.TrimSuffix(route.URI, "/")
+		if err := rr.gatewayIDRange.parse(route.GatewayIDRange); err != nil {
+			return r, errors.Wrap(err, "parse gateway id range error")
+		}
+		r.routes = append(r.routes, rr)
+	}
+
+	for _, instance := range conf.Instances {
+		uri := strings.TrimSuffix(instance, "/")
+		for i := 0; i < routerInfoVirtualNodes; i++ {
+			r.ring = append(r.ring, routerInfoRingNode{
+				hash: routerInfoHash([]byte(fmt.Sprintf("%s#%d", uri, i))),
+				uri:  uri,
+			})
+		}
+	}
+
+	sort.Slice(r.ring, func(i, j int) bool {
+		return r.ring[i].hash < r.ring[j].hash
+	})
+
+	return r, nil
+}
+
+// getURI returns the LNS URI (scheme://host:port) for the given gateway ID.
+// It returns false when the gateway does not match any route and no
+// instances are configured.
+func (r *routerInfoRouter) getURI(gatewayID lorawan.EUI64) (string, bool) {
+	for _, route := range r.routes {
+		if route.gatewayIDRange.contains(gatewayID) {
+			return route.uri, true
+		}
+	}
+
+	if len(r.ring) == 0 {
+		return "", false
+	}
+
+	// Find the first point on the ring >= the hash of the gateway ID,
+	// wrapping around to the first point.
+	h := routerInfoHash(gatewayID[:])
+	i := sort.Search(len(r.ring), func(i int) bool {
+		return r.ring[i].hash >= h
+	})
+	if i == len(r.ring) {
+		i = 0
+	}
+
+	return r.ring[i].uri, true
+}
+
+// routerInfoHash returns the position on the hash ring. SHA-256 is used as
+// it distributes similar inputs (e.g. sequential gateway IDs) evenly.
+func routerInfoHash(b []byte) uint64 {
+	h := sha256.Sum256(b)
+	return binary.BigEndian.Uint64(h[:8])
+}
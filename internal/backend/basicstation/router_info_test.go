@@ -0,0 +1,95 @@
+package basicstation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+func TestRouterInfoRouter(t *testing.T) {
+	t.Run("Not configured", func(t *testing.T) {
+		assert := require.New(t)
+
+		r, err := newRouterInfoRouter(config.BasicStationRouterInfo{})
+		assert.NoError(err)
+
+		_, ok := r.getURI(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8})
+		assert.False(ok)
+	})
+
+	t.Run("Routes", func(t *testing.T) {
+		assert := require.New(t)
+
+		r, err := newRouterInfoRouter(config.BasicStationRouterInfo{
+			Instances: []string{"wss://lns-3.example.com:3001"},
+			Routes: []config.BasicStationRouterInfoRoute{
+				{GatewayIDRange: [2]string{"0000000000000000", "00000000ffffffff"}, URI: "wss://lns-1.example.com:3001/"},
+				{GatewayIDRange: [2]string{"0100000000000000", "01ffffffffffffff"}, URI: "wss://lns-2.example.com:3001"},
+			},
+		})
+		assert.NoError(err)
+
+		uri, ok := r.getURI(lorawan.EUI64{0, 0, 0, 0, 1, 2, 3, 4})
+		assert.True(ok)
+		assert.Equal("wss://lns-1.example.com:3001", uri)
+
+		uri, ok = r.getURI(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8})
+		assert.True(ok)
+		assert.Equal("wss://lns-2.example.com:3001", uri)
+
+		// falls back to the instances
+		uri, ok = r.getURI(lorawan.EUI64{2, 2, 3, 4, 5, 6, 7, 8})
+		assert.True(ok)
+		assert.Equal("wss://lns-3.example.com:3001", uri)
+	})
+
+	t.Run("Consistent hashing", func(t *testing.T) {
+		assert := require.New(t)
+
+		instances := []string{"wss://lns-1.example.com:3001", "wss://lns-2.example.com:3001", "wss://lns-3.example.com:3001"}
+		r, err := newRouterInfoRouter(config.BasicStationRouterInfo{Instances: instances})
+		assert.NoError(err)
+
+		rr, err := newRouterInfoRouter(config.BasicStationRouterInfo{Instances: instances[:2]})
+		assert.NoError(err)
+
+		counts := make(map[string]int)
+		for i := 0; i < 3000; i++ {
+			gatewayID := lorawan.EUI64{0, 0, 0, 0, 0, 0, byte(i >> 8), byte(i)}
+
+			uri, ok := r.getURI(gatewayID)
+			assert.True(ok)
+			counts[uri]++
+
+			// the result must be stable
+			uri2, _ := r.getURI(gatewayID)
+			assert.Equal(uri, uri2)
+
+			// removing an instance must only move the gateways of that
+			// instance
+			if uri != instances[2] {
+				uri3, _ := rr.getURI(gatewayID)
+				assert.Equal(uri, uri3)
+			}
+		}
+
+		assert.Len(counts, 3)
+		for _, c := range counts {
+			assert.True(c > 500)
+		}
+	})
+
+	t.Run("Invalid route", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err := newRouterInfoRouter(config.BasicStationRouterInfo{
+			Routes: []config.BasicStationRouterInfoRoute{
+				{GatewayIDRange: [2]string{"0000000000000000", "00000000ffffffff"}},
+			},
+		})
+		assert.EqualError(err, "route uri must be set")
+	})
+}
@@ -1,6 +1,7 @@
 package structs
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/hex"
 	"time"
@@ -33,17 +34,23 @@ type DownlinkFrame struct {
 	MuxTime  *float64 `json:"MuxTime,omitempty"`
 }
 
-// DownlinkFrameFromProto convers the given protobuf message to a DownlinkFrame.
-func DownlinkFrameFromProto(loraBand band.Band, pb *gw.DownlinkFrame) (DownlinkFrame, error) {
+// DownlinkFrameFromProto converts the item at the given index of the given
+// protobuf message to a DownlinkFrame. When the item is scheduled relative to
+// the uplink and the next item is scheduled one second later for the same
+// uplink, the next item is used as RX2 parameters of the DownlinkFrame.
+// It returns the number of items contained by the DownlinkFrame.
+func DownlinkFrameFromProto(loraBand band.Band, pb *gw.DownlinkFrame, index int) (DownlinkFrame, int, error) {
 	if len(pb.Items) == 0 {
-		return DownlinkFrame{}, errors.New("items must contain at least one item")
+		return DownlinkFrame{}, 0, errors.New("items must contain at least one item")
+	}
+	if index < 0 || index >= len(pb.Items) {
+		return DownlinkFrame{}, 0, errors.New("invalid downlink frame item index")
 	}
 
 	// MuxTime
 	muxTime := float64(time.Now().UnixMicro()) / 1000000
 
-	// We assume this is for RX1
-	item := pb.Items[0]
+	item := pb.Items[index]
 
 	out := DownlinkFrame{
 		MessageType: DownlinkMessage,
@@ -56,7 +63,7 @@ func DownlinkFrameFromProto(loraBand band.Band, pb *gw.DownlinkFrame) (DownlinkF
 
 	// context
 	// depending the scheduling type, there might or might not be a context
-	if len(item.GetTxInfo().Context) >= 8 {
+	if len(item.GetTxInfo().Context) >= 16 {
 		var rctx, xtime uint64
 		rctx = binary.BigEndian.Uint64(item.GetTxInfo().Context[0:8])
 		xtime = binary.BigEndian.Uint64(item.GetTxInfo().Context[8:16])
@@ -66,29 +73,9 @@ func DownlinkFrameFromProto(loraBand band.Band, pb *gw.DownlinkFrame) (DownlinkF
 	}
 
 	// get data-rate
-	var dr int
-	var err error
-
-	modulation := item.GetTxInfo().GetModulation()
-	if lora := modulation.GetLora(); lora != nil {
-		dr, err = loraBand.GetDataRateIndex(false, band.DataRate{
-			Modulation:   band.LoRaModulation,
-			SpreadFactor: int(lora.SpreadingFactor),
-			Bandwidth:    int(lora.Bandwidth / 1000),
-		})
-		if err != nil {
-			return out, errors.Wrap(err, "get data-rate index error")
-		}
-	}
-
-	if fsk := modulation.GetFsk(); fsk != nil {
-		dr, err = loraBand.GetDataRateIndex(false, band.DataRate{
-			Modulation: band.FSKModulation,
-			BitRate:    int(fsk.Datarate),
-		})
-		if err != nil {
-			return out, errors.Wrap(err, "get data-rate index error")
-		}
+	dr, err := getDataRateIndex(loraBand, item.GetTxInfo().GetModulation())
+	if err != nil {
+		return out, 0, err
 	}
 
 	timing := item.GetTxInfo().GetTiming()
@@ -116,41 +103,65 @@ func DownlinkFrameFromProto(loraBand band.Band, pb *gw.DownlinkFrame) (DownlinkF
 		out.GPSTime = &gpsEpoch
 	}
 
-	// We assume this is the RX2.
-	if len(pb.Items) == 2 {
-		item := pb.Items[1]
-
-		if delay := item.GetTxInfo().GetTiming().GetDelay(); delay != nil {
-			modulation := item.GetTxInfo().GetModulation()
-
-			if lora := modulation.GetLora(); lora != nil {
-				dr, err := loraBand.GetDataRateIndex(false, band.DataRate{
-					Modulation:   band.LoRaModulation,
-					SpreadFactor: int(lora.SpreadingFactor),
-					Bandwidth:    int(lora.Bandwidth / 1000),
-				})
-				if err != nil {
-					return out, errors.Wrap(err, "get data-rate index error")
-				}
-
-				out.RX2Freq = &item.GetTxInfo().Frequency
-				out.RX2DR = &dr
-			}
-
-			if fsk := modulation.GetFsk(); fsk != nil {
-				dr, err := loraBand.GetDataRateIndex(false, band.DataRate{
-					Modulation: band.FSKModulation,
-					BitRate:    int(fsk.Datarate),
-				})
-				if err != nil {
-					return out, errors.Wrap(err, "get data-rate index error")
-				}
-
-				out.RX2Freq = &item.GetTxInfo().Frequency
-				out.RX2DR = &dr
-			}
+	// Can the next item be used as RX2?
+	if index+1 < len(pb.Items) && IsRX2Item(item, pb.Items[index+1]) {
+		item := pb.Items[index+1]
+
+		dr, err := getDataRateIndex(loraBand, item.GetTxInfo().GetModulation())
+		if err != nil {
+			return out, 0, err
+		}
+
+		out.RX2Freq = &item.GetTxInfo().Frequency
+		out.RX2DR = &dr
+
+		return out, 2, nil
+	}
+
+	return out, 1, nil
+}
+
+// IsRX2Item returns true when the rx2 item is the RX2 window of the rx1 item.
+// The Basic Station schedules RX2 one second after RX1, using the same
+// uplink context.
+func IsRX2Item(rx1, rx2 *gw.DownlinkFrameItem) bool {
+	rx1Delay := rx1.GetTxInfo().GetTiming().GetDelay()
+	rx2Delay := rx2.GetTxInfo().GetTiming().GetDelay()
+
+	if rx1Delay == nil || rx2Delay == nil {
+		return false
+	}
+
+	if !bytes.Equal(rx1.GetTxInfo().GetContext(), rx2.GetTxInfo().GetContext()) {
+		return false
+	}
+
+	return rx2Delay.GetDelay().AsDuration() == rx1Delay.GetDelay().AsDuration()+time.Second
+}
+
+func getDataRateIndex(loraBand band.Band, modulation *gw.Modulation) (int, error) {
+	if lora := modulation.GetLora(); lora != nil {
+		dr, err := loraBand.GetDataRateIndex(false, band.DataRate{
+			Modulation:   band.LoRaModulation,
+			SpreadFactor: int(lora.SpreadingFactor),
+			Bandwidth:    int(lora.Bandwidth / 1000),
+		})
+		if err != nil {
+			return 0, errors.Wrap(err, "get data-rate index error")
+		}
+		return dr, nil
+	}
+
+	if fsk := modulation.GetFsk(); fsk != nil {
+		dr, err := loraBand.GetDataRateIndex(false, band.DataRate{
+			Modulation: band.FSKModulation,
+			BitRate:    int(fsk.Datarate),
+		})
+		if err != nil {
+			return 0, errors.Wrap(err, "get data-rate index error")
 		}
+		return dr, nil
 	}
 
-	return out, nil
+	return 0, nil
 }
@@ -1,6 +1,7 @@
 package structs
 
 import (
+	"errors"
 	"testing"
 	"time"
 
@@ -25,7 +26,9 @@ func TestDownlinkFrameFromProto(t *testing.T) {
 	tests := []struct {
 		Name  string
 		In    *gw.DownlinkFrame
+		Index int
 		Out   DownlinkFrame
+		Count int
 		Error error
 	}{
 		{
@@ -101,6 +104,7 @@ func TestDownlinkFrameFromProto(t *testing.T) {
 				RX2DR:       &dr1,
 				RX2Freq:     &freq2,
 			},
+			Count: 2,
 		},
 		{
 			Name: "Class-A FSK",
@@ -145,6 +149,7 @@ func TestDownlinkFrameFromProto(t *testing.T) {
 				RX1DR:       &dr7,
 				RX1Freq:     &freq,
 			},
+			Count: 1,
 		},
 		{
 			Name: "Class-B",
@@ -192,6 +197,7 @@ func TestDownlinkFrameFromProto(t *testing.T) {
 				Freq:        &freq,
 				GPSTime:     &gpsTime,
 			},
+			Count: 1,
 		},
 		{
 			Name: "Class-C",
@@ -236,6 +242,82 @@ func TestDownlinkFrameFromProto(t *testing.T) {
 				RX2DR:       &dr2,
 				RX2Freq:     &freq,
 			},
+			Count: 1,
+		},
+		{
+			Name: "Class-C second item",
+			In: &gw.DownlinkFrame{
+				DownlinkId: 1234,
+				GatewayId:  "0102030405060708",
+				Items: []*gw.DownlinkFrameItem{
+					{
+						PhyPayload: []byte{1, 2, 3, 4},
+						TxInfo: &gw.DownlinkTxInfo{
+							Frequency: 868100000,
+							Power:     14,
+							Modulation: &gw.Modulation{
+								Parameters: &gw.Modulation_Lora{
+									Lora: &gw.LoraModulationInfo{
+										Bandwidth:             125000,
+										SpreadingFactor:       10,
+										CodeRate:              gw.CodeRate_CR_4_5,
+										PolarizationInversion: true,
+									},
+								},
+							},
+							Timing: &gw.Timing{
+								Parameters: &gw.Timing_Immediately{
+									Immediately: &gw.ImmediatelyTimingInfo{},
+								},
+							},
+						},
+					},
+					{
+						PhyPayload: []byte{5, 6, 7, 8},
+						TxInfo: &gw.DownlinkTxInfo{
+							Frequency: 868200000,
+							Power:     14,
+							Modulation: &gw.Modulation{
+								Parameters: &gw.Modulation_Lora{
+									Lora: &gw.LoraModulationInfo{
+										Bandwidth:             125000,
+										SpreadingFactor:       11,
+										CodeRate:              gw.CodeRate_CR_4_5,
+										PolarizationInversion: true,
+									},
+								},
+							},
+							Timing: &gw.Timing{
+								Parameters: &gw.Timing_Immediately{
+									Immediately: &gw.ImmediatelyTimingInfo{},
+								},
+							},
+						},
+					},
+				},
+			},
+			Index: 1,
+			Out: DownlinkFrame{
+				MessageType: DownlinkMessage,
+				DevEui:      "01-01-01-01-01-01-01-01",
+				DC:          2,
+				DIID:        1234,
+				Priority:    1,
+				PDU:         "05060708",
+				RX2DR:       &dr1,
+				RX2Freq:     &freq2,
+			},
+			Count: 1,
+		},
+		{
+			Name: "invalid index",
+			In: &gw.DownlinkFrame{
+				Items: []*gw.DownlinkFrameItem{
+					{},
+				},
+			},
+			Index: 1,
+			Error: errors.New("invalid downlink frame item index"),
 		},
 	}
 
@@ -246,14 +328,16 @@ func TestDownlinkFrameFromProto(t *testing.T) {
 	for _, tst := range tests {
 		t.Run(tst.Name, func(t *testing.T) {
 			assert := require.New(t)
-			out, err := DownlinkFrameFromProto(b, tst.In)
-			assert.Equal(tst.Error, err)
-			if err != nil {
+			out, count, err := DownlinkFrameFromProto(b, tst.In, tst.Index)
+			if tst.Error != nil {
+				assert.EqualError(err, tst.Error.Error())
 				return
 			}
+			assert.NoError(err)
 			assert.NotNil(out.MuxTime)
 			out.MuxTime = nil
 			assert.Equal(tst.Out, out)
+			assert.Equal(tst.Count, count)
 		})
 	}
 }
@@ -19,6 +19,9 @@ const (
 	DownlinkMessage             MessageType = "dnmsg"
 	DownlinkTransmittedMessage  MessageType = "dntxed"
 	TimeSyncMessage             MessageType = "timesync"
+	RunCommandMessage           MessageType = "runcmd"
+	GetXTimeMessage             MessageType = "getxtime"
+	RemoteShellMessage          MessageType = "rmtsh"
 )
 
 type messageTypePayload struct {
@@ -0,0 +1,47 @@
+package structs
+
+// RunCommand implements the runcmd message.
+type RunCommand struct {
+	MessageType MessageType `json:"msgtype"`
+
+	Command   string   `json:"command"`
+	Arguments []string `json:"arguments"`
+}
+
+// GetXTimeRequest implements the getxtime request.
+type GetXTimeRequest struct {
+	MessageType MessageType `json:"msgtype"`
+}
+
+// GetXTimeResponse implements the getxtime response.
+type GetXTimeResponse struct {
+	MessageType MessageType `json:"msgtype"`
+
+	XTime int64 `json:"xtime"`
+}
+
+// RemoteShellRequest implements the rmtsh request. Start and Stop contain
+// the index of the session to start or stop.
+type RemoteShellRequest struct {
+	MessageType MessageType `json:"msgtype"`
+
+	User  string `json:"user"`
+	Term  string `json:"term,omitempty"`
+	Start *int   `json:"start,omitempty"`
+	Stop  *int   `json:"stop,omitempty"`
+}
+
+// RemoteShellResponse implements the rmtsh response.
+type RemoteShellResponse struct {
+	MessageType MessageType `json:"msgtype"`
+
+	RemoteShell []RemoteShellSession `json:"rmtsh"`
+}
+
+// RemoteShellSession implements the rmtsh session status.
+type RemoteShellSession struct {
+	User    string `json:"user"`
+	Started bool   `json:"started"`
+	Age     int    `json:"age"`
+	PID     int    `json:"pid"`
+}
@@ -13,6 +13,10 @@ import (
 	"github.com/pkg/errors"
 )
 
+// maxConcentrators defines the max number of SX1301 concentrators supported
+// by the Basic Station.
+const maxConcentrators = 8
+
 var regionNameMapping = map[band.Name]string{
 	band.AS923: "AS923",
 	band.AU915: "AU915",
@@ -84,7 +88,72 @@ type SX1301ConfChanMultiSF struct {
 
 // GetRouterConfig returns the router-config message.
 func GetRouterConfig(region band.Name, netIDs []lorawan.NetID, joinEUIs [][2]lorawan.EUI64, freqMin, freqMax uint32, concentrators []config.BasicStationConcentrator) (RouterConfig, error) {
-	concentratorCount := len(concentrators)
+	concentratorChannels := make([][]*gw.ChannelConfiguration, len(concentrators))
+
+	for concentratorNum, concentratorConf := range concentrators {
+		for _, freq := range concentratorConf.MultiSF.Frequencies {
+			concentratorChannels[concentratorNum] = append(concentratorChannels[concentratorNum], &gw.ChannelConfiguration{
+				Frequency: freq,
+				ModulationConfig: &gw.ChannelConfiguration_LoraModulationConfig{
+					LoraModulationConfig: &gw.LoraModulationConfig{
+						Bandwidth:        125000,
+						SpreadingFactors: []uint32{7, 8, 9, 10, 11, 12},
+					},
+				},
+			})
+		}
+
+		if fskFreq := concentratorConf.FSK.Frequency; fskFreq != 0 {
+			concentratorChannels[concentratorNum] = append(concentratorChannels[concentratorNum], &gw.ChannelConfiguration{
+				Frequency: fskFreq,
+				ModulationConfig: &gw.ChannelConfiguration_FskModulationConfig{
+					FskModulationConfig: &gw.FskModulationConfig{
+						Bandwidth: 125000,
+						Bitrate:   50000,
+					},
+				},
+			})
+		}
+
+		if loraSTDFreq := concentratorConf.LoRaSTD.Frequency; loraSTDFreq != 0 {
+			concentratorChannels[concentratorNum] = append(concentratorChannels[concentratorNum], &gw.ChannelConfiguration{
+				Frequency: loraSTDFreq,
+				ModulationConfig: &gw.ChannelConfiguration_LoraModulationConfig{
+					LoraModulationConfig: &gw.LoraModulationConfig{
+						Bandwidth:        concentratorConf.LoRaSTD.Bandwidth,
+						SpreadingFactors: []uint32{concentratorConf.LoRaSTD.SpreadingFactor},
+					},
+				},
+			})
+		}
+	}
+
+	return getRouterConfig(region, netIDs, joinEUIs, freqMin, freqMax, concentratorChannels)
+}
+
+// GetRouterConfigForGatewayConfiguration returns the router-config message
+// for the given gateway configuration. Channels are assigned to the
+// concentrators by their board index.
+func GetRouterConfigForGatewayConfiguration(region band.Name, netIDs []lorawan.NetID, joinEUIs [][2]lorawan.EUI64, freqMin, freqMax uint32, gwConf *gw.GatewayConfiguration) (RouterConfig, error) {
+	var concentratorChannels [][]*gw.ChannelConfiguration
+
+	for _, channel := range gwConf.GetChannels() {
+		if channel.GetBoard() >= maxConcentrators {
+			return RouterConfig{}, fmt.Errorf("board %d exceeds the max number of concentrators (%d)", channel.GetBoard(), maxConcentrators)
+		}
+
+		for int(channel.GetBoard()) >= len(concentratorChannels) {
+			concentratorChannels = append(concentratorChannels, nil)
+		}
+
+		concentratorChannels[channel.GetBoard()] = append(concentratorChannels[channel.GetBoard()], channel)
+	}
+
+	return getRouterConfig(region, netIDs, joinEUIs, freqMin, freqMax, concentratorChannels)
+}
+
+func getRouterConfig(region band.Name, netIDs []lorawan.NetID, joinEUIs [][2]lorawan.EUI64, freqMin, freqMax uint32, concentratorChannels [][]*gw.ChannelConfiguration) (RouterConfig, error) {
+	concentratorCount := len(concentratorChannels)
 
 	// MuxTime
 	muxTime := float64(time.Now().UnixMicro()) / 1000000
@@ -136,44 +205,11 @@ func GetRouterConfig(region band.Name, netIDs []lorawan.NetID, joinEUIs [][2]lor
 	}
 
 	// Iterate over concentrators
-	for concentratorNum, concentratorConf := range concentrators {
-		var channelConfigs []*gw.ChannelConfiguration
-
-		for _, freq := range concentratorConf.MultiSF.Frequencies {
-			channelConfigs = append(channelConfigs, &gw.ChannelConfiguration{
-				Frequency: freq,
-				ModulationConfig: &gw.ChannelConfiguration_LoraModulationConfig{
-					LoraModulationConfig: &gw.LoraModulationConfig{
-						Bandwidth:        125000,
-						SpreadingFactors: []uint32{7, 8, 9, 10, 11, 12},
-					},
-				},
-			})
-		}
-
-		if fskFreq := concentratorConf.FSK.Frequency; fskFreq != 0 {
-			channelConfigs = append(channelConfigs, &gw.ChannelConfiguration{
-				Frequency: fskFreq,
-				ModulationConfig: &gw.ChannelConfiguration_FskModulationConfig{
-					FskModulationConfig: &gw.FskModulationConfig{
-						Bandwidth: 125000,
-						Bitrate:   50000,
-					},
-				},
-			})
-		}
-
-		if loraSTDFreq := concentratorConf.LoRaSTD.Frequency; loraSTDFreq != 0 {
-			channelConfigs = append(channelConfigs, &gw.ChannelConfiguration{
-				Frequency: loraSTDFreq,
-				ModulationConfig: &gw.ChannelConfiguration_LoraModulationConfig{
-					LoraModulationConfig: &gw.LoraModulationConfig{
-						Bandwidth:        concentratorConf.LoRaSTD.Bandwidth,
-						SpreadingFactors: []uint32{concentratorConf.LoRaSTD.SpreadingFactor},
-					},
-				},
-			})
-		}
+	for concentratorNum, concentratorConfigs := range concentratorChannels {
+		// GetRadioFrequencies sorts the given slice, make sure we don't
+		// modify the channel order of the given slice.
+		channelConfigs := make([]*gw.ChannelConfiguration, len(concentratorConfigs))
+		copy(channelConfigs, concentratorConfigs)
 
 		// Get radio frequencies
 		radioFrequencies, err := sx1301v1.GetRadioFrequencies(channelConfigs)
@@ -235,6 +271,8 @@ func GetRouterConfig(region band.Name, netIDs []lorawan.NetID, joinEUIs [][2]lor
 						c.SX1301Conf[concentratorNum].ChanMultiSF6 = multiFSChan
 					case 7:
 						c.SX1301Conf[concentratorNum].ChanMultiSF7 = multiFSChan
+					default:
+						return c, errors.New("too many multi-SF channels, max: 8")
 					}
 
 					channelI++
@@ -8,6 +8,7 @@ import (
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
 	"github.com/brocaar/lorawan"
 	"github.com/brocaar/lorawan/band"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
 )
 
 func TestRouterConfig(t *testing.T) {
@@ -327,3 +328,73 @@ func TestRouterConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestRouterConfigForGatewayConfiguration(t *testing.T) {
+	assert := require.New(t)
+
+	multiSF := func(board, freq uint32) *gw.ChannelConfiguration {
+		return &gw.ChannelConfiguration{
+			Frequency: freq,
+			Board:     board,
+			ModulationConfig: &gw.ChannelConfiguration_LoraModulationConfig{
+				LoraModulationConfig: &gw.LoraModulationConfig{
+					Bandwidth:        125000,
+					SpreadingFactors: []uint32{7, 8, 9, 10, 11, 12},
+				},
+			},
+		}
+	}
+
+	gwConf := gw.GatewayConfiguration{
+		GatewayId: "0102030405060708",
+		Version:   "1.2.3",
+		Channels: []*gw.ChannelConfiguration{
+			multiSF(0, 868100000),
+			multiSF(1, 867100000),
+			multiSF(0, 868300000),
+		},
+	}
+
+	rc, err := GetRouterConfigForGatewayConfiguration(band.EU868, nil, nil, 863000000, 870000000, &gwConf)
+	assert.NoError(err)
+	assert.NotNil(rc.MuxTime)
+
+	// the channel order of the given configuration must not be modified
+	assert.Equal(uint32(868100000), gwConf.Channels[0].Frequency)
+
+	assert.Equal("sx1301/2", rc.HWSpec)
+	assert.Equal([]SX1301Conf{
+		{
+			Radio0: SX1301ConfRadio{
+				Enable: true,
+				Freq:   868500000,
+			},
+			ChanMultiSF0: SX1301ConfChanMultiSF{
+				Enable: true,
+				Radio:  0,
+				IF:     -400000,
+			},
+			ChanMultiSF1: SX1301ConfChanMultiSF{
+				Enable: true,
+				Radio:  0,
+				IF:     -200000,
+			},
+		},
+		{
+			Radio0: SX1301ConfRadio{
+				Enable: true,
+				Freq:   867500000,
+			},
+			ChanMultiSF0: SX1301ConfChanMultiSF{
+				Enable: true,
+				Radio:  0,
+				IF:     -400000,
+			},
+		},
+	}, rc.SX1301Conf)
+
+	// the board index must be within the supported number of concentrators
+	gwConf.Channels = append(gwConf.Channels, multiSF(4000000000, 868500000))
+	_, err = GetRouterConfigForGatewayConfiguration(band.EU868, nil, nil, 863000000, 870000000, &gwConf)
+	assert.EqualError(err, "board 4000000000 exceeds the max number of concentrators (8)")
+}
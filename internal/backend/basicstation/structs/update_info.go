@@ -0,0 +1,77 @@
+package structs
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// UpdateInfoRequest implements the CUPS update-info request.
+type UpdateInfoRequest struct {
+	Router      EUI64    `json:"router"`
+	CUPSURI     string   `json:"cupsUri"`
+	TCURI       string   `json:"tcUri"`
+	CUPSCredCRC uint32   `json:"cupsCredCrc"`
+	TCCredCRC   uint32   `json:"tcCredCrc"`
+	Station     string   `json:"station"`
+	Model       string   `json:"model"`
+	Package     string   `json:"package"`
+	Keys        []uint32 `json:"keys"`
+}
+
+// UpdateInfoResponse implements the CUPS update-info response.
+// Empty fields are not updated by the station.
+type UpdateInfoResponse struct {
+	CUPSURI        string
+	TCURI          string
+	CUPSCredential []byte
+	TCCredential   []byte
+	KeyCRC         uint32
+	Signature      []byte
+	UpdateData     []byte
+}
+
+// MarshalBinary encodes the response into the CUPS binary format.
+func (r UpdateInfoResponse) MarshalBinary() ([]byte, error) {
+	if len(r.CUPSURI) > 255 {
+		return nil, errors.New("cupsUri exceeds max length of 255 bytes")
+	}
+	if len(r.TCURI) > 255 {
+		return nil, errors.New("tcUri exceeds max length of 255 bytes")
+	}
+	if len(r.CUPSCredential) > 65535 {
+		return nil, errors.New("cupsCred exceeds max length of 65535 bytes")
+	}
+	if len(r.TCCredential) > 65535 {
+		return nil, errors.New("tcCred exceeds max length of 65535 bytes")
+	}
+
+	var buf bytes.Buffer
+
+	buf.WriteByte(uint8(len(r.CUPSURI)))
+	buf.WriteString(r.CUPSURI)
+
+	buf.WriteByte(uint8(len(r.TCURI)))
+	buf.WriteString(r.TCURI)
+
+	binary.Write(&buf, binary.LittleEndian, uint16(len(r.CUPSCredential)))
+	buf.Write(r.CUPSCredential)
+
+	binary.Write(&buf, binary.LittleEndian, uint16(len(r.TCCredential)))
+	buf.Write(r.TCCredential)
+
+	// The signature length includes the 4 byte key CRC.
+	if len(r.Signature) == 0 {
+		binary.Write(&buf, binary.LittleEndian, uint32(0))
+	} else {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(r.Signature)+4))
+		binary.Write(&buf, binary.LittleEndian, r.KeyCRC)
+		buf.Write(r.Signature)
+	}
+
+	binary.Write(&buf, binary.LittleEndian, uint32(len(r.UpdateData)))
+	buf.Write(r.UpdateData)
+
+	return buf.Bytes(), nil
+}
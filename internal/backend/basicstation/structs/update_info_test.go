@@ -0,0 +1,92 @@
+package structs
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateInfoRequest(t *testing.T) {
+	assert := require.New(t)
+
+	var req UpdateInfoRequest
+	assert.NoError(json.Unmarshal([]byte(`{
+		"router": "b827:ebff:fe61:51ed",
+		"cupsUri": "https://cups.example.com:443",
+		"tcUri": "wss://lns.example.com:443",
+		"cupsCredCrc": 1234,
+		"tcCredCrc": 5678,
+		"station": "2.0.6(rpi/std)",
+		"model": "rpi",
+		"package": "1.0.0",
+		"keys": [3735928559]
+	}`), &req))
+
+	assert.Equal(UpdateInfoRequest{
+		Router:      EUI64{0xb8, 0x27, 0xeb, 0xff, 0xfe, 0x61, 0x51, 0xed},
+		CUPSURI:     "https://cups.example.com:443",
+		TCURI:       "wss://lns.example.com:443",
+		CUPSCredCRC: 1234,
+		TCCredCRC:   5678,
+		Station:     "2.0.6(rpi/std)",
+		Model:       "rpi",
+		Package:     "1.0.0",
+		Keys:        []uint32{3735928559},
+	}, req)
+}
+
+func TestUpdateInfoResponse(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Response      UpdateInfoResponse
+		ExpectedBytes []byte
+		ExpectedError string
+	}{
+		{
+			Name:          "empty",
+			ExpectedBytes: []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		},
+		{
+			Name: "all fields",
+			Response: UpdateInfoResponse{
+				CUPSURI:        "a",
+				TCURI:          "bc",
+				CUPSCredential: []byte{0x01},
+				TCCredential:   []byte{0x02, 0x03},
+				KeyCRC:         0x01020304,
+				Signature:      []byte{0x04},
+				UpdateData:     []byte{0x05, 0x06},
+			},
+			ExpectedBytes: []byte{
+				0x01, 'a',
+				0x02, 'b', 'c',
+				0x01, 0x00, 0x01,
+				0x02, 0x00, 0x02, 0x03,
+				0x05, 0x00, 0x00, 0x00, 0x04, 0x03, 0x02, 0x01, 0x04,
+				0x02, 0x00, 0x00, 0x00, 0x05, 0x06,
+			},
+		},
+		{
+			Name: "cups uri too long",
+			Response: UpdateInfoResponse{
+				CUPSURI: string(make([]byte, 256)),
+			},
+			ExpectedError: "cupsUri exceeds max length of 255 bytes",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			b, err := tst.Response.MarshalBinary()
+			if tst.ExpectedError != "" {
+				assert.EqualError(err, tst.ExpectedError)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tst.ExpectedBytes, b)
+		})
+	}
+}
@@ -0,0 +1,448 @@
+package concentratord
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-zeromq/zmq4"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/filters"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+// commandTimeout defines the max. duration to wait for a command response.
+const commandTimeout = time.Second
+
+// Backend implements a ChirpStack Concentratord backend.
+type Backend struct {
+	sync.RWMutex
+
+	eventSockCancel   func()
+	commandSockCancel func()
+	commandMux        sync.Mutex
+
+	eventSock   zmq4.Socket
+	commandSock zmq4.Socket
+
+	downlinkTxAckFunc  func(*gw.DownlinkTxAck)
+	uplinkFrameFunc    func(*gw.UplinkFrame)
+	gatewayStatsFunc   func(*gw.GatewayStats)
+	subscribeEventFunc func(events.Subscribe)
+
+	eventURL   string
+	commandURL string
+
+	gatewayID lorawan.EUI64
+	crcCheck  bool
+	closed    bool
+}
+
+// NewBackend creates a new Backend.
+func NewBackend(conf config.Config) (*Backend, error) {
+	log.WithFields(log.Fields{
+		"event_url":   conf.Backend.Concentratord.EventURL,
+		"command_url": conf.Backend.Concentratord.CommandURL,
+	}).Info("backend/concentratord: setting up backend")
+
+	b := Backend{
+		eventURL:   conf.Backend.Concentratord.EventURL,
+		commandURL: conf.Backend.Concentratord.CommandURL,
+		crcCheck:   conf.Backend.Concentratord.CRCCheck,
+	}
+
+	b.dialEventSockLoop()
+	b.dialCommandSockLoop()
+
+	var err error
+	b.gatewayID, err = b.getGatewayID()
+	if err != nil {
+		return nil, errors.Wrap(err, "get gateway id error")
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": b.gatewayID,
+	}).Info("backend/concentratord: gateway id retrieved")
+
+	return &b, nil
+}
+
+// Start starts the backend.
+func (b *Backend) Start() error {
+	if b.subscribeEventFunc != nil {
+		b.subscribeEventFunc(events.Subscribe{Subscribe: true, GatewayID: b.gatewayID})
+	}
+
+	go b.eventLoop()
+
+	return nil
+}
+
+// Stop stops the backend.
+func (b *Backend) Stop() error {
+	b.Lock()
+	b.closed = true
+	b.Unlock()
+
+	log.Info("backend/concentratord: closing gateway backend")
+
+	if b.subscribeEventFunc != nil {
+		b.subscribeEventFunc(events.Subscribe{Subscribe: false, GatewayID: b.gatewayID})
+	}
+
+	b.eventSockCancel()
+	b.commandSockCancel()
+
+	if err := b.eventSock.Close(); err != nil {
+		return errors.Wrap(err, "close event socket error")
+	}
+	if err := b.commandSock.Close(); err != nil {
+		return errors.Wrap(err, "close command socket error")
+	}
+
+	return nil
+}
+
+// SetDownlinkTxAckFunc sets the DownlinkTXAck handler func.
+func (b *Backend) SetDownlinkTxAckFunc(f func(*gw.DownlinkTxAck)) {
+	b.downlinkTxAckFunc = f
+}
+
+// SetGatewayStatsFunc sets the GatewayStats handler func.
+func (b *Backend) SetGatewayStatsFunc(f func(*gw.GatewayStats)) {
+	b.gatewayStatsFunc = f
+}
+
+// SetUplinkFrameFunc sets the UplinkFrame handler func.
+func (b *Backend) SetUplinkFrameFunc(f func(*gw.UplinkFrame)) {
+	b.uplinkFrameFunc = f
+}
+
+// SetRawPacketForwarderEventFunc sets the RawPacketForwarderEvent handler func.
+func (b *Backend) SetRawPacketForwarderEventFunc(f func(*gw.RawPacketForwarderEvent)) {
+	// not provided by the ChirpStack Concentratord.
+}
+
+// SetSubscribeEventFunc sets the Subscribe handler func.
+func (b *Backend) SetSubscribeEventFunc(f func(events.Subscribe)) {
+	b.subscribeEventFunc = f
+}
+
+// SendDownlinkFrame sends the given downlink frame.
+func (b *Backend) SendDownlinkFrame(pl *gw.DownlinkFrame) error {
+	commandCounter("send_downlink_frame").Inc()
+
+	bb, err := b.commandRequest(&gw.Command{
+		Command: &gw.Command_SendDownlinkFrame{
+			SendDownlinkFrame: pl,
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "send downlink frame error")
+	}
+
+	var ack gw.DownlinkTxAck
+	if err := proto.Unmarshal(bb, &ack); err != nil {
+		return errors.Wrap(err, "protobuf unmarshal error")
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id":  b.gatewayID,
+		"downlink_id": pl.GetDownlinkId(),
+	}).Info("backend/concentratord: downlink-frame sent to concentratord")
+
+	if ack.GatewayId == "" {
+		ack.GatewayId = b.gatewayID.String()
+	}
+	if ack.DownlinkId == 0 {
+		ack.DownlinkId = pl.GetDownlinkId()
+	}
+
+	if b.downlinkTxAckFunc != nil {
+		b.downlinkTxAckFunc(&ack)
+	}
+
+	return nil
+}
+
+// ApplyConfiguration applies the given configuration to the gateway.
+func (b *Backend) ApplyConfiguration(pl *gw.GatewayConfiguration) error {
+	if id := pl.GetGatewayId(); id != "" && id != b.gatewayID.String() {
+		return fmt.Errorf("gateway %s is not handled by concentratord (gateway_id: %s)", id, b.gatewayID)
+	}
+
+	commandCounter("set_gateway_configuration").Inc()
+
+	if _, err := b.commandRequest(&gw.Command{
+		Command: &gw.Command_SetGatewayConfiguration{
+			SetGatewayConfiguration: pl,
+		},
+	}); err != nil {
+		return errors.Wrap(err, "send gateway configuration error")
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": b.gatewayID,
+		"version":    pl.GetVersion(),
+	}).Info("backend/concentratord: gateway-configuration sent to concentratord")
+
+	return nil
+}
+
+// RawPacketForwarderCommand sends the given raw command to the packet-forwarder.
+func (b *Backend) RawPacketForwarderCommand(*gw.RawPacketForwarderCommand) error {
+	return errors.New("raw packet-forwarder command not implemented by ChirpStack Concentratord")
+}
+
+func (b *Backend) isClosed() bool {
+	b.RLock()
+	defer b.RUnlock()
+	return b.closed
+}
+
+func (b *Backend) dialEventSock() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	b.eventSockCancel = cancel
+
+	b.eventSock = zmq4.NewSub(ctx)
+	if err := b.eventSock.Dial(b.eventURL); err != nil {
+		return errors.Wrap(err, "dial event api url error")
+	}
+
+	if err := b.eventSock.SetOption(zmq4.OptionSubscribe, ""); err != nil {
+		return errors.Wrap(err, "set event option error")
+	}
+
+	log.WithFields(log.Fields{
+		"event_url": b.eventURL,
+	}).Info("backend/concentratord: connected to event socket")
+
+	return nil
+}
+
+func (b *Backend) dialCommandSock() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	b.commandSockCancel = cancel
+
+	b.commandSock = zmq4.NewReq(ctx)
+	if err := b.commandSock.Dial(b.commandURL); err != nil {
+		return errors.Wrap(err, "dial command api url error")
+	}
+
+	log.WithFields(log.Fields{
+		"command_url": b.commandURL,
+	}).Info("backend/concentratord: connected to command socket")
+
+	return nil
+}
+
+func (b *Backend) dialEventSockLoop() {
+	for {
+		if err := b.dialEventSock(); err != nil {
+			log.WithError(err).Error("backend/concentratord: event socket dial error")
+			time.Sleep(time.Second)
+			continue
+		}
+		break
+	}
+}
+
+func (b *Backend) dialCommandSockLoop() {
+	for {
+		if err := b.dialCommandSock(); err != nil {
+			log.WithError(err).Error("backend/concentratord: command socket dial error")
+			time.Sleep(time.Second)
+			continue
+		}
+		break
+	}
+}
+
+func (b *Backend) getGatewayID() (lorawan.EUI64, error) {
+	var gatewayID lorawan.EUI64
+
+	commandCounter("get_gateway_id").Inc()
+	bb, err := b.commandRequest(&gw.Command{
+		Command: &gw.Command_GetGatewayId{
+			GetGatewayId: &gw.GetGatewayIdRequest{},
+		},
+	})
+	if err != nil {
+		return gatewayID, errors.Wrap(err, "get gateway id error")
+	}
+
+	var resp gw.GetGatewayIdResponse
+	if err := proto.Unmarshal(bb, &resp); err != nil {
+		return gatewayID, errors.Wrap(err, "protobuf unmarshal error")
+	}
+
+	if err := gatewayID.UnmarshalText([]byte(resp.GetGatewayId())); err != nil {
+		return gatewayID, errors.Wrap(err, "decode gateway id error")
+	}
+
+	return gatewayID, nil
+}
+
+// commandRequest sends the given command to the Concentratord and returns
+// the response payload. As the command socket is a REQ socket, a failed or
+// timed-out request will result in a re-dial of the socket, as the REQ / REP
+// state-machine would otherwise be out of sync.
+func (b *Backend) commandRequest(cmd *gw.Command) ([]byte, error) {
+	b.commandMux.Lock()
+	defer b.commandMux.Unlock()
+
+	bb, err := proto.Marshal(cmd)
+	if err != nil {
+		return nil, errors.Wrap(err, "protobuf marshal error")
+	}
+
+	// The socket is copied, as the command socket is re-dialed on error.
+	sock := b.commandSock
+
+	if err := sock.Send(zmq4.NewMsg(bb)); err != nil {
+		b.redialCommandSock()
+		return nil, errors.Wrap(err, "send command request error")
+	}
+
+	msgC := make(chan zmq4.Msg, 1)
+	errC := make(chan error, 1)
+
+	// Note: on timeout, the re-dial closes the socket which unblocks Recv so
+	// that this goroutine returns.
+	go func() {
+		msg, err := sock.Recv()
+		if err != nil {
+			errC <- err
+			return
+		}
+		msgC <- msg
+	}()
+
+	select {
+	case msg := <-msgC:
+		if len(msg.Frames) == 0 {
+			return nil, errors.New("expected at least one frame")
+		}
+		return msg.Frames[0], nil
+	case err := <-errC:
+		b.redialCommandSock()
+		return nil, errors.Wrap(err, "receive command response error")
+	case <-time.After(commandTimeout):
+		b.redialCommandSock()
+		return nil, errors.New("command response timeout")
+	}
+}
+
+// redialCommandSock closes the current command socket and dials a new one.
+// The caller must hold the commandMux lock.
+func (b *Backend) redialCommandSock() {
+	b.commandSockCancel()
+	if err := b.commandSock.Close(); err != nil {
+		log.WithError(err).Error("backend/concentratord: close command socket error")
+	}
+	b.dialCommandSockLoop()
+}
+
+func (b *Backend) eventLoop() {
+	for {
+		msg, err := b.eventSock.Recv()
+		if err != nil {
+			if b.isClosed() {
+				return
+			}
+
+			log.WithError(err).Error("backend/concentratord: receive event message error")
+
+			// We need to recover both the event and command sockets.
+			func() {
+				b.commandMux.Lock()
+				defer b.commandMux.Unlock()
+
+				b.eventSockCancel()
+				if err := b.eventSock.Close(); err != nil {
+					log.WithError(err).Error("backend/concentratord: close event socket error")
+				}
+				b.dialEventSockLoop()
+				b.redialCommandSock()
+			}()
+			continue
+		}
+
+		if len(msg.Frames) == 0 {
+			continue
+		}
+
+		if err := b.handleEvent(msg.Frames[0]); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"data_base64": base64.StdEncoding.EncodeToString(msg.Frames[0]),
+			}).Error("backend/concentratord: handle event error")
+		}
+	}
+}
+
+func (b *Backend) handleEvent(bb []byte) error {
+	var event gw.Event
+	if err := proto.Unmarshal(bb, &event); err != nil {
+		return errors.Wrap(err, "protobuf unmarshal error")
+	}
+
+	switch v := event.Event.(type) {
+	case *gw.Event_UplinkFrame:
+		eventCounter("up").Inc()
+		b.handleUplinkFrame(v.UplinkFrame)
+	case *gw.Event_GatewayStats:
+		eventCounter("stats").Inc()
+		b.handleGatewayStats(v.GatewayStats)
+	default:
+		log.WithFields(log.Fields{
+			"event": event.String(),
+		}).Debug("backend/concentratord: unsupported event received")
+	}
+
+	return nil
+}
+
+func (b *Backend) handleUplinkFrame(pl *gw.UplinkFrame) {
+	if b.crcCheck && pl.GetRxInfo().GetCrcStatus() != gw.CRCStatus_CRC_OK {
+		log.WithFields(log.Fields{
+			"gateway_id": b.gatewayID,
+			"uplink_id":  pl.GetRxInfo().GetUplinkId(),
+			"crc_status": pl.GetRxInfo().GetCrcStatus(),
+		}).Debug("backend/concentratord: ignoring uplink event, CRC is not valid")
+		return
+	}
+
+	if !filters.MatchFilters(pl.PhyPayload) {
+		log.WithFields(log.Fields{
+			"data_base64": base64.StdEncoding.EncodeToString(pl.PhyPayload),
+		}).Debug("backend/concentratord: frame dropped because of configured filters")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": b.gatewayID,
+		"uplink_id":  pl.GetRxInfo().GetUplinkId(),
+	}).Info("backend/concentratord: uplink event received")
+
+	if b.uplinkFrameFunc != nil {
+		b.uplinkFrameFunc(pl)
+	}
+}
+
+func (b *Backend) handleGatewayStats(pl *gw.GatewayStats) {
+	log.WithFields(log.Fields{
+		"gateway_id": b.gatewayID,
+	}).Info("backend/concentratord: stats event received")
+
+	if b.gatewayStatsFunc != nil {
+		b.gatewayStatsFunc(pl)
+	}
+}
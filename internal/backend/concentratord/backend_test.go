@@ -0,0 +1,281 @@
+package concentratord
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-zeromq/zmq4"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+type BackendTestSuite struct {
+	suite.Suite
+
+	tempDir string
+
+	eventSock   zmq4.Socket
+	commandSock zmq4.Socket
+	cancel      func()
+
+	commandChan chan *gw.Command
+	respChan    chan proto.Message
+
+	backend *Backend
+}
+
+func (ts *BackendTestSuite) SetupSuite() {
+	log.SetLevel(log.ErrorLevel)
+}
+
+func (ts *BackendTestSuite) SetupTest() {
+	var err error
+	assert := require.New(ts.T())
+
+	ts.tempDir, err = ioutil.TempDir("", "test")
+	assert.NoError(err)
+
+	var ctx context.Context
+	ctx, ts.cancel = context.WithCancel(context.Background())
+
+	var conf config.Config
+	conf.Backend.Concentratord.CRCCheck = true
+	conf.Backend.Concentratord.EventURL = fmt.Sprintf("ipc://%s", filepath.Join(ts.tempDir, "events"))
+	conf.Backend.Concentratord.CommandURL = fmt.Sprintf("ipc://%s", filepath.Join(ts.tempDir, "commands"))
+
+	ts.eventSock = zmq4.NewPub(ctx)
+	assert.NoError(ts.eventSock.Listen(conf.Backend.Concentratord.EventURL))
+
+	ts.commandSock = zmq4.NewRep(ctx)
+	assert.NoError(ts.commandSock.Listen(conf.Backend.Concentratord.CommandURL))
+
+	ts.commandChan = make(chan *gw.Command, 1)
+	ts.respChan = make(chan proto.Message, 1)
+
+	go func() {
+		for {
+			msg, err := ts.commandSock.Recv()
+			if err != nil {
+				return
+			}
+
+			var cmd gw.Command
+			if err := proto.Unmarshal(msg.Frames[0], &cmd); err != nil {
+				panic(err)
+			}
+
+			var resp proto.Message
+			if _, ok := cmd.Command.(*gw.Command_GetGatewayId); ok {
+				resp = &gw.GetGatewayIdResponse{GatewayId: "0102030405060708"}
+			} else {
+				ts.commandChan <- &cmd
+				resp = <-ts.respChan
+			}
+
+			bb, err := proto.Marshal(resp)
+			if err != nil {
+				panic(err)
+			}
+
+			if err := ts.commandSock.Send(zmq4.NewMsg(bb)); err != nil {
+				return
+			}
+		}
+	}()
+
+	ts.backend, err = NewBackend(conf)
+	assert.NoError(err)
+	assert.NoError(ts.backend.Start())
+
+	// give the subscriber some time to connect
+	time.Sleep(100 * time.Millisecond)
+}
+
+func (ts *BackendTestSuite) TearDownTest() {
+	ts.backend.Stop()
+	ts.cancel()
+	ts.eventSock.Close()
+	ts.commandSock.Close()
+	os.RemoveAll(ts.tempDir)
+}
+
+func (ts *BackendTestSuite) TestGatewayID() {
+	assert := require.New(ts.T())
+	assert.Equal("0102030405060708", ts.backend.gatewayID.String())
+}
+
+func (ts *BackendTestSuite) TestUplinkFrame() {
+	tests := []struct {
+		Name      string
+		CRCStatus gw.CRCStatus
+		Expected  bool
+	}{
+		{
+			Name:      "CRC OK",
+			CRCStatus: gw.CRCStatus_CRC_OK,
+			Expected:  true,
+		},
+		{
+			Name:      "bad CRC",
+			CRCStatus: gw.CRCStatus_BAD_CRC,
+			Expected:  false,
+		},
+	}
+
+	for _, tst := range tests {
+		ts.T().Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			uplinkFrameChan := make(chan *gw.UplinkFrame, 1)
+			ts.backend.SetUplinkFrameFunc(func(pl *gw.UplinkFrame) {
+				uplinkFrameChan <- pl
+			})
+
+			pl := gw.UplinkFrame{
+				PhyPayload: []byte{1, 2, 3},
+				TxInfo: &gw.UplinkTxInfo{
+					Frequency: 868100000,
+				},
+				RxInfo: &gw.UplinkRxInfo{
+					GatewayId: "0102030405060708",
+					UplinkId:  1234,
+					CrcStatus: tst.CRCStatus,
+				},
+			}
+			bb, err := proto.Marshal(&gw.Event{
+				Event: &gw.Event_UplinkFrame{
+					UplinkFrame: &pl,
+				},
+			})
+			assert.NoError(err)
+			assert.NoError(ts.eventSock.Send(zmq4.NewMsg(bb)))
+
+			select {
+			case up := <-uplinkFrameChan:
+				assert.True(tst.Expected)
+				assert.True(proto.Equal(&pl, up))
+			case <-time.After(200 * time.Millisecond):
+				assert.False(tst.Expected)
+			}
+		})
+	}
+}
+
+func (ts *BackendTestSuite) TestGatewayStats() {
+	assert := require.New(ts.T())
+
+	statsChan := make(chan *gw.GatewayStats, 1)
+	ts.backend.SetGatewayStatsFunc(func(pl *gw.GatewayStats) {
+		statsChan <- pl
+	})
+
+	pl := gw.GatewayStats{
+		GatewayId:         "0102030405060708",
+		RxPacketsReceived: 10,
+	}
+	bb, err := proto.Marshal(&gw.Event{
+		Event: &gw.Event_GatewayStats{
+			GatewayStats: &pl,
+		},
+	})
+	assert.NoError(err)
+	assert.NoError(ts.eventSock.Send(zmq4.NewMsg(bb)))
+
+	stats := <-statsChan
+	assert.True(proto.Equal(&pl, stats))
+}
+
+func (ts *BackendTestSuite) TestSendDownlinkFrame() {
+	assert := require.New(ts.T())
+
+	txAckChan := make(chan *gw.DownlinkTxAck, 1)
+	ts.backend.SetDownlinkTxAckFunc(func(pl *gw.DownlinkTxAck) {
+		txAckChan <- pl
+	})
+
+	pl := gw.DownlinkFrame{
+		GatewayId:  "0102030405060708",
+		DownlinkId: 1234,
+		Items: []*gw.DownlinkFrameItem{
+			{
+				PhyPayload: []byte{1, 2, 3},
+			},
+		},
+	}
+
+	ack := gw.DownlinkTxAck{
+		GatewayId:  "0102030405060708",
+		DownlinkId: 1234,
+		Items: []*gw.DownlinkTxAckItem{
+			{
+				Status: gw.TxAckStatus_OK,
+			},
+		},
+	}
+	ts.respChan <- &ack
+
+	assert.NoError(ts.backend.SendDownlinkFrame(&pl))
+
+	cmd := <-ts.commandChan
+	assert.True(proto.Equal(&pl, cmd.GetSendDownlinkFrame()))
+
+	txAck := <-txAckChan
+	assert.True(proto.Equal(&ack, txAck))
+}
+
+func (ts *BackendTestSuite) TestApplyConfiguration() {
+	assert := require.New(ts.T())
+
+	pl := gw.GatewayConfiguration{
+		GatewayId: "0102030405060708",
+		Version:   "1.2.3",
+	}
+	ts.respChan <- &gw.GatewayConfiguration{}
+
+	assert.NoError(ts.backend.ApplyConfiguration(&pl))
+
+	cmd := <-ts.commandChan
+	assert.True(proto.Equal(&pl, cmd.GetSetGatewayConfiguration()))
+
+	// the configuration of an other gateway is rejected
+	err := ts.backend.ApplyConfiguration(&gw.GatewayConfiguration{
+		GatewayId: "0807060504030201",
+		Version:   "1.2.3",
+	})
+	assert.EqualError(err, "gateway 0807060504030201 is not handled by concentratord (gateway_id: 0102030405060708)")
+}
+
+func (ts *BackendTestSuite) TestCommandTimeout() {
+	assert := require.New(ts.T())
+
+	pl := gw.GatewayConfiguration{
+		GatewayId: "0102030405060708",
+		Version:   "1.2.3",
+	}
+
+	err := ts.backend.ApplyConfiguration(&pl)
+	assert.EqualError(err, "send gateway configuration error: command response timeout")
+	<-ts.commandChan
+
+	// the response of the timed-out command is discarded
+	ts.respChan <- &gw.GatewayConfiguration{}
+	ts.respChan <- &gw.GatewayConfiguration{}
+
+	// the command socket has been re-dialed
+	assert.NoError(ts.backend.ApplyConfiguration(&pl))
+	<-ts.commandChan
+}
+
+func TestBackend(t *testing.T) {
+	suite.Run(t, new(BackendTestSuite))
+}
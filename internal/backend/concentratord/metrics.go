@@ -0,0 +1,26 @@
+package concentratord
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_concentratord_event_count",
+		Help: "The number of received events by the backend (per event type).",
+	}, []string{"event"})
+
+	cc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_concentratord_command_count",
+		Help: "The number of commands sent by the backend (per command type).",
+	}, []string{"command"})
+)
+
+func eventCounter(e string) prometheus.Counter {
+	return ec.With(prometheus.Labels{"event": e})
+}
+
+func commandCounter(c string) prometheus.Counter {
+	return cc.With(prometheus.Labels{"command": c})
+}
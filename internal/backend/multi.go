@@ -0,0 +1,223 @@
+package backend
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/commands"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+// multiBackend runs multiple backends concurrently. The events of all
+// backends are forwarded to the same handler funcs. Downlinks, gateway
+// configuration and raw packet-forwarder commands are routed to the backend
+// holding the gateway, which is tracked using the subscribe events.
+type multiBackend struct {
+	sync.RWMutex
+
+	backends []Backend
+	gateways map[lorawan.EUI64]Backend
+
+	subscribeEventFunc func(events.Subscribe)
+}
+
+func newMultiBackend(backends []Backend) *multiBackend {
+	m := multiBackend{
+		backends: backends,
+		gateways: make(map[lorawan.EUI64]Backend),
+	}
+
+	for i := range backends {
+		b := backends[i]
+		b.SetSubscribeEventFunc(func(pl events.Subscribe) {
+			m.handleSubscribeEvent(b, pl)
+		})
+	}
+
+	return &m
+}
+
+// Start starts all backends.
+func (m *multiBackend) Start() error {
+	for _, b := range m.backends {
+		if err := b.Start(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop stops all backends.
+func (m *multiBackend) Stop() error {
+	for _, b := range m.backends {
+		if err := b.Stop(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetDownlinkTxAckFunc sets the DownlinkTXAck handler func.
+func (m *multiBackend) SetDownlinkTxAckFunc(f func(*gw.DownlinkTxAck)) {
+	for _, b := range m.backends {
+		b.SetDownlinkTxAckFunc(f)
+	}
+}
+
+// SetGatewayStatsFunc sets the GatewayStats handler func.
+func (m *multiBackend) SetGatewayStatsFunc(f func(*gw.GatewayStats)) {
+	for _, b := range m.backends {
+		b.SetGatewayStatsFunc(f)
+	}
+}
+
+// SetUplinkFrameFunc sets the UplinkFrame handler func.
+func (m *multiBackend) SetUplinkFrameFunc(f func(*gw.UplinkFrame)) {
+	for _, b := range m.backends {
+		b.SetUplinkFrameFunc(f)
+	}
+}
+
+// SetOrderedUplinkFrameFunc sets the ordered UplinkFrame handler func for the
+// backends implementing OrderedUplinkBackend.
+func (m *multiBackend) SetOrderedUplinkFrameFunc(f func(*gw.UplinkFrame)) {
+	for _, b := range m.backends {
+		if ob, ok := b.(OrderedUplinkBackend); ok {
+			ob.SetOrderedUplinkFrameFunc(f)
+		}
+	}
+}
+
+// SetRawPacketForwarderEventFunc sets the RawPacketForwarderEvent handler func.
+func (m *multiBackend) SetRawPacketForwarderEventFunc(f func(*gw.RawPacketForwarderEvent)) {
+	for _, b := range m.backends {
+		b.SetRawPacketForwarderEventFunc(f)
+	}
+}
+
+// SetSubscribeEventFunc sets the Subscribe handler func.
+func (m *multiBackend) SetSubscribeEventFunc(f func(events.Subscribe)) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.subscribeEventFunc = f
+}
+
+// SendDownlinkFrame sends the given downlink frame using the backend holding
+// the gateway.
+func (m *multiBackend) SendDownlinkFrame(pl *gw.DownlinkFrame) error {
+	b, err := m.getBackend(pl.GetGatewayId())
+	if err != nil {
+		return err
+	}
+
+	return b.SendDownlinkFrame(pl)
+}
+
+// ApplyConfiguration applies the given configuration using the backend
+// holding the gateway. When no backend holds the gateway, the configuration
+// is applied to all backends, as a backend might store the configuration
+// until the gateway connects or write it for a gateway which is offline.
+func (m *multiBackend) ApplyConfiguration(pl *gw.GatewayConfiguration) error {
+	var gatewayID lorawan.EUI64
+	if err := gatewayID.UnmarshalText([]byte(pl.GetGatewayId())); err != nil {
+		return errors.Wrap(err, "decode gateway id error")
+	}
+
+	if b, ok := m.lookupBackend(gatewayID); ok {
+		return b.ApplyConfiguration(pl)
+	}
+
+	for _, b := range m.backends {
+		if err := b.ApplyConfiguration(pl); err != nil {
+			log.WithError(err).WithField("gateway_id", gatewayID).Debug("backend: gateway configuration not applied by backend")
+		}
+	}
+
+	return nil
+}
+
+// RawPacketForwarderCommand sends the given raw command using the backend
+// holding the gateway.
+func (m *multiBackend) RawPacketForwarderCommand(pl *gw.RawPacketForwarderCommand) error {
+	b, err := m.getBackend(pl.GetGatewayId())
+	if err != nil {
+		return err
+	}
+
+	return b.RawPacketForwarderCommand(pl)
+}
+
+// ExecuteRemoteCommand executes the given command using the backend holding
+// the gateway, when this backend supports remote command execution. When no
+// backend holds the gateway, commands.ErrRemoteExecNotSupported is returned
+// such that the command is executed on the host.
+func (m *multiBackend) ExecuteRemoteCommand(pl *gw.GatewayCommandExecRequest) error {
+	var gatewayID lorawan.EUI64
+	if err := gatewayID.UnmarshalText([]byte(pl.GetGatewayId())); err != nil {
+		return errors.Wrap(err, "decode gateway id error")
+	}
+
+	b, ok := m.lookupBackend(gatewayID)
+	if !ok {
+		return commands.ErrRemoteExecNotSupported
+	}
+
+	e, ok := b.(commands.RemoteExecutor)
+	if !ok {
+		return commands.ErrRemoteExecNotSupported
+	}
+
+	return e.ExecuteRemoteCommand(pl)
+}
+
+func (m *multiBackend) getBackend(gatewayIDStr string) (Backend, error) {
+	var gatewayID lorawan.EUI64
+	if err := gatewayID.UnmarshalText([]byte(gatewayIDStr)); err != nil {
+		return nil, errors.Wrap(err, "decode gateway id error")
+	}
+
+	b, ok := m.lookupBackend(gatewayID)
+	if !ok {
+		return nil, fmt.Errorf("gateway %s is not connected to any backend", gatewayID)
+	}
+
+	return b, nil
+}
+
+func (m *multiBackend) lookupBackend(gatewayID lorawan.EUI64) (Backend, bool) {
+	m.RLock()
+	defer m.RUnlock()
+
+	b, ok := m.gateways[gatewayID]
+	return b, ok
+}
+
+// handleSubscribeEvent keeps track of the backend holding the gateway. When a
+// gateway moves to an other backend, the unsubscribe event of the previous
+// backend is not forwarded, as the gateway is still connected.
+func (m *multiBackend) handleSubscribeEvent(b Backend, pl events.Subscribe) {
+	m.Lock()
+	if pl.Subscribe {
+		m.gateways[pl.GatewayID] = b
+	} else {
+		if current, ok := m.gateways[pl.GatewayID]; ok && current != b {
+			m.Unlock()
+
+			log.WithField("gateway_id", pl.GatewayID).Debug("backend: ignoring unsubscribe event, gateway is connected to other backend")
+			return
+		}
+		delete(m.gateways, pl.GatewayID)
+	}
+	f := m.subscribeEventFunc
+	m.Unlock()
+
+	if f != nil {
+		f(pl)
+	}
+}
@@ -0,0 +1,189 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/commands"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+type testBackend struct {
+	subscribeEventFunc func(events.Subscribe)
+	uplinkFrameFunc    func(*gw.UplinkFrame)
+
+	started        bool
+	downlinkFrames []*gw.DownlinkFrame
+	configurations []*gw.GatewayConfiguration
+}
+
+func (b *testBackend) Start() error {
+	b.started = true
+	return nil
+}
+
+func (b *testBackend) Stop() error {
+	b.started = false
+	return nil
+}
+
+func (b *testBackend) SetDownlinkTxAckFunc(f func(*gw.DownlinkTxAck)) {}
+
+func (b *testBackend) SetGatewayStatsFunc(f func(*gw.GatewayStats)) {}
+
+func (b *testBackend) SetUplinkFrameFunc(f func(*gw.UplinkFrame)) {
+	b.uplinkFrameFunc = f
+}
+
+func (b *testBackend) SetRawPacketForwarderEventFunc(f func(*gw.RawPacketForwarderEvent)) {}
+
+func (b *testBackend) SetSubscribeEventFunc(f func(events.Subscribe)) {
+	b.subscribeEventFunc = f
+}
+
+func (b *testBackend) SendDownlinkFrame(pl *gw.DownlinkFrame) error {
+	b.downlinkFrames = append(b.downlinkFrames, pl)
+	return nil
+}
+
+func (b *testBackend) ApplyConfiguration(pl *gw.GatewayConfiguration) error {
+	b.configurations = append(b.configurations, pl)
+	return nil
+}
+
+func (b *testBackend) RawPacketForwarderCommand(pl *gw.RawPacketForwarderCommand) error {
+	return nil
+}
+
+type testRemoteExecBackend struct {
+	testBackend
+
+	orderedUplinkFrameFunc func(*gw.UplinkFrame)
+	execRequests           []*gw.GatewayCommandExecRequest
+}
+
+func (b *testRemoteExecBackend) SetOrderedUplinkFrameFunc(f func(*gw.UplinkFrame)) {
+	b.orderedUplinkFrameFunc = f
+}
+
+func (b *testRemoteExecBackend) ExecuteRemoteCommand(pl *gw.GatewayCommandExecRequest) error {
+	b.execRequests = append(b.execRequests, pl)
+	return nil
+}
+
+func TestMultiBackend(t *testing.T) {
+	assert := require.New(t)
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	b1 := &testBackend{}
+	b2 := &testRemoteExecBackend{}
+
+	m := newMultiBackend([]Backend{b1, b2})
+
+	var subscribeEvents []events.Subscribe
+	m.SetSubscribeEventFunc(func(pl events.Subscribe) {
+		subscribeEvents = append(subscribeEvents, pl)
+	})
+
+	var uplinkFrames []*gw.UplinkFrame
+	m.SetUplinkFrameFunc(func(pl *gw.UplinkFrame) {
+		uplinkFrames = append(uplinkFrames, pl)
+	})
+
+	var orderedUplinkFrames []*gw.UplinkFrame
+	m.SetOrderedUplinkFrameFunc(func(pl *gw.UplinkFrame) {
+		orderedUplinkFrames = append(orderedUplinkFrames, pl)
+	})
+
+	assert.NoError(m.Start())
+	assert.True(b1.started)
+	assert.True(b2.started)
+
+	t.Run("Uplink from all backends", func(t *testing.T) {
+		assert := require.New(t)
+
+		b1.uplinkFrameFunc(&gw.UplinkFrame{PhyPayload: []byte{1}})
+		b2.uplinkFrameFunc(&gw.UplinkFrame{PhyPayload: []byte{2}})
+		assert.Len(uplinkFrames, 2)
+	})
+
+	t.Run("Ordered uplink", func(t *testing.T) {
+		assert := require.New(t)
+
+		b2.orderedUplinkFrameFunc(&gw.UplinkFrame{PhyPayload: []byte{2}})
+		assert.Len(orderedUplinkFrames, 1)
+	})
+
+	t.Run("Gateway not connected", func(t *testing.T) {
+		assert := require.New(t)
+
+		err := m.SendDownlinkFrame(&gw.DownlinkFrame{GatewayId: gatewayID.String()})
+		assert.EqualError(err, "gateway 0102030405060708 is not connected to any backend")
+
+		// the command is executed on the host
+		err = m.ExecuteRemoteCommand(&gw.GatewayCommandExecRequest{GatewayId: gatewayID.String()})
+		assert.Equal(commands.ErrRemoteExecNotSupported, err)
+
+		// the configuration is applied to all backends
+		assert.NoError(m.ApplyConfiguration(&gw.GatewayConfiguration{GatewayId: gatewayID.String()}))
+		assert.Len(b1.configurations, 1)
+		assert.Len(b2.configurations, 1)
+	})
+
+	t.Run("Gateway connected to first backend", func(t *testing.T) {
+		assert := require.New(t)
+
+		b1.subscribeEventFunc(events.Subscribe{Subscribe: true, GatewayID: gatewayID})
+		assert.Equal([]events.Subscribe{{Subscribe: true, GatewayID: gatewayID}}, subscribeEvents)
+
+		assert.NoError(m.SendDownlinkFrame(&gw.DownlinkFrame{GatewayId: gatewayID.String()}))
+		assert.Len(b1.downlinkFrames, 1)
+		assert.Len(b2.downlinkFrames, 0)
+
+		assert.NoError(m.ApplyConfiguration(&gw.GatewayConfiguration{GatewayId: gatewayID.String()}))
+		assert.Len(b1.configurations, 2)
+		assert.Len(b2.configurations, 1)
+
+		err := m.ExecuteRemoteCommand(&gw.GatewayCommandExecRequest{GatewayId: gatewayID.String()})
+		assert.Equal(commands.ErrRemoteExecNotSupported, err)
+	})
+
+	t.Run("Gateway moves to second backend", func(t *testing.T) {
+		assert := require.New(t)
+		subscribeEvents = nil
+
+		b2.subscribeEventFunc(events.Subscribe{Subscribe: true, GatewayID: gatewayID})
+		b1.subscribeEventFunc(events.Subscribe{Subscribe: false, GatewayID: gatewayID})
+
+		// the unsubscribe of the first backend is not forwarded
+		assert.Equal([]events.Subscribe{{Subscribe: true, GatewayID: gatewayID}}, subscribeEvents)
+
+		assert.NoError(m.SendDownlinkFrame(&gw.DownlinkFrame{GatewayId: gatewayID.String()}))
+		assert.Len(b1.downlinkFrames, 1)
+		assert.Len(b2.downlinkFrames, 1)
+
+		assert.NoError(m.ExecuteRemoteCommand(&gw.GatewayCommandExecRequest{GatewayId: gatewayID.String()}))
+		assert.Len(b2.execRequests, 1)
+	})
+
+	t.Run("Gateway disconnects", func(t *testing.T) {
+		assert := require.New(t)
+		subscribeEvents = nil
+
+		b2.subscribeEventFunc(events.Subscribe{Subscribe: false, GatewayID: gatewayID})
+		assert.Equal([]events.Subscribe{{Subscribe: false, GatewayID: gatewayID}}, subscribeEvents)
+
+		assert.Error(m.SendDownlinkFrame(&gw.DownlinkFrame{GatewayId: gatewayID.String()}))
+
+		err := m.ExecuteRemoteCommand(&gw.GatewayCommandExecRequest{GatewayId: gatewayID.String()})
+		assert.Equal(commands.ErrRemoteExecNotSupported, err)
+		assert.Len(b2.execRequests, 1)
+	})
+
+	assert.NoError(m.Stop())
+	assert.False(b1.started)
+	assert.False(b2.started)
+}
@@ -4,17 +4,20 @@ import (
 	"encoding/base64"
 	"fmt"
 	"net"
+	"runtime"
 	"sync"
 	"time"
 
-	"github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/semtechudp/packets"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/capture"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/commands"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/filters"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/storage"
 	"github.com/brocaar/lorawan"
 	"github.com/chirpstack/chirpstack/api/go/v4/gw"
 )
@@ -29,25 +32,59 @@ type udpPacket struct {
 type Backend struct {
 	sync.RWMutex
 
-	// Cache to temporarily store downlinks.
+	// In-flight downlinks, waiting for the TX_ACK of the gateway.
 	// This is needed since a single downlink command can contain multiple
 	// downlink opportunities (e.g. RX1 and RX2).
-	cache *cache.Cache
+	downlinks downlinks
 
 	// Callback functions for handling events.
 	downlinkTxAckFunc           func(*gw.DownlinkTxAck)
 	gatewayStatsFunc            func(*gw.GatewayStats)
 	uplinkFrameFunc             func(*gw.UplinkFrame)
+	orderedUplinkFrameFunc      func(*gw.UplinkFrame)
 	rawPacketForwarderEventFunc func(*gw.RawPacketForwarderEvent)
 
 	udpSendChan chan udpPacket
 
+	// Workers handling the received UDP packets.
+	workers *workerPool
+
 	wg           sync.WaitGroup
+	done         chan struct{}
+	store        *storage.Store
 	conn         *net.UDPConn
+	batchConn    *batchConn
+	batchSize    int
 	closed       bool
 	gateways     gateways
 	fakeRxTime   bool
 	skipCRCCheck bool
+
+	// Allowed gateway IDs, all gateways are allowed when empty.
+	gatewayIDs map[lorawan.EUI64]struct{}
+
+	// Network masks used for address pinning, pinning is disabled when nil.
+	pinIPv4Mask net.IPMask
+	pinIPv6Mask net.IPMask
+
+	// Fine-timestamp AES keys per gateway, indexed by AES key index.
+	fineTimestampKeys map[lorawan.EUI64]map[uint8]lorawan.AES128Key
+
+	// Upstream servers to which the gateway traffic is relayed.
+	relay relay
+
+	// Recently received PUSH_DATA packets, for detecting retransmissions.
+	pushDataDedup pushDataDedup
+
+	// Capture of the gateway traffic, nil when disabled.
+	capture *capture.Writer
+
+	// When replaying a capture, the packets are not sent to the gateways.
+	replay bool
+
+	// Packet-forwarder configuration per gateway.
+	configurationsMux sync.RWMutex
+	configurations    map[lorawan.EUI64]*pfConfiguration
 }
 
 // NewBackend creates a new backend.
@@ -63,28 +100,187 @@ func NewBackend(conf config.Config) (*Backend, error) {
 		return nil, errors.Wrap(err, "listen udp error")
 	}
 
+	workers := conf.Backend.SemtechUDP.Workers
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+
+	queueSize := conf.Backend.SemtechUDP.QueueSize
+	if queueSize == 0 {
+		queueSize = 1024
+	}
+
+	batchSize := conf.Backend.SemtechUDP.BatchSize
+	if batchSize == 0 {
+		batchSize = 32
+	}
+
+	switch conf.Backend.SemtechUDP.OverflowPolicy {
+	case "", overflowDropNewest, overflowDropOldest:
+	default:
+		return nil, fmt.Errorf("invalid overflow_policy: %s", conf.Backend.SemtechUDP.OverflowPolicy)
+	}
+
+	store, err := storage.Open(conf.Backend.Storage.Directory, "semtechudp")
+	if err != nil {
+		return nil, errors.Wrap(err, "open storage error")
+	}
+
+	captureWriter, err := capture.NewWriter(conf.Backend.SemtechUDP.Capture.File, conf.Backend.SemtechUDP.Capture.MaxSize, conf.Backend.SemtechUDP.Capture.MaxFiles)
+	if err != nil {
+		return nil, errors.Wrap(err, "new capture writer error")
+	}
+
 	b := &Backend{
+		store:       store,
+		capture:     captureWriter,
 		conn:        conn,
-		udpSendChan: make(chan udpPacket),
+		batchConn:   newBatchConn(conn, batchSize),
+		batchSize:   batchSize,
+		udpSendChan: make(chan udpPacket, queueSize),
+		done:        make(chan struct{}),
+		workers:     newWorkerPool(workers, queueSize, conf.Backend.SemtechUDP.OverflowPolicy),
 		gateways: gateways{
 			gateways:                  make(map[lorawan.EUI64]gateway),
 			connectionTimeoutDuration: conf.Backend.SemtechUDP.ConnectionTimeoutDuration,
+			pins:                      make(map[lorawan.EUI64]addressPin),
+			store:                     store,
 		},
-		fakeRxTime:   conf.Backend.SemtechUDP.FakeRxTime,
-		skipCRCCheck: conf.Backend.SemtechUDP.SkipCRCCheck,
-		cache: cache.New(
-			conf.Backend.SemtechUDP.CacheDefaultExpiration,
-			conf.Backend.SemtechUDP.CacheCleanupInterval,
-		),
+		fakeRxTime:     conf.Backend.SemtechUDP.FakeRxTime,
+		skipCRCCheck:   conf.Backend.SemtechUDP.SkipCRCCheck,
+		downlinks:      newDownlinks(conf.Backend.SemtechUDP.CacheDefaultExpiration),
+		pushDataDedup:  newPushDataDedup(conf.Backend.SemtechUDP.PushDataDedupWindow),
+		configurations: make(map[lorawan.EUI64]*pfConfiguration),
+		gatewayIDs:     make(map[lorawan.EUI64]struct{}),
+
+		fineTimestampKeys: make(map[lorawan.EUI64]map[uint8]lorawan.AES128Key),
+	}
+
+	for _, s := range conf.Backend.SemtechUDP.GatewayIDs {
+		var gatewayID lorawan.EUI64
+		if err := gatewayID.UnmarshalText([]byte(s)); err != nil {
+			return nil, errors.Wrap(err, "unmarshal gateway id error")
+		}
+		b.gatewayIDs[gatewayID] = struct{}{}
+	}
+
+	if conf.Backend.SemtechUDP.AddressPinning.Enabled {
+		ipv4Len := conf.Backend.SemtechUDP.AddressPinning.IPv4PrefixLength
+		ipv6Len := conf.Backend.SemtechUDP.AddressPinning.IPv6PrefixLength
+		if ipv4Len < 0 || ipv4Len > 32 || ipv6Len < 0 || ipv6Len > 128 {
+			return nil, errors.New("invalid address pinning prefix length")
+		}
+
+		b.pinIPv4Mask = net.CIDRMask(ipv4Len, 32)
+		b.pinIPv6Mask = net.CIDRMask(ipv6Len, 128)
+	}
+
+	for _, k := range conf.Backend.SemtechUDP.FineTimestampKeys {
+		var gatewayID lorawan.EUI64
+		if err := gatewayID.UnmarshalText([]byte(k.GatewayID)); err != nil {
+			return nil, errors.Wrap(err, "unmarshal gateway id error")
+		}
+
+		var key lorawan.AES128Key
+		if err := key.UnmarshalText([]byte(k.Key)); err != nil {
+			return nil, errors.Wrap(err, "unmarshal fine-timestamp key error")
+		}
+
+		if _, ok := b.fineTimestampKeys[gatewayID]; !ok {
+			b.fineTimestampKeys[gatewayID] = make(map[uint8]lorawan.AES128Key)
+		}
+		b.fineTimestampKeys[gatewayID][k.AESK] = key
+	}
+
+	var upstreams []relayUpstream
+	var downlinkUpstream bool
+	for _, r := range conf.Backend.SemtechUDP.Relay {
+		addr, err := net.ResolveUDPAddr("udp", r.Server)
+		if err != nil {
+			return nil, errors.Wrap(err, "resolve relay server addr error")
+		}
+
+		if r.Downlink {
+			if downlinkUpstream {
+				return nil, errors.New("downlink can only be enabled for one relay server")
+			}
+			downlinkUpstream = true
+		}
+
+		upstreams = append(upstreams, relayUpstream{
+			addr:     addr,
+			downlink: r.Downlink,
+		})
+
+		log.WithFields(log.Fields{
+			"server":   addr,
+			"downlink": r.Downlink,
+		}).Info("backend/semtechudp: relay server configured")
+	}
+	b.downlinks.store = store
+	b.relay = newRelay(upstreams, conf.Backend.SemtechUDP.ConnectionTimeoutDuration)
+
+	for _, pfConf := range conf.Backend.SemtechUDP.Configuration {
+		c := pfConfiguration{
+			baseFile:       pfConf.BaseFile,
+			outputFile:     pfConf.OutputFile,
+			restartCommand: pfConf.RestartCommand,
+		}
+		if err := c.gatewayID.UnmarshalText([]byte(pfConf.GatewayID)); err != nil {
+			return nil, errors.Wrap(err, "unmarshal gateway id error")
+		}
+		if c.outputFile == "" {
+			return nil, fmt.Errorf("output_file must be set for gateway %s", c.gatewayID)
+		}
+
+		b.configurations[c.gatewayID] = &c
+
+		log.WithFields(log.Fields{
+			"gateway_id":      c.gatewayID,
+			"base_file":       c.baseFile,
+			"output_file":     c.outputFile,
+			"restart_command": c.restartCommand,
+		}).Info("backend/semtechudp: packet-forwarder configuration configured")
+	}
+
+	cleanupInterval := conf.Backend.SemtechUDP.CacheCleanupInterval
+	if cleanupInterval == 0 {
+		cleanupInterval = time.Second
 	}
 
+	// The cleanup goroutines must be stopped before closing the store, as
+	// these delete the expired gateways and downlinks.
+	b.wg.Add(2)
 	go func() {
+		defer b.wg.Done()
+
 		for {
 			log.Debug("backend/semtechudp: cleanup gateway registry")
 			if err := b.gateways.cleanup(); err != nil {
 				log.WithError(err).Error("backend/semtechudp: gateway registry cleanup failed")
 			}
-			time.Sleep(time.Minute)
+			b.relay.cleanup()
+
+			select {
+			case <-b.done:
+				return
+			case <-time.After(time.Minute):
+			}
+		}
+	}()
+
+	go func() {
+		defer b.wg.Done()
+
+		for {
+			select {
+			case <-b.done:
+				return
+			case <-time.After(cleanupInterval):
+			}
+
+			b.handleExpiredDownlinks()
+			b.pushDataDedup.cleanup()
 		}
 	}()
 
@@ -93,6 +289,25 @@ func NewBackend(conf config.Config) (*Backend, error) {
 
 // Start stats the backend.
 func (b *Backend) Start() error {
+	// The gateways are restored on start, as the subscribe events must be
+	// handled by the integration.
+	b.downlinks.startStoreLoop()
+	if err := b.gateways.restore(); err != nil {
+		return errors.Wrap(err, "restore gateways error")
+	}
+	if err := b.downlinks.restore(); err != nil {
+		return errors.Wrap(err, "restore downlinks error")
+	}
+
+	b.workers.start(func(up udpPacket) {
+		if err := b.handlePacket(up); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"data_base64": base64.StdEncoding.EncodeToString(up.data),
+				"addr":        up.addr,
+			}).Error("backend/semtechudp: could not handle packet")
+		}
+	}, b.publishUplinkFrame)
+
 	// Add the waitgroups before the goroutines or a race occurs with closing
 	b.wg.Add(2)
 	go func() {
@@ -125,10 +340,26 @@ func (b *Backend) Stop() error {
 		return errors.Wrap(err, "close udp listener error")
 	}
 
+	close(b.done)
+
+	b.relay.close()
+
 	log.Info("backend/semtechudp: handling last packets")
 	close(b.udpSendChan)
 	b.Unlock()
 	b.wg.Wait()
+
+	// write the pending downlink changes before closing the store
+	b.downlinks.stopStoreLoop()
+
+	if err := b.store.Close(); err != nil {
+		return errors.Wrap(err, "close storage error")
+	}
+
+	if err := b.capture.Close(); err != nil {
+		return errors.Wrap(err, "close capture error")
+	}
+
 	return nil
 }
 
@@ -147,6 +378,13 @@ func (b *Backend) SetUplinkFrameFunc(f func(*gw.UplinkFrame)) {
 	b.uplinkFrameFunc = f
 }
 
+// SetOrderedUplinkFrameFunc sets the UplinkFrame handler func which is called
+// in order for the uplinks of a gateway. When set, it is used instead of the
+// func set by SetUplinkFrameFunc.
+func (b *Backend) SetOrderedUplinkFrameFunc(f func(*gw.UplinkFrame)) {
+	b.orderedUplinkFrameFunc = f
+}
+
 // SetSubscribeEventFunc sets the Subscribe handler func.
 func (b *Backend) SetSubscribeEventFunc(f func(events.Subscribe)) {
 	b.gateways.subscribeEventFunc = f
@@ -174,14 +412,6 @@ func (b *Backend) sendDownlinkFrame(frame *gw.DownlinkFrame, i int, txAckItems [
 		return errors.New("invalid downlink frame item index")
 	}
 
-	// Make sure the token is truncated to an uint16.
-	token := uint16(frame.DownlinkId)
-
-	// create cache items
-	b.cache.Set(fmt.Sprintf("%d:ack", token), txAckItems, cache.DefaultExpiration)
-	b.cache.Set(fmt.Sprintf("%d:frame", token), frame, cache.DefaultExpiration)
-	b.cache.Set(fmt.Sprintf("%d:index", token), i, cache.DefaultExpiration)
-
 	var gatewayID lorawan.EUI64
 	if err := gatewayID.UnmarshalText([]byte(frame.GetGatewayId())); err != nil {
 		return errors.Wrap(err, "decode gateway id error")
@@ -192,13 +422,30 @@ func (b *Backend) sendDownlinkFrame(frame *gw.DownlinkFrame, i int, txAckItems [
 		return errors.Wrap(err, "get gateway error")
 	}
 
+	// The token is allocated by the in-flight downlinks registry, such that
+	// it is unique per gateway. Protocol version 1 does not implement the
+	// TX_ACK, in which case the downlink is not tracked.
+	var token uint16
+	if gw.protocolVersion != packets.ProtocolVersion1 {
+		token, err = b.downlinks.add(gatewayID, downlink{
+			frame:      frame,
+			index:      i,
+			txAckItems: txAckItems,
+		})
+		if err != nil {
+			return errors.Wrap(err, "add downlink error")
+		}
+	}
+
 	pullResp, err := packets.GetPullRespPacket(gw.protocolVersion, token, frame, i)
 	if err != nil {
+		b.downlinks.pop(gatewayID, token)
 		return errors.Wrap(err, "get PullRespPacket error")
 	}
 
 	bytes, err := pullResp.MarshalBinary()
 	if err != nil {
+		b.downlinks.pop(gatewayID, token)
 		return errors.Wrap(err, "backend/semtechudp: marshal PullRespPacket error")
 	}
 
@@ -209,11 +456,86 @@ func (b *Backend) sendDownlinkFrame(frame *gw.DownlinkFrame, i int, txAckItems [
 	return nil
 }
 
-// ApplyConfiguration is not implemented.
+// ApplyConfiguration writes the given configuration to the packet-forwarder
+// configuration file and restarts the packet-forwarder. The result is
+// published as exec event.
 func (b *Backend) ApplyConfiguration(config *gw.GatewayConfiguration) error {
+	var gatewayID lorawan.EUI64
+	if err := gatewayID.UnmarshalText([]byte(config.GetGatewayId())); err != nil {
+		return errors.Wrap(err, "decode gateway id error")
+	}
+
+	b.configurationsMux.RLock()
+	pfConfig, ok := b.configurations[gatewayID]
+	var currentVersion string
+	if ok {
+		currentVersion = pfConfig.currentVersion
+	}
+	b.configurationsMux.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("no packet-forwarder configuration for gateway %s", gatewayID)
+	}
+
+	if currentVersion == config.GetVersion() {
+		log.WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"version":    config.GetVersion(),
+		}).Debug("backend/semtechudp: gateway configuration is up-to-date")
+		return nil
+	}
+
+	if err := pfConfig.writeConfiguration(config); err != nil {
+		err = errors.Wrap(err, "write configuration error")
+		commands.PublishExecResponse(&gw.GatewayCommandExecResponse{
+			GatewayId: gatewayID.String(),
+			Error:     err.Error(),
+		})
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id":  gatewayID,
+		"version":     config.GetVersion(),
+		"output_file": pfConfig.outputFile,
+	}).Info("backend/semtechudp: new packet-forwarder configuration written")
+
+	if pfConfig.restartCommand != "" {
+		resp := commands.ExecuteCommand(&gw.GatewayCommandExecRequest{
+			GatewayId: gatewayID.String(),
+			Command:   pfConfig.restartCommand,
+		})
+		if resp.GetError() != "" {
+			return fmt.Errorf("restart packet-forwarder error: %s", resp.GetError())
+		}
+	} else {
+		commands.PublishExecResponse(&gw.GatewayCommandExecResponse{
+			GatewayId: gatewayID.String(),
+		})
+	}
+
+	b.configurationsMux.Lock()
+	pfConfig.currentVersion = config.GetVersion()
+	b.configurationsMux.Unlock()
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"version":    config.GetVersion(),
+	}).Info("backend/semtechudp: gateway configuration applied")
+
 	return nil
 }
 
+func (b *Backend) getConfigurationVersion(gatewayID lorawan.EUI64) string {
+	b.configurationsMux.RLock()
+	defer b.configurationsMux.RUnlock()
+
+	if c, ok := b.configurations[gatewayID]; ok {
+		return c.currentVersion
+	}
+	return ""
+}
+
 // RawPacketForwarderCommand sends the given raw command to the packet-forwarder.
 func (b *Backend) RawPacketForwarderCommand(*gw.RawPacketForwarderCommand) error {
 	return errors.New("raw packet-forwarder command not implemented by Semtech packet-forwarder")
@@ -225,10 +547,18 @@ func (b *Backend) isClosed() bool {
 	return b.closed
 }
 
+func (b *Backend) isReplay() bool {
+	b.RLock()
+	defer b.RUnlock()
+	return b.replay
+}
+
 func (b *Backend) readPackets() error {
-	buf := make([]byte, 65507) // max udp data size
+	// handle the queued packets before returning
+	defer b.workers.close()
+
 	for {
-		i, addr, err := b.conn.ReadFromUDP(buf)
+		pkts, err := b.batchConn.readBatch()
 		if err != nil {
 			if b.isClosed() {
 				return nil
@@ -237,24 +567,44 @@ func (b *Backend) readPackets() error {
 			log.WithError(err).Error("gateway: read from udp error")
 			continue
 		}
-		data := make([]byte, i)
-		copy(data, buf[:i])
-		up := udpPacket{data: data, addr: addr}
-
-		// handle packet async
-		go func(up udpPacket) {
-			if err := b.handlePacket(up); err != nil {
-				log.WithError(err).WithFields(log.Fields{
-					"data_base64": base64.StdEncoding.EncodeToString(up.data),
-					"addr":        up.addr,
-				}).Error("backend/semtechudp: could not handle packet")
-			}
-		}(up)
+
+		for _, up := range pkts {
+			b.captureDatagram(capture.DirectionIn, up)
+			b.workers.enqueue(up)
+		}
 	}
 }
 
 func (b *Backend) sendPackets() error {
+	batch := make([]udpPacket, 0, b.batchSize)
+
 	for p := range b.udpSendChan {
+		batch = append(batch[:0], p)
+
+		// Add the packets that are already queued to the batch, without
+		// waiting for new packets.
+	queued:
+		for len(batch) < b.batchSize {
+			select {
+			case p, ok := <-b.udpSendChan:
+				if !ok {
+					break queued
+				}
+				batch = append(batch, p)
+			default:
+				break queued
+			}
+		}
+
+		b.writePackets(batch)
+	}
+	return nil
+}
+
+func (b *Backend) writePackets(batch []udpPacket) {
+	out := make([]udpPacket, 0, len(batch))
+
+	for _, p := range batch {
 		pt, err := packets.GetPacketType(p.data)
 		if err != nil {
 			log.WithError(err).WithFields(log.Fields{
@@ -270,18 +620,18 @@ func (b *Backend) sendPackets() error {
 			"protocol_version": p.data[0],
 		}).Debug("backend/semtechudp: sending udp packet to gateway")
 
-		_, err = b.conn.WriteToUDP(p.data, p.addr)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"addr":             p.addr,
-				"type":             pt,
-				"protocol_version": p.data[0],
-			}).WithError(err).Error("backend/semtechudp: write to udp error")
-		}
-
 		udpWriteCounter(pt.String()).Inc()
+		b.captureDatagram(capture.DirectionOut, p)
+		out = append(out, p)
+	}
+
+	if b.isReplay() {
+		return
+	}
+
+	if err := b.batchConn.writeBatch(out); err != nil {
+		log.WithError(err).Error("backend/semtechudp: write udp packets error")
 	}
-	return nil
 }
 
 func (b *Backend) handlePacket(up udpPacket) error {
@@ -316,11 +666,47 @@ func (b *Backend) handlePacket(up udpPacket) error {
 	}
 }
 
+// allowPacket returns true when the packet is from an allowed gateway and,
+// when address pinning is enabled, the packet is received from the pinned
+// network of the gateway. Rejected packets are logged and dropped.
+func (b *Backend) allowPacket(gatewayID lorawan.EUI64, up udpPacket) bool {
+	if len(b.gatewayIDs) != 0 {
+		if _, ok := b.gatewayIDs[gatewayID]; !ok {
+			packetRejectedCounter("unknown_gateway").Inc()
+			log.WithFields(log.Fields{
+				"gateway_id": gatewayID,
+				"addr":       up.addr,
+			}).Warning("backend/semtechudp: packet from unknown gateway rejected")
+			return false
+		}
+	}
+
+	if b.pinIPv4Mask != nil {
+		if err := b.gateways.pin(gatewayID, up.addr.IP, b.pinIPv4Mask, b.pinIPv6Mask); err != nil {
+			packetRejectedCounter("address_mismatch").Inc()
+			log.WithError(err).WithFields(log.Fields{
+				"gateway_id": gatewayID,
+				"addr":       up.addr,
+			}).Warning("backend/semtechudp: packet from unexpected address rejected")
+			return false
+		}
+	}
+
+	return true
+}
+
 func (b *Backend) handlePullData(up udpPacket) error {
 	var p packets.PullDataPacket
 	if err := p.UnmarshalBinary(up.data); err != nil {
 		return err
 	}
+
+	if !b.allowPacket(p.GatewayMAC, up) {
+		return nil
+	}
+
+	b.relayPacket(p.GatewayMAC, up.data)
+
 	ack := packets.PullACKPacket{
 		ProtocolVersion: p.ProtocolVersion,
 		RandomToken:     p.RandomToken,
@@ -352,42 +738,26 @@ func (b *Backend) handleTXACK(up udpPacket) error {
 		return err
 	}
 
-	// get downlink frame from cache
-	var frame *gw.DownlinkFrame
-	v, ok := b.cache.Get(fmt.Sprintf("%d:frame", p.RandomToken))
-	if !ok {
-		return fmt.Errorf("no internal frame cache for token %d", p.RandomToken)
-	}
-	if df, ok := v.(*gw.DownlinkFrame); ok {
-		frame = df
-	} else {
-		return fmt.Errorf("expected *gw.DownlinkFrame, got: %T", v)
+	if !b.allowPacket(p.GatewayMAC, up) {
+		return nil
 	}
 
-	// get current downlink frame item from cache
-	var itemIndex int
-	v, ok = b.cache.Get(fmt.Sprintf("%d:index", p.RandomToken))
-	if !ok {
-		return fmt.Errorf("no internal index cache for token %d", p.RandomToken)
-	}
-	if ii, ok := v.(int); ok {
-		itemIndex = ii
-	} else {
-		return fmt.Errorf("expected int, got: %T", v)
+	// get the in-flight downlink
+	dl, err := b.downlinks.pop(p.GatewayMAC, p.RandomToken)
+	if err != nil {
+		return errors.Wrapf(err, "get downlink error (token: %d)", p.RandomToken)
 	}
 
-	// get downlink tx acknowledgement items from cache
-	var txAckItems []*gw.DownlinkTxAckItem
-	v, ok = b.cache.Get(fmt.Sprintf("%d:ack", p.RandomToken))
-	if !ok {
-		return fmt.Errorf("no internal tx ack cache for token %d", p.RandomToken)
-	}
-	if items, ok := v.([]*gw.DownlinkTxAckItem); ok {
-		txAckItems = items
-	} else {
-		return fmt.Errorf("expected []*gw.DownlinkTXAckItem, got: %T", items)
+	// downlink proxied from a relay upstream
+	if dl.relay != nil {
+		b.handleRelayTXACK(dl, up.data)
+		return nil
 	}
 
+	frame := dl.frame
+	itemIndex := dl.index
+	txAckItems := dl.txAckItems
+
 	// validate that the data is sane
 	if itemIndex > len(txAckItems)-1 || len(txAckItems) != len(frame.Items) {
 		return errors.New("cache items are out of sync")
@@ -442,12 +812,57 @@ func (b *Backend) handleTXACK(up udpPacket) error {
 	return nil
 }
 
+// handleExpiredDownlinks reports the downlinks for which no TX_ACK was
+// received within the timeout. As the downlink opportunities have passed,
+// the remaining items are not sent.
+func (b *Backend) handleExpiredDownlinks() {
+	for _, dl := range b.downlinks.cleanup() {
+		downlinkTimeoutCounter().Inc()
+
+		// the TX_ACK timeout is handled by the relay upstream
+		if dl.relay != nil {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"gateway_id":  dl.frame.GetGatewayId(),
+			"downlink_id": dl.frame.GetDownlinkId(),
+		}).Warning("backend/semtechudp: no tx ack received for downlink")
+
+		if dl.index < len(dl.txAckItems) {
+			dl.txAckItems[dl.index] = &gw.DownlinkTxAckItem{
+				Status: gw.TxAckStatus_INTERNAL_ERROR,
+			}
+		}
+
+		if b.downlinkTxAckFunc != nil {
+			b.downlinkTxAckFunc(&gw.DownlinkTxAck{
+				GatewayId:  dl.frame.GetGatewayId(),
+				DownlinkId: dl.frame.GetDownlinkId(),
+				Items:      dl.txAckItems,
+			})
+		}
+	}
+}
+
 func (b *Backend) handlePushData(up udpPacket) error {
 	var p packets.PushDataPacket
 	if err := p.UnmarshalBinary(up.data); err != nil {
 		return err
 	}
 
+	// the packet is not acknowledged when rejected
+	if !b.allowPacket(p.GatewayMAC, up) {
+		return nil
+	}
+
+	// A retransmitted packet is acknowledged, as the previous PUSH_ACK
+	// might have been lost, but it is not handled again.
+	duplicate := b.pushDataDedup.isDuplicate(p.GatewayMAC, p.RandomToken, up.data[12:])
+	if !duplicate {
+		b.relayPacket(p.GatewayMAC, up.data)
+	}
+
 	// ack the packet
 	ack := packets.PushACKPacket{
 		ProtocolVersion: p.ProtocolVersion,
@@ -462,6 +877,15 @@ func (b *Backend) handlePushData(up udpPacket) error {
 		data: bytes,
 	}
 
+	if duplicate {
+		pushDataDuplicateCounter(p.GatewayMAC).Inc()
+		log.WithFields(log.Fields{
+			"gateway_id":   p.GatewayMAC,
+			"random_token": p.RandomToken,
+		}).Debug("backend/semtechudp: duplicate push data packet ignored")
+		return nil
+	}
+
 	// gateway stats
 	stats, err := p.GetGatewayStats()
 	if err != nil {
@@ -474,7 +898,7 @@ func (b *Backend) handlePushData(up udpPacket) error {
 	}
 
 	// uplink frames
-	uplinkFrames, err := p.GetUplinkFrames(b.skipCRCCheck, b.fakeRxTime)
+	uplinkFrames, err := p.GetUplinkFrames(b.skipCRCCheck, b.fakeRxTime, b.getFineTimestampDecryptFunc(p.GatewayMAC))
 	if err != nil {
 		return errors.Wrap(err, "get uplink frames error")
 	}
@@ -483,6 +907,41 @@ func (b *Backend) handlePushData(up udpPacket) error {
 	return nil
 }
 
+// getFineTimestampDecryptFunc returns the function for decrypting the
+// encrypted fine-timestamps of the given gateway, or nil when no keys have
+// been configured for the gateway.
+func (b *Backend) getFineTimestampDecryptFunc(gatewayID lorawan.EUI64) packets.FineTimestampDecryptFunc {
+	keys, ok := b.fineTimestampKeys[gatewayID]
+	if !ok {
+		return nil
+	}
+
+	return func(aesk uint8, etime []byte) (uint32, bool) {
+		key, ok := keys[aesk]
+		if !ok {
+			fineTimestampDecryptCounter("unknown_key").Inc()
+			log.WithFields(log.Fields{
+				"gateway_id": gatewayID,
+				"aesk":       aesk,
+			}).Warning("backend/semtechudp: no fine-timestamp key configured for aes key index")
+			return 0, false
+		}
+
+		nanos, err := packets.DecryptFineTimestamp(key, etime)
+		if err != nil {
+			fineTimestampDecryptCounter("error").Inc()
+			log.WithError(err).WithFields(log.Fields{
+				"gateway_id": gatewayID,
+				"aesk":       aesk,
+			}).Warning("backend/semtechudp: decrypt fine-timestamp error")
+			return 0, false
+		}
+
+		fineTimestampDecryptCounter("ok").Inc()
+		return nanos, true
+	}
+}
+
 func (b *Backend) handleStats(gatewayID lorawan.EUI64, stats *gw.GatewayStats) {
 	if conn, err := b.gateways.get(gatewayID); err == nil {
 		s := conn.stats.ExportStats()
@@ -496,11 +955,23 @@ func (b *Backend) handleStats(gatewayID lorawan.EUI64, stats *gw.GatewayStats) {
 		stats.TxPacketsPerStatus = s.TxPacketsPerStatus
 	}
 
+	stats.ConfigVersion = b.getConfigurationVersion(gatewayID)
+
 	if b.gatewayStatsFunc != nil {
 		b.gatewayStatsFunc(stats)
 	}
 }
 
+// publishUplinkFrame is called by the workers for each uplink frame added to
+// the publish queue.
+func (b *Backend) publishUplinkFrame(pl *gw.UplinkFrame) {
+	if b.orderedUplinkFrameFunc != nil {
+		b.orderedUplinkFrameFunc(pl)
+	} else if b.uplinkFrameFunc != nil {
+		b.uplinkFrameFunc(pl)
+	}
+}
+
 func (b *Backend) handleUplinkFrames(uplinkFrames []*gw.UplinkFrame) error {
 	for i := range uplinkFrames {
 		var gatewayID lorawan.EUI64
@@ -513,9 +984,7 @@ func (b *Backend) handleUplinkFrames(uplinkFrames []*gw.UplinkFrame) error {
 		}
 
 		if filters.MatchFilters(uplinkFrames[i].PhyPayload) {
-			if b.uplinkFrameFunc != nil {
-				b.uplinkFrameFunc(uplinkFrames[i])
-			}
+			b.workers.publish(gatewayID, uplinkFrames[i])
 		} else {
 			log.WithFields(log.Fields{
 				"data_base64": base64.StdEncoding.EncodeToString(uplinkFrames[i].PhyPayload),
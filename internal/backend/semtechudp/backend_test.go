@@ -1,14 +1,16 @@
 package semtechudp
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
-	"github.com/patrickmn/go-cache"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -17,6 +19,7 @@ import (
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/semtechudp/packets"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/capture"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
 	"github.com/brocaar/lorawan"
 	"github.com/chirpstack/chirpstack/api/go/v4/common"
@@ -43,22 +46,50 @@ func (ts *BackendTestSuite) SetupTest() {
 	ts.tempDir, err = ioutil.TempDir("", "test")
 	assert.NoError(err)
 
+	ts.newBackend(ts.config())
+	ts.startBackend()
+
+	gwAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	assert.NoError(err)
+
+	ts.gwUDPConn, err = net.ListenUDP("udp", gwAddr)
+	assert.NoError(err)
+	assert.NoError(ts.gwUDPConn.SetDeadline(time.Now().Add(time.Second)))
+}
+
+// config returns the backend configuration used by SetupTest.
+func (ts *BackendTestSuite) config() config.Config {
 	var conf config.Config
 	conf.Backend.SemtechUDP.UDPBind = "127.0.0.1:0"
+	conf.Backend.SemtechUDP.CacheDefaultExpiration = time.Minute
+	return conf
+}
 
+// newBackend creates the backend using the given configuration.
+func (ts *BackendTestSuite) newBackend(conf config.Config) {
+	var err error
 	ts.backend, err = NewBackend(conf)
-	assert.NoError(err)
+	require.New(ts.T()).NoError(err)
+}
+
+// startBackend starts the backend.
+func (ts *BackendTestSuite) startBackend() {
+	var err error
+	assert := require.New(ts.T())
+
 	assert.NoError(ts.backend.Start())
 
 	ts.backendUDPAddr, err = net.ResolveUDPAddr("udp", ts.backend.conn.LocalAddr().String())
 	assert.NoError(err)
+}
 
-	gwAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
-	assert.NoError(err)
-
-	ts.gwUDPConn, err = net.ListenUDP("udp", gwAddr)
-	assert.NoError(err)
-	assert.NoError(ts.gwUDPConn.SetDeadline(time.Now().Add(time.Second)))
+// replaceBackend stops the backend started by SetupTest and replaces it by a
+// backend using the given configuration, which must be started using
+// startBackend. Settings and handler funcs must not be changed after the
+// backend has been started, as these are read by the handler goroutines.
+func (ts *BackendTestSuite) replaceBackend(conf config.Config) {
+	require.New(ts.T()).NoError(ts.backend.Stop())
+	ts.newBackend(conf)
 }
 
 func (ts *BackendTestSuite) TearDownTest() {
@@ -174,14 +205,13 @@ func (ts *BackendTestSuite) TestTXAck() {
 				ackChan <- pl
 			})
 
-			ts.backend.cache.Set("12345:ack", make([]*gw.DownlinkTxAckItem, 1), cache.DefaultExpiration)
-			ts.backend.cache.Set("12345:frame", &gw.DownlinkFrame{
+			ts.setDownlink(12345, &gw.DownlinkFrame{
+				GatewayId:  "0102030405060708",
 				DownlinkId: 12345,
 				Items: []*gw.DownlinkFrameItem{
 					{},
 				},
-			}, cache.DefaultExpiration)
-			ts.backend.cache.Set("12345:index", 0, cache.DefaultExpiration)
+			}, make([]*gw.DownlinkTxAckItem, 1))
 
 			b, err := test.GatewayPacket.MarshalBinary()
 			assert.NoError(err)
@@ -216,7 +246,7 @@ func (ts *BackendTestSuite) TestTXAckRetryFailOK() {
 	assert.Equal(p.ProtocolVersion, ack.ProtocolVersion)
 
 	// set cache
-	ts.backend.cache.Set("12345:frame", &gw.DownlinkFrame{
+	ts.setDownlink(12345, &gw.DownlinkFrame{
 		Items: []*gw.DownlinkFrameItem{
 			{
 				PhyPayload: []byte{1, 2, 3, 4},
@@ -271,12 +301,10 @@ func (ts *BackendTestSuite) TestTXAckRetryFailOK() {
 		},
 		DownlinkId: 12345,
 		GatewayId:  "0102030405060708",
-	}, cache.DefaultExpiration)
-	ts.backend.cache.Set("12345:index", 0, cache.DefaultExpiration)
-	ts.backend.cache.Set("12345:ack", []*gw.DownlinkTxAckItem{
+	}, []*gw.DownlinkTxAckItem{
 		{Status: gw.TxAckStatus_IGNORED},
 		{Status: gw.TxAckStatus_IGNORED},
-	}, cache.DefaultExpiration)
+	})
 
 	// send a nack on the first downlink attempt
 	ack1 := packets.TXACKPacket{
@@ -302,7 +330,7 @@ func (ts *BackendTestSuite) TestTXAckRetryFailOK() {
 	assert.NoError(pullResp.UnmarshalBinary(buf[:i]))
 	assert.Equal(packets.PullRespPacket{
 		ProtocolVersion: packets.ProtocolVersion2,
-		RandomToken:     12345,
+		RandomToken:     pullResp.RandomToken,
 		Payload: packets.PullRespPayload{
 			TXPK: packets.TXPK{
 				Tmst: &tmst,
@@ -324,7 +352,7 @@ func (ts *BackendTestSuite) TestTXAckRetryFailOK() {
 	// send an ack on the second downlink attempt
 	ack2 := packets.TXACKPacket{
 		ProtocolVersion: packets.ProtocolVersion2,
-		RandomToken:     12345,
+		RandomToken:     pullResp.RandomToken,
 		GatewayMAC:      [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
 		Payload: &packets.TXACKPayload{
 			TXPKACK: packets.TXPKACK{
@@ -380,7 +408,7 @@ func (ts *BackendTestSuite) TestTXAckRetryFailFail() {
 	assert.Equal(p.ProtocolVersion, ack.ProtocolVersion)
 
 	// set cache
-	ts.backend.cache.Set("12345:frame", &gw.DownlinkFrame{
+	ts.setDownlink(12345, &gw.DownlinkFrame{
 		Items: []*gw.DownlinkFrameItem{
 			{
 				PhyPayload: []byte{1, 2, 3, 4},
@@ -435,12 +463,10 @@ func (ts *BackendTestSuite) TestTXAckRetryFailFail() {
 		},
 		DownlinkId: 12345,
 		GatewayId:  "0102030405060708",
-	}, cache.DefaultExpiration)
-	ts.backend.cache.Set("12345:index", 0, cache.DefaultExpiration)
-	ts.backend.cache.Set("12345:ack", []*gw.DownlinkTxAckItem{
+	}, []*gw.DownlinkTxAckItem{
 		{Status: gw.TxAckStatus_IGNORED},
 		{Status: gw.TxAckStatus_IGNORED},
-	}, cache.DefaultExpiration)
+	})
 
 	// Create ack channel
 	ackChan := make(chan *gw.DownlinkTxAck, 1)
@@ -472,7 +498,7 @@ func (ts *BackendTestSuite) TestTXAckRetryFailFail() {
 	assert.NoError(pullResp.UnmarshalBinary(buf[:i]))
 	assert.Equal(packets.PullRespPacket{
 		ProtocolVersion: packets.ProtocolVersion2,
-		RandomToken:     12345,
+		RandomToken:     pullResp.RandomToken,
 		Payload: packets.PullRespPayload{
 			TXPK: packets.TXPK{
 				Tmst: &tmst,
@@ -494,7 +520,7 @@ func (ts *BackendTestSuite) TestTXAckRetryFailFail() {
 	// send a nack on the second downlink attempt
 	ack2 := packets.TXACKPacket{
 		ProtocolVersion: packets.ProtocolVersion2,
-		RandomToken:     12345,
+		RandomToken:     pullResp.RandomToken,
 		GatewayMAC:      [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
 		Payload: &packets.TXACKPayload{
 			TXPKACK: packets.TXPKACK{
@@ -545,7 +571,7 @@ func (ts *BackendTestSuite) TestTXAckRetryOkIgnored() {
 	assert.Equal(p.ProtocolVersion, ack.ProtocolVersion)
 
 	// set cache
-	ts.backend.cache.Set("12345:frame", &gw.DownlinkFrame{
+	ts.setDownlink(12345, &gw.DownlinkFrame{
 		GatewayId: "0102030405060708",
 		Items: []*gw.DownlinkFrameItem{
 			{
@@ -600,12 +626,10 @@ func (ts *BackendTestSuite) TestTXAckRetryOkIgnored() {
 			},
 		},
 		DownlinkId: 12345,
-	}, cache.DefaultExpiration)
-	ts.backend.cache.Set("12345:index", 0, cache.DefaultExpiration)
-	ts.backend.cache.Set("12345:ack", []*gw.DownlinkTxAckItem{
+	}, []*gw.DownlinkTxAckItem{
 		{Status: gw.TxAckStatus_IGNORED},
 		{Status: gw.TxAckStatus_IGNORED},
-	}, cache.DefaultExpiration)
+	})
 
 	// send an ack on the first downlink attempt
 	ack1 := packets.TXACKPacket{
@@ -643,6 +667,47 @@ func (ts *BackendTestSuite) TestTXAckRetryOkIgnored() {
 	}, txAck)
 }
 
+func (ts *BackendTestSuite) TestTXAckTimeout() {
+	assert := require.New(ts.T())
+
+	ackChan := make(chan *gw.DownlinkTxAck, 1)
+	ts.backend.SetDownlinkTxAckFunc(func(pl *gw.DownlinkTxAck) {
+		ackChan <- pl
+	})
+
+	ts.setDownlink(12345, &gw.DownlinkFrame{
+		GatewayId:  "0102030405060708",
+		DownlinkId: 12345,
+		Items: []*gw.DownlinkFrameItem{
+			{},
+			{},
+		},
+	}, []*gw.DownlinkTxAckItem{
+		{Status: gw.TxAckStatus_IGNORED},
+		{Status: gw.TxAckStatus_IGNORED},
+	})
+
+	// expire the downlink
+	ts.backend.downlinks.Lock()
+	key := downlinkKey{gatewayID: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, token: 12345}
+	dl := ts.backend.downlinks.downlinks[key]
+	dl.expires = time.Now().Add(-time.Second)
+	ts.backend.downlinks.downlinks[key] = dl
+	ts.backend.downlinks.Unlock()
+
+	ts.backend.handleExpiredDownlinks()
+
+	txAck := <-ackChan
+	assert.True(proto.Equal(&gw.DownlinkTxAck{
+		GatewayId:  "0102030405060708",
+		DownlinkId: 12345,
+		Items: []*gw.DownlinkTxAckItem{
+			{Status: gw.TxAckStatus_INTERNAL_ERROR},
+			{Status: gw.TxAckStatus_IGNORED},
+		},
+	}, txAck))
+}
+
 func (ts *BackendTestSuite) TestPushData() {
 	latitude := float64(1.234)
 	longitude := float64(2.123)
@@ -829,6 +894,62 @@ func (ts *BackendTestSuite) TestPushData() {
 	}
 }
 
+func (ts *BackendTestSuite) TestPushDataDuplicate() {
+	assert := require.New(ts.T())
+
+	conf := ts.config()
+	conf.Backend.SemtechUDP.PushDataDedupWindow = time.Minute
+	ts.replaceBackend(conf)
+
+	uplinkChan := make(chan *gw.UplinkFrame, 2)
+	ts.backend.SetUplinkFrameFunc(func(pl *gw.UplinkFrame) {
+		uplinkChan <- pl
+	})
+	ts.startBackend()
+
+	p := packets.PushDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     1234,
+		GatewayMAC:      [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Payload: packets.PushDataPayload{
+			RXPK: []packets.RXPK{
+				{
+					Tmst: 708016819,
+					Freq: 868.5,
+					Stat: 1,
+					Modu: "LORA",
+					DatR: packets.DatR{LoRa: "SF7BW125"},
+					CodR: "4/5",
+					Size: 4,
+					Data: []byte{1, 2, 3, 4},
+				},
+			},
+		},
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(err)
+
+	// the retransmitted packet must be acked, but not handled
+	for i := 0; i < 2; i++ {
+		_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+		assert.NoError(err)
+
+		buf := make([]byte, 65507)
+		n, _, err := ts.gwUDPConn.ReadFromUDP(buf)
+		assert.NoError(err)
+		var ack packets.PushACKPacket
+		assert.NoError(ack.UnmarshalBinary(buf[:n]))
+		assert.Equal(p.RandomToken, ack.RandomToken)
+	}
+
+	<-uplinkChan
+	select {
+	case <-uplinkChan:
+		assert.Fail("duplicate uplink frame published")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
 func (ts *BackendTestSuite) TestSendDownlinkFrame() {
 	assert := require.New(ts.T())
 
@@ -1003,11 +1124,356 @@ func (ts *BackendTestSuite) TestSendDownlinkFrame() {
 
 			var pullResp packets.PullRespPacket
 			assert.NoError(pullResp.UnmarshalBinary(buf[:i]))
+
+			// the token is allocated by the in-flight downlinks registry
+			_, err = ts.backend.downlinks.pop(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, pullResp.RandomToken)
+			assert.NoError(err)
+			test.GatewayPacket.RandomToken = pullResp.RandomToken
+
 			assert.Equal(test.GatewayPacket, pullResp)
 		})
 	}
 }
 
+func (ts *BackendTestSuite) TestGatewayAllowlist() {
+	conf := ts.config()
+	conf.Backend.SemtechUDP.GatewayIDs = []string{"0102030405060708"}
+	ts.replaceBackend(conf)
+	ts.startBackend()
+
+	tests := []struct {
+		name      string
+		gatewayID lorawan.EUI64
+		conn      *net.UDPConn
+		expectAck bool
+	}{
+		{
+			name:      "allowed gateway",
+			gatewayID: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+			conn:      ts.gwUDPConn,
+			expectAck: true,
+		},
+		{
+			name:      "unknown gateway",
+			gatewayID: lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1},
+			conn:      ts.gwUDPConn,
+		},
+	}
+
+	for _, tst := range tests {
+		ts.T().Run(tst.name, func(t *testing.T) {
+			ts.sendPullData(t, tst.conn, tst.gatewayID, tst.expectAck)
+		})
+	}
+}
+
+func (ts *BackendTestSuite) TestAddressPinning() {
+	assert := require.New(ts.T())
+
+	conf := ts.config()
+	conf.Backend.SemtechUDP.AddressPinning.Enabled = true
+	conf.Backend.SemtechUDP.AddressPinning.IPv4PrefixLength = 32
+	conf.Backend.SemtechUDP.AddressPinning.IPv6PrefixLength = 128
+	ts.replaceBackend(conf)
+	ts.startBackend()
+
+	otherAddr, err := net.ResolveUDPAddr("udp", "127.0.0.2:0")
+	assert.NoError(err)
+	otherConn, err := net.ListenUDP("udp", otherAddr)
+	assert.NoError(err)
+	defer otherConn.Close()
+
+	tests := []struct {
+		name      string
+		gatewayID lorawan.EUI64
+		conn      *net.UDPConn
+		expectAck bool
+	}{
+		{
+			name:      "first packet pins gateway",
+			gatewayID: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+			conn:      ts.gwUDPConn,
+			expectAck: true,
+		},
+		{
+			name:      "packet from pinned address",
+			gatewayID: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+			conn:      ts.gwUDPConn,
+			expectAck: true,
+		},
+		{
+			name:      "packet from other address",
+			gatewayID: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+			conn:      otherConn,
+		},
+		{
+			name:      "other gateway from other address",
+			gatewayID: lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1},
+			conn:      otherConn,
+			expectAck: true,
+		},
+	}
+
+	for _, tst := range tests {
+		ts.T().Run(tst.name, func(t *testing.T) {
+			ts.sendPullData(t, tst.conn, tst.gatewayID, tst.expectAck)
+		})
+	}
+}
+
+func (ts *BackendTestSuite) TestRelay() {
+	assert := require.New(ts.T())
+
+	upstreamAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	assert.NoError(err)
+	upstreamConn, err := net.ListenUDP("udp", upstreamAddr)
+	assert.NoError(err)
+	defer upstreamConn.Close()
+	assert.NoError(upstreamConn.SetDeadline(time.Now().Add(time.Second)))
+
+	conf := ts.config()
+	conf.Backend.SemtechUDP.ConnectionTimeoutDuration = time.Minute
+	conf.Backend.SemtechUDP.Relay = []struct {
+		Server   string `mapstructure:"server"`
+		Downlink bool   `mapstructure:"downlink"`
+	}{
+		{Server: upstreamConn.LocalAddr().String(), Downlink: true},
+	}
+	ts.replaceBackend(conf)
+
+	var txAck *gw.DownlinkTxAck
+	ts.backend.SetDownlinkTxAckFunc(func(pl *gw.DownlinkTxAck) {
+		txAck = pl
+	})
+	ts.startBackend()
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	buf := make([]byte, 65507)
+	var relayAddr *net.UDPAddr
+	var relayToken uint16
+
+	ts.T().Run("PullData is relayed", func(t *testing.T) {
+		assert := require.New(t)
+
+		pullData := packets.PullDataPacket{
+			ProtocolVersion: packets.ProtocolVersion2,
+			RandomToken:     12345,
+			GatewayMAC:      gatewayID,
+		}
+		b, err := pullData.MarshalBinary()
+		assert.NoError(err)
+
+		_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+		assert.NoError(err)
+
+		i, _, err := ts.gwUDPConn.ReadFromUDP(buf)
+		assert.NoError(err)
+		var ack packets.PullACKPacket
+		assert.NoError(ack.UnmarshalBinary(buf[:i]))
+
+		i, relayAddr, err = upstreamConn.ReadFromUDP(buf)
+		assert.NoError(err)
+		assert.Equal(b, buf[:i])
+	})
+
+	ts.T().Run("PushData is relayed", func(t *testing.T) {
+		assert := require.New(t)
+
+		pushData := packets.PushDataPacket{
+			ProtocolVersion: packets.ProtocolVersion2,
+			RandomToken:     1234,
+			GatewayMAC:      gatewayID,
+		}
+		b, err := pushData.MarshalBinary()
+		assert.NoError(err)
+
+		_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+		assert.NoError(err)
+
+		i, _, err := ts.gwUDPConn.ReadFromUDP(buf)
+		assert.NoError(err)
+		var ack packets.PushACKPacket
+		assert.NoError(ack.UnmarshalBinary(buf[:i]))
+
+		i, addr, err := upstreamConn.ReadFromUDP(buf)
+		assert.NoError(err)
+		assert.Equal(b, buf[:i])
+		assert.Equal(relayAddr, addr)
+	})
+
+	ts.T().Run("PullResp is proxied with rewritten token", func(t *testing.T) {
+		assert := require.New(t)
+
+		pullResp := packets.PullRespPacket{
+			ProtocolVersion: packets.ProtocolVersion2,
+			RandomToken:     4321,
+			Payload: packets.PullRespPayload{
+				TXPK: packets.TXPK{
+					Imme: true,
+					Freq: 868.1,
+					Modu: "LORA",
+					DatR: packets.DatR{LoRa: "SF7BW125"},
+					CodR: "4/5",
+					Size: 3,
+					Data: []byte{1, 2, 3},
+				},
+			},
+		}
+		b, err := pullResp.MarshalBinary()
+		assert.NoError(err)
+
+		_, err = upstreamConn.WriteToUDP(b, relayAddr)
+		assert.NoError(err)
+
+		i, _, err := ts.gwUDPConn.ReadFromUDP(buf)
+		assert.NoError(err)
+
+		var received packets.PullRespPacket
+		assert.NoError(received.UnmarshalBinary(buf[:i]))
+		assert.Equal(pullResp.Payload, received.Payload)
+
+		relayToken = received.RandomToken
+
+		ts.backend.downlinks.Lock()
+		dl, ok := ts.backend.downlinks.downlinks[downlinkKey{gatewayID: gatewayID, token: relayToken}]
+		ts.backend.downlinks.Unlock()
+		assert.True(ok)
+		assert.Equal(pullResp.RandomToken, dl.relay.token)
+	})
+
+	ts.T().Run("TXAck is returned with original token", func(t *testing.T) {
+		assert := require.New(t)
+
+		txAckPacket := packets.TXACKPacket{
+			ProtocolVersion: packets.ProtocolVersion2,
+			RandomToken:     relayToken,
+			GatewayMAC:      gatewayID,
+		}
+		b, err := txAckPacket.MarshalBinary()
+		assert.NoError(err)
+
+		_, err = ts.gwUDPConn.WriteToUDP(b, ts.backendUDPAddr)
+		assert.NoError(err)
+
+		i, _, err := upstreamConn.ReadFromUDP(buf)
+		assert.NoError(err)
+
+		var received packets.TXACKPacket
+		assert.NoError(received.UnmarshalBinary(buf[:i]))
+		assert.EqualValues(4321, received.RandomToken)
+		assert.Equal(gatewayID, received.GatewayMAC)
+		assert.Nil(txAck)
+	})
+}
+
+// sendPullData sends a PULL_DATA packet using the given connection and
+// validates if the backend responds with a PULL_ACK.
+func (ts *BackendTestSuite) TestCapture() {
+	assert := require.New(ts.T())
+
+	path := filepath.Join(ts.tempDir, "capture.jsonl")
+	conf := ts.config()
+	conf.Backend.SemtechUDP.Capture.File = path
+	ts.replaceBackend(conf)
+	ts.startBackend()
+
+	ts.sendPullData(ts.T(), ts.gwUDPConn, lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, true)
+
+	f, err := os.Open(path)
+	assert.NoError(err)
+	defer f.Close()
+	r := capture.NewReader(f)
+
+	rec, err := r.Next()
+	assert.NoError(err)
+	assert.Equal("semtech_udp", rec.Backend)
+	assert.Equal(capture.DirectionIn, rec.Direction)
+	assert.Equal(ts.gwUDPConn.LocalAddr().String(), rec.Addr)
+
+	pt, err := packets.GetPacketType(rec.Data)
+	assert.NoError(err)
+	assert.Equal(packets.PullData, pt)
+
+	rec, err = r.Next()
+	assert.NoError(err)
+	assert.Equal(capture.DirectionOut, rec.Direction)
+	assert.Equal(ts.gwUDPConn.LocalAddr().String(), rec.Addr)
+
+	pt, err = packets.GetPacketType(rec.Data)
+	assert.NoError(err)
+	assert.Equal(packets.PullACK, pt)
+}
+
+func (ts *BackendTestSuite) TestReplay() {
+	assert := require.New(ts.T())
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	pullData := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      gatewayID,
+	}
+	b, err := pullData.MarshalBinary()
+	assert.NoError(err)
+
+	var buf bytes.Buffer
+	for _, rec := range []capture.Record{
+		{Time: time.Now(), Backend: "semtech_udp", Direction: capture.DirectionIn, Addr: "192.0.2.1:1700", Data: b},
+		{Time: time.Now(), Backend: "basic_station", Direction: capture.DirectionIn, Addr: "192.0.2.2:1700", Data: b},
+	} {
+		assert.NoError(json.NewEncoder(&buf).Encode(rec))
+	}
+
+	assert.NoError(ts.backend.Replay(capture.NewReader(&buf), 0))
+
+	gw, err := ts.backend.gateways.get(gatewayID)
+	assert.NoError(err)
+	assert.Equal("192.0.2.1:1700", gw.addr.String())
+}
+
+func (ts *BackendTestSuite) sendPullData(t *testing.T, conn *net.UDPConn, gatewayID lorawan.EUI64, expectAck bool) {
+	assert := require.New(t)
+
+	p := packets.PullDataPacket{
+		ProtocolVersion: packets.ProtocolVersion2,
+		RandomToken:     12345,
+		GatewayMAC:      gatewayID,
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(err)
+
+	_, err = conn.WriteToUDP(b, ts.backendUDPAddr)
+	assert.NoError(err)
+
+	assert.NoError(conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 65507)
+	i, _, err := conn.ReadFromUDP(buf)
+	if !expectAck {
+		assert.Error(err)
+		return
+	}
+	assert.NoError(err)
+
+	var ack packets.PullACKPacket
+	assert.NoError(ack.UnmarshalBinary(buf[:i]))
+	assert.Equal(p.RandomToken, ack.RandomToken)
+}
+
+// setDownlink adds the given downlink to the in-flight downlinks registry
+// using the given token.
+func (ts *BackendTestSuite) setDownlink(token uint16, frame *gw.DownlinkFrame, txAckItems []*gw.DownlinkTxAckItem) {
+	ts.backend.downlinks.Lock()
+	defer ts.backend.downlinks.Unlock()
+
+	ts.backend.downlinks.downlinks[downlinkKey{gatewayID: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, token: token}] = downlink{
+		frame:      frame,
+		txAckItems: txAckItems,
+		expires:    time.Now().Add(time.Minute),
+	}
+}
+
 func TestBackend(t *testing.T) {
 	suite.Run(t, new(BackendTestSuite))
 }
@@ -0,0 +1,65 @@
+package semtechudp
+
+import (
+	"encoding/base64"
+	"net"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/capture"
+)
+
+// captureBackend is the backend name used in the capture records.
+const captureBackend = "semtech_udp"
+
+// captureDatagram writes the given datagram to the capture (when enabled).
+func (b *Backend) captureDatagram(direction string, p udpPacket) {
+	if b.capture == nil {
+		return
+	}
+
+	if err := b.capture.Write(capture.Record{
+		Backend:   captureBackend,
+		Direction: direction,
+		Addr:      p.addr.String(),
+		Data:      p.data,
+	}); err != nil {
+		log.WithError(err).Error("backend/semtechudp: capture datagram error")
+	}
+}
+
+// Replay handles the captured datagrams received from the gateways, as if
+// these were received by the UDP listener. The datagrams sent by the backend
+// are discarded during the replay, as these would otherwise be sent to the
+// captured gateway addresses.
+func (b *Backend) Replay(r *capture.Reader, speed float64) error {
+	b.Lock()
+	b.replay = true
+	b.Unlock()
+
+	return capture.Replay(r, speed, func(rec capture.Record) error {
+		if rec.Backend != captureBackend || rec.Direction != capture.DirectionIn {
+			return nil
+		}
+
+		addr, err := net.ResolveUDPAddr("udp", rec.Addr)
+		if err != nil {
+			return errors.Wrap(err, "resolve udp addr error")
+		}
+
+		up := udpPacket{
+			addr: addr,
+			data: rec.Data,
+		}
+
+		if err := b.handlePacket(up); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"data_base64": base64.StdEncoding.EncodeToString(up.data),
+				"addr":        up.addr,
+			}).Error("backend/semtechudp: could not handle packet")
+		}
+
+		return nil
+	})
+}
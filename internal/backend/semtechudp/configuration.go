@@ -0,0 +1,219 @@
+package semtechudp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config/sx1301v1"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+// multiSFChannels defines the number of multi-SF channels of the SX1301.
+const multiSFChannels = 8
+
+// pfConfiguration holds the packet-forwarder configuration for a gateway.
+type pfConfiguration struct {
+	gatewayID      lorawan.EUI64
+	baseFile       string
+	outputFile     string
+	restartCommand string
+	currentVersion string
+}
+
+// sx1301ConfRadio implements the (partial) SX1301 radio configuration.
+type sx1301ConfRadio struct {
+	Enable bool   `json:"enable"`
+	Freq   uint32 `json:"freq"`
+}
+
+// sx1301ConfChan implements the (partial) SX1301 channel configuration.
+type sx1301ConfChan struct {
+	Enable       bool   `json:"enable"`
+	Radio        int    `json:"radio"`
+	IF           int    `json:"if"`
+	Bandwidth    uint32 `json:"bandwidth,omitempty"`
+	SpreadFactor uint32 `json:"spread_factor,omitempty"`
+	Datarate     uint32 `json:"datarate,omitempty"`
+}
+
+// writeConfiguration merges the given gateway configuration into the base
+// packet-forwarder configuration and writes the result to the output file.
+func (c pfConfiguration) writeConfiguration(conf *gw.GatewayConfiguration) error {
+	baseConf := make(map[string]interface{})
+
+	if c.baseFile != "" {
+		b, err := ioutil.ReadFile(c.baseFile)
+		if err != nil {
+			return errors.Wrap(err, "read base configuration file error")
+		}
+
+		if err := json.Unmarshal(b, &baseConf); err != nil {
+			return errors.Wrap(err, "unmarshal base configuration file error")
+		}
+	}
+
+	sx1301Conf, err := getSX1301Conf(conf)
+	if err != nil {
+		return errors.Wrap(err, "get SX1301 configuration error")
+	}
+
+	if err := mergeConfiguration(baseConf, c.gatewayID, sx1301Conf); err != nil {
+		return errors.Wrap(err, "merge configuration error")
+	}
+
+	b, err := json.MarshalIndent(baseConf, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "marshal configuration error")
+	}
+
+	// Write to a temporary file first, so that the packet-forwarder never
+	// reads a partially written configuration file. The temporary file is
+	// unique, such that concurrent writes do not interleave.
+	tmpFile, err := os.CreateTemp(filepath.Dir(c.outputFile), filepath.Base(c.outputFile)+".*.tmp")
+	if err != nil {
+		return errors.Wrap(err, "create temporary file error")
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(b); err != nil {
+		tmpFile.Close()
+		return errors.Wrap(err, "write configuration file error")
+	}
+
+	if err := tmpFile.Chmod(0644); err != nil {
+		tmpFile.Close()
+		return errors.Wrap(err, "chmod configuration file error")
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return errors.Wrap(err, "close configuration file error")
+	}
+
+	if err := os.Rename(tmpFile.Name(), c.outputFile); err != nil {
+		return errors.Wrap(err, "rename configuration file error")
+	}
+
+	return nil
+}
+
+// getSX1301Conf returns the SX1301_conf items (radios and channels) for the
+// given gateway configuration.
+func getSX1301Conf(conf *gw.GatewayConfiguration) (map[string]interface{}, error) {
+	out := make(map[string]interface{})
+
+	// GetRadioFrequencies sorts the given slice, make sure we don't
+	// modify the channel order of the given configuration.
+	channels := make([]*gw.ChannelConfiguration, len(conf.GetChannels()))
+	copy(channels, conf.GetChannels())
+
+	radios, err := sx1301v1.GetRadioFrequencies(channels)
+	if err != nil {
+		return nil, errors.Wrap(err, "get radio frequencies error")
+	}
+
+	for i, f := range radios {
+		out[fmt.Sprintf("radio_%d", i)] = sx1301ConfRadio{
+			Enable: f != 0,
+			Freq:   f,
+		}
+	}
+
+	// disable all channels by default
+	for i := 0; i < multiSFChannels; i++ {
+		out[fmt.Sprintf("chan_multiSF_%d", i)] = sx1301ConfChan{}
+	}
+	out["chan_Lora_std"] = sx1301ConfChan{}
+	out["chan_FSK"] = sx1301ConfChan{}
+
+	var multiSFI int
+	for _, c := range conf.GetChannels() {
+		r, err := sx1301v1.GetRadioForChannel(radios, c)
+		if err != nil {
+			return nil, errors.Wrap(err, "get radio for channel error")
+		}
+
+		ch := sx1301ConfChan{
+			Enable: true,
+			Radio:  r,
+			IF:     int(c.Frequency) - int(radios[r]),
+		}
+
+		if lora := c.GetLoraModulationConfig(); lora != nil {
+			if len(lora.SpreadingFactors) == 1 {
+				ch.Bandwidth = lora.Bandwidth
+				ch.SpreadFactor = lora.SpreadingFactors[0]
+				out["chan_Lora_std"] = ch
+				continue
+			}
+
+			if multiSFI >= multiSFChannels {
+				return nil, fmt.Errorf("too many multi-SF channels, max: %d", multiSFChannels)
+			}
+
+			out[fmt.Sprintf("chan_multiSF_%d", multiSFI)] = ch
+			multiSFI++
+		}
+
+		if fsk := c.GetFskModulationConfig(); fsk != nil {
+			ch.Bandwidth = fsk.Bandwidth
+			ch.Datarate = fsk.Bitrate
+			out["chan_FSK"] = ch
+		}
+	}
+
+	return out, nil
+}
+
+// mergeConfiguration merges the given SX1301_conf items into the base
+// configuration. Fields that are not set by the items (e.g. the radio type,
+// RSSI offset and TX gain LUT) are kept as-is.
+func mergeConfiguration(baseConf map[string]interface{}, gatewayID lorawan.EUI64, sx1301Conf map[string]interface{}) error {
+	sx1301, ok := baseConf["SX1301_conf"].(map[string]interface{})
+	if !ok {
+		sx1301 = make(map[string]interface{})
+		baseConf["SX1301_conf"] = sx1301
+	}
+
+	for k, v := range sx1301Conf {
+		// convert the item to a map[string]interface{}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return errors.Wrap(err, "marshal json error")
+		}
+		var item map[string]interface{}
+		if err := json.Unmarshal(b, &item); err != nil {
+			return errors.Wrap(err, "unmarshal json error")
+		}
+
+		baseItem, ok := sx1301[k].(map[string]interface{})
+		if !ok {
+			sx1301[k] = item
+			continue
+		}
+
+		// remove the optional channel fields, these will be set again below
+		// when they are present in the new configuration
+		for _, f := range []string{"bandwidth", "spread_factor", "datarate"} {
+			delete(baseItem, f)
+		}
+
+		for kk, vv := range item {
+			baseItem[kk] = vv
+		}
+	}
+
+	gatewayConf, ok := baseConf["gateway_conf"].(map[string]interface{})
+	if !ok {
+		gatewayConf = make(map[string]interface{})
+		baseConf["gateway_conf"] = gatewayConf
+	}
+	gatewayConf["gateway_ID"] = gatewayID.String()
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package semtechudp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+func TestWriteConfiguration(t *testing.T) {
+	assert := require.New(t)
+
+	tempDir, err := ioutil.TempDir("", "test")
+	assert.NoError(err)
+	defer os.RemoveAll(tempDir)
+
+	baseFile := filepath.Join(tempDir, "global_conf.json")
+	outputFile := filepath.Join(tempDir, "local_conf.json")
+
+	assert.NoError(ioutil.WriteFile(baseFile, []byte(`{
+		"SX1301_conf": {
+			"lorawan_public": true,
+			"radio_0": {"enable": true, "type": "SX1257", "freq": 867500000, "rssi_offset": -166.0, "tx_enable": true},
+			"radio_1": {"enable": true, "type": "SX1257", "freq": 868500000, "rssi_offset": -166.0, "tx_enable": false},
+			"chan_multiSF_0": {"enable": true, "radio": 1, "if": -400000},
+			"chan_Lora_std": {"enable": true, "radio": 1, "if": -200000, "bandwidth": 250000, "spread_factor": 7}
+		},
+		"gateway_conf": {
+			"gateway_ID": "0000000000000000",
+			"server_address": "localhost"
+		}
+	}`), 0644))
+
+	c := pfConfiguration{
+		gatewayID:  lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+		baseFile:   baseFile,
+		outputFile: outputFile,
+	}
+
+	assert.NoError(c.writeConfiguration(&gw.GatewayConfiguration{
+		GatewayId: "0102030405060708",
+		Version:   "1.2.3",
+		Channels: []*gw.ChannelConfiguration{
+			{
+				Frequency: 868100000,
+				ModulationConfig: &gw.ChannelConfiguration_LoraModulationConfig{
+					LoraModulationConfig: &gw.LoraModulationConfig{
+						Bandwidth:        125000,
+						SpreadingFactors: []uint32{7, 8, 9, 10, 11, 12},
+					},
+				},
+			},
+			{
+				Frequency: 868300000,
+				ModulationConfig: &gw.ChannelConfiguration_LoraModulationConfig{
+					LoraModulationConfig: &gw.LoraModulationConfig{
+						Bandwidth:        125000,
+						SpreadingFactors: []uint32{7, 8, 9, 10, 11, 12},
+					},
+				},
+			},
+			{
+				Frequency: 868500000,
+				ModulationConfig: &gw.ChannelConfiguration_LoraModulationConfig{
+					LoraModulationConfig: &gw.LoraModulationConfig{
+						Bandwidth:        125000,
+						SpreadingFactors: []uint32{7, 8, 9, 10, 11, 12},
+					},
+				},
+			},
+			{
+				Frequency: 868800000,
+				ModulationConfig: &gw.ChannelConfiguration_FskModulationConfig{
+					FskModulationConfig: &gw.FskModulationConfig{
+						Bandwidth: 125000,
+						Bitrate:   50000,
+					},
+				},
+			},
+		},
+	}))
+
+	b, err := ioutil.ReadFile(outputFile)
+	assert.NoError(err)
+
+	var out map[string]interface{}
+	assert.NoError(json.Unmarshal(b, &out))
+
+	assert.Equal(map[string]interface{}{
+		"SX1301_conf": map[string]interface{}{
+			"lorawan_public": true,
+			"radio_0":        map[string]interface{}{"enable": true, "type": "SX1257", "freq": 868500000.0, "rssi_offset": -166.0, "tx_enable": true},
+			"radio_1":        map[string]interface{}{"enable": false, "type": "SX1257", "freq": 0.0, "rssi_offset": -166.0, "tx_enable": false},
+			"chan_multiSF_0": map[string]interface{}{"enable": true, "radio": 0.0, "if": -400000.0},
+			"chan_multiSF_1": map[string]interface{}{"enable": true, "radio": 0.0, "if": -200000.0},
+			"chan_multiSF_2": map[string]interface{}{"enable": true, "radio": 0.0, "if": 0.0},
+			"chan_multiSF_3": map[string]interface{}{"enable": false, "radio": 0.0, "if": 0.0},
+			"chan_multiSF_4": map[string]interface{}{"enable": false, "radio": 0.0, "if": 0.0},
+			"chan_multiSF_5": map[string]interface{}{"enable": false, "radio": 0.0, "if": 0.0},
+			"chan_multiSF_6": map[string]interface{}{"enable": false, "radio": 0.0, "if": 0.0},
+			"chan_multiSF_7": map[string]interface{}{"enable": false, "radio": 0.0, "if": 0.0},
+			"chan_Lora_std":  map[string]interface{}{"enable": false, "radio": 0.0, "if": 0.0},
+			"chan_FSK":       map[string]interface{}{"enable": true, "radio": 0.0, "if": 300000.0, "bandwidth": 125000.0, "datarate": 50000.0},
+		},
+		"gateway_conf": map[string]interface{}{
+			"gateway_ID":     "0102030405060708",
+			"server_address": "localhost",
+		},
+	}, out)
+
+	// the temporary file is renamed to the output file
+	files, err := filepath.Glob(filepath.Join(tempDir, "*.tmp"))
+	assert.NoError(err)
+	assert.Len(files, 0)
+
+	info, err := os.Stat(outputFile)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0644), info.Mode().Perm())
+}
+
+func TestGetSX1301ConfTooManyChannels(t *testing.T) {
+	assert := require.New(t)
+
+	var conf gw.GatewayConfiguration
+	for i := 0; i < 9; i++ {
+		conf.Channels = append(conf.Channels, &gw.ChannelConfiguration{
+			Frequency: 867100000 + uint32(i*100000),
+			ModulationConfig: &gw.ChannelConfiguration_LoraModulationConfig{
+				LoraModulationConfig: &gw.LoraModulationConfig{
+					Bandwidth:        125000,
+					SpreadingFactors: []uint32{7, 8, 9, 10, 11, 12},
+				},
+			},
+		})
+	}
+
+	_, err := getSX1301Conf(&conf)
+	assert.EqualError(err, "too many multi-SF channels, max: 8")
+}
@@ -0,0 +1,70 @@
+package semtechudp
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/brocaar/lorawan"
+)
+
+// pushDataKey identifies a PUSH_DATA packet. The payload hash is included,
+// as the (uint16) random token alone does not uniquely identify a packet.
+type pushDataKey struct {
+	gatewayID lorawan.EUI64
+	token     uint16
+	hash      [sha256.Size]byte
+}
+
+// pushDataDedup keeps track of the PUSH_DATA packets received within the
+// dedup window, such that packets retransmitted by the packet-forwarder (e.g.
+// because the PUSH_ACK was lost) are not handled twice.
+type pushDataDedup struct {
+	sync.Mutex
+	seen   map[pushDataKey]time.Time
+	window time.Duration
+}
+
+func newPushDataDedup(window time.Duration) pushDataDedup {
+	return pushDataDedup{
+		seen:   make(map[pushDataKey]time.Time),
+		window: window,
+	}
+}
+
+// isDuplicate returns true when the same packet has been received within the
+// dedup window. Else, the packet is recorded and false is returned.
+// Deduplication is disabled when the window is 0.
+func (d *pushDataDedup) isDuplicate(gatewayID lorawan.EUI64, token uint16, payload []byte) bool {
+	if d.window == 0 {
+		return false
+	}
+
+	key := pushDataKey{
+		gatewayID: gatewayID,
+		token:     token,
+		hash:      sha256.Sum256(payload),
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if t, ok := d.seen[key]; ok && time.Since(t) < d.window {
+		return true
+	}
+
+	d.seen[key] = time.Now()
+	return false
+}
+
+// cleanup removes the packets received before the dedup window.
+func (d *pushDataDedup) cleanup() {
+	d.Lock()
+	defer d.Unlock()
+
+	for key, t := range d.seen {
+		if time.Since(t) >= d.window {
+			delete(d.seen, key)
+		}
+	}
+}
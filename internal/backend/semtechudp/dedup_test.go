@@ -0,0 +1,53 @@
+package semtechudp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+)
+
+func TestPushDataDedup(t *testing.T) {
+	gatewayID1 := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	gatewayID2 := lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}
+
+	t.Run("Duplicates", func(t *testing.T) {
+		assert := require.New(t)
+		d := newPushDataDedup(time.Minute)
+
+		assert.False(d.isDuplicate(gatewayID1, 1, []byte("foo")))
+		assert.True(d.isDuplicate(gatewayID1, 1, []byte("foo")))
+
+		// other gateway, token or payload
+		assert.False(d.isDuplicate(gatewayID2, 1, []byte("foo")))
+		assert.False(d.isDuplicate(gatewayID1, 2, []byte("foo")))
+		assert.False(d.isDuplicate(gatewayID1, 1, []byte("bar")))
+	})
+
+	t.Run("Window expired", func(t *testing.T) {
+		assert := require.New(t)
+		d := newPushDataDedup(time.Minute)
+
+		assert.False(d.isDuplicate(gatewayID1, 1, []byte("foo")))
+		for k := range d.seen {
+			d.seen[k] = time.Now().Add(-2 * time.Minute)
+		}
+		assert.False(d.isDuplicate(gatewayID1, 1, []byte("foo")))
+
+		for k := range d.seen {
+			d.seen[k] = time.Now().Add(-2 * time.Minute)
+		}
+		d.cleanup()
+		assert.Len(d.seen, 0)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		assert := require.New(t)
+		d := newPushDataDedup(0)
+
+		assert.False(d.isDuplicate(gatewayID1, 1, []byte("foo")))
+		assert.False(d.isDuplicate(gatewayID1, 1, []byte("foo")))
+	})
+}
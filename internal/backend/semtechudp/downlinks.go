@@ -0,0 +1,131 @@
+package semtechudp
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/storage"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+// errors
+var (
+	errNoFreeDownlinkToken = errors.New("no free downlink token")
+	errDownlinkNotFound    = errors.New("downlink does not exist")
+)
+
+// downlinkKey identifies an in-flight downlink. The token is allocated by the
+// bridge per gateway, as the (uint16) token space is too small to use the
+// downlink ID.
+type downlinkKey struct {
+	gatewayID lorawan.EUI64
+	token     uint16
+}
+
+// downlink contains an in-flight downlink, waiting for the TX_ACK of the
+// gateway. For downlinks proxied from a relay upstream, only relay is set.
+type downlink struct {
+	frame      *gw.DownlinkFrame
+	index      int
+	txAckItems []*gw.DownlinkTxAckItem
+	relay      *relayDownlink
+	expires    time.Time
+}
+
+// downlinks contains the in-flight downlinks registry.
+type downlinks struct {
+	sync.Mutex
+	downlinks map[downlinkKey]downlink
+	tokens    map[lorawan.EUI64]uint16
+	timeout   time.Duration
+
+	// store persists the downlinks, persistence is disabled when nil. The
+	// changes are written by the store loop, such that no disk IO is done
+	// while holding the lock.
+	store     *storage.Store
+	storeChan chan storage.Op
+	storeDone chan struct{}
+}
+
+func newDownlinks(timeout time.Duration) downlinks {
+	return downlinks{
+		downlinks: make(map[downlinkKey]downlink),
+		tokens:    make(map[lorawan.EUI64]uint16),
+		timeout:   timeout,
+	}
+}
+
+// add allocates a token for the given gateway and adds the downlink to the
+// registry. Tokens which are still in-flight are skipped.
+func (d *downlinks) add(gatewayID lorawan.EUI64, dl downlink) (uint16, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	token, ok := d.tokens[gatewayID]
+	if !ok {
+		// Start at a random token, to avoid matching TX_ACKs of downlinks
+		// sent before a restart.
+		token = uint16(rand.Uint32())
+	}
+
+	for i := 0; i <= 0xffff; i++ {
+		token++
+
+		key := downlinkKey{gatewayID: gatewayID, token: token}
+		if _, ok := d.downlinks[key]; ok {
+			downlinkTokenCollisionCounter().Inc()
+			continue
+		}
+
+		dl.expires = time.Now().Add(d.timeout)
+		d.downlinks[key] = dl
+		d.storeDownlink(key, dl)
+		d.tokens[gatewayID] = token
+		downlinksInFlightGauge().Set(float64(len(d.downlinks)))
+
+		return token, nil
+	}
+
+	return 0, errNoFreeDownlinkToken
+}
+
+// pop returns and removes the downlink for the given gateway and token.
+func (d *downlinks) pop(gatewayID lorawan.EUI64, token uint16) (downlink, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	key := downlinkKey{gatewayID: gatewayID, token: token}
+	dl, ok := d.downlinks[key]
+	if !ok {
+		return dl, errDownlinkNotFound
+	}
+
+	delete(d.downlinks, key)
+	d.deleteDownlink(key, dl)
+	downlinksInFlightGauge().Set(float64(len(d.downlinks)))
+
+	return dl, nil
+}
+
+// cleanup removes and returns the expired downlinks.
+func (d *downlinks) cleanup() []downlink {
+	d.Lock()
+	defer d.Unlock()
+
+	var out []downlink
+	now := time.Now()
+
+	for key, dl := range d.downlinks {
+		if dl.expires.Before(now) {
+			out = append(out, dl)
+			delete(d.downlinks, key)
+			d.deleteDownlink(key, dl)
+		}
+	}
+	downlinksInFlightGauge().Set(float64(len(d.downlinks)))
+
+	return out
+}
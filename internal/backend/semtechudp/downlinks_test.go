@@ -0,0 +1,90 @@
+package semtechudp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+func TestDownlinks(t *testing.T) {
+	assert := require.New(t)
+
+	gatewayID1 := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	gatewayID2 := lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}
+	d := newDownlinks(time.Minute)
+
+	t.Run("Add and pop", func(t *testing.T) {
+		assert := require.New(t)
+
+		// the same downlink ID results in different tokens
+		token1, err := d.add(gatewayID1, downlink{frame: &gw.DownlinkFrame{DownlinkId: 1}})
+		assert.NoError(err)
+		token2, err := d.add(gatewayID1, downlink{frame: &gw.DownlinkFrame{DownlinkId: 1}})
+		assert.NoError(err)
+		assert.NotEqual(token1, token2)
+
+		// the token is scoped to the gateway
+		_, err = d.pop(gatewayID2, token1)
+		assert.Equal(errDownlinkNotFound, err)
+
+		dl, err := d.pop(gatewayID1, token1)
+		assert.NoError(err)
+		assert.EqualValues(1, dl.frame.DownlinkId)
+
+		_, err = d.pop(gatewayID1, token1)
+		assert.Equal(errDownlinkNotFound, err)
+
+		_, err = d.pop(gatewayID1, token2)
+		assert.NoError(err)
+	})
+
+	t.Run("Collision", func(t *testing.T) {
+		assert := require.New(t)
+
+		// occupy the next token
+		d.Lock()
+		next := d.tokens[gatewayID1] + 1
+		d.downlinks[downlinkKey{gatewayID: gatewayID1, token: next}] = downlink{frame: &gw.DownlinkFrame{DownlinkId: 2}, expires: time.Now().Add(time.Minute)}
+		d.Unlock()
+
+		token, err := d.add(gatewayID1, downlink{frame: &gw.DownlinkFrame{DownlinkId: 3}})
+		assert.NoError(err)
+		assert.Equal(next+1, token)
+
+		dl, err := d.pop(gatewayID1, next)
+		assert.NoError(err)
+		assert.EqualValues(2, dl.frame.DownlinkId)
+
+		dl, err = d.pop(gatewayID1, token)
+		assert.NoError(err)
+		assert.EqualValues(3, dl.frame.DownlinkId)
+	})
+
+	t.Run("Cleanup", func(t *testing.T) {
+		assert := require.New(t)
+
+		token, err := d.add(gatewayID1, downlink{frame: &gw.DownlinkFrame{DownlinkId: 4}})
+		assert.NoError(err)
+		assert.Len(d.cleanup(), 0)
+
+		d.Lock()
+		key := downlinkKey{gatewayID: gatewayID1, token: token}
+		dl := d.downlinks[key]
+		dl.expires = time.Now().Add(-time.Second)
+		d.downlinks[key] = dl
+		d.Unlock()
+
+		expired := d.cleanup()
+		assert.Len(expired, 1)
+		assert.EqualValues(4, expired[0].frame.DownlinkId)
+
+		_, err = d.pop(gatewayID1, token)
+		assert.Equal(errDownlinkNotFound, err)
+	})
+
+	assert.Len(d.downlinks, 0)
+}
@@ -27,6 +27,61 @@ var (
 		Help: "The number of gateways that disconnected from the backend.",
 	})
 
+	dif = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "backend_semtechudp_downlink_in_flight",
+		Help: "The number of downlinks waiting for a TX_ACK of the gateway.",
+	})
+
+	dtc = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backend_semtechudp_downlink_token_collision_count",
+		Help: "The number of allocated downlink tokens that were skipped because they were still in-flight.",
+	})
+
+	dto = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backend_semtechudp_downlink_tx_ack_timeout_count",
+		Help: "The number of downlinks for which no TX_ACK was received within the timeout.",
+	})
+
+	dsd = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backend_semtechudp_downlink_store_dropped_count",
+		Help: "The number of downlink changes that were not persisted because the store queue was full.",
+	})
+
+	prc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_semtechudp_packet_rejected_count",
+		Help: "The number of UDP packets rejected by the backend (per reason).",
+	}, []string{"reason"})
+
+	wqg = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "backend_semtechudp_worker_queue_size",
+		Help: "The number of received UDP packets waiting to be handled by the workers.",
+	})
+
+	qoc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_semtechudp_worker_queue_overflow_count",
+		Help: "The number of received UDP packets dropped because the worker queue was full (per policy).",
+	}, []string{"policy"})
+
+	pdd = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_semtechudp_push_data_duplicate_count",
+		Help: "The number of retransmitted PUSH_DATA packets that were acknowledged but not handled (per gateway).",
+	}, []string{"gateway_id"})
+
+	ftd = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_semtechudp_fine_timestamp_decrypt_count",
+		Help: "The number of encrypted fine-timestamps handled by the backend (per status).",
+	}, []string{"status"})
+
+	rsc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_semtechudp_relay_sent_count",
+		Help: "The number of UDP packets relayed to the upstream servers (per server and packet_type).",
+	}, []string{"server", "packet_type"})
+
+	rrc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_semtechudp_relay_received_count",
+		Help: "The number of UDP packets received from the upstream servers (per server and packet_type).",
+	}, []string{"server", "packet_type"})
+
 	ackr = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "backend_semtechdup_gateway_ack_rate",
 		Help: "The percentage of upstream datagrams that were acknowledged.",
@@ -54,6 +109,50 @@ func disconnectCounter() prometheus.Counter {
 	return gwd
 }
 
+func downlinksInFlightGauge() prometheus.Gauge {
+	return dif
+}
+
+func downlinkTokenCollisionCounter() prometheus.Counter {
+	return dtc
+}
+
+func downlinkTimeoutCounter() prometheus.Counter {
+	return dto
+}
+
+func downlinkStoreDroppedCounter() prometheus.Counter {
+	return dsd
+}
+
+func packetRejectedCounter(reason string) prometheus.Counter {
+	return prc.With(prometheus.Labels{"reason": reason})
+}
+
+func workerQueueGauge() prometheus.Gauge {
+	return wqg
+}
+
+func queueOverflowCounter(policy string) prometheus.Counter {
+	return qoc.With(prometheus.Labels{"policy": policy})
+}
+
+func pushDataDuplicateCounter(gatewayID lorawan.EUI64) prometheus.Counter {
+	return pdd.With(prometheus.Labels{"gateway_id": gatewayID.String()})
+}
+
+func fineTimestampDecryptCounter(status string) prometheus.Counter {
+	return ftd.With(prometheus.Labels{"status": status})
+}
+
+func relaySentCounter(server, pt string) prometheus.Counter {
+	return rsc.With(prometheus.Labels{"server": server, "packet_type": pt})
+}
+
+func relayReceivedCounter(server, pt string) prometheus.Counter {
+	return rrc.With(prometheus.Labels{"server": server, "packet_type": pt})
+}
+
 func ackRate(gatewayID lorawan.EUI64) prometheus.Gauge {
 	return ackr.With(prometheus.Labels{"gateway_id": gatewayID.String()})
 }
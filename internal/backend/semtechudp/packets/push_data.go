@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"crypto/aes"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -23,6 +24,12 @@ var loRaDataRateRegex = regexp.MustCompile(`SF(\d+)BW(\d+)`)
 // lrFHSSDataRateRegex contains the regexp for parsing the LR-FHSS data-rate string.
 var lrFHSSDataRateRegex = regexp.MustCompile(`M0CW(\d+)`)
 
+// FineTimestampDecryptFunc returns the decrypted fine-timestamp (number of
+// nanoseconds since the last PPS) for the given AES key index and encrypted
+// fine-timestamp. It returns false when the fine-timestamp could not be
+// decrypted.
+type FineTimestampDecryptFunc func(aesk uint8, etime []byte) (uint32, bool)
+
 // PushDataPacket type is used by the gateway mainly to forward the RF packets
 // received, and associated metadata, to the server.
 type PushDataPacket struct {
@@ -80,8 +87,9 @@ func (p PushDataPacket) GetGatewayStats() (*gw.GatewayStats, error) {
 	return &stats, nil
 }
 
-// GetUplinkFrames returns a slice of gw.UplinkFrame.
-func (p PushDataPacket) GetUplinkFrames(skipCRCCheck bool, FakeRxInfoTime bool) ([]*gw.UplinkFrame, error) {
+// GetUplinkFrames returns a slice of gw.UplinkFrame. When the decryptFunc is
+// set, it is used for decrypting the encrypted fine-timestamps.
+func (p PushDataPacket) GetUplinkFrames(skipCRCCheck bool, FakeRxInfoTime bool, decryptFunc FineTimestampDecryptFunc) ([]*gw.UplinkFrame, error) {
 	var frames []*gw.UplinkFrame
 
 	for i := range p.Payload.RXPK {
@@ -103,7 +111,7 @@ func (p PushDataPacket) GetUplinkFrames(skipCRCCheck bool, FakeRxInfoTime bool)
 				if err != nil {
 					return nil, errors.Wrap(err, "backend/semtechudp/packets: get uplink frame error")
 				}
-				frame = setUplinkFrameRSig(frame, p.Payload.RXPK[i], p.Payload.RXPK[i].RSig[j])
+				frame = setUplinkFrameRSig(frame, p.Payload.RXPK[i], p.Payload.RXPK[i].RSig[j], decryptFunc)
 				frame.RxInfo.UplinkId = uint32(p.RandomToken)
 
 				frames = append(frames, frame)
@@ -114,19 +122,54 @@ func (p PushDataPacket) GetUplinkFrames(skipCRCCheck bool, FakeRxInfoTime bool)
 	return frames, nil
 }
 
-func setUplinkFrameRSig(frame *gw.UplinkFrame, rxPK RXPK, rSig RSig) *gw.UplinkFrame {
+func setUplinkFrameRSig(frame *gw.UplinkFrame, rxPK RXPK, rSig RSig, decryptFunc FineTimestampDecryptFunc) *gw.UplinkFrame {
 	frame.RxInfo.Antenna = uint32(rSig.Ant)
 	frame.RxInfo.Channel = uint32(rSig.Chan)
 	frame.RxInfo.Rssi = int32(rSig.RSSIC)
 	frame.RxInfo.Snr = rSig.LSNR
 
-	if len(rSig.ETime) != 0 {
-		// TODO: handle decrypt and expose as plain fine-timestamp.
+	// Encrypted fine-timestamp (SX1301 v2), the decrypted value is exposed as
+	// plain fine-timestamp.
+	if len(rSig.ETime) != 0 && rxPK.Tmms != nil && decryptFunc != nil {
+		if nanos, ok := decryptFunc(rxPK.AESK, rSig.ETime); ok {
+			d := time.Duration(*rxPK.Tmms) * time.Millisecond
+
+			// take the seconds from the gps time
+			d = d - (d % time.Second)
+			// add the nanos from the fine-timestamp
+			d = d + (time.Duration(nanos) * time.Nanosecond)
+
+			frame.RxInfo.FineTimeSinceGpsEpoch = durationpb.New(d)
+		}
 	}
 
 	return frame
 }
 
+// DecryptFineTimestamp decrypts the given encrypted fine-timestamp using the
+// given AES key. It returns the number of nanoseconds since the last PPS.
+func DecryptFineTimestamp(key lorawan.AES128Key, etime []byte) (uint32, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return 0, errors.Wrap(err, "new cipher error")
+	}
+
+	if len(etime) != block.BlockSize() {
+		return 0, fmt.Errorf("invalid encrypted fine-timestamp length: %d", len(etime))
+	}
+
+	pt := make([]byte, block.BlockSize())
+	block.Decrypt(pt, etime)
+
+	// The last 8 bytes contain the number of nanoseconds since the last PPS.
+	nanos := binary.BigEndian.Uint64(pt[len(pt)-8:])
+	if time.Duration(nanos) >= time.Second {
+		return 0, errors.New("fine-timestamp must be less than one second, is the AES key correct?")
+	}
+
+	return uint32(nanos), nil
+}
+
 func getUplinkFrame(gatewayID lorawan.EUI64, stat *Stat, rxpk RXPK, FakeRxInfoTime bool) (*gw.UplinkFrame, error) {
 	frame := gw.UplinkFrame{
 		PhyPayload: rxpk.Data,
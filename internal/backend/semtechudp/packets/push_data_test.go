@@ -1,6 +1,8 @@
 package packets
 
 import (
+	"crypto/aes"
+	"encoding/binary"
 	"testing"
 	"time"
 
@@ -627,7 +629,7 @@ func TestGetUplinkFrame(t *testing.T) {
 	for _, test := range testTable {
 		t.Run(test.Name, func(t *testing.T) {
 			assert := require.New(t)
-			f, err := test.PushDataPacket.GetUplinkFrames(false, false)
+			f, err := test.PushDataPacket.GetUplinkFrames(false, false, nil)
 			assert.Nil(err)
 
 			for _, ff := range f {
@@ -639,3 +641,99 @@ func TestGetUplinkFrame(t *testing.T) {
 		})
 	}
 }
+
+// encryptFineTimestamp returns the encrypted fine-timestamp for the given
+// number of nanoseconds.
+func encryptFineTimestamp(t *testing.T, key lorawan.AES128Key, nanos uint32) []byte {
+	block, err := aes.NewCipher(key[:])
+	require.NoError(t, err)
+
+	pt := make([]byte, block.BlockSize())
+	binary.BigEndian.PutUint64(pt[8:], uint64(nanos))
+
+	ct := make([]byte, block.BlockSize())
+	block.Encrypt(ct, pt)
+	return ct
+}
+
+func TestDecryptFineTimestamp(t *testing.T) {
+	key := lorawan.AES128Key{1, 2, 3, 4, 5, 6, 7, 8, 1, 2, 3, 4, 5, 6, 7, 8}
+
+	t.Run("Valid", func(t *testing.T) {
+		assert := require.New(t)
+
+		nanos, err := DecryptFineTimestamp(key, encryptFineTimestamp(t, key, 123456789))
+		assert.NoError(err)
+		assert.EqualValues(123456789, nanos)
+	})
+
+	t.Run("Invalid length", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err := DecryptFineTimestamp(key, []byte{1, 2, 3})
+		assert.Error(err)
+	})
+
+	t.Run("Invalid key", func(t *testing.T) {
+		assert := require.New(t)
+
+		etime := encryptFineTimestamp(t, lorawan.AES128Key{8, 7, 6, 5, 4, 3, 2, 1}, 123456789)
+		_, err := DecryptFineTimestamp(key, etime)
+		assert.Error(err)
+	})
+}
+
+func TestGetUplinkFramesFineTimestamp(t *testing.T) {
+	assert := require.New(t)
+
+	key := lorawan.AES128Key{1, 2, 3, 4, 5, 6, 7, 8, 1, 2, 3, 4, 5, 6, 7, 8}
+	tmms := int64(10*time.Minute/time.Millisecond) + 500
+
+	p := PushDataPacket{
+		GatewayMAC:      lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+		ProtocolVersion: ProtocolVersion2,
+		Payload: PushDataPayload{
+			RXPK: []RXPK{
+				{
+					Tmms: &tmms,
+					Freq: 868.3,
+					AESK: 1,
+					Stat: 1,
+					Modu: "LORA",
+					DatR: DatR{LoRa: "SF12BW500"},
+					CodR: "4/5",
+					Data: []byte{1, 2, 3, 4, 5},
+					RSig: []RSig{
+						{
+							Ant:   0,
+							ETime: encryptFineTimestamp(t, key, 123456789),
+						},
+						{
+							Ant:   1,
+							ETime: encryptFineTimestamp(t, key, 987654321),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	decryptFunc := func(aesk uint8, etime []byte) (uint32, bool) {
+		if aesk != 1 {
+			return 0, false
+		}
+		nanos, err := DecryptFineTimestamp(key, etime)
+		return nanos, err == nil
+	}
+
+	frames, err := p.GetUplinkFrames(false, false, decryptFunc)
+	assert.NoError(err)
+	assert.Len(frames, 2)
+	assert.Equal(10*time.Minute+123456789*time.Nanosecond, frames[0].RxInfo.FineTimeSinceGpsEpoch.AsDuration())
+	assert.Equal(10*time.Minute+987654321*time.Nanosecond, frames[1].RxInfo.FineTimeSinceGpsEpoch.AsDuration())
+
+	// without decrypt function, the fine-timestamp is not set
+	frames, err = p.GetUplinkFrames(false, false, nil)
+	assert.NoError(err)
+	assert.Nil(frames[0].RxInfo.FineTimeSinceGpsEpoch)
+}
@@ -8,12 +8,14 @@ import (
 
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/stats"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/storage"
 	"github.com/brocaar/lorawan"
 )
 
 // errors
 var (
 	errGatewayDoesNotExist = errors.New("gateway does not exist")
+	errAddressMismatch     = errors.New("gateway address does not match pinned network")
 )
 
 // gateway contains a connection and meta-data for a gateway connection.
@@ -22,6 +24,15 @@ type gateway struct {
 	addr            *net.UDPAddr
 	lastSeen        time.Time
 	protocolVersion uint8
+
+	// storedAt contains the last-seen timestamp of the persisted gateway.
+	storedAt time.Time
+}
+
+// addressPin contains the network a gateway is pinned to.
+type addressPin struct {
+	network  *net.IPNet
+	lastSeen time.Time
 }
 
 // gateways contains the gateways registry.
@@ -30,6 +41,14 @@ type gateways struct {
 	gateways                  map[lorawan.EUI64]gateway
 	connectionTimeoutDuration time.Duration
 
+	// pins contains the network per gateway, when address pinning is
+	// enabled. This is tracked separately from the gateways, as a gateway
+	// is only added to the gateways on PULL_DATA.
+	pins map[lorawan.EUI64]addressPin
+
+	// store persists the gateways, persistence is disabled when nil.
+	store *storage.Store
+
 	subscribeEventFunc func(events.Subscribe)
 }
 
@@ -60,6 +79,15 @@ func (c *gateways) set(gatewayID lorawan.EUI64, gw gateway) error {
 		connectCounter().Inc()
 	} else {
 		gw.stats = gww.stats
+		gw.storedAt = gww.storedAt
+	}
+
+	// To avoid a write on every PULL_DATA, the last-seen timestamp is only
+	// persisted when it is about to expire.
+	if c.store != nil && (!ok || gw.addr.String() != gww.addr.String() || gw.protocolVersion != gww.protocolVersion ||
+		gw.lastSeen.Sub(gw.storedAt) > c.connectionTimeoutDuration/2) {
+		c.storeGateway(gatewayID, gw)
+		gw.storedAt = gw.lastSeen
 	}
 
 	if c.subscribeEventFunc != nil {
@@ -73,6 +101,37 @@ func (c *gateways) set(gatewayID lorawan.EUI64, gw gateway) error {
 	return nil
 }
 
+// pin pins the gateway to the network (using the given masks) of the given
+// IP address. If the gateway is already pinned, errAddressMismatch is
+// returned in case the IP address is not within the pinned network.
+func (c *gateways) pin(gatewayID lorawan.EUI64, ip net.IP, ipv4Mask, ipv6Mask net.IPMask) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if p, ok := c.pins[gatewayID]; ok {
+		if !p.network.Contains(ip) {
+			return errAddressMismatch
+		}
+
+		p.lastSeen = time.Now()
+		c.pins[gatewayID] = p
+		return nil
+	}
+
+	mask := ipv6Mask
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		mask = ipv4Mask
+	}
+
+	c.pins[gatewayID] = addressPin{
+		network:  &net.IPNet{IP: ip.Mask(mask), Mask: mask},
+		lastSeen: time.Now(),
+	}
+
+	return nil
+}
+
 // cleanup removes inactive gateways from the registry.
 func (c *gateways) cleanup() error {
 	c.Lock()
@@ -90,7 +149,17 @@ func (c *gateways) cleanup() error {
 			}
 
 			delete(c.gateways, gatewayID)
+			c.deleteGateway(gatewayID)
+		}
+	}
+
+	// the pin is removed once the gateway is no longer seen from the
+	// pinned network
+	for gatewayID, p := range c.pins {
+		if p.lastSeen.Before(time.Now().Add(-1 * c.connectionTimeoutDuration)) {
+			delete(c.pins, gatewayID)
 		}
 	}
+
 	return nil
 }
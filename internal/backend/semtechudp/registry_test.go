@@ -0,0 +1,114 @@
+package semtechudp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+)
+
+func TestGatewaysPin(t *testing.T) {
+	tests := []struct {
+		name      string
+		first     string
+		next      string
+		ipv4Len   int
+		ipv6Len   int
+		expectErr bool
+	}{
+		{
+			name:    "same ipv4 address",
+			first:   "192.168.1.10",
+			next:    "192.168.1.10",
+			ipv4Len: 32,
+			ipv6Len: 128,
+		},
+		{
+			name:      "other ipv4 address",
+			first:     "192.168.1.10",
+			next:      "192.168.1.11",
+			ipv4Len:   32,
+			ipv6Len:   128,
+			expectErr: true,
+		},
+		{
+			name:    "ipv4 address within prefix",
+			first:   "192.168.1.10",
+			next:    "192.168.1.11",
+			ipv4Len: 24,
+			ipv6Len: 128,
+		},
+		{
+			name:      "ipv4 address outside prefix",
+			first:     "192.168.1.10",
+			next:      "192.168.2.10",
+			ipv4Len:   24,
+			ipv6Len:   128,
+			expectErr: true,
+		},
+		{
+			name:    "ipv6 address within prefix",
+			first:   "2001:db8::1",
+			next:    "2001:db8::2",
+			ipv4Len: 32,
+			ipv6Len: 64,
+		},
+		{
+			name:      "ipv6 address outside prefix",
+			first:     "2001:db8::1",
+			next:      "2001:db9::1",
+			ipv4Len:   32,
+			ipv6Len:   64,
+			expectErr: true,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			gws := gateways{
+				gateways:                  make(map[lorawan.EUI64]gateway),
+				pins:                      make(map[lorawan.EUI64]addressPin),
+				connectionTimeoutDuration: time.Minute,
+			}
+			gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+			ipv4Mask := net.CIDRMask(tst.ipv4Len, 32)
+			ipv6Mask := net.CIDRMask(tst.ipv6Len, 128)
+
+			assert.NoError(gws.pin(gatewayID, net.ParseIP(tst.first), ipv4Mask, ipv6Mask))
+
+			err := gws.pin(gatewayID, net.ParseIP(tst.next), ipv4Mask, ipv6Mask)
+			if tst.expectErr {
+				assert.Equal(errAddressMismatch, err)
+			} else {
+				assert.NoError(err)
+			}
+		})
+	}
+
+	t.Run("pin expires", func(t *testing.T) {
+		assert := require.New(t)
+
+		gws := gateways{
+			gateways:                  make(map[lorawan.EUI64]gateway),
+			pins:                      make(map[lorawan.EUI64]addressPin),
+			connectionTimeoutDuration: time.Minute,
+		}
+		gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+		ipv4Mask := net.CIDRMask(32, 32)
+		ipv6Mask := net.CIDRMask(128, 128)
+
+		assert.NoError(gws.pin(gatewayID, net.ParseIP("192.168.1.10"), ipv4Mask, ipv6Mask))
+
+		p := gws.pins[gatewayID]
+		p.lastSeen = time.Now().Add(-2 * time.Minute)
+		gws.pins[gatewayID] = p
+		assert.NoError(gws.cleanup())
+
+		assert.NoError(gws.pin(gatewayID, net.ParseIP("192.168.1.11"), ipv4Mask, ipv6Mask))
+	})
+}
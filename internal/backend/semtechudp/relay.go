@@ -0,0 +1,264 @@
+package semtechudp
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/semtechudp/packets"
+	"github.com/brocaar/lorawan"
+)
+
+// relayUpstream contains an upstream UDP server to which the gateway traffic
+// is mirrored.
+type relayUpstream struct {
+	addr *net.UDPAddr
+
+	// downlink indicates that PULL_RESP packets from this upstream are
+	// proxied to the gateway.
+	downlink bool
+}
+
+// relayKey identifies the relay socket of a gateway for an upstream.
+type relayKey struct {
+	gatewayID lorawan.EUI64
+	upstream  int
+}
+
+// relayConn contains the UDP socket used for relaying the traffic of a single
+// gateway to a single upstream. A socket per gateway is needed, as the
+// upstream sends the PULL_RESP packets (which do not contain the gateway ID)
+// to the source address of the PULL_DATA packets.
+type relayConn struct {
+	gatewayID lorawan.EUI64
+	upstream  relayUpstream
+	conn      *net.UDPConn
+	lastSeen  time.Time
+}
+
+// relayDownlink contains the upstream and the original token of a proxied
+// downlink, used for returning the TX_ACK to the upstream.
+type relayDownlink struct {
+	conn  *relayConn
+	token uint16
+}
+
+// relay contains the relay sockets per gateway and upstream.
+type relay struct {
+	sync.Mutex
+	upstreams []relayUpstream
+	conns     map[relayKey]*relayConn
+	timeout   time.Duration
+}
+
+func newRelay(upstreams []relayUpstream, timeout time.Duration) relay {
+	return relay{
+		upstreams: upstreams,
+		conns:     make(map[relayKey]*relayConn),
+		timeout:   timeout,
+	}
+}
+
+// getConns returns the relay sockets for the given gateway. New sockets are
+// returned as second value, as these must be read by the caller.
+func (r *relay) getConns(gatewayID lorawan.EUI64) ([]*relayConn, []*relayConn, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	var out, created []*relayConn
+
+	for i, upstream := range r.upstreams {
+		key := relayKey{gatewayID: gatewayID, upstream: i}
+		rc, ok := r.conns[key]
+		if !ok {
+			conn, err := net.DialUDP("udp", nil, upstream.addr)
+			if err != nil {
+				return nil, created, errors.Wrap(err, "dial udp error")
+			}
+
+			rc = &relayConn{
+				gatewayID: gatewayID,
+				upstream:  upstream,
+				conn:      conn,
+			}
+			r.conns[key] = rc
+			created = append(created, rc)
+		}
+
+		rc.lastSeen = time.Now()
+		out = append(out, rc)
+	}
+
+	return out, created, nil
+}
+
+// cleanup closes the relay sockets of gateways that have not sent any packets
+// within the timeout.
+func (r *relay) cleanup() {
+	r.Lock()
+	defer r.Unlock()
+
+	for key, rc := range r.conns {
+		if rc.lastSeen.Before(time.Now().Add(-1 * r.timeout)) {
+			rc.conn.Close()
+			delete(r.conns, key)
+		}
+	}
+}
+
+// close closes all relay sockets.
+func (r *relay) close() {
+	r.Lock()
+	defer r.Unlock()
+
+	for key, rc := range r.conns {
+		rc.conn.Close()
+		delete(r.conns, key)
+	}
+}
+
+// relayPacket forwards the raw packet of the gateway to all upstreams.
+func (b *Backend) relayPacket(gatewayID lorawan.EUI64, data []byte) {
+	if len(b.relay.upstreams) == 0 {
+		return
+	}
+
+	conns, created, err := b.relay.getConns(gatewayID)
+	for _, rc := range created {
+		go b.readRelayPackets(rc)
+	}
+	if err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Error("backend/semtechudp: get relay connections error")
+		return
+	}
+
+	for _, rc := range conns {
+		b.writeRelayPacket(rc, data)
+	}
+}
+
+func (b *Backend) writeRelayPacket(rc *relayConn, data []byte) {
+	pt, err := packets.GetPacketType(data)
+	if err != nil {
+		log.WithError(err).Error("backend/semtechudp: get packet-type error")
+		return
+	}
+
+	if _, err := rc.conn.Write(data); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"gateway_id": rc.gatewayID,
+			"server":     rc.upstream.addr,
+			"type":       pt,
+		}).Error("backend/semtechudp: write to relay upstream error")
+		return
+	}
+
+	relaySentCounter(rc.upstream.addr.String(), pt.String()).Inc()
+}
+
+func (b *Backend) readRelayPackets(rc *relayConn) {
+	buf := make([]byte, 65507) // max udp data size
+	for {
+		i, err := rc.conn.Read(buf)
+		if err != nil {
+			// The socket is closed on cleanup or when the backend is
+			// stopped.
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			log.WithError(err).WithFields(log.Fields{
+				"gateway_id": rc.gatewayID,
+				"server":     rc.upstream.addr,
+			}).Warning("backend/semtechudp: read from relay upstream error")
+			continue
+		}
+		data := make([]byte, i)
+		copy(data, buf[:i])
+
+		if err := b.handleRelayPacket(rc, data); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"gateway_id": rc.gatewayID,
+				"server":     rc.upstream.addr,
+			}).Error("backend/semtechudp: could not handle relay packet")
+		}
+	}
+}
+
+func (b *Backend) handleRelayPacket(rc *relayConn, data []byte) error {
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.closed {
+		return nil
+	}
+
+	pt, err := packets.GetPacketType(data)
+	if err != nil {
+		return err
+	}
+
+	relayReceivedCounter(rc.upstream.addr.String(), pt.String()).Inc()
+
+	// The PUSH_ACK and PULL_ACK packets are not forwarded, as these are
+	// already sent to the gateway by the bridge.
+	if pt != packets.PullResp {
+		return nil
+	}
+
+	if !rc.upstream.downlink {
+		log.WithFields(log.Fields{
+			"gateway_id": rc.gatewayID,
+			"server":     rc.upstream.addr,
+		}).Warning("backend/semtechudp: downlink from non-downlink relay upstream dropped")
+		return nil
+	}
+
+	var p packets.PullRespPacket
+	if err := p.UnmarshalBinary(data); err != nil {
+		return errors.Wrap(err, "unmarshal PullRespPacket error")
+	}
+
+	gw, err := b.gateways.get(rc.gatewayID)
+	if err != nil {
+		return errors.Wrap(err, "get gateway error")
+	}
+
+	// The token of the upstream is replaced by a token allocated by the
+	// in-flight downlinks registry, such that it does not clash with the
+	// downlinks of the bridge. The original token is restored on TX_ACK.
+	if p.ProtocolVersion != packets.ProtocolVersion1 {
+		token, err := b.downlinks.add(rc.gatewayID, downlink{
+			relay: &relayDownlink{
+				conn:  rc,
+				token: p.RandomToken,
+			},
+		})
+		if err != nil {
+			return errors.Wrap(err, "add downlink error")
+		}
+
+		binary.LittleEndian.PutUint16(data[1:3], token)
+	}
+
+	b.udpSendChan <- udpPacket{
+		data: data,
+		addr: gw.addr,
+	}
+
+	return nil
+}
+
+// handleRelayTXACK returns the TX_ACK to the upstream of the proxied downlink,
+// using the original token of the upstream.
+func (b *Backend) handleRelayTXACK(dl downlink, data []byte) {
+	out := make([]byte, len(data))
+	copy(out, data)
+	binary.LittleEndian.PutUint16(out[1:3], dl.relay.token)
+
+	b.writeRelayPacket(dl.relay.conn, out)
+}
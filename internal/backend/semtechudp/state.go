@@ -0,0 +1,312 @@
+package semtechudp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/stats"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/storage"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+// Store buckets.
+const (
+	gatewaysBucket  = "gateways"
+	downlinksBucket = "downlinks"
+)
+
+// Max number of pending and batched store operations of the downlinks.
+const (
+	downlinksStoreQueueSize = 1024
+	downlinksStoreBatchSize = 64
+)
+
+// gatewayRecord contains the persisted state of a gateway.
+type gatewayRecord struct {
+	Addr            string    `json:"addr"`
+	ProtocolVersion uint8     `json:"protocolVersion"`
+	LastSeen        time.Time `json:"lastSeen"`
+}
+
+// downlinkRecord contains the persisted state of an in-flight downlink. The
+// frame and the tx ack items (as gw.DownlinkTxAck) are encoded as protobuf.
+type downlinkRecord struct {
+	Frame      []byte    `json:"frame"`
+	Index      int       `json:"index"`
+	TxAckItems []byte    `json:"txAckItems"`
+	Expires    time.Time `json:"expires"`
+}
+
+func getDownlinkStoreKey(key downlinkKey) []byte {
+	out := make([]byte, 10)
+	copy(out, key.gatewayID[:])
+	binary.BigEndian.PutUint16(out[8:], key.token)
+	return out
+}
+
+// storeGateway persists the given gateway. Note that this must be called
+// with the lock of the registry held.
+func (c *gateways) storeGateway(gatewayID lorawan.EUI64, gw gateway) {
+	b, err := json.Marshal(gatewayRecord{
+		Addr:            gw.addr.String(),
+		ProtocolVersion: gw.protocolVersion,
+		LastSeen:        gw.lastSeen,
+	})
+	if err == nil {
+		err = c.store.Put(gatewaysBucket, gatewayID[:], b)
+	}
+	if err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Error("backend/semtechudp: store gateway error")
+	}
+}
+
+// deleteGateway deletes the persisted gateway. Note that this must be called
+// with the lock of the registry held.
+func (c *gateways) deleteGateway(gatewayID lorawan.EUI64) {
+	if err := c.store.Delete(gatewaysBucket, gatewayID[:]); err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Error("backend/semtechudp: delete stored gateway error")
+	}
+}
+
+// restore restores the persisted gateways. Gateways that have not been seen
+// within the connection timeout are not restored.
+func (c *gateways) restore() error {
+	c.Lock()
+	defer c.Unlock()
+
+	var expired []lorawan.EUI64
+
+	err := c.store.ForEach(gatewaysBucket, func(k, v []byte) error {
+		var gatewayID lorawan.EUI64
+		copy(gatewayID[:], k)
+
+		var rec gatewayRecord
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return errors.Wrap(err, "unmarshal gateway error")
+		}
+
+		if rec.LastSeen.Before(time.Now().Add(-1 * c.connectionTimeoutDuration)) {
+			expired = append(expired, gatewayID)
+			return nil
+		}
+
+		addr, err := net.ResolveUDPAddr("udp", rec.Addr)
+		if err != nil {
+			return errors.Wrap(err, "resolve udp addr error")
+		}
+
+		c.gateways[gatewayID] = gateway{
+			stats:           stats.NewCollector(),
+			addr:            addr,
+			lastSeen:        rec.LastSeen,
+			protocolVersion: rec.ProtocolVersion,
+			storedAt:        rec.LastSeen,
+		}
+		connectCounter().Inc()
+
+		if c.subscribeEventFunc != nil {
+			c.subscribeEventFunc(events.Subscribe{
+				Subscribe: true,
+				GatewayID: gatewayID,
+			})
+		}
+
+		log.WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"addr":       addr,
+		}).Info("backend/semtechudp: gateway restored")
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, gatewayID := range expired {
+		c.deleteGateway(gatewayID)
+	}
+
+	return nil
+}
+
+// storeDownlink persists the given downlink. Downlinks proxied from a relay
+// upstream are not persisted, as the relay sockets are not restored. Note
+// that this must be called with the lock of the registry held.
+func (d *downlinks) storeDownlink(key downlinkKey, dl downlink) {
+	if d.storeChan == nil || dl.relay != nil {
+		return
+	}
+
+	rec := downlinkRecord{
+		Index:   dl.index,
+		Expires: dl.expires,
+	}
+
+	var err error
+	rec.Frame, err = proto.Marshal(dl.frame)
+	if err == nil {
+		rec.TxAckItems, err = proto.Marshal(&gw.DownlinkTxAck{Items: dl.txAckItems})
+	}
+
+	var b []byte
+	if err == nil {
+		b, err = json.Marshal(rec)
+	}
+	if err != nil {
+		log.WithError(err).WithField("gateway_id", key.gatewayID).Error("backend/semtechudp: store downlink error")
+		return
+	}
+
+	d.enqueueStoreOp(storage.Op{Bucket: downlinksBucket, Key: getDownlinkStoreKey(key), Value: b})
+}
+
+// deleteDownlink deletes the persisted downlink. Note that this must be
+// called with the lock of the registry held.
+func (d *downlinks) deleteDownlink(key downlinkKey, dl downlink) {
+	if d.storeChan == nil || dl.relay != nil {
+		return
+	}
+
+	d.enqueueStoreOp(storage.Op{Bucket: downlinksBucket, Key: getDownlinkStoreKey(key)})
+}
+
+// enqueueStoreOp queues the given change for the store loop. The change is
+// dropped when the queue is full, as blocking would stall the TX_ACK
+// handling while holding the lock of the registry.
+func (d *downlinks) enqueueStoreOp(op storage.Op) {
+	select {
+	case d.storeChan <- op:
+	default:
+		downlinkStoreDroppedCounter().Inc()
+		log.WithField("bucket", op.Bucket).Warning("backend/semtechudp: store queue full, dropping downlink change")
+	}
+}
+
+// startStoreLoop starts the loop writing the downlink changes to the store.
+// It must be called before restoring the downlinks.
+func (d *downlinks) startStoreLoop() {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.store == nil || d.storeChan != nil {
+		return
+	}
+
+	d.storeChan = make(chan storage.Op, downlinksStoreQueueSize)
+	d.storeDone = make(chan struct{})
+	go d.storeLoop(d.storeChan, d.storeDone)
+}
+
+// stopStoreLoop stops the store loop, after the pending changes have been
+// written. Changes made after stopping the loop are not persisted.
+func (d *downlinks) stopStoreLoop() {
+	d.Lock()
+	storeChan, storeDone := d.storeChan, d.storeDone
+	d.storeChan = nil
+	d.Unlock()
+
+	if storeChan == nil {
+		return
+	}
+
+	close(storeChan)
+	<-storeDone
+}
+
+// storeLoop writes the changes, in order, to the store. The changes that are
+// already queued are written in a single transaction.
+func (d *downlinks) storeLoop(storeChan chan storage.Op, storeDone chan struct{}) {
+	defer close(storeDone)
+
+	batch := make([]storage.Op, 0, downlinksStoreBatchSize)
+
+	for op := range storeChan {
+		batch = append(batch[:0], op)
+
+	queued:
+		for len(batch) < downlinksStoreBatchSize {
+			select {
+			case op, ok := <-storeChan:
+				if !ok {
+					break queued
+				}
+				batch = append(batch, op)
+			default:
+				break queued
+			}
+		}
+
+		if err := d.store.Write(batch); err != nil {
+			log.WithError(err).Error("backend/semtechudp: write stored downlinks error")
+		}
+	}
+}
+
+// restore restores the persisted downlinks, such that the TX_ACKs received
+// after a restart can be correlated. Expired downlinks are not restored.
+func (d *downlinks) restore() error {
+	d.Lock()
+	defer d.Unlock()
+
+	var expired []downlinkKey
+
+	err := d.store.ForEach(downlinksBucket, func(k, v []byte) error {
+		if len(k) != 10 {
+			return errors.New("invalid downlink key")
+		}
+
+		var key downlinkKey
+		copy(key.gatewayID[:], k[:8])
+		key.token = binary.BigEndian.Uint16(k[8:])
+
+		var rec downlinkRecord
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return errors.Wrap(err, "unmarshal downlink error")
+		}
+
+		if rec.Expires.Before(time.Now()) {
+			expired = append(expired, key)
+			return nil
+		}
+
+		var frame gw.DownlinkFrame
+		if err := proto.Unmarshal(rec.Frame, &frame); err != nil {
+			return errors.Wrap(err, "unmarshal downlink frame error")
+		}
+
+		var txAck gw.DownlinkTxAck
+		if err := proto.Unmarshal(rec.TxAckItems, &txAck); err != nil {
+			return errors.Wrap(err, "unmarshal tx ack items error")
+		}
+
+		d.downlinks[key] = downlink{
+			frame:      &frame,
+			index:      rec.Index,
+			txAckItems: txAck.Items,
+			expires:    rec.Expires,
+		}
+
+		// continue allocating after the last restored token
+		d.tokens[key.gatewayID] = key.token
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range expired {
+		d.deleteDownlink(key, downlink{})
+	}
+	downlinksInFlightGauge().Set(float64(len(d.downlinks)))
+
+	return nil
+}
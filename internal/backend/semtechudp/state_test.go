@@ -0,0 +1,148 @@
+package semtechudp
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/semtechudp/packets"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/storage"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+func TestState(t *testing.T) {
+	assert := require.New(t)
+
+	tempDir, err := ioutil.TempDir("", "test")
+	assert.NoError(err)
+	defer os.RemoveAll(tempDir)
+
+	store, err := storage.Open(tempDir, "semtechudp")
+	assert.NoError(err)
+	defer store.Close()
+
+	gatewayID1 := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	gatewayID2 := lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}
+
+	newGateways := func() gateways {
+		return gateways{
+			gateways:                  make(map[lorawan.EUI64]gateway),
+			pins:                      make(map[lorawan.EUI64]addressPin),
+			connectionTimeoutDuration: time.Minute,
+			store:                     store,
+		}
+	}
+
+	newDownlinksWithStore := func() *downlinks {
+		d := newDownlinks(time.Minute)
+		d.store = store
+		d.startStoreLoop()
+		return &d
+	}
+
+	t.Run("Gateways", func(t *testing.T) {
+		assert := require.New(t)
+
+		addr, err := net.ResolveUDPAddr("udp", "192.168.1.10:1700")
+		assert.NoError(err)
+
+		gws := newGateways()
+		assert.NoError(gws.set(gatewayID1, gateway{
+			addr:            addr,
+			lastSeen:        time.Now(),
+			protocolVersion: packets.ProtocolVersion2,
+		}))
+		assert.NoError(gws.set(gatewayID2, gateway{
+			addr:            addr,
+			lastSeen:        time.Now().Add(-2 * time.Minute),
+			protocolVersion: packets.ProtocolVersion2,
+		}))
+
+		var subscribed []lorawan.EUI64
+		gws = newGateways()
+		gws.subscribeEventFunc = func(pl events.Subscribe) {
+			subscribed = append(subscribed, pl.GatewayID)
+		}
+		assert.NoError(gws.restore())
+
+		// the expired gateway is not restored
+		assert.Equal([]lorawan.EUI64{gatewayID1}, subscribed)
+		_, err = gws.get(gatewayID2)
+		assert.Equal(errGatewayDoesNotExist, err)
+
+		gw, err := gws.get(gatewayID1)
+		assert.NoError(err)
+		assert.Equal(addr.String(), gw.addr.String())
+		assert.Equal(packets.ProtocolVersion2, gw.protocolVersion)
+		assert.NotNil(gw.stats)
+	})
+
+	t.Run("Downlinks", func(t *testing.T) {
+		assert := require.New(t)
+
+		frame := gw.DownlinkFrame{
+			DownlinkId: 123,
+			GatewayId:  gatewayID1.String(),
+			Items: []*gw.DownlinkFrameItem{
+				{PhyPayload: []byte{1, 2, 3}},
+				{PhyPayload: []byte{4, 5, 6}},
+			},
+		}
+		txAckItems := []*gw.DownlinkTxAckItem{
+			{Status: gw.TxAckStatus_TX_FREQ},
+			{Status: gw.TxAckStatus_IGNORED},
+		}
+
+		d := newDownlinksWithStore()
+		token1, err := d.add(gatewayID1, downlink{frame: &frame, index: 1, txAckItems: txAckItems})
+		assert.NoError(err)
+		token2, err := d.add(gatewayID1, downlink{frame: &frame})
+		assert.NoError(err)
+		_, err = d.pop(gatewayID1, token2)
+		assert.NoError(err)
+
+		// the changes are written when stopping the store loop
+		d.stopStoreLoop()
+
+		d = newDownlinksWithStore()
+		assert.NoError(d.restore())
+		assert.Len(d.downlinks, 1)
+
+		dl, err := d.pop(gatewayID1, token1)
+		assert.NoError(err)
+		assert.True(proto.Equal(&frame, dl.frame))
+		assert.Equal(1, dl.index)
+		assert.Len(dl.txAckItems, 2)
+		assert.Equal(gw.TxAckStatus_TX_FREQ, dl.txAckItems[0].Status)
+
+		// the popped downlink is removed from the store
+		d.stopStoreLoop()
+		d = newDownlinksWithStore()
+		assert.NoError(d.restore())
+		assert.Len(d.downlinks, 0)
+		d.stopStoreLoop()
+
+		// changes made after stopping the store loop are not persisted
+		_, err = d.add(gatewayID1, downlink{frame: &frame})
+		assert.NoError(err)
+
+		d = newDownlinksWithStore()
+		assert.NoError(d.restore())
+		assert.Len(d.downlinks, 0)
+		d.stopStoreLoop()
+
+		// changes are dropped instead of blocking when the queue is full
+		d = newDownlinksWithStore()
+		d.stopStoreLoop()
+		d.storeChan = make(chan storage.Op)
+		_, err = d.add(gatewayID1, downlink{frame: &frame})
+		assert.NoError(err)
+	})
+}
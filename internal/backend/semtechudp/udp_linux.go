@@ -0,0 +1,85 @@
+package semtechudp
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+)
+
+// batchConn reads and writes batches of UDP packets, using the recvmmsg and
+// sendmmsg system calls.
+type batchConn struct {
+	conn      *ipv4.PacketConn
+	readMsgs  []ipv4.Message
+	writeMsgs []ipv4.Message
+}
+
+func newBatchConn(conn *net.UDPConn, batchSize int) *batchConn {
+	c := batchConn{
+		conn:      ipv4.NewPacketConn(conn),
+		readMsgs:  make([]ipv4.Message, batchSize),
+		writeMsgs: make([]ipv4.Message, batchSize),
+	}
+
+	for i := range c.readMsgs {
+		c.readMsgs[i].Buffers = [][]byte{make([]byte, 65507)} // max udp data size
+	}
+
+	return &c
+}
+
+// readBatch blocks until at least one packet has been received and returns
+// the received packets.
+func (c *batchConn) readBatch() ([]udpPacket, error) {
+	n, err := c.conn.ReadBatch(c.readMsgs, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]udpPacket, 0, n)
+	for _, msg := range c.readMsgs[:n] {
+		addr, ok := msg.Addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		data := make([]byte, msg.N)
+		copy(data, msg.Buffers[0][:msg.N])
+		out = append(out, udpPacket{data: data, addr: addr})
+	}
+
+	return out, nil
+}
+
+// writeBatch writes the given packets. The batch size must not exceed the
+// batch size of the batchConn. A packet that fails to be written is logged
+// and skipped.
+func (c *batchConn) writeBatch(pkts []udpPacket) error {
+	if len(pkts) > len(c.writeMsgs) {
+		return errors.New("batch size exceeded")
+	}
+
+	msgs := c.writeMsgs[:len(pkts)]
+	for i := range pkts {
+		msgs[i].Buffers = [][]byte{pkts[i].data}
+		msgs[i].Addr = pkts[i].addr
+	}
+
+	for len(msgs) > 0 {
+		n, err := c.conn.WriteBatch(msgs, 0)
+		if err != nil {
+			// n contains the number of packets written before the
+			// failing packet
+			if n < 0 {
+				n = 0
+			}
+			log.WithError(err).WithField("addr", msgs[n].Addr).Error("backend/semtechudp: write to udp error")
+			n++
+		}
+		msgs = msgs[n:]
+	}
+
+	return nil
+}
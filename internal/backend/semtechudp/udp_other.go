@@ -0,0 +1,50 @@
+//go:build !linux
+// +build !linux
+
+package semtechudp
+
+import (
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// batchConn reads and writes UDP packets. Batched reads and writes are only
+// implemented on Linux, on other platforms a batch contains one packet.
+type batchConn struct {
+	conn *net.UDPConn
+	buf  []byte
+}
+
+func newBatchConn(conn *net.UDPConn, batchSize int) *batchConn {
+	return &batchConn{
+		conn: conn,
+		buf:  make([]byte, 65507), // max udp data size
+	}
+}
+
+// readBatch blocks until a packet has been received and returns the received
+// packet.
+func (c *batchConn) readBatch() ([]udpPacket, error) {
+	i, addr, err := c.conn.ReadFromUDP(c.buf)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, i)
+	copy(data, c.buf[:i])
+
+	return []udpPacket{{data: data, addr: addr}}, nil
+}
+
+// writeBatch writes the given packets. A packet that fails to be written is
+// logged and skipped.
+func (c *batchConn) writeBatch(pkts []udpPacket) error {
+	for _, p := range pkts {
+		if _, err := c.conn.WriteToUDP(p.data, p.addr); err != nil {
+			log.WithError(err).WithField("addr", p.addr).Error("backend/semtechudp: write to udp error")
+		}
+	}
+
+	return nil
+}
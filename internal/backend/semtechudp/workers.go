@@ -0,0 +1,140 @@
+package semtechudp
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+// Queue overflow policies.
+const (
+	overflowDropNewest = "drop_newest"
+	overflowDropOldest = "drop_oldest"
+)
+
+// workerPool handles the received UDP packets using a fixed number of
+// workers, each with a bounded queue. The packets of a gateway are always
+// handled by the same worker, such that they are handled in order.
+//
+// Each worker has a bounded publish queue, from which the uplink frames are
+// published by a separate goroutine. This way the worker does not wait for
+// the integration, while the uplinks of a gateway are still published in
+// order.
+type workerPool struct {
+	queues         []chan udpPacket
+	publishQueues  []chan *gw.UplinkFrame
+	overflowPolicy string
+	wg             sync.WaitGroup
+	publishWg      sync.WaitGroup
+}
+
+func newWorkerPool(workers, queueSize int, overflowPolicy string) *workerPool {
+	p := workerPool{
+		queues:         make([]chan udpPacket, workers),
+		publishQueues:  make([]chan *gw.UplinkFrame, workers),
+		overflowPolicy: overflowPolicy,
+	}
+
+	for i := range p.queues {
+		p.queues[i] = make(chan udpPacket, queueSize)
+		p.publishQueues[i] = make(chan *gw.UplinkFrame, queueSize)
+	}
+
+	return &p
+}
+
+// start starts the workers, calling the given handler for each packet and
+// the given publish func for each uplink frame added using publish.
+func (p *workerPool) start(handler func(udpPacket), publish func(*gw.UplinkFrame)) {
+	p.wg.Add(len(p.queues))
+	for _, q := range p.queues {
+		go func(q chan udpPacket) {
+			defer p.wg.Done()
+			for up := range q {
+				workerQueueGauge().Dec()
+				handler(up)
+			}
+		}(q)
+	}
+
+	p.publishWg.Add(len(p.publishQueues))
+	for _, q := range p.publishQueues {
+		go func(q chan *gw.UplinkFrame) {
+			defer p.publishWg.Done()
+			for pl := range q {
+				publish(pl)
+			}
+		}(q)
+	}
+}
+
+// publish adds the uplink frame to the publish queue of the worker for the
+// given gateway ID. When the queue is full, this blocks until there is room,
+// such that the packets queue up in the (bounded) queue of the worker, to
+// which the overflow policy is applied.
+func (p *workerPool) publish(gatewayID [8]byte, pl *gw.UplinkFrame) {
+	p.publishQueues[p.getGatewayWorker(gatewayID[:])] <- pl
+}
+
+// enqueue adds the packet to the queue of the worker for the gateway of the
+// packet. When the queue is full, the overflow policy is applied. Note that
+// enqueue must be called from a single goroutine.
+func (p *workerPool) enqueue(up udpPacket) {
+	q := p.queues[p.getWorker(up)]
+
+	for {
+		select {
+		case q <- up:
+			workerQueueGauge().Inc()
+			return
+		default:
+		}
+
+		if p.overflowPolicy != overflowDropOldest {
+			queueOverflowCounter(overflowDropNewest).Inc()
+			return
+		}
+
+		// Make room by removing the oldest packet. As the worker might have
+		// taken the packet already, the packet is re-offered in the loop.
+		select {
+		case <-q:
+			workerQueueGauge().Dec()
+			queueOverflowCounter(overflowDropOldest).Inc()
+		default:
+		}
+	}
+}
+
+// close closes the queues and waits until the queued packets have been
+// handled and the queued uplink frames have been published.
+func (p *workerPool) close() {
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.wg.Wait()
+
+	for _, q := range p.publishQueues {
+		close(q)
+	}
+	p.publishWg.Wait()
+}
+
+// getWorker returns the worker index for the given packet. The PUSH_DATA,
+// PULL_DATA and TX_ACK packets contain the gateway ID at bytes 4 - 12.
+// Other packets are assigned to the first worker.
+func (p *workerPool) getWorker(up udpPacket) int {
+	if len(up.data) < 12 {
+		return 0
+	}
+
+	return p.getGatewayWorker(up.data[4:12])
+}
+
+// getGatewayWorker returns the worker index for the given gateway ID.
+func (p *workerPool) getGatewayWorker(gatewayID []byte) int {
+	h := fnv.New32a()
+	h.Write(gatewayID)
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
@@ -0,0 +1,123 @@
+package semtechudp
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+func TestWorkerPool(t *testing.T) {
+	getPacket := func(gatewayID byte, seq byte) udpPacket {
+		return udpPacket{
+			data: []byte{2, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, gatewayID, seq},
+		}
+	}
+
+	t.Run("Ordering per gateway", func(t *testing.T) {
+		assert := require.New(t)
+
+		var mux sync.Mutex
+		received := make(map[byte][]byte)
+
+		p := newWorkerPool(4, 256, overflowDropNewest)
+		p.start(func(up udpPacket) {
+			mux.Lock()
+			defer mux.Unlock()
+			received[up.data[11]] = append(received[up.data[11]], up.data[12])
+		}, func(*gw.UplinkFrame) {})
+
+		for seq := byte(0); seq < 50; seq++ {
+			for gatewayID := byte(0); gatewayID < 5; gatewayID++ {
+				p.enqueue(getPacket(gatewayID, seq))
+			}
+		}
+		p.close()
+
+		assert.Len(received, 5)
+		for _, seqs := range received {
+			assert.Len(seqs, 50)
+			for i := range seqs {
+				assert.EqualValues(i, seqs[i])
+			}
+		}
+	})
+
+	t.Run("Publish ordering per gateway", func(t *testing.T) {
+		assert := require.New(t)
+
+		var mux sync.Mutex
+		published := make(map[string][]uint32)
+
+		p := newWorkerPool(4, 256, overflowDropNewest)
+		p.start(func(up udpPacket) {
+			gatewayID := [8]byte{1, 2, 3, 4, 5, 6, 7, up.data[11]}
+			p.publish(gatewayID, &gw.UplinkFrame{
+				RxInfo: &gw.UplinkRxInfo{
+					GatewayId: fmt.Sprintf("%x", gatewayID),
+					UplinkId:  uint32(up.data[12]),
+				},
+			})
+		}, func(pl *gw.UplinkFrame) {
+			mux.Lock()
+			defer mux.Unlock()
+			published[pl.RxInfo.GatewayId] = append(published[pl.RxInfo.GatewayId], pl.RxInfo.UplinkId)
+		})
+
+		for seq := byte(0); seq < 50; seq++ {
+			for gatewayID := byte(0); gatewayID < 5; gatewayID++ {
+				p.enqueue(getPacket(gatewayID, seq))
+			}
+		}
+		p.close()
+
+		assert.Len(published, 5)
+		for _, ids := range published {
+			assert.Len(ids, 50)
+			for i := range ids {
+				assert.EqualValues(i, ids[i])
+			}
+		}
+	})
+
+	tests := []struct {
+		name     string
+		policy   string
+		expected []byte
+	}{
+		{
+			name:     "drop newest",
+			policy:   overflowDropNewest,
+			expected: []byte{0, 1},
+		},
+		{
+			name:     "drop oldest",
+			policy:   overflowDropOldest,
+			expected: []byte{3, 4},
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			// the workers are started after enqueueing, such that the
+			// queue overflows
+			p := newWorkerPool(1, 2, tst.policy)
+			for seq := byte(0); seq < 5; seq++ {
+				p.enqueue(getPacket(1, seq))
+			}
+
+			var received []byte
+			p.start(func(up udpPacket) {
+				received = append(received, up.data[12])
+			}, func(*gw.UplinkFrame) {})
+			p.close()
+
+			assert.Equal(tst.expected, received)
+		})
+	}
+}
@@ -0,0 +1,512 @@
+// Package simulator implements a backend which generates synthetic gateway
+// traffic, e.g. for load-testing the MQTT broker and network server without
+// any radio hardware.
+package simulator
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/stats"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+var errGatewayDoesNotExist = errors.New("gateway does not exist")
+
+// Bounds of the simulated signal quality.
+const (
+	rssiMax = -30
+	snrMin  = -20
+	snrMax  = 15
+)
+
+// fadingRatio defines the std. deviation of the per-uplink RSSI and SNR
+// variation, relative to the configured std. deviation used for the
+// per-device signal quality.
+const fadingRatio = 0.25
+
+// txAckError defines the ratio of downlinks which are acknowledged using the
+// given (error) status.
+type txAckError struct {
+	status gw.TxAckStatus
+	ratio  float64
+}
+
+// device contains the state of a simulated device. The devices are only
+// accessed by the uplink loop of the gateway to which they belong.
+type device struct {
+	devEUI   lorawan.EUI64
+	devAddr  lorawan.DevAddr
+	fCnt     uint32
+	devNonce lorawan.DevNonce
+
+	// The signal quality and spreading-factor are fixed per device, as these
+	// mostly depend on the distance to the gateway.
+	rssi            float64
+	snr             float64
+	spreadingFactor uint32
+}
+
+// gateway contains the state of a simulated gateway.
+type gateway struct {
+	gatewayID lorawan.EUI64
+	devices   []device
+	stats     *stats.Collector
+}
+
+// Backend implements a simulator backend.
+type Backend struct {
+	downlinkTxAckFunc  func(*gw.DownlinkTxAck)
+	uplinkFrameFunc    func(*gw.UplinkFrame)
+	gatewayStatsFunc   func(*gw.GatewayStats)
+	subscribeEventFunc func(events.Subscribe)
+
+	gateways     []*gateway
+	gatewaysByID map[lorawan.EUI64]*gateway
+
+	joinEUI          lorawan.EUI64
+	deviceKey        lorawan.AES128Key
+	uplinkInterval   time.Duration
+	joinRequestRatio float64
+	payloadSize      int
+	frequencies      []uint32
+	bandwidth        uint32
+	rssiStdDev       float64
+	snrStdDev        float64
+	statsInterval    time.Duration
+	txAckErrors      []txAckError
+
+	startTime time.Time
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewBackend creates a new Backend.
+func NewBackend(conf config.Config) (*Backend, error) {
+	c := conf.Backend.Simulator
+
+	log.WithFields(log.Fields{
+		"gateways":            c.Gateways,
+		"devices_per_gateway": c.DevicesPerGateway,
+		"uplink_interval":     c.UplinkInterval,
+	}).Info("backend/simulator: setting up backend")
+
+	if len(c.Frequencies) == 0 {
+		return nil, errors.New("at least one frequency must be configured")
+	}
+	if len(c.SpreadingFactors) == 0 {
+		return nil, errors.New("at least one spreading-factor must be configured")
+	}
+
+	b := Backend{
+		gatewaysByID:     make(map[lorawan.EUI64]*gateway),
+		uplinkInterval:   c.UplinkInterval,
+		joinRequestRatio: c.JoinRequestRatio,
+		payloadSize:      c.PayloadSize,
+		frequencies:      c.Frequencies,
+		bandwidth:        c.Bandwidth,
+		rssiStdDev:       c.RSSIStdDev,
+		snrStdDev:        c.SNRStdDev,
+		statsInterval:    c.StatsInterval,
+		done:             make(chan struct{}),
+	}
+
+	var gatewayIDBase, devEUIBase lorawan.EUI64
+	var devAddrBase lorawan.DevAddr
+
+	if err := gatewayIDBase.UnmarshalText([]byte(c.GatewayIDBase)); err != nil {
+		return nil, errors.Wrap(err, "decode gateway_id_base error")
+	}
+	if err := devEUIBase.UnmarshalText([]byte(c.DevEUIBase)); err != nil {
+		return nil, errors.Wrap(err, "decode dev_eui_base error")
+	}
+	if err := devAddrBase.UnmarshalText([]byte(c.DevAddrBase)); err != nil {
+		return nil, errors.Wrap(err, "decode dev_addr_base error")
+	}
+	if err := b.joinEUI.UnmarshalText([]byte(c.JoinEUI)); err != nil {
+		return nil, errors.Wrap(err, "decode join_eui error")
+	}
+	if err := b.deviceKey.UnmarshalText([]byte(c.DeviceKey)); err != nil {
+		return nil, errors.Wrap(err, "decode device_key error")
+	}
+
+	var ratioSum float64
+	for _, e := range c.TxAckErrors {
+		status, ok := gw.TxAckStatus_value[e.Status]
+		if !ok || gw.TxAckStatus(status) == gw.TxAckStatus_OK || gw.TxAckStatus(status) == gw.TxAckStatus_IGNORED {
+			return nil, fmt.Errorf("invalid tx ack error status: %s", e.Status)
+		}
+		ratioSum += e.Ratio
+
+		b.txAckErrors = append(b.txAckErrors, txAckError{
+			status: gw.TxAckStatus(status),
+			ratio:  e.Ratio,
+		})
+	}
+	if ratioSum > 1 {
+		return nil, errors.New("the sum of the tx ack error ratios must not exceed 1")
+	}
+
+	for i := 0; i < c.Gateways; i++ {
+		g := gateway{
+			gatewayID: addEUI64(gatewayIDBase, uint64(i)),
+			stats:     stats.NewCollector(),
+		}
+
+		for j := 0; j < c.DevicesPerGateway; j++ {
+			n := i*c.DevicesPerGateway + j
+
+			g.devices = append(g.devices, device{
+				devEUI:          addEUI64(devEUIBase, uint64(n)),
+				devAddr:         addDevAddr(devAddrBase, uint32(n)),
+				rssi:            c.RSSIMean + rand.NormFloat64()*c.RSSIStdDev,
+				snr:             c.SNRMean + rand.NormFloat64()*c.SNRStdDev,
+				spreadingFactor: c.SpreadingFactors[rand.Intn(len(c.SpreadingFactors))],
+			})
+		}
+
+		b.gateways = append(b.gateways, &g)
+		b.gatewaysByID[g.gatewayID] = &g
+	}
+
+	return &b, nil
+}
+
+// Start starts the backend.
+func (b *Backend) Start() error {
+	b.startTime = time.Now()
+
+	for _, g := range b.gateways {
+		if b.subscribeEventFunc != nil {
+			b.subscribeEventFunc(events.Subscribe{Subscribe: true, GatewayID: g.gatewayID})
+		}
+
+		b.wg.Add(1)
+		go b.uplinkLoop(g, rand.New(rand.NewSource(rand.Int63())))
+	}
+
+	if b.statsInterval != 0 {
+		b.wg.Add(1)
+		go b.statsLoop()
+	}
+
+	return nil
+}
+
+// Stop stops the backend.
+func (b *Backend) Stop() error {
+	log.Info("backend/simulator: closing gateway backend")
+
+	close(b.done)
+	b.wg.Wait()
+
+	for _, g := range b.gateways {
+		if b.subscribeEventFunc != nil {
+			b.subscribeEventFunc(events.Subscribe{Subscribe: false, GatewayID: g.gatewayID})
+		}
+	}
+
+	return nil
+}
+
+// SetDownlinkTxAckFunc sets the DownlinkTXAck handler func.
+func (b *Backend) SetDownlinkTxAckFunc(f func(*gw.DownlinkTxAck)) {
+	b.downlinkTxAckFunc = f
+}
+
+// SetGatewayStatsFunc sets the GatewayStats handler func.
+func (b *Backend) SetGatewayStatsFunc(f func(*gw.GatewayStats)) {
+	b.gatewayStatsFunc = f
+}
+
+// SetUplinkFrameFunc sets the UplinkFrame handler func.
+func (b *Backend) SetUplinkFrameFunc(f func(*gw.UplinkFrame)) {
+	b.uplinkFrameFunc = f
+}
+
+// SetRawPacketForwarderEventFunc sets the RawPacketForwarderEvent handler func.
+func (b *Backend) SetRawPacketForwarderEventFunc(f func(*gw.RawPacketForwarderEvent)) {
+	// not provided by the simulator.
+}
+
+// SetSubscribeEventFunc sets the Subscribe handler func.
+func (b *Backend) SetSubscribeEventFunc(f func(events.Subscribe)) {
+	b.subscribeEventFunc = f
+}
+
+// SendDownlinkFrame acknowledges the given downlink frame. The status of each
+// item is selected randomly using the configured tx ack error ratios. Items
+// following an item with status OK are ignored, like a gateway would do.
+func (b *Backend) SendDownlinkFrame(pl *gw.DownlinkFrame) error {
+	var gatewayID lorawan.EUI64
+	if err := gatewayID.UnmarshalText([]byte(pl.GetGatewayId())); err != nil {
+		return errors.Wrap(err, "decode gateway id error")
+	}
+
+	g, ok := b.gatewaysByID[gatewayID]
+	if !ok {
+		return errGatewayDoesNotExist
+	}
+
+	ack := gw.DownlinkTxAck{
+		GatewayId:  pl.GetGatewayId(),
+		DownlinkId: pl.GetDownlinkId(),
+		Items:      make([]*gw.DownlinkTxAckItem, len(pl.GetItems())),
+	}
+
+	var sent bool
+	for i := range ack.Items {
+		status := gw.TxAckStatus_IGNORED
+		if !sent {
+			status = b.getTxAckStatus()
+			sent = status == gw.TxAckStatus_OK
+			txAckCounter(status.String()).Inc()
+		}
+
+		ack.Items[i] = &gw.DownlinkTxAckItem{
+			Status: status,
+		}
+	}
+
+	g.stats.CountDownlink(pl, &ack)
+
+	log.WithFields(log.Fields{
+		"gateway_id":  gatewayID,
+		"downlink_id": pl.GetDownlinkId(),
+	}).Debug("backend/simulator: downlink-frame acknowledged")
+
+	if b.downlinkTxAckFunc != nil {
+		b.downlinkTxAckFunc(&ack)
+	}
+
+	return nil
+}
+
+// ApplyConfiguration applies the given configuration to the gateway.
+func (b *Backend) ApplyConfiguration(pl *gw.GatewayConfiguration) error {
+	log.WithFields(log.Fields{
+		"gateway_id": pl.GetGatewayId(),
+		"version":    pl.GetVersion(),
+	}).Info("backend/simulator: ignoring gateway-configuration")
+
+	return nil
+}
+
+// RawPacketForwarderCommand sends the given raw command to the packet-forwarder.
+func (b *Backend) RawPacketForwarderCommand(*gw.RawPacketForwarderCommand) error {
+	return errors.New("raw packet-forwarder command not implemented by simulator")
+}
+
+func (b *Backend) getTxAckStatus() gw.TxAckStatus {
+	x := rand.Float64()
+	for _, e := range b.txAckErrors {
+		if x < e.ratio {
+			return e.status
+		}
+		x -= e.ratio
+	}
+	return gw.TxAckStatus_OK
+}
+
+// uplinkLoop generates the uplinks of the devices of the given gateway. The
+// uplinks are generated as a Poisson process, such that each device sends on
+// average one uplink per uplink interval.
+func (b *Backend) uplinkLoop(g *gateway, r *rand.Rand) {
+	defer b.wg.Done()
+
+	if len(g.devices) == 0 || b.uplinkInterval == 0 {
+		return
+	}
+
+	mean := float64(b.uplinkInterval) / float64(len(g.devices))
+	timer := time.NewTimer(time.Duration(r.ExpFloat64() * mean))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-timer.C:
+		}
+
+		dev := &g.devices[r.Intn(len(g.devices))]
+		frame, err := b.newUplinkFrame(g, dev, r)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"gateway_id": g.gatewayID,
+				"dev_eui":    dev.devEUI,
+			}).Error("backend/simulator: create uplink frame error")
+		} else {
+			g.stats.CountUplink(frame)
+
+			if b.uplinkFrameFunc != nil {
+				b.uplinkFrameFunc(frame)
+			}
+		}
+
+		timer.Reset(time.Duration(r.ExpFloat64() * mean))
+	}
+}
+
+func (b *Backend) statsLoop() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.statsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		}
+
+		for _, g := range b.gateways {
+			stats := g.stats.ExportStats()
+			stats.GatewayId = g.gatewayID.String()
+			stats.Time = timestamppb.Now()
+			stats.Metadata = map[string]string{
+				"simulator": "true",
+			}
+
+			gatewayStatsCounter().Inc()
+
+			if b.gatewayStatsFunc != nil {
+				b.gatewayStatsFunc(stats)
+			}
+		}
+	}
+}
+
+func (b *Backend) newUplinkFrame(g *gateway, dev *device, r *rand.Rand) (*gw.UplinkFrame, error) {
+	var phy lorawan.PHYPayload
+	var err error
+
+	if r.Float64() < b.joinRequestRatio {
+		phy, err = b.newJoinRequest(dev)
+		uplinkCounter("join_request").Inc()
+	} else {
+		phy, err = b.newDataUp(dev, r)
+		uplinkCounter("data_up").Inc()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	phyB, err := phy.MarshalBinary()
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal phypayload error")
+	}
+
+	// The context contains the internal concentrator counter (in us), which
+	// is used for scheduling Class-A downlinks.
+	ctx := make([]byte, 4)
+	binary.BigEndian.PutUint32(ctx, uint32(time.Since(b.startTime)/time.Microsecond))
+
+	return &gw.UplinkFrame{
+		PhyPayload: phyB,
+		TxInfo: &gw.UplinkTxInfo{
+			Frequency: b.frequencies[r.Intn(len(b.frequencies))],
+			Modulation: &gw.Modulation{
+				Parameters: &gw.Modulation_Lora{
+					Lora: &gw.LoraModulationInfo{
+						Bandwidth:       b.bandwidth,
+						SpreadingFactor: dev.spreadingFactor,
+						CodeRate:        gw.CodeRate_CR_4_5,
+					},
+				},
+			},
+		},
+		RxInfo: &gw.UplinkRxInfo{
+			GatewayId: g.gatewayID.String(),
+			UplinkId:  r.Uint32(),
+			GwTime:    timestamppb.Now(),
+			Rssi:      int32(math.Min(dev.rssi+r.NormFloat64()*b.rssiStdDev*fadingRatio, rssiMax)),
+			Snr:       float32(math.Max(math.Min(dev.snr+r.NormFloat64()*b.snrStdDev*fadingRatio, snrMax), snrMin)),
+			Context:   ctx,
+			CrcStatus: gw.CRCStatus_CRC_OK,
+		},
+	}, nil
+}
+
+func (b *Backend) newJoinRequest(dev *device) (lorawan.PHYPayload, error) {
+	dev.devNonce++
+
+	phy := lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{
+			MType: lorawan.JoinRequest,
+			Major: lorawan.LoRaWANR1,
+		},
+		MACPayload: &lorawan.JoinRequestPayload{
+			JoinEUI:  b.joinEUI,
+			DevEUI:   dev.devEUI,
+			DevNonce: dev.devNonce,
+		},
+	}
+
+	if err := phy.SetUplinkJoinMIC(b.deviceKey); err != nil {
+		return phy, errors.Wrap(err, "set uplink join mic error")
+	}
+
+	return phy, nil
+}
+
+func (b *Backend) newDataUp(dev *device, r *rand.Rand) (lorawan.PHYPayload, error) {
+	fPort := uint8(1)
+	payload := make([]byte, b.payloadSize)
+	r.Read(payload)
+
+	phy := lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{
+			MType: lorawan.UnconfirmedDataUp,
+			Major: lorawan.LoRaWANR1,
+		},
+		MACPayload: &lorawan.MACPayload{
+			FHDR: lorawan.FHDR{
+				DevAddr: dev.devAddr,
+				FCtrl: lorawan.FCtrl{
+					ADR: true,
+				},
+				FCnt: dev.fCnt,
+			},
+			FPort: &fPort,
+			FRMPayload: []lorawan.Payload{
+				&lorawan.DataPayload{Bytes: payload},
+			},
+		},
+	}
+	dev.fCnt++
+
+	if err := phy.EncryptFRMPayload(b.deviceKey); err != nil {
+		return phy, errors.Wrap(err, "encrypt frmpayload error")
+	}
+
+	if err := phy.SetUplinkDataMIC(lorawan.LoRaWAN1_0, 0, 0, 0, b.deviceKey, b.deviceKey); err != nil {
+		return phy, errors.Wrap(err, "set uplink data mic error")
+	}
+
+	return phy, nil
+}
+
+func addEUI64(base lorawan.EUI64, n uint64) lorawan.EUI64 {
+	var out lorawan.EUI64
+	binary.BigEndian.PutUint64(out[:], binary.BigEndian.Uint64(base[:])+n)
+	return out
+}
+
+func addDevAddr(base lorawan.DevAddr, n uint32) lorawan.DevAddr {
+	var out lorawan.DevAddr
+	binary.BigEndian.PutUint32(out[:], binary.BigEndian.Uint32(base[:])+n)
+	return out
+}
@@ -0,0 +1,190 @@
+package simulator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+func getConfig() config.Config {
+	var conf config.Config
+	c := &conf.Backend.Simulator
+	c.Gateways = 2
+	c.DevicesPerGateway = 5
+	c.GatewayIDBase = "0102030405060700"
+	c.DevEUIBase = "0000000000000100"
+	c.DevAddrBase = "01000000"
+	c.JoinEUI = "0000000000000000"
+	c.DeviceKey = "01020304050607080102030405060708"
+	c.UplinkInterval = 10 * time.Millisecond
+	c.PayloadSize = 5
+	c.Frequencies = []uint32{868100000}
+	c.SpreadingFactors = []uint32{7}
+	c.Bandwidth = 125000
+	c.RSSIMean = -100
+	c.RSSIStdDev = 10
+	c.SNRMean = 5
+	c.SNRStdDev = 4
+	c.StatsInterval = 10 * time.Millisecond
+	return conf
+}
+
+func TestNewBackend(t *testing.T) {
+	t.Run("Invalid tx ack error status", func(t *testing.T) {
+		assert := require.New(t)
+
+		conf := getConfig()
+		conf.Backend.Simulator.TxAckErrors = append(conf.Backend.Simulator.TxAckErrors, struct {
+			Status string  `mapstructure:"status"`
+			Ratio  float64 `mapstructure:"ratio"`
+		}{Status: "OK", Ratio: 0.5})
+
+		_, err := NewBackend(conf)
+		assert.EqualError(err, "invalid tx ack error status: OK")
+	})
+
+	t.Run("Gateway and device IDs", func(t *testing.T) {
+		assert := require.New(t)
+
+		b, err := NewBackend(getConfig())
+		assert.NoError(err)
+
+		assert.Len(b.gateways, 2)
+		assert.Equal(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 0}, b.gateways[0].gatewayID)
+		assert.Equal(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 1}, b.gateways[1].gatewayID)
+		assert.Len(b.gateways[1].devices, 5)
+		assert.Equal(lorawan.EUI64{0, 0, 0, 0, 0, 0, 1, 5}, b.gateways[1].devices[0].devEUI)
+		assert.Equal(lorawan.DevAddr{1, 0, 0, 5}, b.gateways[1].devices[0].devAddr)
+	})
+}
+
+func TestBackend(t *testing.T) {
+	assert := require.New(t)
+
+	conf := getConfig()
+	conf.Backend.Simulator.TxAckErrors = append(conf.Backend.Simulator.TxAckErrors, struct {
+		Status string  `mapstructure:"status"`
+		Ratio  float64 `mapstructure:"ratio"`
+	}{Status: "COLLISION_PACKET", Ratio: 1})
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+
+	uplinkFrameChan := make(chan *gw.UplinkFrame, 100)
+	gatewayStatsChan := make(chan *gw.GatewayStats, 100)
+	downlinkTxAckChan := make(chan *gw.DownlinkTxAck, 1)
+	subscribeChan := make(chan events.Subscribe, 10)
+
+	b.SetUplinkFrameFunc(func(pl *gw.UplinkFrame) {
+		select {
+		case uplinkFrameChan <- pl:
+		default:
+		}
+	})
+	b.SetGatewayStatsFunc(func(pl *gw.GatewayStats) {
+		select {
+		case gatewayStatsChan <- pl:
+		default:
+		}
+	})
+	b.SetDownlinkTxAckFunc(func(pl *gw.DownlinkTxAck) {
+		downlinkTxAckChan <- pl
+	})
+	b.SetSubscribeEventFunc(func(pl events.Subscribe) {
+		subscribeChan <- pl
+	})
+
+	assert.NoError(b.Start())
+	assert.Equal(events.Subscribe{Subscribe: true, GatewayID: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 0}}, <-subscribeChan)
+	assert.Equal(events.Subscribe{Subscribe: true, GatewayID: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 1}}, <-subscribeChan)
+
+	t.Run("Uplink", func(t *testing.T) {
+		assert := require.New(t)
+
+		up := <-uplinkFrameChan
+		assert.Equal(uint32(868100000), up.GetTxInfo().GetFrequency())
+		assert.Equal(uint32(7), up.GetTxInfo().GetModulation().GetLora().GetSpreadingFactor())
+		assert.Equal(gw.CRCStatus_CRC_OK, up.GetRxInfo().GetCrcStatus())
+		assert.LessOrEqual(up.GetRxInfo().GetRssi(), int32(rssiMax))
+		assert.Len(up.GetRxInfo().GetContext(), 4)
+
+		var phy lorawan.PHYPayload
+		assert.NoError(phy.UnmarshalBinary(up.PhyPayload))
+		assert.Equal(lorawan.UnconfirmedDataUp, phy.MHDR.MType)
+
+		ok, err := phy.ValidateUplinkDataMIC(lorawan.LoRaWAN1_0, 0, 0, 0, b.deviceKey, b.deviceKey)
+		assert.NoError(err)
+		assert.True(ok)
+	})
+
+	t.Run("Gateway stats", func(t *testing.T) {
+		assert := require.New(t)
+
+		stats := <-gatewayStatsChan
+		assert.NotEqual("", stats.GatewayId)
+		assert.NotNil(stats.Time)
+	})
+
+	t.Run("Downlink", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(b.SendDownlinkFrame(&gw.DownlinkFrame{
+			GatewayId:  "0102030405060700",
+			DownlinkId: 123,
+			Items: []*gw.DownlinkFrameItem{
+				{PhyPayload: []byte{1, 2, 3}},
+				{PhyPayload: []byte{4, 5, 6}},
+			},
+		}))
+
+		ack := <-downlinkTxAckChan
+		assert.Equal(uint32(123), ack.DownlinkId)
+		assert.Len(ack.Items, 2)
+		assert.Equal(gw.TxAckStatus_COLLISION_PACKET, ack.Items[0].Status)
+		assert.Equal(gw.TxAckStatus_COLLISION_PACKET, ack.Items[1].Status)
+
+		assert.Equal(errGatewayDoesNotExist, b.SendDownlinkFrame(&gw.DownlinkFrame{
+			GatewayId: "0807060504030201",
+		}))
+	})
+
+	assert.NoError(b.Stop())
+	assert.False((<-subscribeChan).Subscribe)
+	assert.False((<-subscribeChan).Subscribe)
+}
+
+func TestJoinRequest(t *testing.T) {
+	assert := require.New(t)
+
+	conf := getConfig()
+	conf.Backend.Simulator.JoinRequestRatio = 1
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+
+	uplinkFrameChan := make(chan *gw.UplinkFrame, 100)
+	b.SetUplinkFrameFunc(func(pl *gw.UplinkFrame) {
+		select {
+		case uplinkFrameChan <- pl:
+		default:
+		}
+	})
+
+	assert.NoError(b.Start())
+	up := <-uplinkFrameChan
+	assert.NoError(b.Stop())
+
+	var phy lorawan.PHYPayload
+	assert.NoError(phy.UnmarshalBinary(up.PhyPayload))
+	assert.Equal(lorawan.JoinRequest, phy.MHDR.MType)
+
+	ok, err := phy.ValidateUplinkJoinMIC(b.deviceKey)
+	assert.NoError(err)
+	assert.True(ok)
+}
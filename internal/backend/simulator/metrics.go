@@ -0,0 +1,35 @@
+package simulator
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	uc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_simulator_uplink_count",
+		Help: "The number of simulated uplinks (per message type).",
+	}, []string{"type"})
+
+	tac = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_simulator_tx_ack_count",
+		Help: "The number of simulated downlink acknowledgements (per status).",
+	}, []string{"status"})
+
+	gsc = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backend_simulator_gateway_stats_count",
+		Help: "The number of simulated gateway stats.",
+	})
+)
+
+func uplinkCounter(t string) prometheus.Counter {
+	return uc.With(prometheus.Labels{"type": t})
+}
+
+func txAckCounter(s string) prometheus.Counter {
+	return tac.With(prometheus.Labels{"status": s})
+}
+
+func gatewayStatsCounter() prometheus.Counter {
+	return gsc
+}
@@ -0,0 +1,247 @@
+// Package capture implements the recording of the raw gateway traffic of a
+// backend to a (rotating) capture file and the reading of these captures, such
+// that they can be replayed through the backend.
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Directions.
+const (
+	// DirectionIn is used for messages received from the gateway.
+	DirectionIn = "in"
+
+	// DirectionOut is used for messages sent to the gateway.
+	DirectionOut = "out"
+)
+
+// Websocket message types.
+const (
+	MessageTypeText   = "text"
+	MessageTypeBinary = "binary"
+)
+
+// Record contains a single captured message. The captures are stored as
+// JSON lines, one record per line.
+type Record struct {
+	Time        time.Time `json:"time"`
+	Backend     string    `json:"backend"`
+	Direction   string    `json:"direction"`
+	Addr        string    `json:"addr,omitempty"`
+	GatewayID   string    `json:"gatewayID,omitempty"`
+	MessageType string    `json:"messageType,omitempty"`
+	Data        []byte    `json:"data"`
+}
+
+// Replayer defines the interface of a backend which is able to replay
+// captured traffic.
+type Replayer interface {
+	// Replay feeds the captured messages of the given reader to the backend.
+	// The speed is relative to the original speed, replaying without delays
+	// when set to 0.
+	Replay(r *Reader, speed float64) error
+}
+
+// Writer appends records to a capture file. When the file exceeds the max.
+// size, it is rotated. All methods of a nil Writer are no-ops, such that
+// callers do not need to check if capturing has been enabled.
+type Writer struct {
+	sync.Mutex
+
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	f    *os.File
+	size int64
+}
+
+// NewWriter creates a new Writer for the given path. When the file exceeds
+// maxSize bytes, it is rotated, keeping maxFiles rotated files (path.1 being
+// the most recent). Rotation is disabled when maxSize is 0. It returns nil
+// when the path is not set.
+func NewWriter(path string, maxSize int64, maxFiles int) (*Writer, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	w := Writer{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return &w, nil
+}
+
+// Write appends the given record to the capture file. When the time of the
+// record is not set, it is set to the current time.
+func (w *Writer) Write(rec Record) error {
+	if w == nil {
+		return nil
+	}
+
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrap(err, "marshal record error")
+	}
+	b = append(b, '\n')
+
+	w.Lock()
+	defer w.Unlock()
+
+	if w.maxSize != 0 && w.size != 0 && w.size+int64(len(b)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return errors.Wrap(err, "rotate capture file error")
+		}
+	}
+
+	n, err := w.f.Write(b)
+	w.size += int64(n)
+	if err != nil {
+		return errors.Wrap(err, "write capture file error")
+	}
+
+	return nil
+}
+
+// Close closes the capture file.
+func (w *Writer) Close() error {
+	if w == nil {
+		return nil
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	return w.f.Close()
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "open capture file error")
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "stat capture file error")
+	}
+
+	w.f = f
+	w.size = fi.Size()
+
+	return nil
+}
+
+// rotate shifts the rotated files (path.1 becomes path.2 etc.), moves the
+// current file to path.1 and opens a new file. Note that this must be called
+// with the lock held.
+func (w *Writer) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return errors.Wrap(err, "close capture file error")
+	}
+
+	if w.maxFiles == 0 {
+		if err := os.Remove(w.path); err != nil {
+			return errors.Wrap(err, "remove capture file error")
+		}
+		return w.open()
+	}
+
+	for i := w.maxFiles - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "rename capture file error")
+		}
+	}
+
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		return errors.Wrap(err, "rename capture file error")
+	}
+
+	return w.open()
+}
+
+// Reader reads the records of a capture.
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader creates a new Reader.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r: bufio.NewReader(r),
+	}
+}
+
+// Next returns the next record. It returns io.EOF when all records have been
+// read.
+func (r *Reader) Next() (Record, error) {
+	var rec Record
+
+	for {
+		b, err := r.r.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(b) == 0) {
+			return rec, err
+		}
+
+		// skip empty lines
+		b = bytes.TrimSpace(b)
+		if len(b) == 0 {
+			continue
+		}
+
+		if err := json.Unmarshal(b, &rec); err != nil {
+			return rec, errors.Wrap(err, "unmarshal record error")
+		}
+
+		return rec, nil
+	}
+}
+
+// Replay calls the given function for each record of the reader. Between the
+// records, it waits for the time elapsed between the original records, divided
+// by the given speed. When the speed is 0, the records are replayed without
+// delays.
+func Replay(r *Reader, speed float64, fn func(Record) error) error {
+	var prev time.Time
+
+	for {
+		rec, err := r.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if speed != 0 && !prev.IsZero() && rec.Time.After(prev) {
+			time.Sleep(time.Duration(float64(rec.Time.Sub(prev)) / speed))
+		}
+		prev = rec.Time
+
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package capture
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriter(t *testing.T) {
+	assert := require.New(t)
+
+	tempDir, err := ioutil.TempDir("", "test")
+	assert.NoError(err)
+	defer os.RemoveAll(tempDir)
+
+	readAll := func(path string) []Record {
+		f, err := os.Open(path)
+		assert.NoError(err)
+		defer f.Close()
+
+		var out []Record
+		r := NewReader(f)
+		for {
+			rec, err := r.Next()
+			if err == io.EOF {
+				return out
+			}
+			assert.NoError(err)
+			out = append(out, rec)
+		}
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		assert := require.New(t)
+
+		w, err := NewWriter("", 0, 0)
+		assert.NoError(err)
+		assert.Nil(w)
+		assert.NoError(w.Write(Record{}))
+		assert.NoError(w.Close())
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		assert := require.New(t)
+
+		path := filepath.Join(tempDir, "write.jsonl")
+		w, err := NewWriter(path, 0, 0)
+		assert.NoError(err)
+
+		assert.NoError(w.Write(Record{Backend: "semtech_udp", Direction: DirectionIn, Addr: "192.0.2.1:1700", Data: []byte{1, 2, 3}}))
+		assert.NoError(w.Write(Record{Backend: "semtech_udp", Direction: DirectionOut, Addr: "192.0.2.1:1700", Data: []byte{4, 5, 6}}))
+		assert.NoError(w.Close())
+
+		recs := readAll(path)
+		assert.Len(recs, 2)
+		assert.False(recs[0].Time.IsZero())
+		assert.Equal(DirectionIn, recs[0].Direction)
+		assert.Equal([]byte{1, 2, 3}, recs[0].Data)
+		assert.Equal(DirectionOut, recs[1].Direction)
+		assert.Equal([]byte{4, 5, 6}, recs[1].Data)
+	})
+
+	t.Run("Rotate", func(t *testing.T) {
+		assert := require.New(t)
+
+		path := filepath.Join(tempDir, "rotate.jsonl")
+
+		// each record exceeds half of the max. size, so that each write
+		// results in a rotation
+		w, err := NewWriter(path, 100, 2)
+		assert.NoError(err)
+
+		for i := 0; i < 4; i++ {
+			assert.NoError(w.Write(Record{Backend: "semtech_udp", Data: []byte{byte(i)}}))
+		}
+		assert.NoError(w.Close())
+
+		assert.Equal([]byte{3}, readAll(path)[0].Data)
+		assert.Equal([]byte{2}, readAll(path + ".1")[0].Data)
+		assert.Equal([]byte{1}, readAll(path + ".2")[0].Data)
+
+		_, err = os.Stat(path + ".3")
+		assert.True(os.IsNotExist(err))
+	})
+}
+
+func TestReplay(t *testing.T) {
+	assert := require.New(t)
+
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":"2020-01-01T00:00:00Z","backend":"semtech_udp","direction":"in","data":"AQ=="}` + "\n")
+	buf.WriteString("\n")
+	buf.WriteString(`{"time":"2020-01-01T00:00:00.2Z","backend":"semtech_udp","direction":"in","data":"Ag=="}`)
+
+	var data [][]byte
+	start := time.Now()
+	assert.NoError(Replay(NewReader(&buf), 2, func(rec Record) error {
+		data = append(data, rec.Data)
+		return nil
+	}))
+
+	// 200ms at double speed
+	assert.True(time.Since(start) >= 100*time.Millisecond)
+	assert.Equal([][]byte{{1}, {2}}, data)
+}
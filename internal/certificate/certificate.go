@@ -0,0 +1,268 @@
+// Package certificate implements the loading and hot-reloading of TLS
+// certificates, keys and CA certificates.
+package certificate
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Reloader holds the TLS key-pair and CA certificate loaded from the given
+// files. The files are watched for changes and are reloaded when modified.
+// The tls.Config objects returned by the Reloader use callbacks, so that new
+// TLS handshakes use the reloaded material, without affecting existing
+// connections.
+type Reloader struct {
+	sync.RWMutex
+
+	caFile   string
+	certFile string
+	keyFile  string
+
+	keyPair *tls.Certificate
+	caPool  *x509.CertPool
+
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// NewReloader loads the given files and starts watching them for changes.
+// The CA file and key-pair files are optional, but the cert and key files must
+// be set both when one of them is set.
+func NewReloader(caFile, certFile, keyFile string) (*Reloader, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("tls cert and key must both be set")
+	}
+
+	r := Reloader{
+		caFile:   caFile,
+		certFile: certFile,
+		keyFile:  keyFile,
+		done:     make(chan struct{}),
+	}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	r.watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "new file watcher error")
+	}
+
+	// Directories are watched instead of the files, as files are often
+	// replaced (e.g. renamed or symlinked) instead of modified in-place.
+	dirs := make(map[string]struct{})
+	for _, f := range r.files() {
+		dirs[filepath.Dir(f)] = struct{}{}
+	}
+	for dir := range dirs {
+		if err := r.watcher.Add(dir); err != nil {
+			r.watcher.Close()
+			return nil, errors.Wrap(err, "watch directory error")
+		}
+	}
+
+	go r.watch()
+
+	return &r, nil
+}
+
+// Close stops watching the files for changes.
+func (r *Reloader) Close() error {
+	close(r.done)
+	return r.watcher.Close()
+}
+
+// GetCertificate returns the current key-pair. It can be used as
+// tls.Config.GetCertificate callback.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	if r.keyPair == nil {
+		return nil, errors.New("no tls certificate configured")
+	}
+
+	return r.keyPair, nil
+}
+
+// GetClientCertificate returns the current key-pair. It can be used as
+// tls.Config.GetClientCertificate callback.
+func (r *Reloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	// An empty certificate must be returned when no client certificate
+	// has been configured.
+	if r.keyPair == nil {
+		return &tls.Certificate{}, nil
+	}
+
+	return r.keyPair, nil
+}
+
+// CertPool returns the current CA certificate pool, or nil when no CA
+// certificate has been configured.
+func (r *Reloader) CertPool() *x509.CertPool {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.caPool
+}
+
+// ServerTLSConfig returns the tls.Config for a TLS server. When a CA
+// certificate has been configured, clients must present a certificate signed
+// by this CA certificate.
+func (r *Reloader) ServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			conf := tls.Config{
+				GetCertificate: r.GetCertificate,
+			}
+
+			if pool := r.CertPool(); pool != nil {
+				conf.ClientCAs = pool
+				conf.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+
+			return &conf, nil
+		},
+	}
+}
+
+// ClientTLSConfig returns the tls.Config for a TLS client. When a CA
+// certificate has been configured, the server certificate is verified using
+// this CA certificate, else the system CA certificates are used.
+func (r *Reloader) ClientTLSConfig() *tls.Config {
+	conf := tls.Config{
+		GetClientCertificate: r.GetClientCertificate,
+	}
+
+	if r.caFile != "" {
+		// The RootCAs can't be updated after the tls.Config has been
+		// created. Instead, the server certificate is verified by
+		// VerifyConnection using the current CA certificate.
+		conf.InsecureSkipVerify = true
+		conf.VerifyConnection = r.verifyConnection
+	}
+
+	return &conf
+}
+
+func (r *Reloader) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no server certificate received")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         r.CertPool(),
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+func (r *Reloader) files() []string {
+	var out []string
+	for _, f := range []string{r.caFile, r.certFile, r.keyFile} {
+		if f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func (r *Reloader) reload() error {
+	var caPool *x509.CertPool
+	var keyPair *tls.Certificate
+
+	if r.caFile != "" {
+		caCert, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return errors.Wrap(err, "load ca-cert error")
+		}
+
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return errors.New("append ca-cert from pem error")
+		}
+	}
+
+	if r.certFile != "" {
+		kp, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return errors.Wrap(err, "load tls key-pair error")
+		}
+		keyPair = &kp
+	}
+
+	r.Lock()
+	r.caPool = caPool
+	r.keyPair = keyPair
+	r.Unlock()
+
+	return nil
+}
+
+func (r *Reloader) watch() {
+	for {
+		select {
+		case event, ok := <-r.watcher.Events:
+			if !ok {
+				return
+			}
+
+			if !r.isWatchedFile(event.Name) || event.Op == fsnotify.Chmod {
+				continue
+			}
+
+			// When one of the files is being replaced, the key-pair might be
+			// (temporarily) inconsistent. In that case the previous material
+			// is kept and the reload is retried on the next event.
+			if err := r.reload(); err != nil {
+				log.WithError(err).WithField("file", event.Name).Error("certificate: reload tls files error")
+				continue
+			}
+
+			log.WithFields(log.Fields{
+				"ca_file":   r.caFile,
+				"cert_file": r.certFile,
+				"key_file":  r.keyFile,
+			}).Info("certificate: tls files reloaded")
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.WithError(err).Error("certificate: file watcher error")
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *Reloader) isWatchedFile(name string) bool {
+	name = filepath.Clean(name)
+	for _, f := range r.files() {
+		if filepath.Clean(f) == name {
+			return true
+		}
+	}
+
+	// Kubernetes updates mounted secrets by swapping the ..data symlink.
+	return filepath.Base(name) == "..data"
+}
@@ -0,0 +1,144 @@
+package certificate
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeCertificate writes a self-signed certificate and key for localhost
+// with the given serial number.
+func writeCertificate(t *testing.T, certFile, keyFile string, serial int64) {
+	assert := require.New(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(err)
+
+	tmpl := x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	assert.NoError(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(err)
+
+	assert.NoError(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	assert.NoError(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644))
+}
+
+func getSerial(t *testing.T, r *Reloader) int64 {
+	assert := require.New(t)
+
+	kp, err := r.GetCertificate(nil)
+	assert.NoError(err)
+
+	cert, err := x509.ParseCertificate(kp.Certificate[0])
+	assert.NoError(err)
+
+	return cert.SerialNumber.Int64()
+}
+
+func TestReloader(t *testing.T) {
+	assert := require.New(t)
+
+	tempDir, err := ioutil.TempDir("", "test")
+	assert.NoError(err)
+	defer os.RemoveAll(tempDir)
+
+	certFile := filepath.Join(tempDir, "cert.pem")
+	keyFile := filepath.Join(tempDir, "key.pem")
+	writeCertificate(t, certFile, keyFile, 1)
+
+	r, err := NewReloader(certFile, certFile, keyFile)
+	assert.NoError(err)
+	defer r.Close()
+
+	assert.EqualValues(1, getSerial(t, r))
+
+	t.Run("TLS handshake", func(t *testing.T) {
+		assert := require.New(t)
+
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", r.ServerTLSConfig())
+		assert.NoError(err)
+		defer ln.Close()
+
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.(*tls.Conn).Handshake()
+		}()
+
+		conf := r.ClientTLSConfig()
+		conf.ServerName = "localhost"
+
+		conn, err := tls.Dial("tcp", ln.Addr().String(), conf)
+		assert.NoError(err)
+		conn.Close()
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		assert := require.New(t)
+
+		writeCertificate(t, certFile, keyFile, 2)
+
+		for i := 0; i < 50 && getSerial(t, r) != 2; i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+		assert.EqualValues(2, getSerial(t, r))
+	})
+
+	t.Run("TLS handshake unknown CA", func(t *testing.T) {
+		assert := require.New(t)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(err)
+		defer ln.Close()
+
+		otherDir, err := ioutil.TempDir("", "test")
+		assert.NoError(err)
+		defer os.RemoveAll(otherDir)
+		writeCertificate(t, filepath.Join(otherDir, "cert.pem"), filepath.Join(otherDir, "key.pem"), 3)
+		kp, err := tls.LoadX509KeyPair(filepath.Join(otherDir, "cert.pem"), filepath.Join(otherDir, "key.pem"))
+		assert.NoError(err)
+
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{kp}}).Handshake()
+		}()
+
+		conf := r.ClientTLSConfig()
+		conf.ServerName = "localhost"
+
+		_, err = tls.Dial("tcp", ln.Addr().String(), conf)
+		assert.Error(err)
+	})
+}
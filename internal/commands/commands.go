@@ -23,10 +23,23 @@ type command struct {
 	MaxExecutionDuration time.Duration
 }
 
+// ErrRemoteExecNotSupported is returned by a RemoteExecutor when the command
+// can not be executed by the gateway and must be executed on the host.
+var ErrRemoteExecNotSupported = errors.New("remote command execution is not supported")
+
+// RemoteExecutor defines the interface for executing commands on the gateway
+// (e.g. by the packet-forwarder) rather than on the host.
+type RemoteExecutor interface {
+	// ExecuteRemoteCommand executes the given command on the gateway. The
+	// response(s) must be published using PublishExecResponse.
+	ExecuteRemoteCommand(*gw.GatewayCommandExecRequest) error
+}
+
 var (
 	mux sync.RWMutex
 
-	commands map[string]command
+	commands       map[string]command
+	remoteExecutor RemoteExecutor
 )
 
 // Setup configures the gateway commands.
@@ -59,14 +72,48 @@ func Setup(conf config.Config) error {
 	return nil
 }
 
+// SetRemoteExecutor sets the executor for executing commands on the gateway.
+func SetRemoteExecutor(e RemoteExecutor) {
+	mux.Lock()
+	defer mux.Unlock()
+
+	remoteExecutor = e
+}
+
 func gatewayCommandExecRequestFunc(pl *gw.GatewayCommandExecRequest) {
 	go executeCommand(pl)
 }
 
-func executeCommand(cmd *gw.GatewayCommandExecRequest) {
-	var gatewayID lorawan.EUI64
-	copy(gatewayID[:], cmd.GatewayId)
+// executeCommand executes the given command on the gateway when supported by
+// the remote executor, else on the host.
+func executeCommand(pl *gw.GatewayCommandExecRequest) {
+	mux.RLock()
+	e := remoteExecutor
+	mux.RUnlock()
+
+	if e != nil {
+		err := e.ExecuteRemoteCommand(pl)
+		if err == nil {
+			return
+		}
+
+		if err != ErrRemoteExecNotSupported {
+			PublishExecResponse(&gw.GatewayCommandExecResponse{
+				GatewayId: pl.GetGatewayId(),
+				ExecId:    pl.GetExecId(),
+				Error:     err.Error(),
+			})
+			return
+		}
+	}
+
+	ExecuteCommand(pl)
+}
 
+// ExecuteCommand executes the given command request and publishes the
+// response as exec event. It blocks until the command has been executed and
+// returns the published response.
+func ExecuteCommand(cmd *gw.GatewayCommandExecRequest) *gw.GatewayCommandExecResponse {
 	stdout, stderr, err := execute(cmd.Command, cmd.Stdin, cmd.Environment)
 	resp := gw.GatewayCommandExecResponse{
 		GatewayId: cmd.GetGatewayId(),
@@ -78,7 +125,26 @@ func executeCommand(cmd *gw.GatewayCommandExecRequest) {
 		resp.Error = err.Error()
 	}
 
-	if err := integration.GetIntegration().PublishEvent(gatewayID, "exec", cmd.GetExecId(), &resp); err != nil {
+	PublishExecResponse(&resp)
+
+	return &resp
+}
+
+// PublishExecResponse publishes the given command response as exec event.
+func PublishExecResponse(resp *gw.GatewayCommandExecResponse) {
+	var gatewayID lorawan.EUI64
+	if err := gatewayID.UnmarshalText([]byte(resp.GetGatewayId())); err != nil {
+		log.WithError(err).Error("commands: decode gateway id error")
+		return
+	}
+
+	i := integration.GetIntegration()
+	if i == nil {
+		log.WithField("gateway_id", gatewayID).Error("commands: integration is not set")
+		return
+	}
+
+	if err := i.PublishEvent(gatewayID, integration.EventExec, resp.GetExecId(), resp); err != nil {
 		log.WithError(err).Error("commands: publish command execution event error")
 	}
 }
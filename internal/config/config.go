@@ -18,7 +18,11 @@ type Config struct {
 	} `mapstructure:"filters"`
 
 	Backend struct {
-		Type string `mapstructure:"type"`
+		Type []string `mapstructure:"type"`
+
+		Storage struct {
+			Directory string `mapstructure:"directory"`
+		} `mapstructure:"storage"`
 
 		SemtechUDP struct {
 			UDPBind                   string        `mapstructure:"udp_bind"`
@@ -27,76 +31,109 @@ type Config struct {
 			ConnectionTimeoutDuration time.Duration `mapstructure:"connection_timeout_duration"`
 			CacheDefaultExpiration    time.Duration `mapstructure:"cache_default_expiration"`
 			CacheCleanupInterval      time.Duration `mapstructure:"cache_cleanup_interval"`
+			PushDataDedupWindow       time.Duration `mapstructure:"push_data_dedup_window"`
+			Workers                   int           `mapstructure:"workers"`
+			QueueSize                 int           `mapstructure:"queue_size"`
+			OverflowPolicy            string        `mapstructure:"overflow_policy"`
+			BatchSize                 int           `mapstructure:"batch_size"`
+			GatewayIDs                []string      `mapstructure:"gateway_ids"`
+			AddressPinning            struct {
+				Enabled          bool `mapstructure:"enabled"`
+				IPv4PrefixLength int  `mapstructure:"ipv4_prefix_length"`
+				IPv6PrefixLength int  `mapstructure:"ipv6_prefix_length"`
+			} `mapstructure:"address_pinning"`
+			FineTimestampKeys []struct {
+				GatewayID string `mapstructure:"gateway_id"`
+				AESK      uint8  `mapstructure:"aesk"`
+				Key       string `mapstructure:"key"`
+			} `mapstructure:"fine_timestamp_keys"`
+			Relay []struct {
+				Server   string `mapstructure:"server"`
+				Downlink bool   `mapstructure:"downlink"`
+			} `mapstructure:"relay"`
+			Configuration []struct {
+				GatewayID      string `mapstructure:"gateway_id"`
+				BaseFile       string `mapstructure:"base_file"`
+				OutputFile     string `mapstructure:"output_file"`
+				RestartCommand string `mapstructure:"restart_command"`
+			} `mapstructure:"configuration"`
+			Capture Capture `mapstructure:"capture"`
 		} `mapstructure:"semtech_udp"`
 
+		Concentratord struct {
+			CRCCheck   bool   `mapstructure:"crc_check"`
+			EventURL   string `mapstructure:"event_url"`
+			CommandURL string `mapstructure:"command_url"`
+		} `mapstructure:"concentratord"`
+
 		BasicStation struct {
-			Bind             string                     `mapstructure:"bind"`
-			TLSSupportProxy  bool                       `mapstructure:"tls_support_proxy"`
-			TLSCert          string                     `mapstructure:"tls_cert"`
-			TLSKey           string                     `mapstructure:"tls_key"`
-			CACert           string                     `mapstructure:"ca_cert"`
-			StatsInterval    time.Duration              `mapstructure:"stats_interval"`
-			PingInterval     time.Duration              `mapstructure:"ping_interval"`
-			TimesyncInterval time.Duration              `mapstructure:"timesync_interval"`
-			ReadTimeout      time.Duration              `mapstructure:"read_timeout"`
-			WriteTimeout     time.Duration              `mapstructure:"write_timeout"`
-			Region           string                     `mapstructure:"region"`
-			FrequencyMin     uint32                     `mapstructure:"frequency_min"`
-			FrequencyMax     uint32                     `mapstructure:"frequency_max"`
-			Concentrators    []BasicStationConcentrator `mapstructure:"concentrators"`
+			Bind                      string                     `mapstructure:"bind"`
+			TLSSupportProxy           bool                       `mapstructure:"tls_support_proxy"`
+			TLSCert                   string                     `mapstructure:"tls_cert"`
+			TLSKey                    string                     `mapstructure:"tls_key"`
+			CACert                    string                     `mapstructure:"ca_cert"`
+			StatsInterval             time.Duration              `mapstructure:"stats_interval"`
+			PingInterval              time.Duration              `mapstructure:"ping_interval"`
+			TimesyncInterval          time.Duration              `mapstructure:"timesync_interval"`
+			ReadTimeout               time.Duration              `mapstructure:"read_timeout"`
+			WriteTimeout              time.Duration              `mapstructure:"write_timeout"`
+			TxAckTimeout              time.Duration              `mapstructure:"tx_ack_timeout"`
+			RunCommandEnabled         bool                       `mapstructure:"runcmd_enabled"`
+			RemoteShellEnabled        bool                       `mapstructure:"remote_shell_enabled"`
+			RemoteShellMaxDuration    time.Duration              `mapstructure:"remote_shell_max_duration"`
+			DuplicateConnectionPolicy string                     `mapstructure:"duplicate_connection_policy"`
+			Region                    string                     `mapstructure:"region"`
+			FrequencyMin              uint32                     `mapstructure:"frequency_min"`
+			FrequencyMax              uint32                     `mapstructure:"frequency_max"`
+			Concentrators             []BasicStationConcentrator `mapstructure:"concentrators"`
+			Profiles                  []BasicStationProfile      `mapstructure:"profiles"`
+			CUPSDirectory             string                     `mapstructure:"cups_directory"`
+
+			Auth struct {
+				Type           string        `mapstructure:"type"`
+				TokenFile      string        `mapstructure:"token_file"`
+				HMACSecret     string        `mapstructure:"hmac_secret"`
+				ReloadInterval time.Duration `mapstructure:"reload_interval"`
+			} `mapstructure:"auth"`
+
+			RouterInfo BasicStationRouterInfo `mapstructure:"router_info"`
+			Capture    Capture                `mapstructure:"capture"`
 		} `mapstructure:"basic_station"`
+
+		Simulator struct {
+			Gateways          int           `mapstructure:"gateways"`
+			DevicesPerGateway int           `mapstructure:"devices_per_gateway"`
+			GatewayIDBase     string        `mapstructure:"gateway_id_base"`
+			DevEUIBase        string        `mapstructure:"dev_eui_base"`
+			DevAddrBase       string        `mapstructure:"dev_addr_base"`
+			JoinEUI           string        `mapstructure:"join_eui"`
+			DeviceKey         string        `mapstructure:"device_key"`
+			UplinkInterval    time.Duration `mapstructure:"uplink_interval"`
+			JoinRequestRatio  float64       `mapstructure:"join_request_ratio"`
+			PayloadSize       int           `mapstructure:"payload_size"`
+			Frequencies       []uint32      `mapstructure:"frequencies"`
+			SpreadingFactors  []uint32      `mapstructure:"spreading_factors"`
+			Bandwidth         uint32        `mapstructure:"bandwidth"`
+			RSSIMean          float64       `mapstructure:"rssi_mean"`
+			RSSIStdDev        float64       `mapstructure:"rssi_std_dev"`
+			SNRMean           float64       `mapstructure:"snr_mean"`
+			SNRStdDev         float64       `mapstructure:"snr_std_dev"`
+			StatsInterval     time.Duration `mapstructure:"stats_interval"`
+
+			TxAckErrors []struct {
+				Status string  `mapstructure:"status"`
+				Ratio  float64 `mapstructure:"ratio"`
+			} `mapstructure:"tx_ack_errors"`
+		} `mapstructure:"simulator"`
 	} `mapstructure:"backend"`
 
 	Integration struct {
+		Type      string `mapstructure:"type"`
 		Marshaler string `mapstructure:"marshaler"`
 
-		MQTT struct {
-			EventTopicTemplate      string        `mapstructure:"event_topic_template"`
-			CommandTopicTemplate    string        `mapstructure:"command_topic_template"`
-			StateTopicTemplate      string        `mapstructure:"state_topic_template"`
-			StateRetained           bool          `mapstructure:"state_retained"`
-			KeepAlive               time.Duration `mapstructure:"keep_alive"`
-			MaxReconnectInterval    time.Duration `mapstructure:"max_reconnect_interval"`
-			TerminateOnConnectError bool          `mapstructure:"terminate_on_connect_error"`
-			MaxTokenWait            time.Duration `mapstructure:"max_token_wait"`
-
-			Auth struct {
-				Type string `mapstructure:"type"`
-
-				Generic struct {
-					Server       string   `mapstructure:"server"`
-					Servers      []string `mapstructure:"servers"`
-					Username     string   `mapstructure:"username"`
-					Password     string   `mapstrucure:"password"`
-					CACert       string   `mapstructure:"ca_cert"`
-					TLSCert      string   `mapstructure:"tls_cert"`
-					TLSKey       string   `mapstructure:"tls_key"`
-					QOS          uint8    `mapstructure:"qos"`
-					CleanSession bool     `mapstructure:"clean_session"`
-					ClientID     string   `mapstructure:"client_id"`
-				} `mapstructure:"generic"`
-
-				GCPCloudIoTCore struct {
-					Server        string        `mapstructure:"server"`
-					DeviceID      string        `mapstructure:"device_id"`
-					ProjectID     string        `mapstructure:"project_id"`
-					CloudRegion   string        `mapstructure:"cloud_region"`
-					RegistryID    string        `mapstructure:"registry_id"`
-					JWTExpiration time.Duration `mapstructure:"jwt_expiration"`
-					JWTKeyFile    string        `mapstructure:"jwt_key_file"`
-				} `mapstructure:"gcp_cloud_iot_core"`
-
-				AzureIoTHub struct {
-					DeviceConnectionString string        `mapstructure:"device_connection_string"`
-					DeviceID               string        `mapstructure:"device_id"`
-					Hostname               string        `mapstructure:"hostname"`
-					DeviceKey              string        `mapstructure:"-"`
-					SASTokenExpiration     time.Duration `mapstructure:"sas_token_expiration"`
-					TLSCert                string        `mapstructure:"tls_cert"`
-					TLSKey                 string        `mapstructure:"tls_key"`
-				} `mapstructure:"azure_iot_hub"`
-			} `mapstructure:"auth"`
-		} `mapstructure:"mqtt"`
+		MQTT      IntegrationMQTT       `mapstructure:"mqtt"`
+		HTTP      IntegrationHTTP       `mapstructure:"http"`
+		Instances []IntegrationInstance `mapstructure:"instances"`
 	} `mapstructure:"integration"`
 
 	Metrics struct {
@@ -148,5 +185,140 @@ type BasicStationConcentratorFSK struct {
 	Frequency uint32 `mapstructure:"frequency"`
 }
 
+// BasicStationProfile holds a router configuration profile, used for the
+// gateways matching the configured gateway IDs or gateway ID ranges.
+type BasicStationProfile struct {
+	Name            string                     `mapstructure:"name"`
+	GatewayIDs      []string                   `mapstructure:"gateway_ids"`
+	GatewayIDRanges [][2]string                `mapstructure:"gateway_id_ranges"`
+	Region          string                     `mapstructure:"region"`
+	FrequencyMin    uint32                     `mapstructure:"frequency_min"`
+	FrequencyMax    uint32                     `mapstructure:"frequency_max"`
+	Concentrators   []BasicStationConcentrator `mapstructure:"concentrators"`
+
+	Filters struct {
+		NetIDs   []string    `mapstructure:"net_ids"`
+		JoinEUIs [][2]string `mapstructure:"join_euis"`
+	} `mapstructure:"filters"`
+}
+
+// BasicStationRouterInfo holds the configuration for routing gateways to
+// LNS endpoints in router-info responses.
+type BasicStationRouterInfo struct {
+	Instances []string                      `mapstructure:"instances"`
+	Routes    []BasicStationRouterInfoRoute `mapstructure:"routes"`
+}
+
+// BasicStationRouterInfoRoute routes a range of gateway IDs to an LNS
+// endpoint.
+type BasicStationRouterInfoRoute struct {
+	GatewayIDRange [2]string `mapstructure:"gateway_id_range"`
+	URI            string    `mapstructure:"uri"`
+}
+
+// Capture holds the traffic capture configuration of a backend.
+type Capture struct {
+	File     string `mapstructure:"file"`
+	MaxSize  int64  `mapstructure:"max_size"`
+	MaxFiles int    `mapstructure:"max_files"`
+}
+
+// IntegrationMQTT holds the MQTT integration configuration.
+type IntegrationMQTT struct {
+	EventTopicTemplate      string        `mapstructure:"event_topic_template"`
+	CommandTopicTemplate    string        `mapstructure:"command_topic_template"`
+	StateTopicTemplate      string        `mapstructure:"state_topic_template"`
+	StateRetained           bool          `mapstructure:"state_retained"`
+	KeepAlive               time.Duration `mapstructure:"keep_alive"`
+	MaxReconnectInterval    time.Duration `mapstructure:"max_reconnect_interval"`
+	TerminateOnConnectError bool          `mapstructure:"terminate_on_connect_error"`
+	MaxTokenWait            time.Duration `mapstructure:"max_token_wait"`
+	ProtocolVersion         uint          `mapstructure:"protocol_version"`
+	SessionExpiryInterval   time.Duration `mapstructure:"session_expiry_interval"`
+	SharedSubscriptionGroup string        `mapstructure:"shared_subscription_group"`
+
+	Queue struct {
+		Directory       string `mapstructure:"directory"`
+		MQTTQueuePolicy `mapstructure:",squash"`
+		Events          map[string]MQTTQueuePolicy `mapstructure:"events"`
+	} `mapstructure:"queue"`
+
+	Auth struct {
+		Type string `mapstructure:"type"`
+
+		Generic struct {
+			Server       string   `mapstructure:"server"`
+			Servers      []string `mapstructure:"servers"`
+			Username     string   `mapstructure:"username"`
+			Password     string   `mapstrucure:"password"`
+			CACert       string   `mapstructure:"ca_cert"`
+			TLSCert      string   `mapstructure:"tls_cert"`
+			TLSKey       string   `mapstructure:"tls_key"`
+			QOS          uint8    `mapstructure:"qos"`
+			CleanSession bool     `mapstructure:"clean_session"`
+			ClientID     string   `mapstructure:"client_id"`
+		} `mapstructure:"generic"`
+
+		GCPCloudIoTCore struct {
+			Server        string        `mapstructure:"server"`
+			DeviceID      string        `mapstructure:"device_id"`
+			ProjectID     string        `mapstructure:"project_id"`
+			CloudRegion   string        `mapstructure:"cloud_region"`
+			RegistryID    string        `mapstructure:"registry_id"`
+			JWTExpiration time.Duration `mapstructure:"jwt_expiration"`
+			JWTKeyFile    string        `mapstructure:"jwt_key_file"`
+		} `mapstructure:"gcp_cloud_iot_core"`
+
+		AzureIoTHub struct {
+			DeviceConnectionString string        `mapstructure:"device_connection_string"`
+			DeviceID               string        `mapstructure:"device_id"`
+			Hostname               string        `mapstructure:"hostname"`
+			DeviceKey              string        `mapstructure:"-"`
+			SASTokenExpiration     time.Duration `mapstructure:"sas_token_expiration"`
+			TLSCert                string        `mapstructure:"tls_cert"`
+			TLSKey                 string        `mapstructure:"tls_key"`
+		} `mapstructure:"azure_iot_hub"`
+	} `mapstructure:"auth"`
+}
+
+// IntegrationHTTP holds the HTTP integration configuration.
+type IntegrationHTTP struct {
+	EventURLTemplate string            `mapstructure:"event_url_template"`
+	StateURLTemplate string            `mapstructure:"state_url_template"`
+	Timeout          time.Duration     `mapstructure:"timeout"`
+	MaxRetries       int               `mapstructure:"max_retries"`
+	RetryInterval    time.Duration     `mapstructure:"retry_interval"`
+	Headers          map[string]string `mapstructure:"headers"`
+	HMACSecret       string            `mapstructure:"hmac_secret"`
+
+	Command struct {
+		Bind    string `mapstructure:"bind"`
+		CACert  string `mapstructure:"ca_cert"`
+		TLSCert string `mapstructure:"tls_cert"`
+		TLSKey  string `mapstructure:"tls_key"`
+	} `mapstructure:"command"`
+}
+
+// IntegrationInstance holds the configuration of a named integration
+// instance. The MQTT and HTTP configuration of the instance inherit the
+// [integration.mqtt] and [integration.http] configuration, which can be
+// overridden per instance.
+type IntegrationInstance struct {
+	Name      string          `mapstructure:"name"`
+	Type      string          `mapstructure:"type"`
+	Marshaler string          `mapstructure:"marshaler"`
+	Events    []string        `mapstructure:"events"`
+	Commands  bool            `mapstructure:"commands"`
+	MQTT      IntegrationMQTT `mapstructure:"mqtt"`
+	HTTP      IntegrationHTTP `mapstructure:"http"`
+}
+
+// MQTTQueuePolicy holds the limits of the MQTT integration event queue.
+type MQTTQueuePolicy struct {
+	MaxSize    int           `mapstructure:"max_size"`
+	MaxAge     time.Duration `mapstructure:"max_age"`
+	DropPolicy string        `mapstructure:"drop_policy"`
+}
+
 // C holds the global configuration.
 var C Config
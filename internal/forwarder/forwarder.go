@@ -29,6 +29,9 @@ func Setup(conf config.Config) error {
 	// setup backend callbacks
 	b.SetSubscribeEventFunc(gatewaySubscribeFunc)
 	b.SetUplinkFrameFunc(uplinkFrameFunc)
+	if ob, ok := b.(backend.OrderedUplinkBackend); ok {
+		ob.SetOrderedUplinkFrameFunc(publishUplinkFrame)
+	}
 	b.SetGatewayStatsFunc(gatewayStatsFunc)
 	b.SetDownlinkTxAckFunc(downlinkTxAckFunc)
 	b.SetRawPacketForwarderEventFunc(rawPacketForwarderEventFunc)
@@ -50,21 +53,26 @@ func gatewaySubscribeFunc(pl events.Subscribe) {
 }
 
 func uplinkFrameFunc(pl *gw.UplinkFrame) {
-	go func(pl *gw.UplinkFrame) {
-		var gatewayID lorawan.EUI64
-		if err := gatewayID.UnmarshalText([]byte(pl.GetRxInfo().GetGatewayId())); err != nil {
-			log.WithError(err).Error("decode gateway id error")
-			return
-		}
+	go publishUplinkFrame(pl)
+}
 
-		if err := integration.GetIntegration().PublishEvent(gatewayID, integration.EventUp, pl.GetRxInfo().GetUplinkId(), pl); err != nil {
-			log.WithError(err).WithFields(log.Fields{
-				"gateway_id": gatewayID,
-				"event_type": integration.EventUp,
-				"uplink_id":  pl.GetRxInfo().GetUplinkId(),
-			}).Error("publish event error")
-		}
-	}(pl)
+// publishUplinkFrame publishes the uplink before returning. It is used as
+// handler func for the backends implementing backend.OrderedUplinkBackend,
+// such that the uplinks of a gateway are published in order.
+func publishUplinkFrame(pl *gw.UplinkFrame) {
+	var gatewayID lorawan.EUI64
+	if err := gatewayID.UnmarshalText([]byte(pl.GetRxInfo().GetGatewayId())); err != nil {
+		log.WithError(err).Error("decode gateway id error")
+		return
+	}
+
+	if err := integration.GetIntegration().PublishEvent(gatewayID, integration.EventUp, pl.GetRxInfo().GetUplinkId(), pl); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"event_type": integration.EventUp,
+			"uplink_id":  pl.GetRxInfo().GetUplinkId(),
+		}).Error("publish event error")
+	}
 }
 
 func gatewayStatsFunc(pl *gw.GatewayStats) {
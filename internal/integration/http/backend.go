@@ -0,0 +1,649 @@
+// Package http implements an integration which publishes the events and
+// states to a HTTP endpoint (webhook) and which receives the commands through
+// a HTTP server.
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/certificate"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+// Signature headers. The signature is the hex encoded HMAC-SHA256 of
+// "<timestamp>.<body>", using the configured HMAC secret.
+const (
+	signatureHeader          = "X-Signature"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+)
+
+// maxSignatureAge defines the max age of the signature timestamp of the
+// received commands, to prevent replaying old commands.
+const maxSignatureAge = 5 * time.Minute
+
+// maxBodySize defines the max body size of the received commands.
+const maxBodySize = 1 << 20
+
+// Backend implements a HTTP integration.
+type Backend struct {
+	client      *http.Client
+	ctx         context.Context
+	cancel      context.CancelFunc
+	contentType string
+
+	eventURLTemplate *template.Template
+	stateURLTemplate *template.Template
+	maxRetries       int
+	retryInterval    time.Duration
+	headers          map[string]string
+	hmacSecret       []byte
+
+	ln       net.Listener
+	server   *http.Server
+	certs    *certificate.Reloader
+	isClosed atomic.Bool
+
+	gatewaysMux sync.RWMutex
+	gateways    map[lorawan.EUI64]struct{}
+
+	downlinkFrameFunc             func(*gw.DownlinkFrame)
+	gatewayConfigurationFunc      func(*gw.GatewayConfiguration)
+	gatewayCommandExecRequestFunc func(*gw.GatewayCommandExecRequest)
+	rawPacketForwarderCommandFunc func(*gw.RawPacketForwarderCommand)
+
+	marshal   func(msg proto.Message) ([]byte, error)
+	unmarshal func(b []byte, msg proto.Message) error
+}
+
+// NewBackend creates a new Backend.
+func NewBackend(conf config.Config) (*Backend, error) {
+	var err error
+	httpConf := conf.Integration.HTTP
+
+	b := Backend{
+		client: &http.Client{
+			Timeout: httpConf.Timeout,
+		},
+		maxRetries:    httpConf.MaxRetries,
+		retryInterval: httpConf.RetryInterval,
+		headers:       httpConf.Headers,
+		hmacSecret:    []byte(httpConf.HMACSecret),
+		gateways:      make(map[lorawan.EUI64]struct{}),
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+
+	switch conf.Integration.Marshaler {
+	case "json":
+		b.contentType = "application/json"
+
+		b.marshal = func(msg proto.Message) ([]byte, error) {
+			return protojson.MarshalOptions{
+				EmitUnpopulated: false,
+			}.Marshal(msg)
+		}
+
+		b.unmarshal = func(b []byte, msg proto.Message) error {
+			return protojson.UnmarshalOptions{
+				DiscardUnknown: true,
+				AllowPartial:   true,
+			}.Unmarshal(b, msg)
+		}
+	case "protobuf":
+		b.contentType = "application/x-protobuf"
+
+		b.marshal = func(msg proto.Message) ([]byte, error) {
+			return proto.Marshal(msg)
+		}
+
+		b.unmarshal = func(b []byte, msg proto.Message) error {
+			return proto.Unmarshal(b, msg)
+		}
+	default:
+		return nil, fmt.Errorf("integration/http: unknown marshaler: %s", conf.Integration.Marshaler)
+	}
+
+	if httpConf.EventURLTemplate == "" {
+		return nil, errors.New("integration/http: event_url_template must be set")
+	}
+
+	b.eventURLTemplate, err = template.New("event").Parse(httpConf.EventURLTemplate)
+	if err != nil {
+		return nil, errors.Wrap(err, "integration/http: parse event-url template error")
+	}
+
+	if httpConf.StateURLTemplate != "" {
+		b.stateURLTemplate, err = template.New("state").Parse(httpConf.StateURLTemplate)
+		if err != nil {
+			return nil, errors.Wrap(err, "integration/http: parse state-url template error")
+		}
+	}
+
+	if httpConf.Command.Bind != "" {
+		// the commands must be authenticated, either by signature or by
+		// client certificate
+		if httpConf.HMACSecret == "" && httpConf.Command.CACert == "" {
+			return nil, errors.New("integration/http: command.bind requires hmac_secret or command.ca_cert to be set")
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /gateway/{gateway_id}/command/{command}", b.handleCommand)
+
+		// using net.Listen makes it easier to test as we can bind to ":0" and
+		// then read back the Addr to find the assigned (random) port.
+		b.ln, err = net.Listen("tcp", httpConf.Command.Bind)
+		if err != nil {
+			return nil, errors.Wrap(err, "integration/http: create listener error")
+		}
+
+		b.server = &http.Server{
+			Handler: mux,
+		}
+
+		if httpConf.Command.TLSCert != "" || httpConf.Command.TLSKey != "" || httpConf.Command.CACert != "" {
+			b.certs, err = certificate.NewReloader(httpConf.Command.CACert, httpConf.Command.TLSCert, httpConf.Command.TLSKey)
+			if err != nil {
+				b.ln.Close()
+				return nil, errors.Wrap(err, "integration/http: load tls certificates error")
+			}
+			b.server.TLSConfig = b.certs.ServerTLSConfig()
+		}
+	}
+
+	return &b, nil
+}
+
+// Start starts the integration.
+func (b *Backend) Start() error {
+	if b.server == nil {
+		return nil
+	}
+
+	go func() {
+		log.WithFields(log.Fields{
+			"bind": b.ln.Addr(),
+			"tls":  b.certs != nil,
+		}).Info("integration/http: starting command server")
+
+		var err error
+		if b.certs == nil {
+			err = b.server.Serve(b.ln)
+		} else {
+			// the certificates are provided by the TLSConfig
+			err = b.server.ServeTLS(b.ln, "", "")
+		}
+		if err != nil && !b.isClosed.Load() {
+			log.WithError(err).Fatal("integration/http: command server error")
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the integration.
+func (b *Backend) Stop() error {
+	// The lock is not held while publishing, as the (retried) requests might
+	// take a while.
+	b.gatewaysMux.RLock()
+	gatewayIDs := make([]lorawan.EUI64, 0, len(b.gateways))
+	for gatewayID := range b.gateways {
+		gatewayIDs = append(gatewayIDs, gatewayID)
+	}
+	b.gatewaysMux.RUnlock()
+
+	// Set gateway state to offline for all gateways.
+	for _, gatewayID := range gatewayIDs {
+		pl := gw.ConnState{
+			GatewayId: gatewayID.String(),
+			State:     gw.ConnState_OFFLINE,
+		}
+		if err := b.PublishState(gatewayID, "conn", &pl); err != nil {
+			log.WithError(err).Error("integration/http: publish state error")
+		}
+	}
+
+	// abort the pending (retried) requests
+	b.cancel()
+
+	if b.server == nil {
+		return nil
+	}
+
+	b.isClosed.Store(true)
+	if b.certs != nil {
+		if err := b.certs.Close(); err != nil {
+			log.WithError(err).Error("integration/http: close certificate reloader error")
+		}
+	}
+	return b.server.Close()
+}
+
+// SetDownlinkFrameFunc sets the DownlinkFrame handler func.
+func (b *Backend) SetDownlinkFrameFunc(f func(*gw.DownlinkFrame)) {
+	b.downlinkFrameFunc = f
+}
+
+// SetGatewayConfigurationFunc sets the GatewayConfiguration handler func.
+func (b *Backend) SetGatewayConfigurationFunc(f func(*gw.GatewayConfiguration)) {
+	b.gatewayConfigurationFunc = f
+}
+
+// SetGatewayCommandExecRequestFunc sets the GatewayCommandExecRequest handler func.
+func (b *Backend) SetGatewayCommandExecRequestFunc(f func(*gw.GatewayCommandExecRequest)) {
+	b.gatewayCommandExecRequestFunc = f
+}
+
+// SetRawPacketForwarderCommandFunc sets the RawPacketForwarderCommand handler func.
+func (b *Backend) SetRawPacketForwarderCommandFunc(f func(*gw.RawPacketForwarderCommand)) {
+	b.rawPacketForwarderCommandFunc = f
+}
+
+// SetGatewaySubscription sets or unsets the gateway. Commands are only
+// accepted for subscribed gateways. When the subscription changes, the
+// conn state of the gateway is published.
+func (b *Backend) SetGatewaySubscription(subscribe bool, gatewayID lorawan.EUI64) error {
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"subscribe":  subscribe,
+	}).Debug("integration/http: set gateway subscription")
+
+	b.gatewaysMux.Lock()
+	_, subscribed := b.gateways[gatewayID]
+	if subscribe {
+		b.gateways[gatewayID] = struct{}{}
+	} else {
+		delete(b.gateways, gatewayID)
+	}
+	b.gatewaysMux.Unlock()
+
+	if subscribe == subscribed {
+		return nil
+	}
+
+	statePL := gw.ConnState{
+		GatewayId: gatewayID.String(),
+		State:     gw.ConnState_OFFLINE,
+	}
+	if subscribe {
+		statePL.State = gw.ConnState_ONLINE
+	}
+
+	if err := b.PublishState(gatewayID, "conn", &statePL); err != nil {
+		return errors.Wrap(err, "publish conn state error")
+	}
+
+	return nil
+}
+
+// PublishEvent publishes the given event.
+func (b *Backend) PublishEvent(gatewayID lorawan.EUI64, event string, id uint32, v proto.Message) error {
+	httpEventCounter(event).Inc()
+
+	url := bytes.NewBuffer(nil)
+	if err := b.eventURLTemplate.Execute(url, struct {
+		GatewayID lorawan.EUI64
+		EventType string
+	}{gatewayID, event}); err != nil {
+		return errors.Wrap(err, "execute event template error")
+	}
+
+	pl, err := b.marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "marshal message error")
+	}
+
+	fields := log.Fields{
+		"url":        url.String(),
+		"event":      event,
+		"gateway_id": gatewayID,
+	}
+	headers := map[string]string{
+		"X-Gateway-ID": gatewayID.String(),
+		"X-Event-Type": event,
+	}
+	if event == "up" {
+		fields["uplink_id"] = id
+		headers["X-Uplink-ID"] = fmt.Sprintf("%d", id)
+	}
+
+	log.WithFields(fields).Info("integration/http: publishing event")
+
+	return b.post(url.String(), pl, headers)
+}
+
+// PublishState publishes the given state.
+func (b *Backend) PublishState(gatewayID lorawan.EUI64, state string, v proto.Message) error {
+	if b.stateURLTemplate == nil {
+		log.WithFields(log.Fields{
+			"state":      state,
+			"gateway_id": gatewayID,
+		}).Debug("integration/http: ignoring publish state, no state_url_template configured")
+		return nil
+	}
+
+	httpStateCounter(state).Inc()
+
+	url := bytes.NewBuffer(nil)
+	if err := b.stateURLTemplate.Execute(url, struct {
+		GatewayID lorawan.EUI64
+		StateType string
+	}{gatewayID, state}); err != nil {
+		return errors.Wrap(err, "execute state template error")
+	}
+
+	pl, err := b.marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "marshal message error")
+	}
+
+	log.WithFields(log.Fields{
+		"url":        url.String(),
+		"state":      state,
+		"gateway_id": gatewayID,
+	}).Info("integration/http: publishing state")
+
+	return b.post(url.String(), pl, map[string]string{
+		"X-Gateway-ID": gatewayID.String(),
+		"X-State-Type": state,
+	})
+}
+
+// post posts the given payload to the given URL. Connection errors and
+// 5xx / 429 responses are retried up to max retries times, doubling the
+// retry interval after each attempt.
+func (b *Backend) post(url string, pl []byte, headers map[string]string) error {
+	interval := b.retryInterval
+
+	for attempt := 0; ; attempt++ {
+		retry, err := b.doPost(url, pl, headers)
+		if err == nil {
+			return nil
+		}
+
+		if !retry || attempt >= b.maxRetries {
+			httpErrorCounter().Inc()
+			return err
+		}
+
+		log.WithError(err).WithFields(log.Fields{
+			"url":     url,
+			"attempt": attempt + 1,
+		}).Warning("integration/http: request error, retrying")
+		httpRetryCounter().Inc()
+
+		select {
+		case <-time.After(interval):
+		case <-b.ctx.Done():
+			return errors.Wrap(err, "integration stopped")
+		}
+
+		interval *= 2
+	}
+}
+
+// doPost performs a single post request. It returns true when the request
+// can be retried in case of an error.
+func (b *Backend) doPost(url string, pl []byte, headers map[string]string) (bool, error) {
+	req, err := http.NewRequestWithContext(b.ctx, http.MethodPost, url, bytes.NewReader(pl))
+	if err != nil {
+		return false, errors.Wrap(err, "new request error")
+	}
+
+	req.Header.Set("Content-Type", b.contentType)
+	for k, v := range b.headers {
+		req.Header.Set(k, v)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	if len(b.hmacSecret) != 0 {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(signatureTimestampHeader, ts)
+		req.Header.Set(signatureHeader, b.sign(ts, pl))
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return true, errors.Wrap(err, "request error")
+	}
+	defer resp.Body.Close()
+
+	// read the body so that the connection can be re-used
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+}
+
+// sign returns the signature of the given timestamp and payload.
+func (b *Backend) sign(ts string, pl []byte) string {
+	mac := hmac.New(sha256.New, b.hmacSecret)
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(pl)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature verifies the signature of the received command. This is
+// a no-op when no HMAC secret is configured.
+func (b *Backend) verifySignature(r *http.Request, pl []byte) error {
+	if len(b.hmacSecret) == 0 {
+		return nil
+	}
+
+	tsStr := r.Header.Get(signatureTimestampHeader)
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		return errors.New("invalid signature timestamp")
+	}
+
+	if age := time.Since(time.Unix(ts, 0)); age > maxSignatureAge || age < -maxSignatureAge {
+		return errors.New("signature timestamp out of range")
+	}
+
+	if !hmac.Equal([]byte(r.Header.Get(signatureHeader)), []byte(b.sign(tsStr, pl))) {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
+
+// isSubscribed returns true when the given gateway is subscribed.
+func (b *Backend) isSubscribed(gatewayID lorawan.EUI64) bool {
+	b.gatewaysMux.RLock()
+	defer b.gatewaysMux.RUnlock()
+	_, ok := b.gateways[gatewayID]
+	return ok
+}
+
+func (b *Backend) handleCommand(w http.ResponseWriter, r *http.Request) {
+	var gatewayID lorawan.EUI64
+	if err := gatewayID.UnmarshalText([]byte(r.PathValue("gateway_id"))); err != nil {
+		http.Error(w, "invalid gateway id", http.StatusBadRequest)
+		return
+	}
+
+	pl, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, "read body error", http.StatusBadRequest)
+		return
+	}
+
+	if err := b.verifySignature(r, pl); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"gateway_id":  gatewayID,
+			"remote_addr": r.RemoteAddr,
+		}).Warning("integration/http: verify command signature error")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if !b.isSubscribed(gatewayID) {
+		http.Error(w, "gateway is not connected", http.StatusNotFound)
+		return
+	}
+
+	command := r.PathValue("command")
+	switch command {
+	case "down":
+		err = b.handleDownlinkFrame(gatewayID, pl)
+	case "config":
+		err = b.handleGatewayConfiguration(gatewayID, pl)
+	case "exec":
+		err = b.handleGatewayCommandExecRequest(gatewayID, pl)
+	case "raw":
+		err = b.handleRawPacketForwarderCommand(gatewayID, pl)
+	default:
+		log.WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"command":    command,
+		}).Warning("integration/http: unexpected command received")
+		http.Error(w, "unknown command", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"command":    command,
+		}).Error("integration/http: handle command error")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	httpCommandCounter(command).Inc()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (b *Backend) handleDownlinkFrame(gatewayID lorawan.EUI64, pl []byte) error {
+	var downlinkFrame gw.DownlinkFrame
+	if err := b.unmarshal(pl, &downlinkFrame); err != nil {
+		return errors.Wrap(err, "unmarshal downlink frame error")
+	}
+
+	if len(downlinkFrame.Items) == 0 {
+		return errors.New("downlink must have at least one item")
+	}
+
+	if err := setGatewayID(gatewayID, &downlinkFrame.GatewayId); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id":  gatewayID,
+		"downlink_id": downlinkFrame.GetDownlinkId(),
+	}).Info("integration/http: downlink frame received")
+
+	if b.downlinkFrameFunc != nil {
+		b.downlinkFrameFunc(&downlinkFrame)
+	}
+
+	return nil
+}
+
+func (b *Backend) handleGatewayConfiguration(gatewayID lorawan.EUI64, pl []byte) error {
+	var gatewayConfig gw.GatewayConfiguration
+	if err := b.unmarshal(pl, &gatewayConfig); err != nil {
+		return errors.Wrap(err, "unmarshal gateway configuration error")
+	}
+
+	if err := setGatewayID(gatewayID, &gatewayConfig.GatewayId); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+	}).Info("integration/http: gateway configuration received")
+
+	if b.gatewayConfigurationFunc != nil {
+		b.gatewayConfigurationFunc(&gatewayConfig)
+	}
+
+	return nil
+}
+
+func (b *Backend) handleGatewayCommandExecRequest(gatewayID lorawan.EUI64, pl []byte) error {
+	var gatewayCommandExecRequest gw.GatewayCommandExecRequest
+	if err := b.unmarshal(pl, &gatewayCommandExecRequest); err != nil {
+		return errors.Wrap(err, "unmarshal gateway command execution request error")
+	}
+
+	if err := setGatewayID(gatewayID, &gatewayCommandExecRequest.GatewayId); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+	}).Info("integration/http: gateway command execution request received")
+
+	if b.gatewayCommandExecRequestFunc != nil {
+		b.gatewayCommandExecRequestFunc(&gatewayCommandExecRequest)
+	}
+
+	return nil
+}
+
+func (b *Backend) handleRawPacketForwarderCommand(gatewayID lorawan.EUI64, pl []byte) error {
+	var rawPacketForwarderCommand gw.RawPacketForwarderCommand
+	if err := b.unmarshal(pl, &rawPacketForwarderCommand); err != nil {
+		return errors.Wrap(err, "unmarshal raw packet-forwarder command error")
+	}
+
+	if err := setGatewayID(gatewayID, &rawPacketForwarderCommand.GatewayId); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+	}).Info("integration/http: raw packet-forwarder command received")
+
+	if b.rawPacketForwarderCommandFunc != nil {
+		b.rawPacketForwarderCommandFunc(&rawPacketForwarderCommand)
+	}
+
+	return nil
+}
+
+// setGatewayID sets the gateway ID of the command to the gateway ID of the
+// URL when it is not set. When it is set, it must match the gateway ID of the
+// URL.
+func setGatewayID(gatewayID lorawan.EUI64, id *string) error {
+	if *id == "" {
+		*id = gatewayID.String()
+		return nil
+	}
+
+	var cmdGatewayID lorawan.EUI64
+	if err := cmdGatewayID.UnmarshalText([]byte(*id)); err != nil {
+		return errors.Wrap(err, "decode gateway id error")
+	}
+
+	if cmdGatewayID != gatewayID {
+		return fmt.Errorf("gateway id %s does not match the gateway id of the url", cmdGatewayID)
+	}
+
+	return nil
+}
@@ -0,0 +1,233 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+type request struct {
+	path    string
+	headers http.Header
+	body    []byte
+}
+
+func TestBackend(t *testing.T) {
+	assert := require.New(t)
+
+	log.SetLevel(log.ErrorLevel)
+
+	var mu sync.Mutex
+	var requests []request
+	var failures int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		requests = append(requests, request{r.URL.Path, r.Header, b})
+	}))
+	defer server.Close()
+
+	getRequests := func() []request {
+		mu.Lock()
+		defer mu.Unlock()
+		out := requests
+		requests = nil
+		return out
+	}
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	var conf config.Config
+	conf.Integration.Marshaler = "json"
+	conf.Integration.HTTP.EventURLTemplate = server.URL + "/gateway/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.Integration.HTTP.StateURLTemplate = server.URL + "/gateway/{{ .GatewayID }}/state/{{ .StateType }}"
+	conf.Integration.HTTP.Timeout = time.Second
+	conf.Integration.HTTP.MaxRetries = 2
+	conf.Integration.HTTP.RetryInterval = time.Millisecond
+	conf.Integration.HTTP.Headers = map[string]string{"authorization": "Bearer secret"}
+	conf.Integration.HTTP.HMACSecret = "foo"
+	conf.Integration.HTTP.Command.Bind = "127.0.0.1:0"
+
+	backend, err := NewBackend(conf)
+	assert.NoError(err)
+	assert.NoError(backend.Start())
+	defer backend.Stop()
+
+	commandURL := func(command string) string {
+		return fmt.Sprintf("http://%s/gateway/%s/command/%s", backend.ln.Addr(), gatewayID, command)
+	}
+
+	postCommand := func(url string, body []byte, sign bool) int {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		assert.NoError(err)
+		if sign {
+			ts := strconv.FormatInt(time.Now().Unix(), 10)
+			req.Header.Set(signatureTimestampHeader, ts)
+			req.Header.Set(signatureHeader, backend.sign(ts, body))
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("Invalid configuration", func(t *testing.T) {
+		assert := require.New(t)
+
+		conf := conf
+		conf.Integration.Marshaler = "foo"
+		_, err := NewBackend(conf)
+		assert.EqualError(err, "integration/http: unknown marshaler: foo")
+
+		conf = config.Config{}
+		conf.Integration.Marshaler = "json"
+		_, err = NewBackend(conf)
+		assert.EqualError(err, "integration/http: event_url_template must be set")
+
+		conf.Integration.HTTP.EventURLTemplate = server.URL
+		conf.Integration.HTTP.Command.Bind = "127.0.0.1:0"
+		_, err = NewBackend(conf)
+		assert.EqualError(err, "integration/http: command.bind requires hmac_secret or command.ca_cert to be set")
+	})
+
+	t.Run("SetGatewaySubscription", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(backend.SetGatewaySubscription(true, gatewayID))
+		assert.NoError(backend.SetGatewaySubscription(true, gatewayID))
+
+		reqs := getRequests()
+		assert.Len(reqs, 1)
+		assert.Equal("/gateway/0102030405060708/state/conn", reqs[0].path)
+		assert.Equal("conn", reqs[0].headers.Get("X-State-Type"))
+		assert.JSONEq(`{"gatewayId":"0102030405060708","state":"ONLINE"}`, string(reqs[0].body))
+	})
+
+	t.Run("PublishEvent", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(backend.PublishEvent(gatewayID, "up", 123, &gw.UplinkFrame{PhyPayload: []byte{1, 2, 3}}))
+
+		reqs := getRequests()
+		assert.Len(reqs, 1)
+		assert.Equal("/gateway/0102030405060708/event/up", reqs[0].path)
+		assert.Equal("application/json", reqs[0].headers.Get("Content-Type"))
+		assert.Equal("Bearer secret", reqs[0].headers.Get("Authorization"))
+		assert.Equal("0102030405060708", reqs[0].headers.Get("X-Gateway-ID"))
+		assert.Equal("up", reqs[0].headers.Get("X-Event-Type"))
+		assert.Equal("123", reqs[0].headers.Get("X-Uplink-ID"))
+		assert.JSONEq(`{"phyPayload":"AQID"}`, string(reqs[0].body))
+
+		ts := reqs[0].headers.Get(signatureTimestampHeader)
+		assert.Equal(backend.sign(ts, reqs[0].body), reqs[0].headers.Get(signatureHeader))
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		assert := require.New(t)
+
+		mu.Lock()
+		failures = 2
+		mu.Unlock()
+
+		assert.NoError(backend.PublishEvent(gatewayID, "stats", 0, &gw.GatewayStats{}))
+		assert.Len(getRequests(), 1)
+
+		mu.Lock()
+		failures = 3
+		mu.Unlock()
+
+		assert.EqualError(backend.PublishEvent(gatewayID, "stats", 0, &gw.GatewayStats{}), "unexpected status code: 503")
+		assert.Len(getRequests(), 0)
+	})
+
+	t.Run("Commands", func(t *testing.T) {
+		downChan := make(chan *gw.DownlinkFrame, 1)
+		backend.SetDownlinkFrameFunc(func(pl *gw.DownlinkFrame) {
+			downChan <- pl
+		})
+
+		execChan := make(chan *gw.GatewayCommandExecRequest, 1)
+		backend.SetGatewayCommandExecRequestFunc(func(pl *gw.GatewayCommandExecRequest) {
+			execChan <- pl
+		})
+
+		t.Run("Downlink", func(t *testing.T) {
+			assert := require.New(t)
+
+			body := []byte(`{"downlinkId":123,"items":[{"phyPayload":"AQID"}]}`)
+			assert.Equal(http.StatusAccepted, postCommand(commandURL("down"), body, true))
+
+			pl := <-downChan
+			assert.Equal("0102030405060708", pl.GatewayId)
+			assert.EqualValues(123, pl.DownlinkId)
+			assert.Equal([]byte{1, 2, 3}, pl.Items[0].PhyPayload)
+		})
+
+		t.Run("Exec", func(t *testing.T) {
+			assert := require.New(t)
+
+			body := []byte(`{"gatewayId":"0102030405060708","command":"reboot","execId":1}`)
+			assert.Equal(http.StatusAccepted, postCommand(commandURL("exec"), body, true))
+
+			pl := <-execChan
+			assert.Equal("reboot", pl.Command)
+		})
+
+		t.Run("Gateway ID mismatch", func(t *testing.T) {
+			assert := require.New(t)
+
+			body := []byte(`{"gatewayId":"0807060504030201","command":"reboot"}`)
+			assert.Equal(http.StatusBadRequest, postCommand(commandURL("exec"), body, true))
+		})
+
+		t.Run("Invalid signature", func(t *testing.T) {
+			assert := require.New(t)
+
+			body := []byte(`{"downlinkId":123,"items":[{"phyPayload":"AQID"}]}`)
+			assert.Equal(http.StatusUnauthorized, postCommand(commandURL("down"), body, false))
+		})
+
+		t.Run("Unknown command", func(t *testing.T) {
+			assert := require.New(t)
+
+			assert.Equal(http.StatusNotFound, postCommand(commandURL("foo"), []byte(`{}`), true))
+		})
+
+		t.Run("Gateway not connected", func(t *testing.T) {
+			assert := require.New(t)
+
+			assert.NoError(backend.SetGatewaySubscription(false, gatewayID))
+			reqs := getRequests()
+			assert.Len(reqs, 1)
+			// note: OFFLINE is the default value and is therefore omitted
+			assert.JSONEq(`{"gatewayId":"0102030405060708"}`, string(reqs[0].body))
+
+			body := []byte(`{"downlinkId":123,"items":[{"phyPayload":"AQID"}]}`)
+			assert.Equal(http.StatusNotFound, postCommand(commandURL("down"), body, true))
+		})
+	})
+}
@@ -1,10 +1,15 @@
 package integration
 
 import (
+	"fmt"
+	"path/filepath"
+
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/http"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/mqtt"
 	"github.com/brocaar/lorawan"
 	"github.com/chirpstack/chirpstack/api/go/v4/gw"
@@ -16,21 +21,143 @@ const (
 	EventStats = "stats"
 	EventAck   = "ack"
 	EventRaw   = "raw"
+	EventExec  = "exec"
 )
 
 var integration Integration
 
-// Setup configures the integration.
+// Setup configures the integration. When integration instances are
+// configured, an integration is created for each instance and the events are
+// published to all instances. As the instances inherit the base
+// configuration, the MQTT queue of each instance is stored in a sub-directory
+// named after the instance and the MQTT client IDs and HTTP command binds
+// must be unique.
 func Setup(conf config.Config) error {
-	var err error
-	integration, err = mqtt.NewBackend(conf)
-	if err != nil {
-		return errors.Wrap(err, "setup mqtt integration error")
+	if len(conf.Integration.Instances) == 0 {
+		var err error
+		integration, err = newIntegration(conf)
+		if err != nil {
+			return errors.Wrap(err, "setup integration error")
+		}
+
+		return nil
+	}
+
+	if err := validateInstances(conf.Integration.Instances); err != nil {
+		return err
+	}
+
+	var instances []instance
+
+	for _, c := range conf.Integration.Instances {
+		inst := instance{
+			name:     c.Name,
+			commands: c.Commands,
+		}
+
+		if len(c.Events) != 0 {
+			inst.events = make(map[string]struct{})
+			for _, e := range c.Events {
+				switch e {
+				case EventUp, EventStats, EventAck, EventRaw, EventExec:
+					inst.events[e] = struct{}{}
+				default:
+					return fmt.Errorf("unknown event type for integration instance %s: %s", c.Name, e)
+				}
+			}
+		}
+
+		// the queue directory might be inherited from the base configuration
+		if c.MQTT.Queue.Directory != "" {
+			c.MQTT.Queue.Directory = filepath.Join(c.MQTT.Queue.Directory, c.Name)
+		}
+
+		instanceConf := conf
+		instanceConf.Integration.Type = c.Type
+		instanceConf.Integration.Marshaler = c.Marshaler
+		instanceConf.Integration.MQTT = c.MQTT
+		instanceConf.Integration.HTTP = c.HTTP
+
+		var err error
+		inst.integration, err = newIntegration(instanceConf)
+		if err != nil {
+			return errors.Wrapf(err, "setup integration %s error", c.Name)
+		}
+
+		log.WithFields(log.Fields{
+			"name":     c.Name,
+			"type":     c.Type,
+			"events":   c.Events,
+			"commands": c.Commands,
+		}).Info("integration: integration instance configured")
+
+		instances = append(instances, inst)
+	}
+
+	integration = newMultiIntegration(instances)
+
+	return nil
+}
+
+// validateInstances validates the names of the given integration instances
+// and the settings which can not be shared by instances. This is done before
+// any of the integrations is created, e.g. binding the HTTP command server.
+func validateInstances(instances []config.IntegrationInstance) error {
+	names := make(map[string]struct{})
+	clientIDs := make(map[string]string)
+	binds := make(map[string]string)
+
+	for _, c := range instances {
+		if c.Name == "" {
+			return errors.New("integration instance name must be set")
+		}
+		if _, ok := names[c.Name]; ok {
+			return fmt.Errorf("duplicate integration instance: %s", c.Name)
+		}
+		names[c.Name] = struct{}{}
+
+		switch c.Type {
+		case "", "mqtt":
+			if id := c.MQTT.Auth.Generic.ClientID; id != "" {
+				if name, ok := clientIDs[id]; ok {
+					return fmt.Errorf("integration instances %s and %s use the same client_id: %s", name, c.Name, id)
+				}
+				clientIDs[id] = c.Name
+			}
+		case "http":
+			if bind := c.HTTP.Command.Bind; bind != "" {
+				if name, ok := binds[bind]; ok {
+					return fmt.Errorf("integration instances %s and %s use the same command bind: %s", name, c.Name, bind)
+				}
+				binds[bind] = c.Name
+			}
+		}
 	}
 
 	return nil
 }
 
+// newIntegration creates the integration for the configured integration
+// type.
+func newIntegration(conf config.Config) (Integration, error) {
+	switch conf.Integration.Type {
+	case "", "mqtt":
+		b, err := mqtt.NewBackend(conf)
+		if err != nil {
+			return nil, errors.Wrap(err, "new mqtt integration error")
+		}
+		return b, nil
+	case "http":
+		b, err := http.NewBackend(conf)
+		if err != nil {
+			return nil, errors.Wrap(err, "new http integration error")
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown integration type: %s", conf.Integration.Type)
+	}
+}
+
 // GetIntegration returns the integration.
 func GetIntegration() Integration {
 	return integration
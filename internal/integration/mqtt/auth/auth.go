@@ -2,13 +2,12 @@ package auth
 
 import (
 	"crypto/tls"
-	"crypto/x509"
-	"io/ioutil"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/pkg/errors"
 
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/certificate"
 	"github.com/brocaar/lorawan"
 )
 
@@ -26,33 +25,25 @@ type Authentication interface {
 	// ReconnectAfter returns a time.Duration after which the MQTT client must re-connect.
 	// Note: return 0 to disable the periodical re-connect feature.
 	ReconnectAfter() time.Duration
+
+	// Close releases the resources held by the authentication, e.g. the
+	// watched certificate files.
+	Close() error
 }
 
-func newTLSConfig(cafile, certFile, certKeyFile string) (*tls.Config, error) {
+// newTLSConfig returns the TLS configuration for the given files, or nil when
+// none of the files are set. The files are reloaded when modified, so that
+// new connections use the new certificates. The returned reloader must be
+// closed by the caller.
+func newTLSConfig(cafile, certFile, certKeyFile string) (*tls.Config, *certificate.Reloader, error) {
 	if cafile == "" && certFile == "" && certKeyFile == "" {
-		return nil, nil
-	}
-
-	tlsConfig := &tls.Config{}
-
-	if cafile != "" {
-		cacert, err := ioutil.ReadFile(cafile)
-		if err != nil {
-			return nil, errors.Wrap(err, "load ca-cert error")
-		}
-		certpool := x509.NewCertPool()
-		certpool.AppendCertsFromPEM(cacert)
-
-		tlsConfig.RootCAs = certpool // RootCAs = certs used to verify server cert.
+		return nil, nil, nil
 	}
 
-	if certFile != "" && certKeyFile != "" {
-		kp, err := tls.LoadX509KeyPair(certFile, certKeyFile)
-		if err != nil {
-			return nil, errors.Wrap(err, "load tls key-pair error")
-		}
-		tlsConfig.Certificates = []tls.Certificate{kp}
+	certs, err := certificate.NewReloader(cafile, certFile, certKeyFile)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "load tls certificates error")
 	}
 
-	return tlsConfig, nil
+	return certs.ClientTLSConfig(), certs, nil
 }
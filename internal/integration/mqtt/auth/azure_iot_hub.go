@@ -14,6 +14,7 @@ import (
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/pkg/errors"
 
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/certificate"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
 	"github.com/brocaar/lorawan"
 )
@@ -124,6 +125,7 @@ type AzureIoTHubAuthentication struct {
 	sasTokenExpiration time.Duration
 
 	tlsConfig *tls.Config
+	certs     *certificate.Reloader
 }
 
 // NewAzureIoTHubAuthentication creates an AzureIoTHubAuthentication.
@@ -175,12 +177,14 @@ func NewAzureIoTHubAuthentication(c config.Config) (Authentication, error) {
 	}
 
 	if at == authTypeX509 {
-		kp, err := tls.LoadX509KeyPair(conf.TLSCert, conf.TLSKey)
+		// the key-pair is reloaded when modified
+		certs, err := certificate.NewReloader("", conf.TLSCert, conf.TLSKey)
 		if err != nil {
 			return nil, errors.Wrap(err, "load tls key-pair error")
 		}
 
-		tlsConfig.Certificates = []tls.Certificate{kp}
+		tlsConfig.GetClientCertificate = certs.GetClientCertificate
+		auth.certs = certs
 	}
 
 	auth.clientID = conf.DeviceID
@@ -232,6 +236,14 @@ func (a *AzureIoTHubAuthentication) ReconnectAfter() time.Duration {
 	return a.sasTokenExpiration
 }
 
+// Close stops watching the key-pair files.
+func (a *AzureIoTHubAuthentication) Close() error {
+	if a.certs == nil {
+		return nil
+	}
+	return a.certs.Close()
+}
+
 func createSASToken(uri string, deviceKey []byte, expiration time.Duration) (string, error) {
 	encoded := url.QueryEscape(uri)
 	exp := time.Now().Add(expiration).Unix()
@@ -90,3 +90,8 @@ func (a *GCPCloudIoTCoreAuthentication) Update(opts *mqtt.ClientOptions) error {
 func (a *GCPCloudIoTCoreAuthentication) ReconnectAfter() time.Duration {
 	return a.jwtExpiration
 }
+
+// Close is a no-op, as no resources are held.
+func (a *GCPCloudIoTCoreAuthentication) Close() error {
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/certificate"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
 	"github.com/brocaar/lorawan"
 )
@@ -21,11 +22,12 @@ type GenericAuthentication struct {
 	clientID     string
 
 	tlsConfig *tls.Config
+	certs     *certificate.Reloader
 }
 
 // NewGenericAuthentication creates a GenericAuthentication.
 func NewGenericAuthentication(conf config.Config) (Authentication, error) {
-	tlsConfig, err := newTLSConfig(
+	tlsConfig, certs, err := newTLSConfig(
 		conf.Integration.MQTT.Auth.Generic.CACert,
 		conf.Integration.MQTT.Auth.Generic.TLSCert,
 		conf.Integration.MQTT.Auth.Generic.TLSKey,
@@ -36,6 +38,7 @@ func NewGenericAuthentication(conf config.Config) (Authentication, error) {
 
 	return &GenericAuthentication{
 		tlsConfig:    tlsConfig,
+		certs:        certs,
 		servers:      conf.Integration.MQTT.Auth.Generic.Servers,
 		username:     conf.Integration.MQTT.Auth.Generic.Username,
 		password:     conf.Integration.MQTT.Auth.Generic.Password,
@@ -89,3 +92,11 @@ func (a *GenericAuthentication) Update(opts *mqtt.ClientOptions) error {
 func (a *GenericAuthentication) ReconnectAfter() time.Duration {
 	return 0
 }
+
+// Close stops watching the certificate files.
+func (a *GenericAuthentication) Close() error {
+	if a.certs == nil {
+		return nil
+	}
+	return a.certs.Close()
+}
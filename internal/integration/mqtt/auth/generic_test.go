@@ -33,5 +33,10 @@ func TestGenericAuthentication(t *testing.T) {
 			assert := require.New(t)
 			assert.Equal(&gatewayID, auth.GetGatewayID())
 		})
+
+		t.Run("Close", func(t *testing.T) {
+			assert := require.New(t)
+			assert.NoError(auth.Close())
+		})
 	})
 }
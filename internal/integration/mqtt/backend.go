@@ -24,10 +24,11 @@ import (
 type Backend struct {
 	auth auth.Authentication
 
-	conn       paho.Client
+	conn       client
 	connMux    sync.RWMutex
 	connClosed bool
 	clientOpts *paho.ClientOptions
+	newClient  func() client
 
 	downlinkFrameFunc             func(*gw.DownlinkFrame)
 	gatewayConfigurationFunc      func(*gw.GatewayConfiguration)
@@ -41,12 +42,27 @@ type Backend struct {
 	terminateOnConnectError bool
 	stateRetained           bool
 	maxTokenWait            time.Duration
+	sessionExpiryInterval   time.Duration
+	sharedSubscriptionGroup string
 
 	qos                  uint8
 	eventTopicTemplate   *template.Template
 	stateTopicTemplate   *template.Template
 	commandTopicTemplate *template.Template
 
+	// The queueMux is held while deciding between publishing and queueing an
+	// event when the queue is enabled, and while publishing a queued event,
+	// such that the events are published in order. When both are needed, the
+	// queueMux must be locked before the connMux. The publishWg tracks the
+	// events being published outside the queueMux, as these are queued when
+	// the publish fails.
+	queue       *queue
+	queueMux    sync.Mutex
+	queueDone   chan struct{}
+	queueWg     sync.WaitGroup
+	queueClosed bool
+	publishWg   sync.WaitGroup
+
 	marshal   func(msg proto.Message) ([]byte, error)
 	unmarshal func(b []byte, msg proto.Message) error
 }
@@ -63,6 +79,21 @@ func NewBackend(conf config.Config) (*Backend, error) {
 		gatewaysSubscribed:      make(map[lorawan.EUI64]struct{}),
 		stateRetained:           conf.Integration.MQTT.StateRetained,
 		maxTokenWait:            conf.Integration.MQTT.MaxTokenWait,
+		sessionExpiryInterval:   conf.Integration.MQTT.SessionExpiryInterval,
+		sharedSubscriptionGroup: conf.Integration.MQTT.SharedSubscriptionGroup,
+	}
+
+	switch conf.Integration.MQTT.ProtocolVersion {
+	case 0, 4:
+		b.newClient = b.newClientV3
+
+		if b.sharedSubscriptionGroup != "" {
+			return nil, errors.New("integration/mqtt: shared_subscription_group requires protocol_version 5")
+		}
+	case 5:
+		b.newClient = b.newClientV5
+	default:
+		return nil, fmt.Errorf("integration/mqtt: unsupported protocol version: %d", conf.Integration.MQTT.ProtocolVersion)
 	}
 
 	switch conf.Integration.MQTT.Auth.Type {
@@ -136,10 +167,6 @@ func NewBackend(conf config.Config) (*Backend, error) {
 		return nil, errors.Wrap(err, "integration/mqtt: parse event-topic template error")
 	}
 
-	b.clientOpts.SetProtocolVersion(4)
-	b.clientOpts.SetAutoReconnect(true) // this is required for buffering messages in case offline!
-	b.clientOpts.SetOnConnectHandler(b.onConnected)
-	b.clientOpts.SetConnectionLostHandler(b.onConnectionLost)
 	b.clientOpts.SetKeepAlive(conf.Integration.MQTT.KeepAlive)
 	b.clientOpts.SetMaxReconnectInterval(conf.Integration.MQTT.MaxReconnectInterval)
 
@@ -184,6 +211,12 @@ func NewBackend(conf config.Config) (*Backend, error) {
 		}
 	}
 
+	b.queue, err = openQueue(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, "integration/mqtt: open queue error")
+	}
+	b.queueDone = make(chan struct{})
+
 	return &b, nil
 }
 
@@ -192,11 +225,30 @@ func (b *Backend) Start() error {
 	b.connectLoop()
 	go b.reconnectLoop()
 	go b.subscribeLoop()
+
+	if b.queue != nil {
+		b.queueWg.Add(1)
+		go b.queueLoop()
+	}
+
 	return nil
 }
 
 // Stop stops the integration.
 func (b *Backend) Stop() error {
+	// The queue loop and the events being published must be done before
+	// closing the queue. This is done before locking the connMux, as these
+	// read the connection state.
+	if b.queue != nil {
+		close(b.queueDone)
+		b.queueWg.Wait()
+
+		b.queueMux.Lock()
+		b.queueClosed = true
+		b.queueMux.Unlock()
+		b.publishWg.Wait()
+	}
+
 	b.connMux.Lock()
 	defer b.connMux.Unlock()
 
@@ -214,8 +266,19 @@ func (b *Backend) Stop() error {
 		}
 	}
 
-	b.conn.Disconnect(250)
+	b.conn.disconnect()
 	b.connClosed = true
+
+	if err := b.auth.Close(); err != nil {
+		log.WithError(err).Error("integration/mqtt: close authentication error")
+	}
+
+	if b.queue != nil {
+		if err := b.queue.close(); err != nil {
+			return errors.Wrap(err, "close queue error")
+		}
+	}
+
 	return nil
 }
 
@@ -276,22 +339,39 @@ func (b *Backend) SetGatewaySubscription(subscribe bool, gatewayID lorawan.EUI64
 	return nil
 }
 
-func (b *Backend) subscribeGateway(gatewayID lorawan.EUI64) error {
+// getCommandTopic returns the command topic for the given gateway. When a
+// shared subscription group is configured, the topic is prefixed with
+// $share/<group>/, such that the commands are load-balanced over all the
+// ChirpStack Gateway Bridge instances within the same group.
+func (b *Backend) getCommandTopic(gatewayID lorawan.EUI64) (string, error) {
 	topic := bytes.NewBuffer(nil)
 	if err := b.commandTopicTemplate.Execute(topic, struct{ GatewayID lorawan.EUI64 }{gatewayID}); err != nil {
-		return errors.Wrap(err, "execute command topic template error")
+		return "", errors.Wrap(err, "execute command topic template error")
+	}
+
+	if b.sharedSubscriptionGroup != "" {
+		return fmt.Sprintf("$share/%s/%s", b.sharedSubscriptionGroup, topic.String()), nil
+	}
+
+	return topic.String(), nil
+}
+
+func (b *Backend) subscribeGateway(gatewayID lorawan.EUI64) error {
+	topic, err := b.getCommandTopic(gatewayID)
+	if err != nil {
+		return err
 	}
 	log.WithFields(log.Fields{
-		"topic": topic.String(),
+		"topic": topic,
 		"qos":   b.qos,
 	}).Info("integration/mqtt: subscribing to topic")
 
-	if err := tokenWrapper(b.conn.Subscribe(topic.String(), b.qos, b.handleCommand), b.maxTokenWait); err != nil {
+	if err := b.conn.subscribe(topic, b.qos); err != nil {
 		return errors.Wrap(err, "subscribe topic error")
 	}
 
 	log.WithFields(log.Fields{
-		"topic": topic.String(),
+		"topic": topic,
 		"qos":   b.qos,
 	}).Debug("integration/mqtt: subscribed to topic")
 
@@ -299,39 +379,78 @@ func (b *Backend) subscribeGateway(gatewayID lorawan.EUI64) error {
 }
 
 func (b *Backend) unsubscribeGateway(gatewayID lorawan.EUI64) error {
-	topic := bytes.NewBuffer(nil)
-	if err := b.commandTopicTemplate.Execute(topic, struct{ GatewayID lorawan.EUI64 }{gatewayID}); err != nil {
-		return errors.Wrap(err, "execute command topic template error")
+	topic, err := b.getCommandTopic(gatewayID)
+	if err != nil {
+		return err
 	}
 	log.WithFields(log.Fields{
-		"topic": topic.String(),
+		"topic": topic,
 	}).Info("integration/mqtt: unsubscribing from topic")
 
-	if err := tokenWrapper(b.conn.Unsubscribe(topic.String()), b.maxTokenWait); err != nil {
+	if err := b.conn.unsubscribe(topic); err != nil {
 		return errors.Wrap(err, "unsubscribe topic error")
 	}
 
 	log.WithFields(log.Fields{
-		"topic": topic.String(),
+		"topic": topic,
 	}).Debug("integration/mqtt: unsubscribed from topic")
 
 	return nil
 }
 
-// PublishEvent publishes the given event.
+// PublishEvent publishes the given event. When the queue is enabled, the
+// event is queued when not connected to the MQTT broker or when the publish
+// fails. To keep the events in order, events are also queued as long as the
+// queue is not empty.
 func (b *Backend) PublishEvent(gatewayID lorawan.EUI64, event string, id uint32, v proto.Message) error {
 	mqttEventCounter(event).Inc()
 
-	fields := log.Fields{}
-	if event == "up" {
-		fields["uplink_id"] = id
+	pl, err := b.marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "marshal message error")
 	}
 
-	if event == "down" {
-		fields["downlink_id"] = id
+	item := queueItem{
+		GatewayID: gatewayID,
+		Event:     event,
+		ID:        id,
+		Payload:   pl,
+		Time:      time.Now(),
+	}
+
+	if b.queue != nil {
+		b.queueMux.Lock()
+
+		if b.queueClosed {
+			b.queueMux.Unlock()
+			return errors.New("integration is closed")
+		}
+
+		if b.queue.len() > 0 || !b.isConnected() {
+			defer b.queueMux.Unlock()
+			return b.queueEvent(item)
+		}
+
+		// the lock is not held during the publish, such that a slow publish
+		// does not block the queue loop and Stop
+		b.publishWg.Add(1)
+		b.queueMux.Unlock()
+		defer b.publishWg.Done()
+	}
+
+	if err := b.publishEvent(gatewayID, event, id, pl); err != nil {
+		if b.queue == nil {
+			return err
+		}
+
+		log.WithError(err).WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"event":      event,
+		}).Warning("integration/mqtt: publish event error, queueing event")
+		return b.queueEvent(item)
 	}
 
-	return b.publishEvent(gatewayID, event, fields, v)
+	return nil
 }
 
 // PublishState publishes the given state as retained message.
@@ -365,7 +484,11 @@ func (b *Backend) PublishState(gatewayID lorawan.EUI64, state string, v proto.Me
 		"state":      state,
 		"gateway_id": gatewayID,
 	}).Info("integration/mqtt: publishing state")
-	if err := tokenWrapper(b.conn.Publish(topic.String(), b.qos, b.stateRetained, bytes), b.maxTokenWait); err != nil {
+	props := []userProperty{
+		{"gateway_id", gatewayID.String()},
+		{"state_type", state},
+	}
+	if err := b.conn.publish(topic.String(), b.qos, b.stateRetained, bytes, props); err != nil {
 		return err
 	}
 	return nil
@@ -380,10 +503,10 @@ func (b *Backend) connect() error {
 	}
 
 	if b.conn != nil {
-		b.conn.Disconnect(250)
+		b.conn.disconnect()
 	}
-	b.conn = paho.NewClient(b.clientOpts)
-	if err := tokenWrapper(b.conn.Connect(), b.maxTokenWait); err != nil {
+	b.conn = b.newClient()
+	if err := b.conn.connect(); err != nil {
 		return err
 	}
 
@@ -413,7 +536,7 @@ func (b *Backend) disconnect() error {
 	b.connMux.Lock()
 	defer b.connMux.Unlock()
 
-	b.conn.Disconnect(250)
+	b.conn.disconnect()
 	return nil
 }
 
@@ -435,7 +558,7 @@ func (b *Backend) reconnectLoop() {
 	}
 }
 
-func (b *Backend) onConnected(c paho.Client) {
+func (b *Backend) onConnected() {
 	mqttConnectCounter().Inc()
 	log.Info("integration/mqtt: connected to mqtt broker")
 
@@ -459,7 +582,7 @@ func (b *Backend) subscribeLoop() {
 			break
 		}
 
-		if !b.conn.IsConnected() {
+		if !b.isConnected() {
 			continue
 		}
 
@@ -525,7 +648,7 @@ func (b *Backend) subscribeLoop() {
 	}
 }
 
-func (b *Backend) onConnectionLost(c paho.Client, err error) {
+func (b *Backend) onConnectionLost(err error) {
 	if b.terminateOnConnectError {
 		log.Fatal(err)
 	}
@@ -533,11 +656,11 @@ func (b *Backend) onConnectionLost(c paho.Client, err error) {
 	log.WithError(err).Error("mqtt: connection error")
 }
 
-func (b *Backend) handleDownlinkFrame(c paho.Client, msg paho.Message) {
+func (b *Backend) handleDownlinkFrame(topic string, payload []byte) {
 	var downlinkFrame gw.DownlinkFrame
-	if err := b.unmarshal(msg.Payload(), &downlinkFrame); err != nil {
+	if err := b.unmarshal(payload, &downlinkFrame); err != nil {
 		log.WithFields(log.Fields{
-			"topic": msg.Topic(),
+			"topic": topic,
 		}).WithError(err).Error("integration/mqtt: unmarshal downlink frame error")
 		return
 	}
@@ -559,13 +682,13 @@ func (b *Backend) handleDownlinkFrame(c paho.Client, msg paho.Message) {
 	}
 }
 
-func (b *Backend) handleGatewayConfiguration(c paho.Client, msg paho.Message) {
+func (b *Backend) handleGatewayConfiguration(topic string, payload []byte) {
 	log.WithFields(log.Fields{
-		"topic": msg.Topic(),
+		"topic": topic,
 	}).Info("integration/mqtt: gateway configuration received")
 
 	var gatewayConfig gw.GatewayConfiguration
-	if err := b.unmarshal(msg.Payload(), &gatewayConfig); err != nil {
+	if err := b.unmarshal(payload, &gatewayConfig); err != nil {
 		log.WithError(err).Error("integration/mqtt: unmarshal gateway configuration error")
 		return
 	}
@@ -575,11 +698,11 @@ func (b *Backend) handleGatewayConfiguration(c paho.Client, msg paho.Message) {
 	}
 }
 
-func (b *Backend) handleGatewayCommandExecRequest(c paho.Client, msg paho.Message) {
+func (b *Backend) handleGatewayCommandExecRequest(topic string, payload []byte) {
 	var gatewayCommandExecRequest gw.GatewayCommandExecRequest
-	if err := b.unmarshal(msg.Payload(), &gatewayCommandExecRequest); err != nil {
+	if err := b.unmarshal(payload, &gatewayCommandExecRequest); err != nil {
 		log.WithFields(log.Fields{
-			"topic": msg.Topic(),
+			"topic": topic,
 		}).WithError(err).Error("integration/mqtt: unmarshal gateway command execution request error")
 		return
 	}
@@ -587,7 +710,7 @@ func (b *Backend) handleGatewayCommandExecRequest(c paho.Client, msg paho.Messag
 	var gatewayID lorawan.EUI64
 	if err := gatewayID.UnmarshalText([]byte(gatewayCommandExecRequest.GetGatewayId())); err != nil {
 		log.WithFields(log.Fields{
-			"topic": msg.Topic(),
+			"topic": topic,
 		}).WithError(err).Error("integration/mqtt: decode gateway id error")
 		return
 	}
@@ -601,11 +724,11 @@ func (b *Backend) handleGatewayCommandExecRequest(c paho.Client, msg paho.Messag
 	}
 }
 
-func (b *Backend) handleRawPacketForwarderCommand(c paho.Client, msg paho.Message) {
+func (b *Backend) handleRawPacketForwarderCommand(topic string, payload []byte) {
 	var rawPacketForwarderCommand gw.RawPacketForwarderCommand
-	if err := b.unmarshal(msg.Payload(), &rawPacketForwarderCommand); err != nil {
+	if err := b.unmarshal(payload, &rawPacketForwarderCommand); err != nil {
 		log.WithFields(log.Fields{
-			"topic": msg.Topic(),
+			"topic": topic,
 		}).WithError(err).Error("integration/mqtt: unmarshal raw packet-forwarder command error")
 		return
 	}
@@ -613,7 +736,7 @@ func (b *Backend) handleRawPacketForwarderCommand(c paho.Client, msg paho.Messag
 	var gatewayID lorawan.EUI64
 	if err := gatewayID.UnmarshalText([]byte(rawPacketForwarderCommand.GetGatewayId())); err != nil {
 		log.WithFields(log.Fields{
-			"topic": msg.Topic(),
+			"topic": topic,
 		}).WithError(err).Error("integration/mqtt: decode gateway id error")
 		return
 	}
@@ -627,25 +750,25 @@ func (b *Backend) handleRawPacketForwarderCommand(c paho.Client, msg paho.Messag
 	}
 }
 
-func (b *Backend) handleCommand(c paho.Client, msg paho.Message) {
-	if strings.HasSuffix(msg.Topic(), "down") || strings.Contains(msg.Topic(), "command=down") {
+func (b *Backend) handleCommand(topic string, payload []byte) {
+	if strings.HasSuffix(topic, "down") || strings.Contains(topic, "command=down") {
 		mqttCommandCounter("down").Inc()
-		b.handleDownlinkFrame(c, msg)
-	} else if strings.HasSuffix(msg.Topic(), "config") || strings.Contains(msg.Topic(), "command=config") {
+		b.handleDownlinkFrame(topic, payload)
+	} else if strings.HasSuffix(topic, "config") || strings.Contains(topic, "command=config") {
 		mqttCommandCounter("config").Inc()
-		b.handleGatewayConfiguration(c, msg)
-	} else if strings.HasSuffix(msg.Topic(), "exec") || strings.Contains(msg.Topic(), "command=exec") {
-		b.handleGatewayCommandExecRequest(c, msg)
-	} else if strings.HasSuffix(msg.Topic(), "raw") || strings.Contains(msg.Topic(), "command=raw") {
-		b.handleRawPacketForwarderCommand(c, msg)
+		b.handleGatewayConfiguration(topic, payload)
+	} else if strings.HasSuffix(topic, "exec") || strings.Contains(topic, "command=exec") {
+		b.handleGatewayCommandExecRequest(topic, payload)
+	} else if strings.HasSuffix(topic, "raw") || strings.Contains(topic, "command=raw") {
+		b.handleRawPacketForwarderCommand(topic, payload)
 	} else {
 		log.WithFields(log.Fields{
-			"topic": msg.Topic(),
+			"topic": topic,
 		}).Warning("integration/mqtt: unexpected command received")
 	}
 }
 
-func (b *Backend) publishEvent(gatewayID lorawan.EUI64, event string, fields log.Fields, msg proto.Message) error {
+func (b *Backend) publishEvent(gatewayID lorawan.EUI64, event string, id uint32, pl []byte) error {
 	topic := bytes.NewBuffer(nil)
 	if err := b.eventTopicTemplate.Execute(topic, struct {
 		GatewayID lorawan.EUI64
@@ -654,9 +777,13 @@ func (b *Backend) publishEvent(gatewayID lorawan.EUI64, event string, fields log
 		return errors.Wrap(err, "execute event template error")
 	}
 
-	bytes, err := b.marshal(msg)
-	if err != nil {
-		return errors.Wrap(err, "marshal message error")
+	fields := log.Fields{}
+	if event == "up" {
+		fields["uplink_id"] = id
+	}
+
+	if event == "down" {
+		fields["downlink_id"] = id
 	}
 
 	fields["topic"] = topic.String()
@@ -664,22 +791,105 @@ func (b *Backend) publishEvent(gatewayID lorawan.EUI64, event string, fields log
 	fields["event"] = event
 
 	log.WithFields(fields).Info("integration/mqtt: publishing event")
-	if err := tokenWrapper(b.conn.Publish(topic.String(), b.qos, false, bytes), b.maxTokenWait); err != nil {
+	props := []userProperty{
+		{"gateway_id", gatewayID.String()},
+		{"event_type", event},
+	}
+	if event == "up" {
+		props = append(props, userProperty{"uplink_id", fmt.Sprintf("%d", id)})
+	}
+
+	if err := b.conn.publish(topic.String(), b.qos, false, pl, props); err != nil {
 		return err
 	}
 	return nil
 }
 
+func (b *Backend) queueEvent(item queueItem) error {
+	log.WithFields(log.Fields{
+		"gateway_id": item.GatewayID,
+		"event":      item.Event,
+	}).Info("integration/mqtt: queueing event")
+
+	if err := b.queue.push(item); err != nil {
+		return errors.Wrap(err, "queue event error")
+	}
+	return nil
+}
+
+// queueLoop publishes the queued events, in order, while connected to the
+// MQTT broker. Publishing is retried on the next run in case of an error.
+// The loop returns when the queueDone channel is closed.
+func (b *Backend) queueLoop() {
+	defer b.queueWg.Done()
+
+	for {
+		select {
+		case <-b.queueDone:
+			return
+		case <-time.After(time.Millisecond * 100):
+		}
+
+		if !b.isConnected() {
+			continue
+		}
+
+		for b.publishQueuedEvent() {
+			select {
+			case <-b.queueDone:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// publishQueuedEvent publishes the oldest queued event and removes it from
+// the queue. It returns false when the queue is empty or in case of an error.
+func (b *Backend) publishQueuedEvent() bool {
+	b.queueMux.Lock()
+	defer b.queueMux.Unlock()
+
+	// avoid a database transaction on each run of the queue loop while idle
+	if b.queue.len() == 0 {
+		return false
+	}
+
+	key, item, ok, err := b.queue.peek()
+	if err != nil {
+		log.WithError(err).Error("integration/mqtt: read queue error")
+		return false
+	}
+	if !ok {
+		return false
+	}
+
+	if err := b.publishEvent(item.GatewayID, item.Event, item.ID, item.Payload); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"gateway_id": item.GatewayID,
+			"event":      item.Event,
+		}).Error("integration/mqtt: publish queued event error")
+		return false
+	}
+
+	if err := b.queue.remove(item.Event, key); err != nil {
+		log.WithError(err).Error("integration/mqtt: remove queued event error")
+		return false
+	}
+
+	return true
+}
+
+// isConnected returns true when connected to the MQTT broker.
+func (b *Backend) isConnected() bool {
+	b.connMux.RLock()
+	defer b.connMux.RUnlock()
+	return b.conn != nil && b.conn.isConnected()
+}
+
 // isClosed returns true when the integration is shutting down.
 func (b *Backend) isClosed() bool {
 	b.connMux.RLock()
 	defer b.connMux.RUnlock()
 	return b.connClosed
 }
-
-func tokenWrapper(token paho.Token, timeout time.Duration) error {
-	if !token.WaitTimeout(timeout) {
-		return errors.New("token wait timeout error")
-	}
-	return token.Error()
-}
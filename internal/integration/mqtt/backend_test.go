@@ -1,6 +1,9 @@
 package mqtt
 
 import (
+	"context"
+	"net"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
@@ -9,6 +12,7 @@ import (
 	"github.com/chirpstack/chirpstack/api/go/v4/gw"
 	"google.golang.org/protobuf/proto"
 
+	paho5 "github.com/eclipse/paho.golang/paho"
 	paho "github.com/eclipse/paho.mqtt.golang"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
@@ -21,9 +25,11 @@ import (
 type MQTTBackendTestSuite struct {
 	suite.Suite
 
-	mqttClient paho.Client
-	backend    *Backend
-	gatewayID  lorawan.EUI64
+	protocolVersion uint
+	server          string
+	mqttClient      paho.Client
+	backend         *Backend
+	gatewayID       lorawan.EUI64
 }
 
 func (ts *MQTTBackendTestSuite) SetupSuite() {
@@ -38,6 +44,7 @@ func (ts *MQTTBackendTestSuite) SetupSuite() {
 	if v := os.Getenv("TEST_MQTT_SERVER"); v != "" {
 		server = v
 	}
+	ts.server = server
 	if v := os.Getenv("TEST_MQTT_USERNAME"); v != "" {
 		username = v
 	}
@@ -66,6 +73,7 @@ func (ts *MQTTBackendTestSuite) SetupSuite() {
 	conf.Integration.MQTT.Auth.Generic.CleanSession = true
 	conf.Integration.MQTT.Auth.Generic.ClientID = ts.gatewayID.String()
 	conf.Integration.MQTT.MaxTokenWait = time.Second
+	conf.Integration.MQTT.ProtocolVersion = ts.protocolVersion
 
 	var err error
 	ts.backend, err = NewBackend(conf)
@@ -189,6 +197,74 @@ func (ts *MQTTBackendTestSuite) TestPublishUplinkFrame() {
 	assert.True(proto.Equal(&uplink, uplinkReceived))
 }
 
+func (ts *MQTTBackendTestSuite) TestUserProperties() {
+	if ts.protocolVersion != 5 {
+		ts.T().Skip("user properties require MQTT v5")
+	}
+
+	assert := require.New(ts.T())
+
+	u, err := url.Parse(ts.server)
+	assert.NoError(err)
+	conn, err := net.Dial("tcp", u.Host)
+	assert.NoError(err)
+
+	propsChan := make(chan paho5.UserProperties, 1)
+	client := paho5.NewClient(paho5.ClientConfig{
+		Conn: conn,
+		OnPublishReceived: []func(paho5.PublishReceived) (bool, error){
+			func(pr paho5.PublishReceived) (bool, error) {
+				propsChan <- pr.Packet.Properties.User
+				return true, nil
+			},
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	connect := paho5.Connect{
+		ClientID:   "user-properties-test",
+		CleanStart: true,
+		KeepAlive:  30,
+	}
+	if v := os.Getenv("TEST_MQTT_USERNAME"); v != "" {
+		connect.Username = v
+		connect.UsernameFlag = true
+	}
+	if v := os.Getenv("TEST_MQTT_PASSWORD"); v != "" {
+		connect.Password = []byte(v)
+		connect.PasswordFlag = true
+	}
+	_, err = client.Connect(ctx, &connect)
+	assert.NoError(err)
+	defer client.Disconnect(&paho5.Disconnect{})
+
+	_, err = client.Subscribe(ctx, &paho5.Subscribe{
+		Subscriptions: []paho5.SubscribeOptions{
+			{Topic: "gateway/+/event/up"},
+		},
+	})
+	assert.NoError(err)
+
+	uplink := gw.UplinkFrame{
+		PhyPayload: []byte{1, 2, 3, 4},
+		RxInfo: &gw.UplinkRxInfo{
+			UplinkId: 123,
+		},
+	}
+	assert.NoError(ts.backend.PublishEvent(ts.gatewayID, "up", uplink.GetRxInfo().GetUplinkId(), &uplink))
+
+	select {
+	case props := <-propsChan:
+		assert.Equal(ts.gatewayID.String(), props.Get("gateway_id"))
+		assert.Equal("up", props.Get("event_type"))
+		assert.Equal("123", props.Get("uplink_id"))
+	case <-time.After(time.Second):
+		assert.Fail("uplink event not received")
+	}
+}
+
 func (ts *MQTTBackendTestSuite) TestGatewayStats() {
 	assert := require.New(ts.T())
 
@@ -365,5 +441,236 @@ func (ts *MQTTBackendTestSuite) TestRawPacketForwarderCommand() {
 }
 
 func TestMQTTBackend(t *testing.T) {
-	suite.Run(t, new(MQTTBackendTestSuite))
+	suite.Run(t, &MQTTBackendTestSuite{protocolVersion: 4})
+}
+
+func TestMQTTBackendV5(t *testing.T) {
+	suite.Run(t, &MQTTBackendTestSuite{protocolVersion: 5})
+}
+
+func TestQueueLoop(t *testing.T) {
+	assert := require.New(t)
+
+	tempDir, err := os.MkdirTemp("", "test")
+	assert.NoError(err)
+	defer os.RemoveAll(tempDir)
+
+	server := "tcp://127.0.0.1:1883"
+	if v := os.Getenv("TEST_MQTT_SERVER"); v != "" {
+		server = v
+	}
+
+	opts := paho.NewClientOptions().AddBroker(server).SetUsername(os.Getenv("TEST_MQTT_USERNAME")).SetPassword(os.Getenv("TEST_MQTT_PASSWORD"))
+	mqttClient := paho.NewClient(opts)
+	token := mqttClient.Connect()
+	token.Wait()
+	assert.NoError(token.Error())
+	defer mqttClient.Disconnect(0)
+
+	idChan := make(chan string, 3)
+	token = mqttClient.Subscribe("gateway/0102030405060708/event/queued", 0, func(c paho.Client, msg paho.Message) {
+		idChan <- string(msg.Payload())
+	})
+	token.Wait()
+	assert.NoError(token.Error())
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	var conf config.Config
+	conf.Integration.Marshaler = "json"
+	conf.Integration.MQTT.EventTopicTemplate = "gateway/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.Integration.MQTT.CommandTopicTemplate = "gateway/{{ .GatewayID }}/command/#"
+	conf.Integration.MQTT.Auth.Type = "generic"
+	conf.Integration.MQTT.Auth.Generic.Servers = []string{server}
+	conf.Integration.MQTT.Auth.Generic.Username = os.Getenv("TEST_MQTT_USERNAME")
+	conf.Integration.MQTT.Auth.Generic.Password = os.Getenv("TEST_MQTT_PASSWORD")
+	conf.Integration.MQTT.Auth.Generic.CleanSession = true
+	conf.Integration.MQTT.Auth.Generic.ClientID = "queue-loop-test"
+	conf.Integration.MQTT.MaxTokenWait = time.Second
+	conf.Integration.MQTT.Queue.Directory = tempDir
+
+	backend, err := NewBackend(conf)
+	assert.NoError(err)
+
+	// events queued before the start are published by the queue loop, the
+	// event published after the start must be published after these
+	for _, id := range []string{"1", "2"} {
+		assert.NoError(backend.queue.push(queueItem{
+			GatewayID: gatewayID,
+			Event:     "queued",
+			Payload:   []byte(id),
+			Time:      time.Now(),
+		}))
+	}
+
+	assert.NoError(backend.Start())
+	assert.NoError(backend.PublishEvent(gatewayID, "queued", 0, &gw.UplinkFrame{}))
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		select {
+		case id := <-idChan:
+			ids = append(ids, id)
+		case <-time.After(time.Second):
+			assert.FailNow("event not received")
+		}
+	}
+	assert.Equal([]string{"1", "2", "{}"}, ids)
+
+	// the queue loop must be stopped before the queue is closed
+	assert.NoError(backend.Stop())
+}
+
+// offlineClient implements a client which is never connected.
+type offlineClient struct{}
+
+func (c *offlineClient) connect() error                                            { return nil }
+func (c *offlineClient) disconnect()                                               {}
+func (c *offlineClient) isConnected() bool                                         { return false }
+func (c *offlineClient) publish(string, uint8, bool, []byte, []userProperty) error { return nil }
+func (c *offlineClient) subscribe(string, uint8) error                             { return nil }
+func (c *offlineClient) unsubscribe(string) error                                  { return nil }
+
+func TestQueueStop(t *testing.T) {
+	assert := require.New(t)
+
+	tempDir, err := os.MkdirTemp("", "test")
+	assert.NoError(err)
+	defer os.RemoveAll(tempDir)
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	var conf config.Config
+	conf.Integration.Marshaler = "json"
+	conf.Integration.MQTT.EventTopicTemplate = "gateway/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.Integration.MQTT.CommandTopicTemplate = "gateway/{{ .GatewayID }}/command/#"
+	conf.Integration.MQTT.Auth.Type = "generic"
+	conf.Integration.MQTT.Auth.Generic.Servers = []string{"tcp://127.0.0.1:1883"}
+	conf.Integration.MQTT.Queue.Directory = tempDir
+
+	backend, err := NewBackend(conf)
+	assert.NoError(err)
+	backend.conn = &offlineClient{}
+
+	// events are queued while publishing concurrently with the stop
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			backend.PublishEvent(gatewayID, "up", 0, &gw.UplinkFrame{})
+		}
+	}()
+
+	assert.NoError(backend.Stop())
+	<-done
+
+	assert.EqualError(backend.PublishEvent(gatewayID, "up", 0, &gw.UplinkFrame{}), "integration is closed")
+}
+
+func TestProtocolVersion(t *testing.T) {
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	var conf config.Config
+	conf.Integration.Marshaler = "json"
+	conf.Integration.MQTT.EventTopicTemplate = "gateway/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.Integration.MQTT.CommandTopicTemplate = "gateway/{{ .GatewayID }}/command/#"
+	conf.Integration.MQTT.Auth.Type = "generic"
+	conf.Integration.MQTT.Auth.Generic.Servers = []string{"tcp://127.0.0.1:1883"}
+
+	t.Run("Shared subscription requires v5", func(t *testing.T) {
+		assert := require.New(t)
+
+		conf := conf
+		conf.Integration.MQTT.ProtocolVersion = 4
+		conf.Integration.MQTT.SharedSubscriptionGroup = "bridges"
+
+		_, err := NewBackend(conf)
+		assert.EqualError(err, "integration/mqtt: shared_subscription_group requires protocol_version 5")
+	})
+
+	t.Run("Unsupported version", func(t *testing.T) {
+		assert := require.New(t)
+
+		conf := conf
+		conf.Integration.MQTT.ProtocolVersion = 3
+
+		_, err := NewBackend(conf)
+		assert.EqualError(err, "integration/mqtt: unsupported protocol version: 3")
+	})
+
+	t.Run("v5 shared subscription", func(t *testing.T) {
+		assert := require.New(t)
+
+		conf := conf
+		conf.Integration.MQTT.ProtocolVersion = 5
+		conf.Integration.MQTT.SharedSubscriptionGroup = "bridges"
+
+		b, err := NewBackend(conf)
+		assert.NoError(err)
+
+		topic, err := b.getCommandTopic(gatewayID)
+		assert.NoError(err)
+		assert.Equal("$share/bridges/gateway/0102030405060708/command/#", topic)
+	})
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	assert := require.New(t)
+
+	backoff := reconnectBackoff(5 * time.Second)
+	assert.Equal(time.Duration(0), backoff(0))
+	assert.Equal(time.Second, backoff(1))
+	assert.Equal(2*time.Second, backoff(2))
+	assert.Equal(4*time.Second, backoff(3))
+	assert.Equal(5*time.Second, backoff(4))
+	assert.Equal(5*time.Second, backoff(100))
+}
+
+func TestHandlePublishV5(t *testing.T) {
+	expiry := func(v uint32) *paho5.PublishProperties {
+		return &paho5.PublishProperties{MessageExpiry: &v}
+	}
+
+	tests := []struct {
+		name       string
+		properties *paho5.PublishProperties
+		handled    bool
+	}{
+		{
+			name:    "no properties",
+			handled: true,
+		},
+		{
+			name:       "remaining expiry",
+			properties: expiry(10),
+			handled:    true,
+		},
+		{
+			name:       "expired",
+			properties: expiry(0),
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			var handled bool
+			c := clientV5{
+				handler: func(topic string, payload []byte) {
+					handled = true
+				},
+			}
+
+			ok, err := c.handlePublish(paho5.PublishReceived{
+				Packet: &paho5.Publish{
+					Topic:      "gateway/0102030405060708/command/down",
+					Properties: tst.properties,
+				},
+			})
+			assert.NoError(err)
+			assert.True(ok)
+			assert.Equal(tst.handled, handled)
+		})
+	}
 }
@@ -0,0 +1,96 @@
+package mqtt
+
+import (
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+)
+
+// client defines the interface of the MQTT client, such that the integration
+// can use either MQTT v3.1.1 or MQTT v5.
+type client interface {
+	// connect connects to the MQTT broker. It blocks until the connection has
+	// been established or the max token wait has elapsed.
+	connect() error
+
+	// disconnect disconnects from the MQTT broker.
+	disconnect()
+
+	// isConnected returns true when connected to the MQTT broker.
+	isConnected() bool
+
+	// publish publishes the given payload. The user properties are only sent
+	// when using MQTT v5.
+	publish(topic string, qos uint8, retained bool, payload []byte, props []userProperty) error
+
+	// subscribe subscribes to the given topic. Received messages are passed
+	// to the command handler of the integration.
+	subscribe(topic string, qos uint8) error
+
+	// unsubscribe unsubscribes from the given topic.
+	unsubscribe(topic string) error
+}
+
+// userProperty defines a MQTT v5 user property.
+type userProperty struct {
+	key   string
+	value string
+}
+
+// clientV3 implements a MQTT v3.1.1 client.
+type clientV3 struct {
+	conn         paho.Client
+	maxTokenWait time.Duration
+	handler      func(topic string, payload []byte)
+}
+
+func (b *Backend) newClientV3() client {
+	b.clientOpts.SetProtocolVersion(4)
+	b.clientOpts.SetAutoReconnect(true) // this is required for buffering messages in case offline!
+	b.clientOpts.SetOnConnectHandler(func(c paho.Client) {
+		b.onConnected()
+	})
+	b.clientOpts.SetConnectionLostHandler(func(c paho.Client, err error) {
+		b.onConnectionLost(err)
+	})
+
+	return &clientV3{
+		conn:         paho.NewClient(b.clientOpts),
+		maxTokenWait: b.maxTokenWait,
+		handler:      b.handleCommand,
+	}
+}
+
+func (c *clientV3) connect() error {
+	return tokenWrapper(c.conn.Connect(), c.maxTokenWait)
+}
+
+func (c *clientV3) disconnect() {
+	c.conn.Disconnect(250)
+}
+
+func (c *clientV3) isConnected() bool {
+	return c.conn.IsConnected()
+}
+
+func (c *clientV3) publish(topic string, qos uint8, retained bool, payload []byte, props []userProperty) error {
+	return tokenWrapper(c.conn.Publish(topic, qos, retained, payload), c.maxTokenWait)
+}
+
+func (c *clientV3) subscribe(topic string, qos uint8) error {
+	return tokenWrapper(c.conn.Subscribe(topic, qos, func(_ paho.Client, msg paho.Message) {
+		c.handler(msg.Topic(), msg.Payload())
+	}), c.maxTokenWait)
+}
+
+func (c *clientV3) unsubscribe(topic string) error {
+	return tokenWrapper(c.conn.Unsubscribe(topic), c.maxTokenWait)
+}
+
+func tokenWrapper(token paho.Token, timeout time.Duration) error {
+	if !token.WaitTimeout(timeout) {
+		return errors.New("token wait timeout error")
+	}
+	return token.Error()
+}
@@ -0,0 +1,219 @@
+package mqtt
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	paho5 "github.com/eclipse/paho.golang/paho"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// clientV5 implements a MQTT v5 client.
+//
+// The connection settings (servers, client ID, credentials, TLS and last will)
+// are taken from the paho v3 client options, such that all authentication
+// types can be used with MQTT v5.
+type clientV5 struct {
+	sync.RWMutex
+
+	conf         autopaho.ClientConfig
+	conn         *autopaho.ConnectionManager
+	connected    bool
+	maxTokenWait time.Duration
+	handler      func(topic string, payload []byte)
+}
+
+func (b *Backend) newClientV5() client {
+	c := clientV5{
+		maxTokenWait: b.maxTokenWait,
+		handler:      b.handleCommand,
+	}
+
+	c.conf = autopaho.ClientConfig{
+		ServerUrls: b.clientOpts.Servers,
+		TlsCfg:     b.clientOpts.TLSConfig,
+		KeepAlive:  uint16(b.clientOpts.KeepAlive),
+
+		// The session expiry interval replaces the clean session flag. When
+		// set, the broker keeps the subscriptions and queued commands of the
+		// session for the given interval after a disconnect.
+		CleanStartOnInitialConnection: b.sessionExpiryInterval == 0,
+		SessionExpiryInterval:         uint32(b.sessionExpiryInterval / time.Second),
+
+		ReconnectBackoff: reconnectBackoff(b.clientOpts.MaxReconnectInterval),
+		ConnectTimeout:   b.maxTokenWait,
+		ConnectUsername:  b.clientOpts.Username,
+		ConnectPassword:  []byte(b.clientOpts.Password),
+
+		OnConnectionUp: func(*autopaho.ConnectionManager, *paho5.Connack) {
+			c.setConnected(true)
+			b.onConnected()
+		},
+		OnConnectionDown: func() bool {
+			c.setConnected(false)
+			b.onConnectionLost(errors.New("connection lost"))
+			return true
+		},
+		OnConnectError: func(err error) {
+			log.WithError(err).Error("integration/mqtt: connection error")
+		},
+
+		ClientConfig: paho5.ClientConfig{
+			ClientID:          b.clientOpts.ClientID,
+			OnPublishReceived: []func(paho5.PublishReceived) (bool, error){c.handlePublish},
+		},
+	}
+
+	if b.clientOpts.WillEnabled {
+		c.conf.WillMessage = &paho5.WillMessage{
+			Topic:   b.clientOpts.WillTopic,
+			Payload: b.clientOpts.WillPayload,
+			QoS:     b.clientOpts.WillQos,
+			Retain:  b.clientOpts.WillRetained,
+		}
+	}
+
+	return &c
+}
+
+func (c *clientV5) connect() error {
+	conn, err := autopaho.NewConnection(context.Background(), c.conf)
+	if err != nil {
+		return errors.Wrap(err, "new connection error")
+	}
+
+	c.Lock()
+	c.conn = conn
+	c.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.maxTokenWait)
+	defer cancel()
+
+	if err := conn.AwaitConnection(ctx); err != nil {
+		_ = conn.Disconnect(context.Background())
+		return errors.Wrap(err, "await connection error")
+	}
+
+	return nil
+}
+
+func (c *clientV5) disconnect() {
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+
+	_ = c.getConn().Disconnect(ctx)
+	c.setConnected(false)
+}
+
+func (c *clientV5) isConnected() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.connected
+}
+
+func (c *clientV5) publish(topic string, qos uint8, retained bool, payload []byte, props []userProperty) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.maxTokenWait)
+	defer cancel()
+
+	// Similar to the v3 client, wait for the connection to be restored in
+	// case it is offline.
+	if err := c.getConn().AwaitConnection(ctx); err != nil {
+		return errors.Wrap(err, "await connection error")
+	}
+
+	pub := paho5.Publish{
+		Topic:      topic,
+		QoS:        qos,
+		Retain:     retained,
+		Payload:    payload,
+		Properties: &paho5.PublishProperties{},
+	}
+	for _, p := range props {
+		pub.Properties.User.Add(p.key, p.value)
+	}
+
+	if _, err := c.getConn().Publish(ctx, &pub); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *clientV5) subscribe(topic string, qos uint8) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.maxTokenWait)
+	defer cancel()
+
+	_, err := c.getConn().Subscribe(ctx, &paho5.Subscribe{
+		Subscriptions: []paho5.SubscribeOptions{
+			{Topic: topic, QoS: qos},
+		},
+	})
+	return err
+}
+
+func (c *clientV5) unsubscribe(topic string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.maxTokenWait)
+	defer cancel()
+
+	_, err := c.getConn().Unsubscribe(ctx, &paho5.Unsubscribe{
+		Topics: []string{topic},
+	})
+	return err
+}
+
+func (c *clientV5) getConn() *autopaho.ConnectionManager {
+	c.RLock()
+	defer c.RUnlock()
+	return c.conn
+}
+
+func (c *clientV5) setConnected(connected bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.connected = connected
+}
+
+// handlePublish handles the received messages. Note that commands which have
+// been published with a message expiry interval are dropped by the broker
+// when they expire before they could be delivered, e.g. when a downlink is
+// queued while the connection is lost. As the broker sends the remaining
+// expiry interval, commands which are delivered with a remaining interval of
+// 0 have expired and are dropped as well.
+func (c *clientV5) handlePublish(pr paho5.PublishReceived) (bool, error) {
+	fields := log.Fields{
+		"topic": pr.Packet.Topic,
+	}
+	if pr.Packet.Properties != nil && pr.Packet.Properties.MessageExpiry != nil {
+		fields["message_expiry"] = *pr.Packet.Properties.MessageExpiry
+
+		if *pr.Packet.Properties.MessageExpiry == 0 {
+			log.WithFields(fields).Warning("integration/mqtt: dropping expired message")
+			return true, nil
+		}
+	}
+	log.WithFields(fields).Debug("integration/mqtt: message received")
+
+	c.handler(pr.Packet.Topic, pr.Packet.Payload)
+	return true, nil
+}
+
+// reconnectBackoff returns an exponential backoff, starting at one second,
+// which is capped at the given max interval.
+func reconnectBackoff(max time.Duration) func(int) time.Duration {
+	return func(attempt int) time.Duration {
+		if attempt <= 0 {
+			return 0
+		}
+
+		d := time.Second
+		for i := 1; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if max > 0 && d > max {
+			d = max
+		}
+		return d
+	}
+}
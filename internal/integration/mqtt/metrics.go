@@ -35,6 +35,16 @@ var (
 		Name: "integration_mqtt_reconnect_count",
 		Help: "The number of times the integration reconnected to the MQTT broker (this also increments the disconnect and connect counters).",
 	})
+
+	qd = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "integration_mqtt_queue_depth",
+		Help: "The number of gateway events in the MQTT integration queue (per event).",
+	}, []string{"event"})
+
+	qdc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "integration_mqtt_queue_drop_count",
+		Help: "The number of gateway events dropped from the MQTT integration queue (per event and reason).",
+	}, []string{"event", "reason"})
 )
 
 func mqttEventCounter(e string) prometheus.Counter {
@@ -60,3 +70,11 @@ func mqttDisconnectCounter() prometheus.Counter {
 func mqttReconnectCounter() prometheus.Counter {
 	return mqttr
 }
+
+func mqttQueueDepthGauge(e string) prometheus.Gauge {
+	return qd.With(prometheus.Labels{"event": e})
+}
+
+func mqttQueueDropCounter(e, r string) prometheus.Counter {
+	return qdc.With(prometheus.Labels{"event": e, "reason": r})
+}
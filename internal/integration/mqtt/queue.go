@@ -0,0 +1,341 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+// Drop policies.
+const (
+	dropOldest = "drop_oldest"
+	dropNewest = "drop_newest"
+)
+
+// Drop reasons.
+const (
+	dropReasonMaxSize = "max_size"
+	dropReasonMaxAge  = "max_age"
+	dropReasonInvalid = "invalid"
+)
+
+// sequenceBucket holds the sequence used for generating the queue keys. The
+// events are stored in a bucket per event type.
+const sequenceBucket = "sequence"
+
+// queuePolicy defines the limits of the queue for an event type.
+type queuePolicy struct {
+	maxSize    int
+	maxAge     time.Duration
+	dropNewest bool
+}
+
+// queueItem contains a queued event. The payload contains the marshaled
+// event, such that the (configured) marshaler is not needed on replay.
+type queueItem struct {
+	GatewayID lorawan.EUI64 `json:"gatewayID"`
+	Event     string        `json:"event"`
+	ID        uint32        `json:"id"`
+	Payload   []byte        `json:"payload"`
+	Time      time.Time     `json:"time"`
+}
+
+// queue implements a persistent store-and-forward queue for the events that
+// could not be published, e.g. because the MQTT broker is unreachable. The
+// events are stored in a bucket per event type, using a global sequence as
+// key, such that the events can be replayed in order.
+type queue struct {
+	sync.Mutex
+
+	db       *bolt.DB
+	policy   queuePolicy
+	policies map[string]queuePolicy
+	depth    map[string]int
+}
+
+// newQueuePolicy returns the queue policy for the given configuration. The
+// settings which are not set are taken from the given default. When the drop
+// policy is not set in either, drop_oldest is used.
+func newQueuePolicy(conf, def config.MQTTQueuePolicy) (queuePolicy, error) {
+	maxSize := conf.MaxSize
+	if maxSize == 0 {
+		maxSize = def.MaxSize
+	}
+
+	maxAge := conf.MaxAge
+	if maxAge == 0 {
+		maxAge = def.MaxAge
+	}
+
+	dropPolicy := conf.DropPolicy
+	if dropPolicy == "" {
+		dropPolicy = def.DropPolicy
+	}
+	if dropPolicy == "" {
+		dropPolicy = dropOldest
+	}
+
+	switch dropPolicy {
+	case dropOldest, dropNewest:
+	default:
+		return queuePolicy{}, fmt.Errorf("unknown drop policy: %s", dropPolicy)
+	}
+
+	return queuePolicy{
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		dropNewest: dropPolicy == dropNewest,
+	}, nil
+}
+
+// openQueue opens or creates the queue in the configured directory. It
+// returns nil when the directory is not set.
+func openQueue(conf config.Config) (*queue, error) {
+	qConf := conf.Integration.MQTT.Queue
+	if qConf.Directory == "" {
+		return nil, nil
+	}
+
+	q := queue{
+		policies: make(map[string]queuePolicy),
+		depth:    make(map[string]int),
+	}
+
+	var err error
+	q.policy, err = newQueuePolicy(qConf.MQTTQueuePolicy, config.MQTTQueuePolicy{})
+	if err != nil {
+		return nil, err
+	}
+
+	for event, c := range qConf.Events {
+		p, err := newQueuePolicy(c, qConf.MQTTQueuePolicy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "event %s policy error", event)
+		}
+		q.policies[event] = p
+	}
+
+	if err := os.MkdirAll(qConf.Directory, 0700); err != nil {
+		return nil, errors.Wrap(err, "create directory error")
+	}
+
+	q.db, err = bolt.Open(filepath.Join(qConf.Directory, "mqtt_queue.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "open database error")
+	}
+
+	// restore the queue depth of the queued events
+	err = q.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if string(name) == sequenceBucket {
+				return nil
+			}
+
+			q.depth[string(name)] = b.Stats().KeyN
+			mqttQueueDepthGauge(string(name)).Set(float64(b.Stats().KeyN))
+			return nil
+		})
+	})
+	if err != nil {
+		q.db.Close()
+		return nil, errors.Wrap(err, "read queue depth error")
+	}
+
+	return &q, nil
+}
+
+// getPolicy returns the policy for the given event type.
+func (q *queue) getPolicy(event string) queuePolicy {
+	if p, ok := q.policies[event]; ok {
+		return p
+	}
+	return q.policy
+}
+
+// len returns the number of queued events.
+func (q *queue) len() int {
+	q.Lock()
+	defer q.Unlock()
+
+	var n int
+	for _, d := range q.depth {
+		n += d
+	}
+	return n
+}
+
+// push adds the given item to the queue. When the queue for the event type
+// is full, either the oldest event is removed or the given item is dropped,
+// depending on the drop policy.
+func (q *queue) push(item queueItem) error {
+	q.Lock()
+	defer q.Unlock()
+
+	policy := q.getPolicy(item.Event)
+	if policy.maxSize > 0 && q.depth[item.Event] >= policy.maxSize && policy.dropNewest {
+		mqttQueueDropCounter(item.Event, dropReasonMaxSize).Inc()
+		return nil
+	}
+
+	b, err := json.Marshal(item)
+	if err != nil {
+		return errors.Wrap(err, "marshal queue item error")
+	}
+
+	var dropped bool
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		seqBucket, err := tx.CreateBucketIfNotExists([]byte(sequenceBucket))
+		if err != nil {
+			return errors.Wrap(err, "create bucket error")
+		}
+
+		bucket, err := tx.CreateBucketIfNotExists([]byte(item.Event))
+		if err != nil {
+			return errors.Wrap(err, "create bucket error")
+		}
+
+		if policy.maxSize > 0 && q.depth[item.Event] >= policy.maxSize {
+			c := bucket.Cursor()
+			if k, _ := c.First(); k != nil {
+				if err := c.Delete(); err != nil {
+					return errors.Wrap(err, "delete oldest item error")
+				}
+				dropped = true
+			}
+		}
+
+		seq, err := seqBucket.NextSequence()
+		if err != nil {
+			return errors.Wrap(err, "get sequence error")
+		}
+
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+
+		return bucket.Put(key, b)
+	})
+	if err != nil {
+		return err
+	}
+
+	if dropped {
+		q.depth[item.Event]--
+		mqttQueueDropCounter(item.Event, dropReasonMaxSize).Inc()
+	}
+	q.depth[item.Event]++
+	mqttQueueDepthGauge(item.Event).Set(float64(q.depth[item.Event]))
+
+	return nil
+}
+
+// peek returns the oldest item of the queue, with its key. Items exceeding
+// the max age of their event type and items that can't be decoded are
+// removed. It returns false when the queue is empty.
+func (q *queue) peek() ([]byte, queueItem, bool, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	for {
+		key, event, value, err := q.oldest()
+		if err != nil {
+			return nil, queueItem{}, false, err
+		}
+
+		if key == nil {
+			return nil, queueItem{}, false, nil
+		}
+
+		reason := dropReasonInvalid
+		var item queueItem
+		if err := json.Unmarshal(value, &item); err == nil {
+			policy := q.getPolicy(item.Event)
+			if policy.maxAge == 0 || time.Since(item.Time) <= policy.maxAge {
+				return key, item, true, nil
+			}
+			reason = dropReasonMaxAge
+		}
+
+		err = q.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(event))
+			if b == nil {
+				return nil
+			}
+
+			return b.Delete(key)
+		})
+		if err != nil {
+			return nil, queueItem{}, false, errors.Wrap(err, "delete item error")
+		}
+
+		q.depth[event]--
+		mqttQueueDepthGauge(event).Set(float64(q.depth[event]))
+		mqttQueueDropCounter(event, reason).Inc()
+	}
+}
+
+// oldest returns the key, event type and value of the oldest item of the
+// queue. The returned key is nil when the queue is empty.
+func (q *queue) oldest() ([]byte, string, []byte, error) {
+	var key, value []byte
+	var event string
+
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if string(name) == sequenceBucket {
+				return nil
+			}
+
+			k, v := b.Cursor().First()
+			if k != nil && (key == nil || bytes.Compare(k, key) < 0) {
+				key = append([]byte{}, k...)
+				value = append([]byte{}, v...)
+				event = string(name)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	return key, event, value, nil
+}
+
+// remove removes the item with the given key and event type from the queue.
+func (q *queue) remove(event string, key []byte) error {
+	q.Lock()
+	defer q.Unlock()
+
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(event))
+		if b == nil {
+			return nil
+		}
+
+		return b.Delete(key)
+	})
+	if err != nil {
+		return err
+	}
+
+	q.depth[event]--
+	mqttQueueDepthGauge(event).Set(float64(q.depth[event]))
+
+	return nil
+}
+
+// close closes the queue.
+func (q *queue) close() error {
+	return q.db.Close()
+}
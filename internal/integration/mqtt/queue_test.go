@@ -0,0 +1,178 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+func TestQueue(t *testing.T) {
+	assert := require.New(t)
+
+	tempDir, err := ioutil.TempDir("", "test")
+	assert.NoError(err)
+	defer os.RemoveAll(tempDir)
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	var conf config.Config
+	conf.Integration.MQTT.Queue.Directory = tempDir
+	conf.Integration.MQTT.Queue.MaxSize = 3
+	conf.Integration.MQTT.Queue.DropPolicy = dropOldest
+	conf.Integration.MQTT.Queue.Events = map[string]config.MQTTQueuePolicy{
+		"stats": {
+			MaxSize:    1,
+			MaxAge:     time.Minute,
+			DropPolicy: dropNewest,
+		},
+		"ack": {
+			DropPolicy: dropNewest,
+		},
+	}
+
+	newItem := func(event string, id uint32, ts time.Time) queueItem {
+		return queueItem{
+			GatewayID: gatewayID,
+			Event:     event,
+			ID:        id,
+			Payload:   []byte{byte(id)},
+			Time:      ts,
+		}
+	}
+
+	// drain pops all items from the queue and returns their ids.
+	drain := func(q *queue) []uint32 {
+		var out []uint32
+		for {
+			key, item, ok, err := q.peek()
+			assert.NoError(err)
+			if !ok {
+				return out
+			}
+			assert.NoError(q.remove(item.Event, key))
+			out = append(out, item.ID)
+		}
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		assert := require.New(t)
+
+		var conf config.Config
+		q, err := openQueue(conf)
+		assert.NoError(err)
+		assert.Nil(q)
+	})
+
+	t.Run("Invalid drop policy", func(t *testing.T) {
+		assert := require.New(t)
+
+		conf := conf
+		conf.Integration.MQTT.Queue.DropPolicy = "foo"
+		_, err := openQueue(conf)
+		assert.EqualError(err, "unknown drop policy: foo")
+	})
+
+	q, err := openQueue(conf)
+	assert.NoError(err)
+
+	t.Run("In order", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(q.push(newItem("up", 1, time.Now())))
+		assert.NoError(q.push(newItem("stats", 2, time.Now())))
+		assert.NoError(q.push(newItem("up", 3, time.Now())))
+		assert.Equal(3, q.len())
+
+		assert.Equal([]uint32{1, 2, 3}, drain(q))
+		assert.Equal(0, q.len())
+	})
+
+	t.Run("Drop oldest", func(t *testing.T) {
+		assert := require.New(t)
+
+		for i := uint32(1); i <= 5; i++ {
+			assert.NoError(q.push(newItem("up", i, time.Now())))
+		}
+		assert.Equal(3, q.len())
+		assert.Equal([]uint32{3, 4, 5}, drain(q))
+	})
+
+	t.Run("Drop newest", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(q.push(newItem("stats", 1, time.Now())))
+		assert.NoError(q.push(newItem("stats", 2, time.Now())))
+		assert.Equal(1, q.len())
+		assert.Equal([]uint32{1}, drain(q))
+	})
+
+	t.Run("Policy defaults", func(t *testing.T) {
+		assert := require.New(t)
+
+		// the max size of the ack events is taken from the global policy
+		assert.Equal(queuePolicy{maxSize: 3, dropNewest: true}, q.getPolicy("ack"))
+
+		for i := uint32(1); i <= 5; i++ {
+			assert.NoError(q.push(newItem("ack", i, time.Now())))
+		}
+		assert.Equal([]uint32{1, 2, 3}, drain(q))
+	})
+
+	t.Run("Max age", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(q.push(newItem("stats", 1, time.Now().Add(-2*time.Minute))))
+		assert.NoError(q.push(newItem("up", 2, time.Now().Add(-2*time.Minute))))
+		assert.Equal(2, q.len())
+
+		// the up events do not have a max age
+		assert.Equal([]uint32{2}, drain(q))
+		assert.Equal(0, q.len())
+	})
+
+	t.Run("Invalid item", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(q.push(newItem("up", 1, time.Now())))
+		assert.NoError(q.db.Update(func(tx *bolt.Tx) error {
+			seq, err := tx.Bucket([]byte(sequenceBucket)).NextSequence()
+			if err != nil {
+				return err
+			}
+
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, seq)
+			return tx.Bucket([]byte("up")).Put(key, []byte("invalid"))
+		}))
+		q.depth["up"]++
+		assert.NoError(q.push(newItem("up", 3, time.Now())))
+		assert.Equal(3, q.len())
+
+		// the item which can't be decoded is removed
+		assert.Equal([]uint32{1, 3}, drain(q))
+		assert.Equal(0, q.len())
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(q.push(newItem("up", 1, time.Now())))
+		assert.NoError(q.push(newItem("ack", 2, time.Now())))
+		assert.NoError(q.close())
+
+		q, err = openQueue(conf)
+		assert.NoError(err)
+		defer q.close()
+
+		assert.Equal(2, q.len())
+		assert.Equal([]uint32{1, 2}, drain(q))
+	})
+}
@@ -0,0 +1,238 @@
+package integration
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+// instanceQueueSize defines the max number of events and states queued for
+// publishing per integration instance.
+const instanceQueueSize = 1024
+
+// instance holds a named integration instance.
+type instance struct {
+	name        string
+	integration Integration
+
+	// events holds the event types to publish, all events are published
+	// when nil.
+	events map[string]struct{}
+
+	// commands defines if the downlinks, gateway configuration and commands
+	// received by this instance must be handled.
+	commands bool
+
+	// queue holds the events and states to publish, in order. Each instance
+	// publishes from its own goroutine, such that a slow or unreachable
+	// instance does not delay publishing to the other instances.
+	queue chan func() error
+}
+
+// multiIntegration publishes the events to multiple integration instances.
+// Only the downlinks, gateway configuration and commands received by the
+// instances for which commands are enabled are handled.
+type multiIntegration struct {
+	sync.RWMutex
+	instances []instance
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+func newMultiIntegration(instances []instance) *multiIntegration {
+	m := multiIntegration{
+		instances: instances,
+	}
+
+	for i := range m.instances {
+		m.instances[i].queue = make(chan func() error, instanceQueueSize)
+
+		m.wg.Add(1)
+		go m.publishLoop(m.instances[i])
+	}
+
+	return &m
+}
+
+// publishLoop publishes the queued events and states of the given instance
+// until its queue is closed.
+func (m *multiIntegration) publishLoop(inst instance) {
+	defer m.wg.Done()
+
+	for f := range inst.queue {
+		if err := f(); err != nil {
+			log.WithError(err).WithField("name", inst.name).Error("integration: publish error")
+		}
+	}
+}
+
+// enqueue queues the given publish func for the given instance. The func is
+// dropped when the queue of the instance is full. Note that this must be
+// called with the (read) lock held.
+func (m *multiIntegration) enqueue(inst instance, f func() error) error {
+	select {
+	case inst.queue <- f:
+		return nil
+	default:
+		return fmt.Errorf("integration %s: publish queue is full", inst.name)
+	}
+}
+
+// SetGatewaySubscription updates the gateway subscription of all instances.
+func (m *multiIntegration) SetGatewaySubscription(subscribe bool, gatewayID lorawan.EUI64) error {
+	var errs []string
+	for _, inst := range m.instances {
+		if e := inst.integration.SetGatewaySubscription(subscribe, gatewayID); e != nil {
+			errs = append(errs, fmt.Sprintf("integration %s: %s", inst.name, e))
+		}
+	}
+	return combineErrors(errs)
+}
+
+// PublishEvent queues the given event for the instances publishing the event
+// type. The publish errors of the instances are logged. An error is returned
+// when the event could not be queued for one of the instances, the event is
+// still published to the other instances.
+func (m *multiIntegration) PublishEvent(gatewayID lorawan.EUI64, event string, id uint32, v proto.Message) error {
+	m.RLock()
+	defer m.RUnlock()
+
+	if m.closed {
+		return errors.New("integration is closed")
+	}
+
+	var errs []string
+	for _, inst := range m.instances {
+		if inst.events != nil {
+			if _, ok := inst.events[event]; !ok {
+				continue
+			}
+		}
+
+		integration := inst.integration
+		if e := m.enqueue(inst, func() error {
+			return integration.PublishEvent(gatewayID, event, id, v)
+		}); e != nil {
+			errs = append(errs, e.Error())
+		}
+	}
+	return combineErrors(errs)
+}
+
+// PublishState queues the given state for all instances.
+func (m *multiIntegration) PublishState(gatewayID lorawan.EUI64, state string, v proto.Message) error {
+	m.RLock()
+	defer m.RUnlock()
+
+	if m.closed {
+		return errors.New("integration is closed")
+	}
+
+	var errs []string
+	for _, inst := range m.instances {
+		integration := inst.integration
+		if e := m.enqueue(inst, func() error {
+			return integration.PublishState(gatewayID, state, v)
+		}); e != nil {
+			errs = append(errs, e.Error())
+		}
+	}
+	return combineErrors(errs)
+}
+
+// SetDownlinkFrameFunc sets the DownlinkFrame handler func.
+func (m *multiIntegration) SetDownlinkFrameFunc(f func(*gw.DownlinkFrame)) {
+	for _, inst := range m.instances {
+		if inst.commands {
+			inst.integration.SetDownlinkFrameFunc(f)
+		}
+	}
+}
+
+// SetRawPacketForwarderCommandFunc sets the RawPacketForwarderCommand handler func.
+func (m *multiIntegration) SetRawPacketForwarderCommandFunc(f func(*gw.RawPacketForwarderCommand)) {
+	for _, inst := range m.instances {
+		if inst.commands {
+			inst.integration.SetRawPacketForwarderCommandFunc(f)
+		}
+	}
+}
+
+// SetGatewayConfigurationFunc sets the GatewayConfiguration handler func.
+func (m *multiIntegration) SetGatewayConfigurationFunc(f func(*gw.GatewayConfiguration)) {
+	for _, inst := range m.instances {
+		if inst.commands {
+			inst.integration.SetGatewayConfigurationFunc(f)
+		}
+	}
+}
+
+// SetGatewayCommandExecRequestFunc sets the GatewayCommandExecRequest handler func.
+func (m *multiIntegration) SetGatewayCommandExecRequestFunc(f func(*gw.GatewayCommandExecRequest)) {
+	for _, inst := range m.instances {
+		if inst.commands {
+			inst.integration.SetGatewayCommandExecRequestFunc(f)
+		}
+	}
+}
+
+// Start starts all instances. The instances are started concurrently, as
+// starting an instance blocks until it is connected.
+func (m *multiIntegration) Start() error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(m.instances))
+
+	for i := range m.instances {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = m.instances[i].integration.Start()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return errors.Wrapf(err, "start integration %s error", m.instances[i].name)
+		}
+	}
+	return nil
+}
+
+// Stop publishes the queued events and states and stops all instances. The
+// instances are stopped, even when stopping one of the instances failed.
+func (m *multiIntegration) Stop() error {
+	m.Lock()
+	if !m.closed {
+		m.closed = true
+		for _, inst := range m.instances {
+			close(inst.queue)
+		}
+	}
+	m.Unlock()
+	m.wg.Wait()
+
+	var errs []string
+	for _, inst := range m.instances {
+		if e := inst.integration.Stop(); e != nil {
+			errs = append(errs, fmt.Sprintf("integration %s: %s", inst.name, e))
+		}
+	}
+	return combineErrors(errs)
+}
+
+// combineErrors returns the given errors (of the instances) as a single
+// error, or nil when there are no errors.
+func combineErrors(errs []string) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(errs, "; "))
+}
@@ -0,0 +1,316 @@
+package integration
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+	"github.com/chirpstack/chirpstack/api/go/v4/gw"
+)
+
+type testIntegration struct {
+	sync.Mutex
+	downlinkFrameFunc func(*gw.DownlinkFrame)
+
+	started       bool
+	publishErr    error
+	publishBlock  chan struct{}
+	stopErr       error
+	events        []string
+	states        []string
+	subscriptions map[lorawan.EUI64]bool
+}
+
+func (i *testIntegration) getEvents() []string {
+	i.Lock()
+	defer i.Unlock()
+	return append([]string(nil), i.events...)
+}
+
+func (i *testIntegration) getStates() []string {
+	i.Lock()
+	defer i.Unlock()
+	return append([]string(nil), i.states...)
+}
+
+func (i *testIntegration) SetGatewaySubscription(subscribe bool, gatewayID lorawan.EUI64) error {
+	if i.subscriptions == nil {
+		i.subscriptions = make(map[lorawan.EUI64]bool)
+	}
+	i.subscriptions[gatewayID] = subscribe
+	return nil
+}
+
+func (i *testIntegration) PublishEvent(gatewayID lorawan.EUI64, event string, id uint32, v proto.Message) error {
+	i.Lock()
+	block := i.publishBlock
+	i.Unlock()
+
+	if block != nil {
+		<-block
+	}
+
+	i.Lock()
+	defer i.Unlock()
+	i.events = append(i.events, event)
+	return i.publishErr
+}
+
+func (i *testIntegration) PublishState(gatewayID lorawan.EUI64, state string, v proto.Message) error {
+	i.Lock()
+	defer i.Unlock()
+	i.states = append(i.states, state)
+	return nil
+}
+
+func (i *testIntegration) SetDownlinkFrameFunc(f func(*gw.DownlinkFrame)) {
+	i.downlinkFrameFunc = f
+}
+
+func (i *testIntegration) SetRawPacketForwarderCommandFunc(f func(*gw.RawPacketForwarderCommand)) {}
+
+func (i *testIntegration) SetGatewayConfigurationFunc(f func(*gw.GatewayConfiguration)) {}
+
+func (i *testIntegration) SetGatewayCommandExecRequestFunc(f func(*gw.GatewayCommandExecRequest)) {}
+
+func (i *testIntegration) Start() error {
+	i.started = true
+	return nil
+}
+
+func (i *testIntegration) Stop() error {
+	i.started = false
+	return i.stopErr
+}
+
+func TestMultiIntegration(t *testing.T) {
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	i1 := &testIntegration{}
+	i2 := &testIntegration{}
+
+	m := newMultiIntegration([]instance{
+		{name: "chirpstack", integration: i1, commands: true},
+		{name: "analytics", integration: i2, events: map[string]struct{}{EventUp: {}}},
+	})
+
+	t.Run("Start", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(m.Start())
+		assert.True(i1.started)
+		assert.True(i2.started)
+	})
+
+	t.Run("Subscription", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(m.SetGatewaySubscription(true, gatewayID))
+		assert.True(i1.subscriptions[gatewayID])
+		assert.True(i2.subscriptions[gatewayID])
+	})
+
+	t.Run("Events", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(m.PublishEvent(gatewayID, EventUp, 1, &gw.UplinkFrame{}))
+		assert.NoError(m.PublishEvent(gatewayID, EventStats, 0, &gw.GatewayStats{}))
+		assert.NoError(m.PublishState(gatewayID, "conn", &gw.ConnState{}))
+
+		assert.Eventually(func() bool { return len(i1.getEvents()) == 2 && len(i1.getStates()) == 1 }, time.Second, 10*time.Millisecond)
+		assert.Eventually(func() bool { return len(i2.getEvents()) == 1 && len(i2.getStates()) == 1 }, time.Second, 10*time.Millisecond)
+
+		assert.Equal([]string{EventUp, EventStats}, i1.getEvents())
+		assert.Equal([]string{EventUp}, i2.getEvents())
+		assert.Equal([]string{"conn"}, i1.getStates())
+		assert.Equal([]string{"conn"}, i2.getStates())
+	})
+
+	t.Run("Publish error", func(t *testing.T) {
+		assert := require.New(t)
+
+		i1.Lock()
+		i1.publishErr = errors.New("boom")
+		i1.Unlock()
+		defer func() {
+			i1.Lock()
+			i1.publishErr = nil
+			i1.Unlock()
+		}()
+
+		// the publish error is logged by the publish loop of the instance
+		assert.NoError(m.PublishEvent(gatewayID, EventUp, 2, &gw.UplinkFrame{}))
+		assert.Eventually(func() bool { return len(i1.getEvents()) == 3 }, time.Second, 10*time.Millisecond)
+
+		// the event is still published to the other instance
+		assert.Eventually(func() bool { return len(i2.getEvents()) == 2 }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Slow instance", func(t *testing.T) {
+		assert := require.New(t)
+
+		block := make(chan struct{})
+		i1.Lock()
+		i1.publishBlock = block
+		i1.Unlock()
+
+		assert.NoError(m.PublishEvent(gatewayID, EventUp, 3, &gw.UplinkFrame{}))
+
+		// the blocked instance does not delay the other instance
+		assert.Eventually(func() bool { return len(i2.getEvents()) == 3 }, time.Second, 10*time.Millisecond)
+		assert.Len(i1.getEvents(), 3)
+
+		i1.Lock()
+		i1.publishBlock = nil
+		i1.Unlock()
+		close(block)
+
+		assert.Eventually(func() bool { return len(i1.getEvents()) == 4 }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Commands", func(t *testing.T) {
+		assert := require.New(t)
+
+		m.SetDownlinkFrameFunc(func(*gw.DownlinkFrame) {})
+		assert.NotNil(i1.downlinkFrameFunc)
+		assert.Nil(i2.downlinkFrameFunc)
+	})
+
+	t.Run("Stop", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(m.Stop())
+		assert.False(i1.started)
+		assert.False(i2.started)
+
+		assert.EqualError(m.PublishEvent(gatewayID, EventUp, 4, &gw.UplinkFrame{}), "integration is closed")
+		assert.EqualError(m.PublishState(gatewayID, "conn", &gw.ConnState{}), "integration is closed")
+	})
+
+	t.Run("Stop error", func(t *testing.T) {
+		assert := require.New(t)
+
+		i1 := &testIntegration{started: true, stopErr: errors.New("boom")}
+		i2 := &testIntegration{started: true}
+		m := newMultiIntegration([]instance{
+			{name: "chirpstack", integration: i1, commands: true},
+			{name: "analytics", integration: i2},
+		})
+
+		// the remaining instances are stopped on error
+		assert.EqualError(m.Stop(), "integration chirpstack: boom")
+		assert.False(i2.started)
+	})
+
+	t.Run("Setup validation", func(t *testing.T) {
+		newInstance := func(name string, events ...string) config.IntegrationInstance {
+			inst := config.IntegrationInstance{
+				Name:      name,
+				Marshaler: "json",
+				Events:    events,
+			}
+			inst.MQTT.Auth.Type = "generic"
+			return inst
+		}
+
+		withClientID := func(inst config.IntegrationInstance, clientID string) config.IntegrationInstance {
+			inst.MQTT.Auth.Generic.ClientID = clientID
+			return inst
+		}
+
+		withBind := func(inst config.IntegrationInstance, bind string) config.IntegrationInstance {
+			inst.Type = "http"
+			inst.HTTP.EventURLTemplate = "http://localhost/event"
+			inst.HTTP.HMACSecret = "secret"
+			inst.HTTP.Command.Bind = bind
+			return inst
+		}
+
+		tests := []struct {
+			name      string
+			instances []config.IntegrationInstance
+			err       string
+		}{
+			{
+				name:      "no name",
+				instances: []config.IntegrationInstance{{}},
+				err:       "integration instance name must be set",
+			},
+			{
+				name:      "duplicate name",
+				instances: []config.IntegrationInstance{newInstance("foo"), newInstance("foo")},
+				err:       "duplicate integration instance: foo",
+			},
+			{
+				name:      "unknown event",
+				instances: []config.IntegrationInstance{newInstance("foo", "bar")},
+				err:       "unknown event type for integration instance foo: bar",
+			},
+			{
+				name: "duplicate client_id",
+				instances: []config.IntegrationInstance{
+					withClientID(newInstance("foo"), "bridge"),
+					withClientID(newInstance("bar"), "bridge"),
+				},
+				err: "integration instances foo and bar use the same client_id: bridge",
+			},
+			{
+				name: "duplicate command bind",
+				instances: []config.IntegrationInstance{
+					withBind(newInstance("foo"), "127.0.0.1:8090"),
+					withBind(newInstance("bar"), "127.0.0.1:8090"),
+				},
+				err: "integration instances foo and bar use the same command bind: 127.0.0.1:8090",
+			},
+			{
+				name: "unknown type",
+				instances: []config.IntegrationInstance{
+					{Name: "foo", Type: "bar"},
+				},
+				err: "setup integration foo error: unknown integration type: bar",
+			},
+		}
+
+		for _, tst := range tests {
+			t.Run(tst.name, func(t *testing.T) {
+				assert := require.New(t)
+
+				var conf config.Config
+				conf.Integration.Instances = tst.instances
+				assert.EqualError(Setup(conf), tst.err)
+			})
+		}
+	})
+
+	t.Run("Setup queue directory", func(t *testing.T) {
+		assert := require.New(t)
+
+		tempDir, err := os.MkdirTemp("", "test")
+		assert.NoError(err)
+		defer os.RemoveAll(tempDir)
+
+		// the instances inherit the global queue directory
+		var conf config.Config
+		for _, name := range []string{"foo", "bar"} {
+			inst := config.IntegrationInstance{
+				Name:      name,
+				Marshaler: "json",
+			}
+			inst.MQTT.Auth.Type = "generic"
+			inst.MQTT.Auth.Generic.ClientID = name
+			inst.MQTT.Queue.Directory = tempDir
+			conf.Integration.Instances = append(conf.Integration.Instances, inst)
+		}
+
+		assert.NoError(Setup(conf))
+		assert.FileExists(filepath.Join(tempDir, "foo", "mqtt_queue.db"))
+		assert.FileExists(filepath.Join(tempDir, "bar", "mqtt_queue.db"))
+	})
+}
@@ -0,0 +1,138 @@
+// Package storage implements an embedded key-value store, used by the
+// backends for persisting state (e.g. the gateway registry) across restarts.
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Op contains a write operation. The key is deleted when the value is nil.
+type Op struct {
+	Bucket string
+	Key    []byte
+	Value  []byte
+}
+
+// Store implements a key-value store, organized in buckets. All methods of a
+// nil Store are no-ops, such that callers do not need to check if
+// persistence has been enabled.
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens or creates the store with the given name in the given
+// directory. It returns nil when the directory is not set.
+func Open(dir, name string) (*Store, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "create directory error")
+	}
+
+	// The timeout avoids blocking forever when the database file is locked
+	// by an other process.
+	db, err := bolt.Open(filepath.Join(dir, name+".db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "open database error")
+	}
+
+	return &Store{db: db}, nil
+}
+
+// Close closes the store.
+func (s *Store) Close() error {
+	if s == nil {
+		return nil
+	}
+
+	return s.db.Close()
+}
+
+// Put stores the value under the given key in the given bucket.
+func (s *Store) Put(bucket string, key, value []byte) error {
+	if s == nil {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return errors.Wrap(err, "create bucket error")
+		}
+
+		return b.Put(key, value)
+	})
+}
+
+// Delete deletes the given key from the given bucket.
+func (s *Store) Delete(bucket string, key []byte) error {
+	if s == nil {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.Delete(key)
+	})
+}
+
+// Write applies the given operations, in order, in a single transaction.
+func (s *Store) Write(ops []Op) error {
+	if s == nil {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, op := range ops {
+			if op.Value == nil {
+				b := tx.Bucket([]byte(op.Bucket))
+				if b == nil {
+					continue
+				}
+
+				if err := b.Delete(op.Key); err != nil {
+					return err
+				}
+				continue
+			}
+
+			b, err := tx.CreateBucketIfNotExists([]byte(op.Bucket))
+			if err != nil {
+				return errors.Wrap(err, "create bucket error")
+			}
+
+			if err := b.Put(op.Key, op.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ForEach calls the given function for each key and value in the given
+// bucket. The key and value are only valid during the function call.
+func (s *Store) ForEach(bucket string, fn func(key, value []byte) error) error {
+	if s == nil {
+		return nil
+	}
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(fn)
+	})
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	assert := require.New(t)
+
+	tempDir, err := ioutil.TempDir("", "test")
+	assert.NoError(err)
+	defer os.RemoveAll(tempDir)
+
+	getAll := func(s *Store) map[string]string {
+		out := make(map[string]string)
+		assert.NoError(s.ForEach("bucket", func(k, v []byte) error {
+			out[string(k)] = string(v)
+			return nil
+		}))
+		return out
+	}
+
+	s, err := Open(tempDir, "test")
+	assert.NoError(err)
+
+	t.Run("Empty bucket", func(t *testing.T) {
+		assert := require.New(t)
+		assert.Len(getAll(s), 0)
+		assert.NoError(s.Delete("bucket", []byte("foo")))
+	})
+
+	t.Run("Put and delete", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(s.Put("bucket", []byte("foo"), []byte("bar")))
+		assert.NoError(s.Put("bucket", []byte("bar"), []byte("baz")))
+		assert.NoError(s.Delete("bucket", []byte("bar")))
+		assert.Equal(map[string]string{"foo": "bar"}, getAll(s))
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(s.Write([]Op{
+			{Bucket: "bucket", Key: []byte("bar"), Value: []byte("baz")},
+			{Bucket: "bucket", Key: []byte("baz"), Value: []byte("foo")},
+			{Bucket: "bucket", Key: []byte("bar")},
+			{Bucket: "other", Key: []byte("foo")},
+		}))
+		assert.Equal(map[string]string{"foo": "bar", "baz": "foo"}, getAll(s))
+		assert.NoError(s.Delete("bucket", []byte("baz")))
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(s.Close())
+		s, err = Open(tempDir, "test")
+		assert.NoError(err)
+		defer s.Close()
+
+		assert.Equal(map[string]string{"foo": "bar"}, getAll(s))
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		assert := require.New(t)
+
+		s, err := Open("", "test")
+		assert.NoError(err)
+		assert.Nil(s)
+
+		assert.NoError(s.Put("bucket", []byte("foo"), []byte("bar")))
+		assert.Len(getAll(s), 0)
+		assert.NoError(s.Close())
+	})
+}